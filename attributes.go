@@ -0,0 +1,58 @@
+package broadcaster
+
+// Fields of the auth packet that are part of the protocol rather than the
+// auth data, never kept as attributes.
+var authEnvelopeFields = []string{typeField, tokenField, sessionField, nonceField, proofField, refField, tenantField, maxRateField}
+
+// Turns an accepted auth packet into the attributes of a connection: a fresh
+// copy without envelope fields, passed through Server.SanitizeAuthData. The
+// result is stored with the session and handed to all later callbacks. It's
+// never modified, re-authenticating replaces it as a whole.
+func (s *Server) connectionAttributes(auth ClientMessage) ClientMessage {
+	data := make(ClientMessage, len(auth))
+	for k, v := range auth {
+		data[k] = v
+	}
+	for _, field := range authEnvelopeFields {
+		delete(data, field)
+	}
+
+	if s.SanitizeAuthData != nil {
+		var sanitized map[string]interface{}
+		ok := s.runCallback("SanitizeAuthData", func() {
+			sanitized = s.SanitizeAuthData(data)
+		})
+		if !ok {
+			// Keep nothing we might have been asked to strip.
+			sanitized = nil
+		}
+		data = make(ClientMessage, len(sanitized)+1)
+		for k, v := range sanitized {
+			data[k] = v
+		}
+	}
+
+	data[idField] = auth[idField]
+	data[clientIDField] = auth[clientIDField]
+	delete(data, tenantField)
+	if tenant := s.tenant(data); tenant != "" {
+		data[tenantField] = tenant
+	}
+	return data
+}
+
+// Attributes of a connection included in presence events, see
+// Server.PresenceAttributes.
+func (s *Server) presenceAttributes(data ClientMessage) map[string]interface{} {
+	if len(s.PresenceAttributes) == 0 {
+		return nil
+	}
+
+	attrs := make(map[string]interface{}, len(s.PresenceAttributes))
+	for _, k := range s.PresenceAttributes {
+		if v, ok := data[k]; ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,119 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Types of audit events.
+const (
+	// Connection or re-authentication refused: no auth packet, denied by
+	// CanConnect, expired, or a session that can't be resumed
+	AuditAuthFailed = "auth_failed"
+
+	// Subscription denied by CanSubscribe
+	AuditSubscribeRefused = "subscribe_refused"
+
+	// Client publish denied by CanPublish
+	AuditPublishRefused = "publish_refused"
+
+	// Subscription ended because CanSubscribe no longer allows it (see
+	// Server.RevalidateSubscriptions), or by Server.ForceUnsubscribe
+	AuditSubscriptionRevoked = "subscription_revoked"
+
+	// Runtime configuration replaced, see Server.UpdateConfig
+	AuditConfigChanged = "config_changed"
+)
+
+// Reason codes of audit events.
+const (
+	AuditReasonAuthExpected = "auth_expected"
+	AuditReasonUnauthorized = "unauthorized"
+	AuditReasonRefused      = "refused"
+	AuditReasonInvalidNonce = "invalid_nonce"
+	AuditReasonInvalidProof = "invalid_proof"
+	AuditReasonAuthExpired  = "auth_expired"
+	AuditReasonAuthTimeout  = "auth_timeout"
+	AuditReasonNoSession    = "no_session"
+	AuditReasonForced       = "forced"
+)
+
+// A security-relevant event, see Server.OnAuditEvent.
+//
+// The JSON encoding of this type is stable: fields may be added, but existing
+// ones won't be renamed or removed.
+type AuditEvent struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connection_id,omitempty"`
+	Identity     string    `json:"identity,omitempty"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	Transport    string    `json:"transport,omitempty"`
+	Channel      string    `json:"channel,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// Delivers audit events in the background. Events are dropped (and counted)
+// when the queue is full, auditing never blocks the connection.
+type auditor struct {
+	dropped uint64
+	events  chan AuditEvent
+
+	onEvent func(e AuditEvent)
+	log     *json.Encoder
+	logf    func(format string, args ...interface{})
+}
+
+func newAuditor(size int, onEvent func(e AuditEvent), log io.Writer, logf func(format string, args ...interface{})) *auditor {
+	a := &auditor{
+		events:  make(chan AuditEvent, size),
+		onEvent: onEvent,
+		logf:    logf,
+	}
+	if log != nil {
+		a.log = json.NewEncoder(log)
+	}
+	go a.run()
+	return a
+}
+
+func (a *auditor) Emit(e AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case a.events <- e:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+func (a *auditor) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (a *auditor) run() {
+	for e := range a.events {
+		if a.onEvent != nil {
+			runCallback(a.logf, "OnAuditEvent", func() {
+				a.onEvent(e)
+			})
+		}
+		if a.log != nil {
+			a.log.Encode(e)
+		}
+	}
+}
+
+func (s *Server) audit(e AuditEvent) {
+	if s.auditor == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = s.clock.Now()
+	}
+	s.auditor.Emit(e)
+}
@@ -0,0 +1,115 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditEventEncoding(t *testing.T) {
+	e := AuditEvent{
+		Type:         AuditSubscribeRefused,
+		Time:         time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		ConnectionID: "node-1234",
+		Identity:     "user1",
+		RemoteAddr:   "127.0.0.1:1234",
+		Transport:    "websocket",
+		Channel:      "secret",
+		Reason:       AuditReasonRefused,
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"type":"subscribe_refused","time":"2016-01-02T03:04:05Z","connection_id":"node-1234","identity":"user1","remote_addr":"127.0.0.1:1234","transport":"websocket","channel":"secret","reason":"refused"}`
+	if string(data) != expected {
+		t.Errorf("Unexpected encoding: %s", data)
+	}
+}
+
+func TestAuditDropsWhenFull(t *testing.T) {
+	block := make(chan bool)
+	a := newAuditor(1, func(e AuditEvent) {
+		<-block
+	}, nil, t.Logf)
+	defer close(block)
+
+	// First one is being handled, second one is queued.
+	a.Emit(AuditEvent{Type: AuditAuthFailed})
+	<-time.After(10 * time.Millisecond)
+	a.Emit(AuditEvent{Type: AuditAuthFailed})
+	a.Emit(AuditEvent{Type: AuditAuthFailed})
+
+	if a.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", a.Dropped())
+	}
+}
+
+func testAudit(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	events := make(chan AuditEvent, 10)
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return data["token"] == "abcdefg"
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return false
+		},
+		Identity: func(data map[string]interface{}) string {
+			s, _ := data["user"].(string)
+			return s
+		},
+		OnAuditEvent: func(e AuditEvent) {
+			events <- e
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	_, err = clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "mallory"}
+	})
+	if err == nil {
+		t.Fatal("Expected auth error")
+	}
+
+	e := <-events
+	if e.Type != AuditAuthFailed || e.Reason != AuditReasonUnauthorized || e.Identity != "mallory" {
+		t.Errorf("Unexpected event: %#v", e)
+	}
+	if e.ConnectionID == "" || e.RemoteAddr == "" {
+		t.Errorf("Missing connection details: %#v", e)
+	}
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice", "token": "abcdefg"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("secret")
+	if err == nil {
+		t.Fatal("Expected subscribe error")
+	}
+
+	e = <-events
+	if e.Type != AuditSubscribeRefused || e.Channel != "secret" || e.Identity != "alice" {
+		t.Errorf("Unexpected event: %#v", e)
+	}
+	if e.ConnectionID != client.ConnectionID() {
+		t.Errorf("Expected connection %s, got %s", client.ConnectionID(), e.ConnectionID)
+	}
+}
+
+func TestWSAudit(t *testing.T) {
+	testAudit(t, newWSClient)
+}
+
+func TestLPAudit(t *testing.T) {
+	testAudit(t, newLPClient)
+}
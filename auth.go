@@ -0,0 +1,55 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes of an AuthFailedMessage when the first message isn't an
+// AuthMessage, sent in its "code" field. Refused auth data has no code.
+const (
+	// The message has no type field, e.g. "type" was sent for "__type"
+	AuthErrorMissingType = "missing_type"
+
+	// The message has another type, e.g. "Auth" or "subscribe"
+	AuthErrorWrongType = "wrong_type"
+)
+
+// Commonly confused with the type field, named in the reason when a client
+// sends one of these instead.
+var authTypeLookalikes = []string{"type", "_type", "event"}
+
+// Checks that the first message of a connection is an AuthMessage, returns
+// the AuthFailedMessage that refuses it if not, nil if it is. Field names in
+// the reason are those on the wire, see Server.EnvelopeFields.
+func (s *Server) checkAuthType(m ClientMessage) ClientMessage {
+	name := typeField
+	if wire, ok := s.EnvelopeFields[typeField]; ok {
+		name = wire
+	}
+
+	v, ok := m[typeField]
+	if !ok {
+		reason := fmt.Sprintf("Auth expected, missing %q field", name)
+		for _, lookalike := range authTypeLookalikes {
+			if _, ok := m[lookalike]; ok && lookalike != name {
+				reason = fmt.Sprintf("Auth expected, missing %q field (got %q)", name, lookalike)
+				break
+			}
+		}
+		return authTypeError(AuthErrorMissingType, reason)
+	}
+	if t, _ := v.(string); t != AuthMessage {
+		got, _ := json.Marshal(v)
+		return authTypeError(AuthErrorWrongType, fmt.Sprintf("Auth expected, %q is %s", name, got))
+	}
+	return nil
+}
+
+func authTypeError(code, reason string) ClientMessage {
+	return ClientMessage{
+		typeField: AuthFailedMessage,
+		"code":    code,
+		"reason":  reason,
+	}
+}
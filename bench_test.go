@@ -0,0 +1,269 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clientFunc func(s *testServer, conf ...func(c *Client)) (*Client, error)
+
+func benchmarkConnect(b *testing.B, clientFn clientFunc) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := clientFn(server)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Disconnect()
+	}
+}
+
+func BenchmarkWSConnect(b *testing.B) {
+	benchmarkConnect(b, newWSClient)
+}
+
+func BenchmarkLPConnect(b *testing.B) {
+	benchmarkConnect(b, newLPClient)
+}
+
+func benchmarkSubscribe(b *testing.B, clientFn clientFunc) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		channel := fmt.Sprintf("test%d", i%10)
+		err := client.Subscribe(channel)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = client.Unsubscribe(channel)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWSSubscribe(b *testing.B) {
+	benchmarkSubscribe(b, newWSClient)
+}
+
+func BenchmarkLPSubscribe(b *testing.B) {
+	benchmarkSubscribe(b, newLPClient)
+}
+
+// Load test for the hub: 10k subscribes from 100 clients at once, per
+// iteration. Reports the 99th percentile as seen by the clients, and as
+// spent in the hub, to compare changes to the hub by.
+func benchmarkSubscribeLatency(b *testing.B, clientFn clientFunc) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Stop()
+
+	latency := newLatencyRecorder()
+	clients := make([]*Client, 100)
+	for i := range clients {
+		c, err := clientFn(server, func(c *Client) {
+			c.SubscribeLatency = func(msgType, channel string, d time.Duration) {
+				if msgType == SubscribeMessage {
+					latency.Record(d)
+				}
+			}
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Disconnect()
+		clients[i] = c
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j, c := range clients {
+			wg.Add(1)
+			go func(j int, c *Client) {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					channel := fmt.Sprintf("test%d", (j*100+k)%1000)
+					err := c.Subscribe(channel)
+					if err == nil {
+						err = c.Unsubscribe(channel)
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}(j, c)
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		b.Fatal(err)
+	}
+	hub := stats.HubLatency[SubscribeMessage].Quantile(0.99)
+	b.ReportMetric(float64(latency.Histogram().Quantile(0.99).Microseconds()), "p99-µs")
+	b.ReportMetric(float64(hub.Microseconds()), "hub-p99-µs")
+}
+
+func BenchmarkWSSubscribeLatency(b *testing.B) {
+	benchmarkSubscribeLatency(b, newWSClient)
+}
+
+func BenchmarkLPSubscribeLatency(b *testing.B) {
+	benchmarkSubscribeLatency(b, newLPClient)
+}
+
+// Publishes b.N messages to n subscribers, each of them has to receive all.
+func benchmarkFanout(b *testing.B, clientFn clientFunc, n int, s *Server) {
+	server, err := startServer(s, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Stop()
+
+	clients := make([]*Client, n)
+	for i := range clients {
+		client, err := clientFn(server)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.Disconnect()
+
+		err = client.Subscribe("test")
+		if err != nil {
+			b.Fatal(err)
+		}
+		clients[i] = client
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != n {
+			<-time.After(10 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				<-c.Messages
+			}
+		}(c)
+	}
+
+	for i := 0; i < b.N; i++ {
+		err := server.Broadcaster.Publish("test", "Test message")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func BenchmarkWSFanout10(b *testing.B) {
+	benchmarkFanout(b, newWSClient, 10, nil)
+}
+
+func BenchmarkWSFanout100(b *testing.B) {
+	benchmarkFanout(b, newWSClient, 100, nil)
+}
+
+func BenchmarkLPFanout10(b *testing.B) {
+	benchmarkFanout(b, newLPClient, 10, nil)
+}
+
+// Same, but with room for bursts in the long-poll requests.
+func BenchmarkLPFanout10Buffered(b *testing.B) {
+	benchmarkFanout(b, newLPClient, 10, &Server{LongPollBufferSize: 1000})
+}
+
+// With the recent message cache, compare with BenchmarkWSFanout10.
+func BenchmarkWSFanout10Cached(b *testing.B) {
+	benchmarkFanout(b, newWSClient, 10, &Server{LocalCacheSize: 100})
+}
+
+// With broadcast messages in binary frames, compare with BenchmarkWSFanout10.
+func BenchmarkWSFanout10Binary(b *testing.B) {
+	binaryClient := func(s *testServer, conf ...func(c *Client)) (*Client, error) {
+		return newWSClient(s, append(conf, func(c *Client) {
+			c.BinaryFrames = true
+		})...)
+	}
+	benchmarkFanout(b, binaryClient, 10, &Server{BinaryFrames: true})
+}
+
+func benchmarkFrameMessage() ClientMessage {
+	return ClientMessage{
+		typeField: MessageMessage,
+		"channel": "prices.EURUSD",
+		"body":    "1.08415",
+		"id":      "5f2b7c0e9a1d4e36",
+		"seq":     int64(123456),
+	}
+}
+
+func BenchmarkFrameEncodeJSON(b *testing.B) {
+	m := benchmarkFrameMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(m)
+	}
+}
+
+func BenchmarkFrameEncodeBinary(b *testing.B) {
+	m := benchmarkFrameMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeBinaryFrame(m)
+	}
+}
+
+func BenchmarkFrameDecodeJSON(b *testing.B) {
+	data, _ := json.Marshal(benchmarkFrameMessage())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := ClientMessage{}
+		json.Unmarshal(data, &m)
+	}
+}
+
+func BenchmarkFrameDecodeBinary(b *testing.B) {
+	data, _ := encodeBinaryFrame(benchmarkFrameMessage())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decodeBinaryFrame(data)
+	}
+}
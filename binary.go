@@ -0,0 +1,163 @@
+package broadcaster
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// WebSocket subprotocol of the compact binary frames, see Server.BinaryFrames.
+//
+// Clients ask for it when connecting. Once agreed on, the server sends
+// broadcast messages as binary WebSocket frames, everything else stays JSON
+// in text frames: replies, presence events, messages with fields the format
+// doesn't cover. Clients keep sending JSON. A binary frame is laid out as:
+//
+//	byte     frame type, 1 for a MessageMessage
+//	byte     flags, for the fields that follow the channel:
+//	           0x01 an ID
+//	           0x02 a sequence number
+//	           0x04 an origin
+//	uvarint  length of the channel name, followed by the name
+//	uvarint  length of the ID, followed by the ID, if flagged
+//	uvarint  the sequence number, if flagged
+//	uvarint  length of the origin, followed by the origin, if flagged
+//	rest     the body
+//
+// Lengths are in bytes, strings are UTF-8. Unsigned varints are those of
+// Protocol Buffers (and encoding/binary): 7 bits at a time, least
+// significant group first, with the high bit set on all but the last byte.
+// Other frame types and flags are reserved, clients should drop frames they
+// don't know.
+const BinaryFramesProtocol = "broadcaster.binary.v1"
+
+const binaryMessageFrame = 1
+
+const (
+	binaryHasID     = 0x01
+	binaryHasSeq    = 0x02
+	binaryHasOrigin = 0x04
+
+	binaryFlags = binaryHasID | binaryHasSeq | binaryHasOrigin
+)
+
+var errBinaryFrame = errors.New("Malformed binary frame")
+
+// Encodes a broadcast message as a binary frame, returns false for messages
+// that don't fit the format.
+func encodeBinaryFrame(m ClientMessage) ([]byte, bool) {
+	if m.Type() != MessageMessage {
+		return nil, false
+	}
+	channel, ok := m["channel"].(string)
+	if !ok {
+		return nil, false
+	}
+	body, ok := m["body"].(string)
+	if !ok {
+		return nil, false
+	}
+
+	flags := byte(0)
+	var id, origin string
+	var seq uint64
+	for k, v := range m {
+		switch k {
+		case typeField, "channel", "body":
+		case "id":
+			id, ok = v.(string)
+			flags |= binaryHasID
+		case "seq":
+			seq, ok = binarySeq(v)
+			flags |= binaryHasSeq
+		case "origin":
+			origin, ok = v.(string)
+			flags |= binaryHasOrigin
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+
+	size := 2 + 3*binary.MaxVarintLen64 + len(channel) + len(id) + len(origin) + len(body)
+	data := make([]byte, 0, size)
+	data = append(data, binaryMessageFrame, flags)
+	data = appendBinaryString(data, channel)
+	if flags&binaryHasID != 0 {
+		data = appendBinaryString(data, id)
+	}
+	if flags&binaryHasSeq != 0 {
+		data = binary.AppendUvarint(data, seq)
+	}
+	if flags&binaryHasOrigin != 0 {
+		data = appendBinaryString(data, origin)
+	}
+	data = append(data, body...)
+	return data, true
+}
+
+// Sequence numbers are int64 on the server, float64 once decoded from JSON.
+func binarySeq(v interface{}) (uint64, bool) {
+	switch seq := v.(type) {
+	case int64:
+		return uint64(seq), seq >= 0
+	case float64:
+		return uint64(seq), seq >= 0 && seq <= math.MaxInt64 && seq == math.Trunc(seq)
+	}
+	return 0, false
+}
+
+func appendBinaryString(data []byte, s string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(s)))
+	return append(data, s...)
+}
+
+// Decodes a binary frame into the message JSON would have given: the
+// sequence number is a float64.
+func decodeBinaryFrame(data []byte) (ClientMessage, error) {
+	if len(data) < 2 || data[0] != binaryMessageFrame || data[1]&^binaryFlags != 0 {
+		return nil, errBinaryFrame
+	}
+	flags := data[1]
+	data = data[2:]
+
+	m := ClientMessage{typeField: MessageMessage}
+	var ok bool
+	m["channel"], data, ok = readBinaryString(data)
+	if !ok {
+		return nil, errBinaryFrame
+	}
+	if flags&binaryHasID != 0 {
+		m["id"], data, ok = readBinaryString(data)
+		if !ok {
+			return nil, errBinaryFrame
+		}
+	}
+	if flags&binaryHasSeq != 0 {
+		seq, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errBinaryFrame
+		}
+		m["seq"] = float64(seq)
+		data = data[n:]
+	}
+	if flags&binaryHasOrigin != 0 {
+		m["origin"], data, ok = readBinaryString(data)
+		if !ok {
+			return nil, errBinaryFrame
+		}
+	}
+	m["body"] = string(data)
+	return m, nil
+}
+
+func readBinaryString(data []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return "", nil, false
+	}
+	data = data[n:]
+	return string(data[:size]), data[size:], true
+}
@@ -0,0 +1,147 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryFrames(t *testing.T) {
+	for _, m := range []ClientMessage{
+		newBroadcastMessage("test", "Hello"),
+		newBroadcastMessage("", ""),
+		{typeField: MessageMessage, "channel": "test", "body": "Hello", "id": "abc", "seq": int64(300)},
+		{typeField: MessageMessage, "channel": "test", "body": "{\"a\": 1}", "id": "", "seq": float64(0), "origin": "conn"},
+	} {
+		data, ok := encodeBinaryFrame(m)
+		if !ok {
+			t.Errorf("Expected %v to be encoded", m)
+			continue
+		}
+		got, err := decodeBinaryFrame(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// As if it went through JSON
+		buf, _ := json.Marshal(m)
+		want := ClientMessage{}
+		json.Unmarshal(buf, &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+
+	// Left to JSON
+	for _, m := range []ClientMessage{
+		newChannelMessage(SubscribeOKMessage, "test"),
+		{typeField: MessageMessage, "channel": "test", "body": 1},
+		{typeField: MessageMessage, "channel": "test", "body": "Hello", "conflated": 2},
+		{typeField: MessageMessage, "channel": "test", "body": "Hello", "seq": int64(-1)},
+	} {
+		if _, ok := encodeBinaryFrame(m); ok {
+			t.Errorf("Expected %v not to be encoded", m)
+		}
+	}
+
+	for _, data := range [][]byte{
+		{},
+		{binaryMessageFrame},
+		{2, 0, 0},
+		{binaryMessageFrame, 0x08, 0},
+		{binaryMessageFrame, 0, 5, 'a'},
+		{binaryMessageFrame, binaryHasSeq, 0},
+	} {
+		if _, err := decodeBinaryFrame(data); err == nil {
+			t.Errorf("Expected %v to be refused", data)
+		}
+	}
+}
+
+func TestWSBinaryFrames(t *testing.T) {
+	server, err := startServer(&Server{BinaryFrames: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	binary := func(c *Client) bool {
+		return c.transport.(*websocketClientTransport).binary
+	}
+
+	client, err := newWSClient(server, func(c *Client) {
+		c.BinaryFrames = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if !binary(client) {
+		t.Fatal("Expected binary frames to be agreed on")
+	}
+
+	// Replies stay JSON, messages are decoded as usual
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, seq, err := server.Broadcaster.PublishWithID("test", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m.Type() != MessageMessage || m.Channel() != "test" || m["body"] != "Hello" || m["id"] != id || m.Seq() != seq {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+
+	// Only when asked for
+	other, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+	if binary(other) {
+		t.Error("Expected JSON by default")
+	}
+}
+
+func TestWSBinaryFramesRefused(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server, func(c *Client) {
+		c.BinaryFrames = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if client.transport.(*websocketClientTransport).binary {
+		t.Fatal("Expected to fall back to JSON")
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("test", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "Hello" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+}
@@ -0,0 +1,269 @@
+package broadcaster
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Above this share of the limit, buffers holding more than their fair share
+// stop accepting messages, so the largest ones are cut off first.
+const bufferPressure = 0.8
+
+// Accounts the bytes held in outbound buffers across all connections of a
+// server, in the buffers of paused subscriptions and in the recent message
+// cache, and keeps them under a limit. See Server.MaxBufferedBytes for the order in which room is made.
+//
+// Broadcast messages are shared between their receivers, but are accounted
+// for each of them: the limit is conservative.
+type bufferAccount struct {
+	used      int64
+	highWater int64
+	dropped   uint64
+	shed      uint64
+	trimmed   uint64
+
+	// Last sequence number handed out to a held message
+	heldSeq uint64
+
+	// See Server.MaxBufferedBytes, can change while running
+	max int64
+
+	buffers map[*outbox]bool
+	held    map[*pauseBuffer]bool
+
+	// See Server.LocalCacheSize, nil when disabled
+	cache *recentCache
+
+	sync.Mutex
+}
+
+func newBufferAccount(max int64) *bufferAccount {
+	return &bufferAccount{
+		max:     max,
+		buffers: make(map[*outbox]bool),
+		held:    make(map[*pauseBuffer]bool),
+	}
+}
+
+func (a *bufferAccount) Register(o *outbox) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.buffers[o] = true
+}
+
+func (a *bufferAccount) Unregister(o *outbox) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.buffers, o)
+}
+
+func (a *bufferAccount) RegisterHeld(b *pauseBuffer) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.held[b] = true
+}
+
+func (a *bufferAccount) UnregisterHeld(b *pauseBuffer) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.held, b)
+}
+
+func (a *bufferAccount) limit() int64 {
+	return atomic.LoadInt64(&a.max)
+}
+
+// Lowering the limit doesn't drop anything, buffers shrink as they're
+// written out.
+func (a *bufferAccount) SetMax(max int64) {
+	atomic.StoreInt64(&a.max, max)
+}
+
+// Decides whether a message of the given size can be queued in o, after
+// making room in the cache. When the limit would be exceeded, held messages
+// are trimmed, then the largest buffer is shed to make room.
+func (a *bufferAccount) Admit(o *outbox, size int64) bool {
+	if a.limit() <= 0 {
+		return true
+	}
+
+	a.trimCached(size)
+	used := atomic.LoadInt64(&a.used)
+	if used+size > a.limit() {
+		if a.trimHeld(size) {
+			return true
+		}
+		a.shedLargest()
+		if atomic.LoadInt64(&a.used)+size > a.limit() {
+			atomic.AddUint64(&a.dropped, 1)
+			return false
+		}
+		return true
+	}
+
+	if float64(used+size) > float64(a.limit())*bufferPressure {
+		if o.Bytes() > used/int64(a.count()) {
+			atomic.AddUint64(&a.dropped, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// Like Admit, but for messages that mustn't be dropped: only refuses those
+// that don't fit at all, after shedding the largest buffer.
+func (a *bufferAccount) AdmitReliable(size int64) bool {
+	if a.limit() <= 0 {
+		return true
+	}
+	a.trimCached(size)
+	if atomic.LoadInt64(&a.used)+size <= a.limit() || a.trimHeld(size) {
+		return true
+	}
+	a.shedLargest()
+	return atomic.LoadInt64(&a.used)+size <= a.limit()
+}
+
+// Decides whether a paused subscription can hold a message of the given
+// size. Only ever makes room by trimming cached and held messages, oldest
+// first: those are the ones the subscriber is least likely to miss.
+func (a *bufferAccount) AdmitHeld(size int64) bool {
+	if a.limit() <= 0 {
+		return true
+	}
+	a.trimCached(size)
+	if atomic.LoadInt64(&a.used)+size <= a.limit() || a.trimHeld(size) {
+		return true
+	}
+	atomic.AddUint64(&a.trimmed, 1)
+	return false
+}
+
+// Decides whether the recent message cache can keep a message of the given
+// size. Only below the pressure threshold: cached messages never make room
+// for themselves.
+func (a *bufferAccount) AdmitCached(size int64) bool {
+	return a.limit() <= 0 || float64(atomic.LoadInt64(&a.used)+size) <= float64(a.limit())*bufferPressure
+}
+
+// Drops cached messages, oldest first, until a message of the given size
+// stays below the pressure threshold or the cache is empty. They give way
+// before anything else.
+func (a *bufferAccount) trimCached(size int64) {
+	if a.cache == nil {
+		return
+	}
+	for !a.AdmitCached(size) {
+		if !a.cache.TrimOldest() {
+			return
+		}
+	}
+}
+
+func (a *bufferAccount) NextHeld() uint64 {
+	return atomic.AddUint64(&a.heldSeq, 1)
+}
+
+// Drops held messages, oldest first across all paused subscriptions, until
+// a message of the given size fits. Returns false if it still doesn't.
+func (a *bufferAccount) trimHeld(size int64) bool {
+	for atomic.LoadInt64(&a.used)+size > a.limit() {
+		b := a.oldestHeld()
+		if b == nil {
+			return false
+		}
+		if b.TrimOldest() {
+			atomic.AddUint64(&a.trimmed, 1)
+		}
+	}
+	return true
+}
+
+func (a *bufferAccount) oldestHeld() *pauseBuffer {
+	a.Lock()
+	defer a.Unlock()
+
+	var oldest *pauseBuffer
+	var oldestSeq uint64
+	for b := range a.held {
+		seq, ok := b.Oldest()
+		if ok && (oldest == nil || seq < oldestSeq) {
+			oldest, oldestSeq = b, seq
+		}
+	}
+	return oldest
+}
+
+func (a *bufferAccount) Add(n int64) {
+	used := atomic.AddInt64(&a.used, n)
+	for {
+		high := atomic.LoadInt64(&a.highWater)
+		if used <= high || atomic.CompareAndSwapInt64(&a.highWater, high, used) {
+			return
+		}
+	}
+}
+
+func (a *bufferAccount) Release(n int64) {
+	atomic.AddInt64(&a.used, -n)
+}
+
+func (a *bufferAccount) count() int {
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.buffers) == 0 {
+		return 1
+	}
+	return len(a.buffers)
+}
+
+func (a *bufferAccount) shedLargest() {
+	a.Lock()
+	var largest *outbox
+	for o, _ := range a.buffers {
+		if largest == nil || o.Bytes() > largest.Bytes() {
+			largest = o
+		}
+	}
+	a.Unlock()
+
+	if largest != nil && largest.Bytes() > 0 {
+		atomic.AddUint64(&a.shed, 1)
+		largest.Shed()
+	}
+}
+
+type bufferStats struct {
+	Used      int64
+	HighWater int64
+	Dropped   uint64
+	Shed      uint64
+	Trimmed   uint64
+}
+
+func (a *bufferAccount) Stats() bufferStats {
+	return bufferStats{
+		Used:      atomic.LoadInt64(&a.used),
+		HighWater: atomic.LoadInt64(&a.highWater),
+		Dropped:   atomic.LoadUint64(&a.dropped),
+		Shed:      atomic.LoadUint64(&a.shed),
+		Trimmed:   atomic.LoadUint64(&a.trimmed),
+	}
+}
+
+// Rough estimate of the memory held by a queued message.
+func messageSize(m ClientMessage) int64 {
+	n := int64(64)
+	for k, v := range m {
+		n += int64(len(k)) + 16
+		if s, ok := v.(string); ok {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
@@ -0,0 +1,190 @@
+package broadcaster
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBufferAccountSheds(t *testing.T) {
+	s := &Server{buffers: newBufferAccount(10000)}
+
+	shed := false
+	large := s.newOutbox("", func() {
+		shed = true
+	})
+	small := s.newOutbox("", nil)
+
+	m := newBroadcastMessage("test", strings.Repeat("x", 1000))
+	for i := 0; i < 7; i++ {
+		if !large.Push(PriorityNormal, m) {
+			t.Fatalf("Message %d refused", i)
+		}
+	}
+
+	// Approaching the limit: the largest buffer no longer grows, others can.
+	if large.Push(PriorityNormal, m) {
+		t.Error("Expected large buffer to refuse messages")
+	}
+	if !small.Push(PriorityNormal, m) {
+		t.Error("Expected small buffer to accept messages")
+	}
+
+	// Full: the largest buffer is shed to make room.
+	if !small.Push(PriorityNormal, m) {
+		t.Error("Expected room after shedding")
+	}
+	if !shed {
+		t.Error("Expected large buffer to be shed")
+	}
+
+	stats := s.buffers.Stats()
+	if stats.Used != small.Bytes() || stats.Shed != 1 || stats.Dropped != 1 {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+	if stats.HighWater > 10000 {
+		t.Errorf("Limit exceeded: %d", stats.HighWater)
+	}
+
+	small.Drain()
+	if s.buffers.Stats().Used != 0 {
+		t.Errorf("Expected buffers to be released, got %d", s.buffers.Stats().Used)
+	}
+}
+
+func TestBufferAccountTrimsHeld(t *testing.T) {
+	s := &Server{buffers: newBufferAccount(10000)}
+
+	shed := false
+	o := s.newOutbox("", func() {
+		shed = true
+	})
+	first := newAccountedPauseBuffer(100, false, s.buffers)
+	second := newAccountedPauseBuffer(100, false, s.buffers)
+
+	m := newBroadcastMessage("test", strings.Repeat("x", 1000))
+	for i := 0; i < 3; i++ {
+		first.Add(m)
+		second.Add(m)
+	}
+	for i := 0; i < 3; i++ {
+		if !o.Push(PriorityNormal, m) {
+			t.Fatalf("Message %d refused", i)
+		}
+	}
+
+	// Full: held messages go first, oldest first, before any connection.
+	for i := 0; i < 3; i++ {
+		if !o.Push(PriorityNormal, m) {
+			t.Fatalf("Message %d refused", i)
+		}
+	}
+	if shed {
+		t.Error("Expected held messages to be trimmed before shedding")
+	}
+
+	// Held messages only push out other held messages.
+	first.Add(m)
+
+	count := func(b *pauseBuffer) (int, int) {
+		held, skipped := 0, 0
+		b.Flush("test", func(m ClientMessage) {
+			if m.Type() == SkippedMessage {
+				skipped += m["count"].(int)
+			} else {
+				held++
+			}
+		})
+		return held, skipped
+	}
+	if held, skipped := count(first); held != 1 || skipped != 3 {
+		t.Errorf("Expected 1 held and 3 skipped, got %d and %d", held, skipped)
+	}
+	if held, skipped := count(second); held != 1 || skipped != 2 {
+		t.Errorf("Expected 1 held and 2 skipped, got %d and %d", held, skipped)
+	}
+	if shed {
+		t.Error("Expected held messages not to shed connections")
+	}
+
+	stats := s.buffers.Stats()
+	if stats.Trimmed != 5 || stats.Shed != 0 || stats.HighWater > 10000 {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+
+	first.Release()
+	second.Release()
+	o.Drain()
+	if s.buffers.Stats().Used != 0 {
+		t.Errorf("Expected buffers to be released, got %d", s.buffers.Stats().Used)
+	}
+}
+
+// Wedges a bunch of readers and floods them, memory should stay bounded.
+func TestBufferLimit(t *testing.T) {
+	limit := int64(1024 * 1024)
+	server, err := startServer(&Server{MaxBufferedBytes: limit}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	for i := 0; i < 20; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(ClientMessage{typeField: AuthMessage})
+		conn.WriteJSON(ClientMessage{typeField: SubscribeMessage, "channel": "test"})
+		// Never reads
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 20 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	body := strings.Repeat("x", 16*1024)
+	for i := 0; i < 1000; i++ {
+		err := server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for the hub to work through the backlog, memory should plateau.
+	timeout := time.After(30 * time.Second)
+	last := uint64(0)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("Hub didn't settle")
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.BufferedBytesHighWater > limit {
+			t.Fatalf("Limit exceeded: %d", stats.BufferedBytesHighWater)
+		}
+
+		dropped := stats.BufferDroppedMessages + stats.ShedConnections
+		if dropped > 0 && dropped == last {
+			return
+		}
+		last = dropped
+	}
+}
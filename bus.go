@@ -0,0 +1,138 @@
+package broadcaster
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Where messages are published and received, the pub/sub part of
+// redisBackend. Only Redis implements it so far. Publishes that go along
+// with other changes in Redis, e.g. messages kept for at-least-once
+// subscribers or added to a stream, are sent in the same transaction
+// instead, as are the control messages of such changes.
+type messageBus interface {
+	// Publishes to a channel, returns the number of connections that got
+	// it, or receiversUnknown with an unexpectedReplyError.
+	Publish(channel string, data []byte) (int, error)
+
+	// Opens a connection to receive messages on, see busConn.
+	Listen() (busConn, error)
+}
+
+// A connection to a messageBus, its subscriptions last as long as it does.
+// A single goroutine receives: messages as busMessage, replies to
+// (un)subscribing as busSubscription, and an error once the connection is
+// broken or closed.
+type busConn interface {
+	Subscribe(channels ...string) error
+	Unsubscribe(channels ...string) error
+	PSubscribe(patterns ...string) error
+	PUnsubscribe(patterns ...string) error
+	Receive() interface{}
+	Close() error
+}
+
+// A message received on a busConn. Pattern is the one it matched when
+// subscribed to by PSubscribe.
+type busMessage struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+// The reply to (un)subscribing on a busConn: Kind is "subscribe",
+// "unsubscribe", "psubscribe" or "punsubscribe".
+type busSubscription struct {
+	Kind    string
+	Channel string
+}
+
+// Returned by messageBus.Publish along with receiversUnknown when Redis
+// doesn't reply with a count, e.g. through a proxy. The message went out
+// nonetheless.
+type unexpectedReplyError struct {
+	err error
+}
+
+func (e *unexpectedReplyError) Error() string {
+	return e.err.Error()
+}
+
+// The messageBus of Redis pub/sub: publishes go through the pool, each
+// listening connection is one of its own.
+type redisBus struct {
+	pool        *redis.Pool
+	host        string
+	dialOptions []redis.DialOption
+}
+
+func (r *redisBus) Publish(channel string, data []byte) (int, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("PUBLISH", channel, data)
+	if err != nil {
+		return 0, err
+	}
+	receivers, err := redis.Int(reply, nil)
+	if err != nil {
+		return receiversUnknown, &unexpectedReplyError{err}
+	}
+	return receivers, nil
+}
+
+func (r *redisBus) Listen() (busConn, error) {
+	c, err := redis.Dial("tcp", r.host, r.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return redisBusConn{redis.PubSubConn{Conn: c}}, nil
+}
+
+// A busConn on a connection of its own to Redis, turns what redigo
+// receives into bus events.
+type redisBusConn struct {
+	conn redis.PubSubConn
+}
+
+func (c redisBusConn) Subscribe(channels ...string) error {
+	return c.conn.Subscribe(redisArgs(channels)...)
+}
+
+func (c redisBusConn) Unsubscribe(channels ...string) error {
+	return c.conn.Unsubscribe(redisArgs(channels)...)
+}
+
+func (c redisBusConn) PSubscribe(patterns ...string) error {
+	return c.conn.PSubscribe(redisArgs(patterns)...)
+}
+
+func (c redisBusConn) PUnsubscribe(patterns ...string) error {
+	return c.conn.PUnsubscribe(redisArgs(patterns)...)
+}
+
+func (c redisBusConn) Receive() interface{} {
+	switch v := c.conn.Receive().(type) {
+	case redis.Message:
+		return busMessage{Channel: v.Channel, Data: v.Data}
+	case redis.PMessage:
+		return busMessage{Channel: v.Channel, Pattern: v.Pattern, Data: v.Data}
+	case redis.Subscription:
+		return busSubscription{Kind: v.Kind, Channel: v.Channel}
+	case error:
+		return v
+	}
+	// A pong, never asked for
+	return nil
+}
+
+func (c redisBusConn) Close() error {
+	return c.conn.Close()
+}
+
+func redisArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,192 @@
+package broadcaster
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A messageBus within the process, for the pub/sub of the backend without
+// Redis.
+type memoryBus struct {
+	conns map[*memoryBusConn]bool
+	sync.Mutex
+}
+
+type memoryBusConn struct {
+	bus      *memoryBus
+	channels map[string]bool
+	patterns map[string]bool
+
+	// What Receive returns next, unbounded so that a publish never waits for
+	// a receiver while holding the bus lock. ready is signaled on the bus
+	// lock when there's more, or once closed.
+	queue  []interface{}
+	closed bool
+	ready  *sync.Cond
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{conns: make(map[*memoryBusConn]bool)}
+}
+
+func (m *memoryBus) Publish(channel string, data []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	receivers := 0
+	for c := range m.conns {
+		if c.channels[channel] {
+			c.push(busMessage{Channel: channel, Data: data})
+			receivers++
+			continue
+		}
+		for pattern := range c.patterns {
+			if ok, _ := path.Match(pattern, channel); ok {
+				c.push(busMessage{Channel: channel, Pattern: pattern, Data: data})
+				receivers++
+				break
+			}
+		}
+	}
+	return receivers, nil
+}
+
+func (m *memoryBus) Listen() (busConn, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	c := &memoryBusConn{
+		bus:      m,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		ready:    sync.NewCond(&m.Mutex),
+	}
+	m.conns[c] = true
+	return c, nil
+}
+
+// Queues an event for Receive, with the bus lock held.
+func (c *memoryBusConn) push(v interface{}) {
+	c.queue = append(c.queue, v)
+	c.ready.Signal()
+}
+
+func (c *memoryBusConn) update(kind string, set map[string]bool, add bool, names []string) error {
+	c.bus.Lock()
+	defer c.bus.Unlock()
+
+	for _, name := range names {
+		if add {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+		c.push(busSubscription{Kind: kind, Channel: name})
+	}
+	return nil
+}
+
+func (c *memoryBusConn) Subscribe(channels ...string) error {
+	return c.update("subscribe", c.channels, true, channels)
+}
+
+func (c *memoryBusConn) Unsubscribe(channels ...string) error {
+	return c.update("unsubscribe", c.channels, false, channels)
+}
+
+func (c *memoryBusConn) PSubscribe(patterns ...string) error {
+	return c.update("psubscribe", c.patterns, true, patterns)
+}
+
+func (c *memoryBusConn) PUnsubscribe(patterns ...string) error {
+	return c.update("punsubscribe", c.patterns, false, patterns)
+}
+
+func (c *memoryBusConn) Receive() interface{} {
+	c.bus.Lock()
+	defer c.bus.Unlock()
+
+	for len(c.queue) == 0 && !c.closed {
+		c.ready.Wait()
+	}
+	if c.closed {
+		return io.EOF
+	}
+	v := c.queue[0]
+	c.queue = c.queue[1:]
+	return v
+}
+
+func (c *memoryBusConn) Close() error {
+	c.bus.Lock()
+	defer c.bus.Unlock()
+
+	delete(c.bus.conns, c)
+	c.closed = true
+	c.ready.Broadcast()
+	return nil
+}
+
+func TestMessageBus(t *testing.T) {
+	bus := newMemoryBus()
+	b := &redisBackend{
+		bus:            bus,
+		controlChannel: "control",
+		dialRetrier:    newConnectionRetrier(nil),
+		subscriptions:  make(map[string]bool),
+		confirmed:      make(map[string]chan struct{}),
+		pending:        make(map[string]int),
+		streams:        make(map[string]*streamConsumer),
+		Messages:       make(chan redis.Message, 10),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.listen()
+	defer b.Close()
+
+	expect := func(channel, data string) {
+		t.Helper()
+		select {
+		case m := <-b.Messages:
+			if m.Channel != channel || string(m.Data) != data {
+				t.Errorf("Expected %s on %s, got %s on %s", data, channel, m.Data, m.Channel)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s on %s", data, channel)
+		}
+	}
+
+	err := b.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.WaitSubscribed("news", time.Second) {
+		t.Fatal("Expected the subscription to be confirmed")
+	}
+	n, err := bus.Publish("news", []byte("hello"))
+	if err != nil || n != 1 {
+		t.Fatalf("Expected one receiver, got %d %v", n, err)
+	}
+	expect("news", "hello")
+
+	// Control messages arrive on the same connection
+	err = b.AnnounceSubscribed("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("control", "subscribed news")
+
+	err = b.Unsubscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = bus.Publish("news", []byte("gone"))
+	if err != nil || n != 0 {
+		t.Errorf("Expected no receivers, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,204 @@
+package broadcaster
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a channel's cached messages outlive its last local subscriber,
+// for clients that reconnect within seconds.
+const localCacheGrace = 30 * time.Second
+
+// Keeps the last few messages of each channel with local subscribers, as
+// received from Redis, see Server.LocalCacheSize. Replaying from here spares
+// a round trip to Redis for clients that were only gone for a moment.
+//
+// Messages can arrive out of order when they're published concurrently, and
+// go missing while the channel has no local subscribers. Since only returns
+// what's cached when it has every message of the range, callers fall back to
+// Redis otherwise.
+type recentCache struct {
+	size     int
+	clock    clock
+	buffers  *bufferAccount
+	channels map[string]*cachedChannel
+
+	// Last number handed out to a cached message, orders them across
+	// channels for trimming.
+	added uint64
+
+	hits   uint64
+	misses uint64
+
+	sync.Mutex
+}
+
+type cachedChannel struct {
+	// Up to size messages, oldest first
+	messages []cachedMessage
+
+	// Evicts the channel once the grace period is over, set while it has
+	// no local subscribers.
+	evict timer
+}
+
+type cachedMessage struct {
+	seq   int64
+	data  []byte
+	size  int64
+	added uint64
+}
+
+func newRecentCache(size int, clock clock, buffers *bufferAccount) *recentCache {
+	c := &recentCache{
+		size:     size,
+		clock:    clock,
+		buffers:  buffers,
+		channels: make(map[string]*cachedChannel),
+	}
+	buffers.cache = c
+	return c
+}
+
+// Caches a message as published, replacing the oldest of the channel once
+// it's full. Only messages that fit well within Server.MaxBufferedBytes are
+// cached: they're the first to give way.
+func (c *recentCache) Add(channel string, seq int64, data []byte) {
+	size := int64(len(data)) + 64
+	if !c.buffers.AdmitCached(size) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	ch, ok := c.channels[channel]
+	if !ok {
+		ch = &cachedChannel{}
+		c.channels[channel] = ch
+	}
+
+	if len(ch.messages) == c.size {
+		c.buffers.Release(ch.messages[0].size)
+		ch.messages = ch.messages[1:]
+	}
+	c.added++
+	ch.messages = append(ch.messages, cachedMessage{seq: seq, data: data, size: size, added: c.added})
+	c.buffers.Add(size)
+}
+
+// Returns the messages of a channel after the given sequence number, up to
+// and including the current one, ordered by sequence number. False if any
+// of them isn't cached.
+func (c *recentCache) Since(channel string, after, current int64) ([][]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	var found []cachedMessage
+	if ch, ok := c.channels[channel]; ok {
+		for _, m := range ch.messages {
+			if m.seq > after && m.seq <= current {
+				found = append(found, m)
+			}
+		}
+	}
+	// Sequence numbers are unique per channel.
+	if int64(len(found)) != current-after {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].seq < found[j].seq
+	})
+	result := make([][]byte, len(found))
+	for i, m := range found {
+		result[i] = m.data
+	}
+	return result, true
+}
+
+// Called when a channel lost its last local subscriber, evicts it after the
+// grace period unless it gets one again.
+func (c *recentCache) Idle(channel string) {
+	c.Lock()
+	defer c.Unlock()
+
+	ch, ok := c.channels[channel]
+	if !ok || ch.evict != nil {
+		return
+	}
+	ch.evict = c.clock.AfterFunc(localCacheGrace, func() {
+		c.Lock()
+		defer c.Unlock()
+
+		// Unless it was subscribed to and left again in the meantime
+		if c.channels[channel] == ch && ch.evict != nil {
+			c.remove(channel)
+		}
+	})
+}
+
+// Called when a channel got a local subscriber.
+func (c *recentCache) Active(channel string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ch, ok := c.channels[channel]; ok && ch.evict != nil {
+		ch.evict.Stop()
+		ch.evict = nil
+	}
+}
+
+// Drops the oldest cached message across all channels, to make room in the
+// buffer budget. Returns false if there's none.
+func (c *recentCache) TrimOldest() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	var oldest *cachedChannel
+	var oldestChannel string
+	for channel, ch := range c.channels {
+		if oldest == nil || ch.messages[0].added < oldest.messages[0].added {
+			oldest, oldestChannel = ch, channel
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	if len(oldest.messages) == 1 {
+		c.remove(oldestChannel)
+		return true
+	}
+	c.buffers.Release(oldest.messages[0].size)
+	oldest.messages = oldest.messages[1:]
+	return true
+}
+
+// Must hold the lock.
+func (c *recentCache) remove(channel string) {
+	ch := c.channels[channel]
+	for _, m := range ch.messages {
+		c.buffers.Release(m.size)
+	}
+	if ch.evict != nil {
+		ch.evict.Stop()
+	}
+	delete(c.channels, channel)
+}
+
+type cacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (c *recentCache) Stats() cacheStats {
+	return cacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
@@ -0,0 +1,189 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentCache(t *testing.T) {
+	clock := newFakeClock()
+	buffers := newBufferAccount(0)
+	c := newRecentCache(3, clock, buffers)
+
+	since := func(after, current int64) string {
+		data, ok := c.Since("test", after, current)
+		if !ok {
+			return "miss"
+		}
+		bodies := []string{}
+		for _, d := range data {
+			bodies = append(bodies, string(d))
+		}
+		return strings.Join(bodies, ",")
+	}
+	add := func(seqs ...int64) {
+		for _, seq := range seqs {
+			c.Add("test", seq, []byte{byte('0' + seq)})
+		}
+	}
+
+	add(1, 2, 3, 4)
+	if got := since(0, 4); got != "miss" {
+		t.Errorf("Expected the oldest to be evicted, got %s", got)
+	}
+	if got := since(1, 4); got != "2,3,4" {
+		t.Errorf("Unexpected messages: %s", got)
+	}
+	if got := since(4, 5); got != "miss" {
+		t.Errorf("Expected a miss for what isn't there yet, got %s", got)
+	}
+
+	// Concurrent publishes arrive in any order, gaps go to Redis.
+	add(6, 5)
+	if got := since(4, 6); got != "5,6" {
+		t.Errorf("Expected messages by sequence number, got %s", got)
+	}
+	add(8)
+	if got := since(5, 8); got != "miss" {
+		t.Errorf("Expected a miss for a gap, got %s", got)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 3 {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+
+	// Kept for the grace period once the channel goes idle
+	c.Idle("test")
+	clock.Advance(localCacheGrace / 2)
+	c.Active("test")
+	clock.Advance(localCacheGrace)
+	if got := since(5, 6); got != "6" {
+		t.Errorf("Expected the channel to be kept, got %s", got)
+	}
+
+	c.Idle("test")
+	clock.Advance(localCacheGrace)
+	for i := 0; i < 100 && buffers.Stats().Used != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if got := since(5, 6); got != "miss" {
+		t.Errorf("Expected the channel to be evicted, got %s", got)
+	}
+	if buffers.Stats().Used != 0 {
+		t.Errorf("Expected the cache to be released, got %d", buffers.Stats().Used)
+	}
+}
+
+func TestBufferAccountTrimsCached(t *testing.T) {
+	s := &Server{buffers: newBufferAccount(10000)}
+	c := newRecentCache(100, newFakeClock(), s.buffers)
+
+	shed := false
+	o := s.newOutbox("", func() {
+		shed = true
+	})
+
+	// Only cached below the pressure threshold
+	data := []byte(strings.Repeat("x", 1000))
+	for seq := int64(1); seq <= 10; seq++ {
+		c.Add("test", seq, data)
+	}
+	if _, ok := c.Since("test", 0, 7); !ok {
+		t.Error("Expected the first messages to be cached")
+	}
+	if _, ok := c.Since("test", 7, 8); ok {
+		t.Error("Expected the cache to stop short of the pressure threshold")
+	}
+
+	// Cached messages give way first, oldest first.
+	m := newBroadcastMessage("test", strings.Repeat("x", 1000))
+	for i := 0; i < 7; i++ {
+		if !o.Push(PriorityNormal, m) {
+			t.Fatalf("Message %d refused", i)
+		}
+	}
+	if shed {
+		t.Error("Expected cached messages to be trimmed before shedding")
+	}
+	if _, ok := c.Since("test", 0, 1); ok {
+		t.Error("Expected the oldest message to be trimmed")
+	}
+	if used := s.buffers.Stats().Used; used > 8000 {
+		t.Errorf("Expected to stay below the pressure threshold, got %d", used)
+	}
+
+	o.Drain()
+	for c.TrimOldest() {
+	}
+	if s.buffers.Stats().Used != 0 {
+		t.Errorf("Expected buffers to be released, got %d", s.buffers.Stats().Used)
+	}
+}
+
+func TestLocalCacheReplay(t *testing.T) {
+	server, err := startServer(&Server{LocalCacheSize: 10}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Keeps the channel subscribed on the node while the other is gone.
+	watcher, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Disconnect()
+	err = watcher.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := client.ClientID()
+
+	publishBodies(t, server, "test", "one")
+	receiveBodies(t, client, "one")
+	waitAcked(t, server, client, "test")
+	client.Disconnect()
+
+	publishBodies(t, server, "test", "two", "three")
+	receiveBodies(t, watcher, "one", "two", "three")
+
+	// Only the cache has them now.
+	conn := server.Broadcaster.current().redis.conn.Get()
+	_, err = conn.Do("DEL", server.Broadcaster.current().redis.key("pending:test"))
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = newWSClient(server, func(c *Client) {
+		c.clientID = clientID
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveBodies(t, client, "two", "three")
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LocalCacheHits != 1 {
+		t.Errorf("Expected a cache hit, got %#v", stats)
+	}
+}
@@ -0,0 +1,91 @@
+package broadcaster
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// Runs a user-supplied callback. A panic is logged and reported as false,
+// callers treat it as a denial: one buggy callback can't take down the
+// connection handlers or the hub.
+func runCallback(logf func(format string, args ...interface{}), name string, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logf("Callback %s panicked: %v\n%s", name, r, debug.Stack())
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// Runs a callback of the server, see runCallback. Panics are logged with
+// the name of the server.
+func (s *Server) runCallback(name string, fn func()) bool {
+	return runCallback(s.logf, name, fn)
+}
+
+func (s *Server) canConnect(data map[string]interface{}) bool {
+	if s.CanConnect == nil {
+		return true
+	}
+	allowed := false
+	s.runCallback("CanConnect", func() {
+		allowed = s.CanConnect(data)
+	})
+	return allowed
+}
+
+func (s *Server) canSubscribe(data map[string]interface{}, channel string) bool {
+	if s.CanSubscribe == nil {
+		return true
+	}
+	allowed := false
+	s.runCallback("CanSubscribe", func() {
+		allowed = s.CanSubscribe(data, channel)
+	})
+	return allowed
+}
+
+// The options of a new subscription, with the filter SubscriptionFilter
+// returns, see subscriptionOptions.Filter.
+func (s *Server) subscriptionOptions(data map[string]interface{}, channel string, echo bool, qos string) subscriptionOptions {
+	opts := subscriptionOptions{Echo: echo, QoS: qos}
+	if s.SubscriptionFilter == nil {
+		return opts
+	}
+	var filter func(m ClientMessage) bool
+	if !s.runCallback("SubscriptionFilter", func() {
+		filter = s.SubscriptionFilter(data, channel)
+	}) {
+		opts.Filter = func(m ClientMessage) bool { return false }
+	} else if filter != nil {
+		opts.Filter = func(m ClientMessage) bool {
+			delivers := false
+			s.runCallback("SubscriptionFilter", func() {
+				delivers = filter(m)
+			})
+			return delivers
+		}
+	}
+	return opts
+}
+
+func (s *Server) canPublish(data map[string]interface{}, channel string) bool {
+	if s.CanPublish == nil {
+		return false
+	}
+	allowed := false
+	s.runCallback("CanPublish", func() {
+		allowed = s.CanPublish(data, channel)
+	})
+	return allowed
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	allowed := false
+	s.runCallback("CheckOrigin", func() {
+		allowed = s.CheckOrigin(r)
+	})
+	return allowed
+}
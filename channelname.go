@@ -0,0 +1,40 @@
+package broadcaster
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Segments of hierarchical channel names allowed by default, see
+// Server.ChannelSegment. Leaves out "*", which patterns use.
+var defaultChannelSegment = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Error code of a SubscribeErrorMessage for a malformed channel name.
+const subscribeErrorInvalidChannel = "invalid_channel"
+
+// Checks a channel name against the hierarchy scheme, see
+// Server.ChannelSeparator. Names are only checked when a separator is set.
+func (s *Server) validateChannel(channel string) error {
+	if s.ChannelSeparator == "" {
+		return nil
+	}
+	if channel == "" {
+		return fmt.Errorf("Invalid channel name: empty")
+	}
+	for _, segment := range strings.Split(channel, s.ChannelSeparator) {
+		if segment == "" {
+			return fmt.Errorf("Invalid channel name %q: empty segment", channel)
+		}
+		if !s.ChannelSegment.MatchString(segment) {
+			return fmt.Errorf("Invalid channel name %q: segment %q not allowed", channel, segment)
+		}
+	}
+	return nil
+}
+
+func newInvalidChannelMessage(channel string, err error) ClientMessage {
+	reply := newChannelErrorMessage(SubscribeErrorMessage, channel, err)
+	reply["code"] = subscribeErrorInvalidChannel
+	return reply
+}
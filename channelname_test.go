@@ -0,0 +1,101 @@
+package broadcaster
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestValidateChannel(t *testing.T) {
+	dotted := &Server{ChannelSeparator: ".", ChannelSegment: defaultChannelSegment}
+	slashed := &Server{ChannelSeparator: "/", ChannelSegment: regexp.MustCompile(`^[a-z.]+$`)}
+	unchecked := &Server{ChannelSegment: defaultChannelSegment}
+
+	for _, c := range []struct {
+		server  *Server
+		channel string
+		valid   bool
+	}{
+		{dotted, "orders", true},
+		{dotted, "orders.eu.paid", true},
+		{dotted, "orders.eu-west_1", true},
+		{dotted, "", false},
+		{dotted, "orders..paid", false},
+		{dotted, ".orders", false},
+		{dotted, "orders.", false},
+		{dotted, ".", false},
+		{dotted, "orders.*", false},
+		{dotted, "orders.e u", false},
+		{dotted, "orders/eu", false},
+
+		{slashed, "orders/eu.west", true},
+		{slashed, "orders//eu", false},
+		{slashed, "orders/", false},
+		{slashed, "orders/EU", false},
+
+		{unchecked, "orders..paid.", true},
+		{unchecked, "", true},
+	} {
+		err := c.server.validateChannel(c.channel)
+		if (err == nil) != c.valid {
+			t.Errorf("%q with separator %q: expected valid %v, got %v", c.channel, c.server.ChannelSeparator, c.valid, err)
+		}
+	}
+}
+
+func TestInvalidChannel(t *testing.T) {
+	server, err := startServer(&Server{
+		ChannelSeparator: ".",
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"orders..paid", "orders.", "orders.*"} {
+		err = client.Subscribe(channel)
+		if err == nil {
+			t.Errorf("Expected the subscribe to %q to fail", channel)
+		}
+
+		_, err = client.Publish(channel, "Test")
+		if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidChannel {
+			t.Errorf("Expected the client publish to %q to fail, got %v", channel, err)
+		}
+
+		err = server.Broadcaster.Publish(channel, "Test")
+		if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidChannel {
+			t.Errorf("Expected the publish to %q to fail, got %v", channel, err)
+		}
+	}
+
+	err = client.Subscribe("orders.eu.paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Publish("orders.eu.paid", "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("orders.eu.paid", "Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m.Channel() != "orders.eu.paid" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the message")
+	}
+}
@@ -0,0 +1,213 @@
+package broadcaster
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Reports a node may miss before its counts are left out, see
+// Server.ChannelStatsInterval.
+const channelCountsMissedReports = 3
+
+// Subscribers of a channel, see Server.ChannelStats.
+type ChannelStat struct {
+	// Subscriptions on this node, as in Stats.LocalSubscriptions
+	LocalSubscribers int
+
+	// Subscriptions on all nodes, this one included
+	Subscribers int
+}
+
+// Returns the number of subscribers of the given channels, on this node and
+// across all nodes. Unlike Stats, only the given channels are looked at, so
+// it stays cheap with many channels. Channels without subscribers are
+// included, with zeros.
+//
+// Each call is a snapshot: the counts of this node are taken at once. Those
+// of the other nodes are the ones they last reported, up to
+// ChannelStatsInterval ago. A node that stopped reporting, e.g. because it
+// crashed, is left out after a few intervals.
+func (s *Server) ChannelStats(channels ...string) (map[string]ChannelStat, error) {
+	if !s.isPrepared() {
+		return nil, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+
+	result := make(map[string]ChannelStat, len(channels))
+	if len(channels) == 0 {
+		return result, nil
+	}
+	local := st.hub.SubscriberCounts(channels)
+	others, err := st.redis.ChannelCounts(channels, s.NodeID, s.channelReporter.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		result[channel] = ChannelStat{
+			LocalSubscribers: local[channel],
+			Subscribers:      local[channel] + others[channel],
+		}
+	}
+	return result, nil
+}
+
+// Sends the counts of this node to Redis every ChannelStatsInterval, those
+// that changed since the last report.
+type channelReporter struct {
+	s *Server
+
+	// Real time rather than the server's clock: the counts expire in Redis
+	clock clock
+
+	// Sends every count with the next report, e.g. after Redis lost them
+	full bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newChannelReporter(s *Server) *channelReporter {
+	return &channelReporter{
+		s:     s,
+		clock: realClock{},
+		full:  true,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (r *channelReporter) Run() {
+	defer close(r.done)
+
+	t := r.clock.NewTicker(r.s.ChannelStatsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			r.report()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Stops reporting and withdraws the counts of this node, so that the other
+// nodes no longer count them.
+func (r *channelReporter) Stop() {
+	st := r.s.current()
+	close(r.quit)
+	<-r.done
+
+	err := st.redis.ForgetChannelCounts(r.s.NodeID)
+	if err != nil {
+		r.s.logf("Failed to withdraw channel counts: %s", err)
+	}
+}
+
+func (r *channelReporter) report() {
+	st := r.s.current()
+	full := r.full
+	counts := st.hub.ChangedCounts(full)
+	ttl := channelCountsMissedReports * r.s.ChannelStatsInterval
+	existed, err := st.redis.ReportChannelCounts(r.s.NodeID, counts, r.clock.Now().Add(ttl), ttl)
+	if err != nil {
+		r.s.logf("Failed to report channel counts: %s", err)
+		r.full = true
+		return
+	}
+	// The counts expired meanwhile, or there were none
+	r.full = !existed && !full
+}
+
+// Stores the counts of a node, zero removes a channel. Returns whether the
+// node had counts stored already.
+func (b *redisBackend) ReportChannelCounts(node string, counts map[string]int, expires time.Time, ttl time.Duration) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("channel-counts:%s", node)
+	set := redis.Args{}.Add(key)
+	del := redis.Args{}.Add(key)
+	for channel, n := range counts {
+		if n > 0 {
+			set = set.Add(channel, n)
+		} else {
+			del = del.Add(channel)
+		}
+	}
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", key)
+	if len(set) > 1 {
+		conn.Send("HSET", set...)
+	}
+	if len(del) > 1 {
+		conn.Send("HDEL", del...)
+	}
+	conn.Send("PEXPIRE", key, int64(ttl/time.Millisecond))
+	conn.Send("ZADD", b.key("channel-count-nodes"), quotaScore(expires), node)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(values[0], nil)
+}
+
+func (b *redisBackend) ForgetChannelCounts(node string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", b.key("channel-counts:%s", node))
+	conn.Send("ZREM", b.key("channel-count-nodes"), node)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Sums up the counts the nodes other than skip reported for the channels,
+// those that stopped reporting are dropped.
+func (b *redisBackend) ChannelCounts(channels []string, skip string, now time.Time) (map[string]int, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	nodesKey := b.key("channel-count-nodes")
+	conn.Send("ZREMRANGEBYSCORE", nodesKey, "-inf", quotaScore(now))
+	nodes, err := redis.Strings(conn.Do("ZRANGEBYSCORE", nodesKey, "("+quotaScore(now), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := redis.Args{}.AddFlat(channels)
+	asked := 0
+	for _, node := range nodes {
+		if node == skip {
+			continue
+		}
+		conn.Send("HMGET", append(redis.Args{b.key("channel-counts:%s", node)}, fields...)...)
+		asked++
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(channels))
+	for i := 0; i < asked; i++ {
+		values, err := redis.Values(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range values {
+			n, err := redis.Int(v, nil)
+			if err == redis.ErrNil {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			counts[channels[j]] += n
+		}
+	}
+	return counts, nil
+}
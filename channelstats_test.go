@@ -0,0 +1,68 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChannelStats(t *testing.T) {
+	c := startCluster(t, 2, func(node int) *Server {
+		return &Server{ChannelStatsInterval: 20 * time.Millisecond}
+	})
+
+	subscribe := func(node int, channels ...string) *Client {
+		client := c.Connect(node, ClientModeWebsocket)
+		for _, channel := range channels {
+			err := client.Subscribe(channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return client
+	}
+	subscribe(0, "news", "lobby")
+	subscribe(1, "news")
+	leaving := subscribe(1, "news", "other")
+
+	// The other node's counts arrive with its next report
+	expect := func(expected string) {
+		t.Helper()
+		var got string
+		for i := 0; i < 500; i++ {
+			stats, err := c.Server(0).ChannelStats("news", "lobby", "missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = fmt.Sprint(stats)
+			if got == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+	expect("map[lobby:{1 1} missing:{0 0} news:{1 3}]")
+
+	// Unsubscribing counts too
+	err := leaving.Disconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("map[lobby:{1 1} missing:{0 0} news:{1 2}]")
+
+	// A node that's gone no longer counts
+	err = c.Server(1).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("map[lobby:{1 1} missing:{0 0} news:{1 1}]")
+
+	stats, err := c.Server(0).ChannelStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Errorf("Expected no channels, got %v", stats)
+	}
+}
@@ -1,9 +1,12 @@
 package broadcaster
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +22,16 @@ const (
 
 type messageChan chan ClientMessage
 
+// Returned by the methods of a client after Disconnect, including Disconnect
+// itself when called again.
+var ErrClientClosed = errors.New("Client closed")
+
+// Returned when connecting over WebSocket to a server that can't upgrade the
+// connection, because it's reached over HTTP/2 (e.g. through a proxy). In
+// ClientModeAuto the client falls back to long-polling, and sticks to it
+// when reconnecting.
+var ErrWebsocketUnsupported = errors.New("WebSocket unsupported by the server")
+
 type Client struct {
 	Mode ClientMode
 
@@ -28,20 +41,101 @@ type Client struct {
 	// Set when disconnecting
 	Error error
 
-	// Incoming messages
+	// Incoming messages, as well as presence events and a
+	// ResubscribedMessage for each channel restored after reconnecting.
+	// Messages of channels with a handler go to that instead, see
+	// OnMessage.
 	Messages chan ClientMessage
 
+	// Incoming messages as undecoded JSON frames, only used when RawMode is
+	// set. Each slice is freshly allocated and owned by the receiver, the
+	// client never reuses it.
+	RawMessages <-chan []byte
+
+	// Deliver broadcast messages on RawMessages instead of Messages. Both
+	// are mutually exclusive: nothing is sent to Messages in raw mode.
+	RawMode bool
+
+	// Ask the server for broadcast messages as compact binary frames over
+	// WebSocket, see Server.BinaryFrames. Falls back to JSON when the server
+	// doesn't agree. Ignored in raw mode, which passes on JSON frames.
+	BinaryFrames bool
+
+	// Names of the envelope fields on the wire, must match those of the
+	// server, see Server.EnvelopeFields. Raw messages are passed on as
+	// received, in the server's dialect.
+	EnvelopeFields EnvelopeFields
+
+	// Keys of end-to-end encrypted channels, optional. Returns nil for
+	// channels that aren't encrypted. Published bodies are encrypted with
+	// the first key, incoming ones are decrypted with the key they name.
+	// Messages that can't be decrypted keep their ciphertext and get a
+	// "decryptError" field. Not applied to RawMessages.
+	ChannelKeys func(channel string) []ChannelKey
+
 	// Receives true when disconnected
 	Disconnected chan bool
 
+	// Receives true when the server revoked all subscriptions because the
+	// auth data expired. Use Reauthenticate to regain access.
+	AuthExpired chan bool
+
 	// Timeout
 	Timeout time.Duration
 
 	// Ping interval
 	PingInterval time.Duration
 
-	// Reconnection attempts
-	MaxAttempts int
+	// Measures the round-trip time in the background at this interval, see
+	// RTT. Zero, the default, means only Ping measures it.
+	RTTInterval time.Duration
+
+	// How to reconnect when the connection drops, DefaultReconnectPolicy
+	// unless changed.
+	ReconnectPolicy ReconnectPolicy
+
+	// Called with the time each successful subscribe or unsubscribe took,
+	// from sending it until the server's answer arrived, e.g. to watch for a
+	// saturated server. The type is SubscribeMessage or UnsubscribeMessage.
+	// Optional, runs on the calling goroutine.
+	SubscribeLatency func(msgType, channel string, d time.Duration)
+
+	// Subscribes the server refuses (a SubscribeErrorMessage, e.g. denied
+	// by its CanSubscribe) are logged rather than returned as an error, for
+	// code that subscribes to many channels and only wants those it's
+	// allowed. The subscription simply doesn't exist, no messages arrive
+	// on the channel, and SubscribeWithID returns an empty ID. Being rate
+	// limited is still an error. Off by default.
+	IgnoreRefusedSubscribes bool
+
+	// Asks the server to deliver at most this many messages per second,
+	// e.g. for a client on a slow mobile link. Messages that arrive faster
+	// are coalesced: while one of a channel waits for its turn, the next
+	// one replaces it and carries the number it replaced in "conflated",
+	// like with ChannelConfig.Conflate. This is lossy, only the latest
+	// state of a channel gets through, so it suits channels of state
+	// (prices, positions, counters) but not events that all matter.
+	// Replies and messages of at-least-once subscriptions are delayed
+	// rather than dropped.
+	//
+	// Without it, a client that can't keep up has its messages pile up on
+	// the server until Server.MaxBufferedBytes sheds its buffer and drops
+	// the connection. With it, the server holds about one message per
+	// channel for the client instead. Zero, the default, means as fast as
+	// the connection allows. Only WebSocket and local clients are
+	// throttled, long-poll clients already get whatever piled up between
+	// polls in one response.
+	MaxRate float64
+
+	// How often to poll when the long-poll server can't hold polls open,
+	// e.g. behind a proxy that buffers responses or cuts idle connections.
+	// The client switches after a few polls in a row come back empty right
+	// away, or time out at a proxy. Defaults to 2 seconds.
+	PollInterval time.Duration
+
+	// Injects faults into the connection, for testing. Only active in
+	// builds with the "faults" tag, see Faults.
+	Faults Faults
 
 	// Connection params
 	host   string
@@ -51,12 +145,76 @@ type Client struct {
 	// Only used while testing
 	skip_auth bool
 
+	// In-process server, see Server.LocalClient
+	local *Server
+
+	// No server at all, see NewLoopbackClient
+	loopback bool
+
 	// Internal bits
 	transport         clientTransport
 	results           map[string]messageChan
 	should_disconnect bool
 	attempts          int
-	channels          map[string]bool
+	rawMessages       chan []byte
+	connectionID      string
+	clientID          string
+	clock             clock
+
+	// Set while connecting again after the connection dropped, rather than
+	// moving on purpose, see ResubscribedMessage.
+	recovering bool
+
+	// The server refused to upgrade, see ErrWebsocketUnsupported
+	websocketUnsupported bool
+
+	// Credential presented instead of the auth data when connecting again,
+	// see Server.SessionTTL. Guarded by deliverLock.
+	session string
+
+	// Drops duplicates while moving to another server, see Server.Drain.
+	// Guarded by deliverLock.
+	dedup *messageDedup
+
+	// Channels subscribed at least once, their messages get acknowledged.
+	// Guarded by deliverLock.
+	reliable map[string]bool
+
+	// Channels to subscribe to again after reconnecting, and how. Guarded
+	// by deliverLock.
+	channels      map[string]bool
+	subscriptions map[string]SubscribeOptions
+
+	// See SubscribeChan, guarded by deliverLock.
+	subscriptionChans map[string]chan ClientMessage
+
+	// Sequence number of the last message received on the channels
+	// subscribed with a cursor, see SubscribeOptions.Cursor. Guarded by
+	// deliverLock.
+	cursors map[string]int64
+
+	// Open while connecting, until the channels above are subscribed to
+	// again. Subscribing and unsubscribing wait for it, so that changes
+	// made during an outage apply after the restored subscriptions. Guarded
+	// by deliverLock, nil when not connecting.
+	restoring chan struct{}
+
+	// Latest round-trip time in nanoseconds, accessed atomically.
+	rtt      int64
+	sampling bool
+
+	// See OnMessage, sorted by precedence.
+	handlers     []messageHandler
+	handlerOrder int
+	handlersLock sync.Mutex
+
+	// Frames received before disconnecting are still delivered, the lock
+	// guards against closing the channels while doing so.
+	stopping       chan struct{}
+	listenerDone   chan struct{}
+	closed         bool
+	deliverLock    sync.Mutex
+	disconnectOnce sync.Once
 }
 
 func NewClient(urlStr string) (*Client, error) {
@@ -65,16 +223,25 @@ func NewClient(urlStr string) (*Client, error) {
 		return nil, err
 	}
 
+	raw := make(chan []byte, 10)
 	return &Client{
-		host:         u.Host,
-		path:         u.Path,
-		secure:       u.Scheme == "https",
-		Timeout:      30 * time.Second,
-		PingInterval: 30 * time.Second,
-		MaxAttempts:  10,
-		channels:     make(map[string]bool),
-		Messages:     make(messageChan, 10),
-		Disconnected: make(chan bool, 0),
+		host:            u.Host,
+		path:            u.Path,
+		secure:          u.Scheme == "https",
+		Timeout:         30 * time.Second,
+		PingInterval:    30 * time.Second,
+		ReconnectPolicy: DefaultReconnectPolicy,
+		PollInterval:    2 * time.Second,
+		channels:        make(map[string]bool),
+		subscriptions:   make(map[string]SubscribeOptions),
+		reliable:        make(map[string]bool),
+		Messages:        make(messageChan, 10),
+		RawMessages:     raw,
+		Disconnected:    make(chan bool, 0),
+		AuthExpired:     make(chan bool, 1),
+		rawMessages:     raw,
+		clock:           realClock{},
+		stopping:        make(chan struct{}),
 	}, nil
 }
 
@@ -93,15 +260,35 @@ func (c *Client) url(mode ClientMode) string {
 }
 
 func (c *Client) Connect() error {
+	if c.stopped() {
+		return ErrClientClosed
+	}
+	c.beginRestore()
 	c.should_disconnect = false
+	resuming := c.sessionCredential() != ""
 
-	if c.Mode == ClientModeAuto || c.Mode == ClientModeWebsocket {
+	if c.local != nil {
+		c.transport = &localClientTransport{server: c.local}
+		err := c.transport.Connect(c.authPacket())
+		if err != nil {
+			return err
+		}
+	} else if c.loopback {
+		c.transport = &loopbackClientTransport{}
+		err := c.transport.Connect(c.authPacket())
+		if err != nil {
+			return err
+		}
+	} else if c.Mode == ClientModeWebsocket || c.Mode == ClientModeAuto && !c.websocketUnsupported {
 		c.transport = &websocketClientTransport{client: c}
-		err := c.transport.Connect(c.AuthData)
+		err := c.transport.Connect(c.authPacket())
 		if err != nil {
 			if c.Mode == ClientModeAuto {
+				if err == ErrWebsocketUnsupported {
+					c.websocketUnsupported = true
+				}
 				c.transport = newlongpollClientTransport(c)
-				err := c.transport.Connect(c.AuthData)
+				err := c.transport.Connect(c.authPacket())
 				if err != nil {
 					return err
 				}
@@ -109,9 +296,9 @@ func (c *Client) Connect() error {
 				return err
 			}
 		}
-	} else if c.Mode == ClientModeLongPoll {
+	} else if c.Mode == ClientModeLongPoll || c.Mode == ClientModeAuto {
 		c.transport = newlongpollClientTransport(c)
-		err := c.transport.Connect(c.AuthData)
+		err := c.transport.Connect(c.authPacket())
 		if err != nil {
 			return err
 		}
@@ -125,88 +312,599 @@ func (c *Client) Connect() error {
 			return err
 		}
 
+		if m.Type() == AuthChallengeMessage {
+			m, err = c.answerChallenge(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		if m.Type() == AuthFailedMessage && resuming {
+			// Expired or revoked, authenticate in full instead.
+			c.setSession("")
+			c.transport.Close()
+			return c.Connect()
+		}
 		if m.Type() == AuthFailedMessage {
 			return fmt.Errorf("Auth error: %s", m["reason"])
 		} else if m.Type() != AuthOKMessage {
 			return fmt.Errorf("Expected %s or %s, got %s instead", AuthOKMessage, AuthFailedMessage, m.Type())
 		}
+		c.connectionID = m.ConnectionID()
+		c.clientID = m.ClientID()
+		c.setSession(m.Session())
 	}
 
-	go c.listen()
+	// Starts polling, before Disconnect can stop it.
+	c.transport.onConnect()
+
+	done := make(chan struct{})
+	c.listenerDone = done
+	go c.listen(c.transport, done)
+
+	if c.RTTInterval > 0 && !c.sampling {
+		c.sampling = true
+		go c.sampleRTT()
+	}
 
-	for channel, _ := range c.channels {
-		err := c.Subscribe(channel)
+	for channel, opts := range c.resubscriptions() {
+		_, err := c.subscribe(channel, opts)
 		if err != nil {
 			return err
 		}
+		if c.recovering {
+			c.resubscribed(channel)
+		}
 	}
 
+	c.endRestore()
 	return nil
 }
 
+// Tells the application about a gap, see ResubscribedMessage. Not when the
+// server refused the channel this time, see IgnoreRefusedSubscribes.
+func (c *Client) resubscribed(channel string) {
+	c.deliverLock.Lock()
+	subscribed := c.channels[channel]
+	c.deliverLock.Unlock()
+	if !subscribed {
+		return
+	}
+
+	c.deliverControl(ClientMessage{typeField: ResubscribedMessage, "channel": channel})
+}
+
+// Holds back subscription changes until endRestore, see restoring.
+func (c *Client) beginRestore() {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	if c.restoring == nil {
+		c.restoring = make(chan struct{})
+	}
+}
+
+func (c *Client) endRestore() {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	if c.restoring != nil {
+		close(c.restoring)
+		c.restoring = nil
+	}
+}
+
+// Waits until the subscriptions are restored, if connecting.
+func (c *Client) waitRestored() error {
+	c.deliverLock.Lock()
+	restoring := c.restoring
+	c.deliverLock.Unlock()
+	if restoring == nil {
+		return nil
+	}
+
+	select {
+	case <-restoring:
+		return nil
+	case <-c.stopping:
+		return ErrClientClosed
+	case <-after(c.clock, c.Timeout):
+		return errors.New("Reconnecting timed out")
+	}
+}
+
+// Repeats the auth packet, with proof that it was made for the nonce in the
+// challenge. Returns the reply.
+func (c *Client) answerChallenge(challenge ClientMessage) (ClientMessage, error) {
+	nonce, _ := challenge["nonce"].(string)
+
+	data := c.authPacket()
+	data[nonceField] = nonce
+	data[proofField] = authProof(nonce, data)
+
+	err := c.send(AuthMessage, data)
+	if err != nil {
+		return nil, err
+	}
+	return c.transport.Receive()
+}
+
+// The ID assigned to this connection by the server, useful for debugging.
+// Changes when reconnecting.
+func (c *Client) ConnectionID() string {
+	return c.connectionID
+}
+
+// The ID assigned to this client by the server. Unlike the connection ID, it
+// stays the same when reconnecting. See Server.ClientIDKey.
+func (c *Client) ClientID() string {
+	return c.clientID
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	logf("", format, args...)
+}
+
+// The auth data, along with the client ID once there is one. Just the
+// session credential when there's one of those. The delivery rate goes
+// along either way.
+func (c *Client) authPacket() ClientMessage {
+	data := make(ClientMessage)
+	if c.MaxRate > 0 {
+		data[maxRateField] = c.MaxRate
+	}
+	if session := c.sessionCredential(); session != "" {
+		data[sessionField] = session
+		return data
+	}
+	for k, v := range c.AuthData {
+		data[k] = v
+	}
+	if c.clientID != "" {
+		data[clientIDField] = c.clientID
+	}
+	return data
+}
+
+// Replaces the auth data on an open connection, e.g. to refresh a token
+// before it expires. Subscriptions are kept.
+func (c *Client) Reauthenticate(authData map[string]interface{}) error {
+	result := c.resultChan("%s", AuthMessage)
+
+	data := make(ClientMessage)
+	for k, v := range authData {
+		data[k] = v
+	}
+	err := c.send(AuthMessage, data)
+	if err != nil {
+		return err
+	}
+
+	var m ClientMessage
+	select {
+	case r, ok := <-result:
+		if !ok {
+			return c.closedError()
+		}
+		m = r
+	case <-after(c.clock, c.Timeout):
+		c.dropResult("%s", AuthMessage)
+		return errors.New("Re-authentication timed out")
+	}
+
+	if m.Type() == AuthFailedMessage {
+		return fmt.Errorf("Auth error: %s", m["reason"])
+	} else if m.Type() != AuthOKMessage {
+		return fmt.Errorf("Expected %s or %s, got %s instead", AuthOKMessage, AuthFailedMessage, m.Type())
+	}
+
+	c.AuthData = authData
+	c.setSession(m.Session())
+	return nil
+}
+
+func (c *Client) sessionCredential() string {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	return c.session
+}
+
+func (c *Client) setSession(session string) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	c.session = session
+}
+
+// Closes the connection. Messages that were already received, such as a
+// final KickMessage, are delivered before Messages is closed. Calls in
+// progress are cut short, later ones fail with ErrClientClosed.
 func (c *Client) Disconnect() error {
-	c.should_disconnect = true
-	err := c.transport.Close()
-	if err != nil && c.Error == nil {
-		c.Error = err
+	err := ErrClientClosed
+	c.disconnectOnce.Do(func() {
+		err = c.disconnect()
+	})
+	return err
+}
+
+func (c *Client) disconnect() error {
+	close(c.stopping)
+	if c.transport != nil {
+		err := c.transport.Close()
+		if err != nil && c.Error == nil {
+			c.Error = err
+		}
+	}
+
+	if c.listenerDone != nil {
+		select {
+		case <-c.listenerDone:
+		case <-after(c.clock, c.Timeout):
+		}
 	}
+
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	c.closed = true
 	for _, r := range c.results {
 		close(r)
 	}
 	close(c.Messages)
+	close(c.rawMessages)
+	c.closeSubscriptionChan("")
 	return c.Error
 }
 
+// Whether Disconnect was called.
+func (c *Client) stopped() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// The error of a call cut short by Disconnect.
+func (c *Client) closedError() error {
+	if c.Error != nil {
+		return c.Error
+	}
+	return ErrClientClosed
+}
+
 func (c *Client) disconnected() {
-	if c.should_disconnect {
+	if c.should_disconnect || c.stopped() {
 		return
 	}
 
-	if c.attempts == c.MaxAttempts {
+	if c.attempts >= c.ReconnectPolicy.MaxAttempts {
+		c.attempts = 0
 		c.Error = errors.New("Disconnected")
-		c.Disconnected <- true
+		select {
+		case c.Disconnected <- true:
+		case <-c.stopping:
+		}
+		return
 	}
 
 	c.attempts++
+	c.recovering = true
 	err := c.Connect()
+	c.recovering = false
 	if err == nil {
 		// Connected!
+		c.attempts = 0
 		return
 	}
 
-	// Back off
-	<-time.After(time.Duration(c.attempts-1) * time.Second)
+	// Back off, unless that was the last attempt
+	if c.attempts < c.ReconnectPolicy.MaxAttempts {
+		select {
+		case <-after(c.clock, c.ReconnectPolicy.delay(c.attempts)):
+		case <-c.stopping:
+			return
+		}
+	}
 	c.disconnected()
 }
 
-func (c *Client) listen() {
-	c.transport.onConnect()
+// Reads from a single transport: while migrating, the old one is read until
+// its server hangs up.
+func (c *Client) listen(t clientTransport, done chan struct{}) {
+	defer close(done)
 
+	migrating := false
 	for {
-		m, err := c.receive()
+		var m ClientMessage
+		var err error
+		if c.RawMode {
+			m, err = c.receiveRaw(t)
+		} else {
+			m, err = t.Receive()
+		}
 		if err != nil {
-			c.disconnected()
+			if !migrating {
+				c.disconnected()
+			}
 			return
 		}
 
-		if m.Type() == MessageMessage {
-			c.Messages <- m
-		} else {
-			channel, ok := c.results[m.ResultId()]
-			if !ok {
-				// Unrequested result?
+		if m == nil {
+			// Already delivered as a raw message
+		} else if m.Type() == MessageMessage {
+			if !c.isNew(m) {
+				continue
+			}
+			c.decrypt(m)
+			if c.deliverSubscription(m) {
+				// Has a channel of its own
+			} else if handler := c.handlerFor(m.Channel()); handler != nil {
+				handler(m)
 			} else {
-				channel <- m
+				c.deliver(m)
+			}
+			c.ack(t, m.Channel(), m.Seq())
+			c.advanceCursor(m.Channel(), m.Seq(), false)
+		} else if m.Type() == MemberAddedMessage || m.Type() == MemberRemovedMessage || m.Type() == SkippedMessage || m.Type() == ExpiredMessage {
+			c.deliverControl(m)
+		} else if m.Type() == KickMessage {
+			// Final message, the server hangs up after this.
+			c.should_disconnect = true
+			c.Error = fmt.Errorf("Kicked: %s", m["body"])
+			c.deliverControl(m)
+			c.transport.Close()
+		} else if m.Type() == UnsubscribedMessage || m.Type() == UnsubscribeOKMessage && (m["reason"] == reasonExpired || m.Revoked()) {
+			// Not a reply, the subscription ran out or the server ended it,
+			// see ClientMessage.Revoked and Server.ForceUnsubscribe.
+			c.setSubscribed(m.Channel(), false, SubscribeOptions{})
+			c.setReliable(m.Channel(), false)
+			c.deliverControl(m)
+		} else if m.Type() == MigrateMessage {
+			c.deliverControl(m)
+			if u, ok := migrationURL(m); ok && !migrating {
+				migrating = true
+				go c.migrate(t, done, u, m.Hold())
+			}
+		} else if m.Type() == DrainingMessage {
+			c.deliverControl(m)
+			// Moves to wherever the same URL leads now.
+			if c.ReconnectPolicy.MaxAttempts > 0 && !migrating {
+				migrating = true
+				go c.migrate(t, done, nil, false)
 			}
+		} else if m.Type() == AuthExpiredMessage {
+			c.setSubscribed("", false, SubscribeOptions{})
+			c.setReliable("", false)
+			select {
+			case c.AuthExpired <- true:
+			default:
+			}
+		} else {
+			c.deliverResult(m)
 		}
 	}
 }
 
+// Remembers whether a channel is subscribed, and closes the Go channel of a
+// subscription that ended (see SubscribeChan). An empty channel forgets all
+// of them.
+func (c *Client) setSubscribed(channel string, subscribed bool, opts SubscribeOptions) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	if channel == "" {
+		c.channels = make(map[string]bool)
+		c.cursors = nil
+		c.closeSubscriptionChan("")
+		return
+	}
+	c.channels[channel] = subscribed
+	if subscribed {
+		c.subscriptions[channel] = opts
+		if !opts.Cursor {
+			delete(c.cursors, channel)
+		}
+	} else {
+		delete(c.cursors, channel)
+		c.closeSubscriptionChan(channel)
+	}
+}
+
+// Sequence number of the last message received on a channel subscribed
+// with a cursor, or of the last one published before subscribing. False if
+// it's not known, e.g. when the channel wasn't subscribed with a cursor. See
+// SubscribeOptions.Cursor.
+func (c *Client) Cursor(channel string) (int64, bool) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	seq, ok := c.cursors[channel]
+	return seq, ok
+}
+
+// Moves the cursor of a channel forward, starts it if asked to. Messages
+// that were replayed can arrive before the reply to subscribing.
+func (c *Client) advanceCursor(channel string, seq int64, start bool) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	current, ok := c.cursors[channel]
+	if !ok && !start {
+		return
+	}
+	if c.cursors == nil {
+		c.cursors = make(map[string]int64)
+	}
+	if !ok || seq > current {
+		c.cursors[channel] = seq
+	}
+}
+
+// Channels to subscribe to again after reconnecting, with their options.
+func (c *Client) resubscriptions() map[string]SubscribeOptions {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	subscriptions := make(map[string]SubscribeOptions, len(c.channels))
+	for channel, subscribed := range c.channels {
+		if subscribed {
+			subscriptions[channel] = c.subscriptions[channel]
+		}
+	}
+	return subscriptions
+}
+
+// Marks a channel as subscribed at least once, or not. An empty channel
+// clears them all.
+func (c *Client) setReliable(channel string, reliable bool) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	if channel == "" {
+		c.reliable = make(map[string]bool)
+	} else if reliable {
+		c.reliable[channel] = true
+	} else {
+		delete(c.reliable, channel)
+	}
+}
+
+// Acknowledges a message of an at-least-once subscription, on the transport
+// it arrived on. Long-poll sessions don't need it.
+func (c *Client) ack(t clientTransport, channel string, seq int64) {
+	c.deliverLock.Lock()
+	reliable := c.reliable[channel]
+	c.deliverLock.Unlock()
+
+	if _, ok := t.(*longpollClientTransport); ok || !reliable || seq == 0 {
+		return
+	}
+	t.Send(ClientMessage{typeField: AckMessage, "channel": channel, "seq": seq})
+}
+
+// Replaces the body of a message on an encrypted channel by its plaintext.
+func (c *Client) decrypt(m ClientMessage) {
+	keys := c.channelKeys(m.Channel())
+	if keys == nil {
+		return
+	}
+
+	body, _ := m["body"].(string)
+	key, err := findChannelKey(keys, body)
+	if err == nil {
+		body, err = DecryptBody(key, m.Channel(), body)
+	}
+	if err != nil {
+		m["decryptError"] = err.Error()
+		return
+	}
+	m["body"] = body
+}
+
+// Encrypts a body about to be published, if the channel is encrypted.
+func (c *Client) encrypt(channel, body string) (string, error) {
+	keys := c.channelKeys(channel)
+	if keys == nil {
+		return body, nil
+	}
+	return EncryptBody(keys[0], channel, body)
+}
+
+func (c *Client) channelKeys(channel string) []ChannelKey {
+	if c.ChannelKeys == nil {
+		return nil
+	}
+	keys := c.ChannelKeys(channel)
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys
+}
+
+// Hands a message to the application. Only dropped when disconnecting while
+// nobody's reading and the buffer is full.
+func (c *Client) deliver(m ClientMessage) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.Messages <- m:
+		return
+	default:
+	}
+	select {
+	case c.Messages <- m:
+	case <-c.stopping:
+	}
+}
+
+// Returns false for a copy of a message that already arrived on another
+// connection while migrating.
+func (c *Client) isNew(m ClientMessage) bool {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	if c.dedup == nil {
+		return true
+	}
+	return c.dedup.isNew(m, migrationDedupSize)
+}
+
+func (c *Client) deliverRaw(data []byte) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.rawMessages <- data:
+		return
+	default:
+	}
+	select {
+	case c.rawMessages <- data:
+	case <-c.stopping:
+	}
+}
+
+// Delivers a message other than a published one, such as a notice of the
+// server, as a raw frame in RawMode.
+func (c *Client) deliverControl(m ClientMessage) {
+	if !c.RawMode {
+		c.deliver(m)
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		c.logf("Failed to encode %s message: %s", m.Type(), err)
+		return
+	}
+	c.deliverRaw(data)
+}
+
+func (c *Client) deliverResult(m ClientMessage) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	channel, ok := c.results[m.ResultId()]
+	if !ok || c.closed {
+		// Unrequested result?
+	} else {
+		channel <- m
+	}
+}
+
 func (c *Client) send(msg string, data ClientMessage) error {
+	if c.stopped() {
+		return ErrClientClosed
+	}
 	if data == nil {
 		data = make(ClientMessage)
 	}
-	data["__type"] = msg
+	data[typeField] = msg
 	return c.transport.Send(data)
 }
 
@@ -214,16 +912,64 @@ func (c *Client) receive() (ClientMessage, error) {
 	return c.transport.Receive()
 }
 
+// Only decodes what's needed to route a frame, the tag matches typeField.
+type frameHeader struct {
+	Type    string `json:"__type"`
+	Channel string `json:"channel"`
+	Seq     int64  `json:"seq"`
+	ID      string `json:"id"`
+}
+
+// Passes broadcast messages on to RawMessages without decoding them, other
+// frames are decoded as usual.
+func (c *Client) receiveRaw(t clientTransport) (ClientMessage, error) {
+	data, err := t.ReceiveRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := c.EnvelopeFields.header(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Type == MessageMessage {
+		c.deliverRaw(data)
+		c.ack(t, h.Channel, h.Seq)
+		return nil, nil
+	}
+
+	m := ClientMessage{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return c.EnvelopeFields.decode(m), nil
+}
+
 func (c *Client) resultChan(format string, args ...interface{}) chan ClientMessage {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	channel := make(chan ClientMessage, 1)
+	if c.closed {
+		// Never answered
+		close(channel)
+		return channel
+	}
 	if c.results == nil {
 		c.results = make(map[string]messageChan)
 	}
-	name := fmt.Sprintf(format, args...)
-	channel := make(chan ClientMessage, 1)
-	c.results[name] = channel
+	c.results[fmt.Sprintf(format, args...)] = channel
 	return channel
 }
 
+func (c *Client) dropResult(format string, args ...interface{}) {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	delete(c.results, fmt.Sprintf(format, args...))
+}
+
 func (c *Client) call(msgType string, msg ClientMessage) (ClientMessage, error) {
 	result := c.resultChan("%s_%s", msgType, msg["channel"])
 
@@ -234,51 +980,418 @@ func (c *Client) call(msgType string, msg ClientMessage) (ClientMessage, error)
 
 	m, ok := <-result
 	if !ok {
-		return nil, c.Error
+		return nil, c.closedError()
 	}
 	return m, nil
 }
 
 func (c *Client) Subscribe(channel string) error {
-	m, err := c.call(SubscribeMessage, ClientMessage{"channel": channel})
+	return c.SubscribeWith(channel, SubscribeOptions{})
+}
+
+// Subscribes until the TTL passes, unless renewed with Touch or by
+// subscribing again. The server may shorten it. An UnsubscribeOKMessage with
+// reason "expired" arrives on Messages when it runs out.
+func (c *Client) SubscribeTTL(channel string, ttl time.Duration) error {
+	return c.SubscribeWith(channel, SubscribeOptions{TTL: ttl})
+}
+
+type SubscribeOptions struct {
+	// See SubscribeTTL, zero means no expiry.
+	TTL time.Duration
+
+	// Receive the messages this client publishes on the channel, which are
+	// left out by default.
+	Echo bool
+
+	// Delivery guarantee, QoSAtMostOnce by default. At least once, messages
+	// are acknowledged once they're passed to Messages, RawMessages or a
+	// handler, those that weren't are delivered again after reconnecting.
+	// Long-polling keeps messages on the server between polls either way.
+	QoS string
+
+	// Keeps track of the sequence number of the last message received, see
+	// Cursor, and resumes after it when subscribing again after
+	// reconnecting. At least once, the server then delivers what came after
+	// it, rather than what the client ID didn't acknowledge: for clients
+	// that don't keep their ID. A SkippedMessage tells how many messages it
+	// no longer had.
+	Cursor bool
+}
+
+// Subscribes with the given options. Subscribing again replaces them.
+func (c *Client) SubscribeWith(channel string, opts SubscribeOptions) error {
+	_, err := c.SubscribeWithID(channel, opts)
+	return err
+}
+
+// Like SubscribeWith, but also returns the ID the server assigned to the
+// subscription, for UnsubscribeID. Subscribing again to the same channel
+// keeps the ID. IDs don't survive reconnecting: the client subscribes
+// again, which gets new ones.
+//
+// While reconnecting, subscribing and unsubscribing wait until the earlier
+// subscriptions are restored, then apply on top of them.
+func (c *Client) SubscribeWithID(channel string, opts SubscribeOptions) (string, error) {
+	err := c.waitRestored()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return c.subscribe(channel, opts)
+}
 
-	if m.Type() == SubscribeErrorMessage {
-		return fmt.Errorf("Subscribe error: %s", m["reason"])
+func (c *Client) subscribe(channel string, opts SubscribeOptions) (string, error) {
+	msg := ClientMessage{"channel": channel}
+	if opts.TTL > 0 {
+		msg["ttl"] = opts.TTL.Seconds()
+	}
+	if opts.Echo {
+		msg["echo"] = true
+	}
+	if opts.QoS != "" {
+		msg["qos"] = opts.QoS
+	}
+	if opts.Cursor {
+		if seq, ok := c.Cursor(channel); ok {
+			msg["lastSeq"] = seq
+		} else {
+			msg["cursor"] = true
+		}
+	}
+	// Replayed messages may arrive before the reply.
+	c.setReliable(channel, opts.QoS == QoSAtLeastOnce)
+	start := c.clock.Now()
+	m, err := c.call(SubscribeMessage, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if m.Type() == SubscribeErrorMessage && c.IgnoreRefusedSubscribes {
+		c.logf("Subscribe to %s refused: %s", channel, m["reason"])
+		return "", nil
+	} else if m.Type() == SubscribeErrorMessage || m.Type() == RateLimitedMessage {
+		return "", fmt.Errorf("Subscribe error: %s", m["reason"])
 	} else if m.Type() != SubscribeOKMessage {
-		return fmt.Errorf("Expected %s or %s, got %s instead", SubscribeOKMessage, SubscribeErrorMessage, m.Type())
+		return "", fmt.Errorf("Expected %s or %s, got %s instead", SubscribeOKMessage, SubscribeErrorMessage, m.Type())
 	}
 
 	if m["channel"] != channel {
-		return fmt.Errorf("Expected channel %s, got %s instead", channel, m["channel"])
+		return "", fmt.Errorf("Expected channel %s, got %s instead", channel, m["channel"])
 	}
-	c.channels[channel] = true
-	return nil
+	c.setSubscribed(channel, true, opts)
+	if _, ok := m["seq"]; ok && opts.Cursor {
+		c.advanceCursor(channel, m.Seq(), true)
+	}
+	c.timed(SubscribeMessage, channel, start)
+	return m.SubscriptionID(), nil
+}
+
+// Renews the TTL of a subscription, without waiting for the server.
+func (c *Client) Touch(channel string) error {
+	return c.send(TouchMessage, ClientMessage{"channel": channel})
 }
 
 func (c *Client) Unsubscribe(channel string) error {
+	err := c.waitRestored()
+	if err != nil {
+		return err
+	}
+	start := c.clock.Now()
 	m, err := c.call(UnsubscribeMessage, ClientMessage{"channel": channel})
 	if err != nil {
 		return err
 	}
 
-	if m.Type() != UnsubscribeOKMessage {
+	if m.Type() == RateLimitedMessage {
+		return fmt.Errorf("Unsubscribe error: %s", m["reason"])
+	} else if m.Type() != UnsubscribeOKMessage {
 		return fmt.Errorf("Expected %s, got %s instead", UnsubscribeOKMessage, m.Type())
 	}
 	if m["channel"] != channel {
 		return fmt.Errorf("Expected channel %s, got %s instead", channel, m["channel"])
 	}
-	c.channels[channel] = false
+	c.setSubscribed(channel, false, SubscribeOptions{})
+	c.setReliable(channel, false)
+	c.timed(UnsubscribeMessage, channel, start)
 	return nil
 }
 
+// Reports the time a call took, see SubscribeLatency.
+func (c *Client) timed(msgType, channel string, start time.Time) {
+	if c.SubscribeLatency == nil {
+		return
+	}
+	d := c.clock.Now().Sub(start)
+	runCallback(c.logf, "SubscribeLatency", func() {
+		c.SubscribeLatency(msgType, channel, d)
+	})
+}
+
+// Unsubscribes from the subscription with the given ID, see
+// SubscribeWithID.
+func (c *Client) UnsubscribeID(id string) error {
+	err := c.waitRestored()
+	if err != nil {
+		return err
+	}
+	msg := ClientMessage{"subscription": id}
+	result := c.resultChan("%s_#%s", UnsubscribeMessage, id)
+
+	start := c.clock.Now()
+	err = c.send(UnsubscribeMessage, msg)
+	if err != nil {
+		return err
+	}
+	m, ok := <-result
+	if !ok {
+		return c.closedError()
+	}
+
+	if m.Type() == UnsubscribeErrorMessage || m.Type() == RateLimitedMessage {
+		return fmt.Errorf("Unsubscribe error: %s", m["reason"])
+	} else if m.Type() != UnsubscribeOKMessage {
+		return fmt.Errorf("Expected %s, got %s instead", UnsubscribeOKMessage, m.Type())
+	}
+	channel := m.Channel()
+	c.setSubscribed(channel, false, SubscribeOptions{})
+	c.setReliable(channel, false)
+	c.timed(UnsubscribeMessage, channel, start)
+	return nil
+}
+
+// Stops the server from delivering a channel until Resume, without
+// unsubscribing. It holds back what's published in the meantime, up to a
+// limit, see ChannelConfig.PauseBufferSize. Not supported by long-polling.
+func (c *Client) Pause(channel string) error {
+	return c.pauseCall(PauseMessage, PauseOKMessage, "Pause", channel)
+}
+
+// Delivers what was held back while the channel was paused, then carries on
+// as before. A SkippedMessage on Messages tells how many messages were
+// dropped, if any.
+func (c *Client) Resume(channel string) error {
+	return c.pauseCall(ResumeMessage, ResumeOKMessage, "Resume", channel)
+}
+
+func (c *Client) pauseCall(msgType, okType, name, channel string) error {
+	if _, ok := c.transport.(*longpollClientTransport); ok {
+		return errors.New("Pausing isn't supported by long-polling")
+	}
+
+	m, err := c.call(msgType, ClientMessage{"channel": channel})
+	if err != nil {
+		return err
+	}
+	if m.Type() != okType {
+		return fmt.Errorf("%s error: %s", name, m["reason"])
+	}
+	return nil
+}
+
+// Fetches the current members of a presence channel the client is
+// subscribed to, across all nodes, ordered by key. For showing the whole
+// list on demand, rather than keeping track of the MemberAddedMessage and
+// MemberRemovedMessage events. Fails for channels without presence (see
+// ChannelConfig.Presence), and when asked too often (see
+// Server.SubscribersRateLimit).
+func (c *Client) Subscribers(channel string) ([]Member, error) {
+	m, err := c.call(SubscribersMessage, ClientMessage{"channel": channel})
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() == RateLimitedMessage {
+		return nil, errors.New("Subscribers rate limited")
+	}
+	if m.Type() != SubscribersOKMessage {
+		return nil, fmt.Errorf("Subscribers error: %s", m["reason"])
+	}
+	return decodeMembers(m["members"])
+}
+
+// Publishes a message and waits for the server to confirm it, returns the
+// ID assigned to the message. Failures are returned as a *PublishError.
+func (c *Client) Publish(channel, body string) (string, error) {
+	return c.PublishWith(channel, body, PublishOptions{})
+}
+
+type PublishOptions struct {
+	// Don't deliver the message back to this connection, even if it
+	// subscribed to the channel with echo. Other connections of the same
+	// user still get it, the "origin" field tells them where it came from.
+	SuppressEcho bool
+
+	// Small headers delivered along with the message, e.g. a trace ID, see
+	// ClientMessage.Header. At most 1 KB, names and values together. Names
+	// starting with "__" are reserved for server-side publishes, the server
+	// drops them from those of clients.
+	Headers map[string]string
+
+	// What to do when the message reached no subscriber on any node, see
+	// Server.Unrouted. Server-side publishes only.
+	Unrouted UnroutedPolicy
+
+	// Compacts the messages kept for at-least-once subscribers: of those
+	// with the same key, e.g. the ID of the record they update, only the
+	// latest is replayed to a subscriber that comes back. The others are
+	// still delivered live. At most 256 bytes, delivered along as the
+	// "compactionKey" field, see ClientMessage.CompactionKey.
+	//
+	// A compacted replay is ordered by sequence number, each key where its
+	// latest message is: the sequence numbers skip those superseded. No
+	// SkippedMessage comes before a replay with compacted messages, those
+	// missing can't be told from those lost to Server.PendingLimit.
+	// Publishes with the same key should come from one publisher at a time,
+	// the message Redis stores last is the one kept. Durable streams keep
+	// all messages.
+	CompactionKey string
+
+	// Drops the message rather than deliver it this long after it was
+	// published, overriding ChannelConfig.MessageTTL, e.g. for a cursor
+	// position that's useless once it's stale.
+	TTL time.Duration
+}
+
+// Like Publish, with the given options.
+func (c *Client) PublishWith(channel, body string, opts PublishOptions) (string, error) {
+	body, err := c.encrypt(channel, body)
+	if err != nil {
+		return "", err
+	}
+
+	ref := randomId(8)
+	result := c.resultChan("%s_%s", PublishMessage, ref)
+
+	msg := ClientMessage{
+		"channel": channel,
+		"body":    body,
+		refField:  ref,
+	}
+	if opts.SuppressEcho {
+		msg["suppressEcho"] = true
+	}
+	if len(opts.Headers) > 0 {
+		msg["headers"] = opts.Headers
+	}
+	if opts.CompactionKey != "" {
+		msg["compactionKey"] = opts.CompactionKey
+	}
+	if opts.TTL > 0 {
+		msg["ttl"] = opts.TTL.Seconds()
+	}
+	err = c.send(PublishMessage, msg)
+	if err != nil {
+		return "", err
+	}
+
+	var m ClientMessage
+	select {
+	case r, ok := <-result:
+		if !ok {
+			return "", c.closedError()
+		}
+		m = r
+	case <-after(c.clock, c.Timeout):
+		c.dropResult("%s_%s", PublishMessage, ref)
+		return "", errors.New("Publish timed out")
+	}
+
+	if m.Type() == PublishErrorMessage {
+		code, _ := m["code"].(string)
+		reason, _ := m["reason"].(string)
+		retryAfter, _ := m["retryAfter"].(float64)
+		return "", &PublishError{
+			Code:       code,
+			Reason:     reason,
+			RetryAfter: time.Duration(retryAfter * float64(time.Second)),
+		}
+	} else if m.Type() != PublishOKMessage {
+		return "", fmt.Errorf("Expected %s or %s, got %s instead", PublishOKMessage, PublishErrorMessage, m.Type())
+	}
+
+	id, _ := m["id"].(string)
+	return id, nil
+}
+
+// Publishes a message without waiting for confirmation.
+func (c *Client) Notify(channel, body string) error {
+	body, err := c.encrypt(channel, body)
+	if err != nil {
+		return err
+	}
+	return c.send(PublishMessage, ClientMessage{
+		"channel": channel,
+		"body":    body,
+	})
+}
+
+// Measures the round-trip time to the server with a PingMessage, which the
+// server answers right away, ahead of any queued messages. Over long-polling
+// it's the time a request takes. Also updates RTT.
+func (c *Client) Ping(timeout time.Duration) (time.Duration, error) {
+	ref := randomId(8)
+	result := c.resultChan("%s_%s", PingMessage, ref)
+
+	start := c.clock.Now()
+	err := c.send(PingMessage, ClientMessage{
+		refField: ref,
+		"ts":     start.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		c.dropResult("%s_%s", PingMessage, ref)
+		return 0, err
+	}
+
+	var m ClientMessage
+	select {
+	case r, ok := <-result:
+		if !ok {
+			return 0, c.closedError()
+		}
+		m = r
+	case <-after(c.clock, timeout):
+		c.dropResult("%s_%s", PingMessage, ref)
+		return 0, errors.New("Ping timed out")
+	}
+	c.dropResult("%s_%s", PingMessage, ref)
+
+	if m.Type() == RateLimitedMessage {
+		return 0, errors.New("Ping rate limited")
+	} else if m.Type() != PongMessage {
+		return 0, fmt.Errorf("Expected %s, got %s instead", PongMessage, m.Type())
+	}
+
+	rtt := c.clock.Now().Sub(start)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	return rtt, nil
+}
+
+// The latest round-trip time measured by Ping or in the background (see
+// RTTInterval), zero if there's none yet.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+func (c *Client) sampleRTT() {
+	ticker := c.clock.NewTicker(c.RTTInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			// Failures show up elsewhere, e.g. as a reconnect.
+			c.Ping(c.Timeout)
+		case <-c.stopping:
+			return
+		}
+	}
+}
+
 type clientTransport interface {
 	Connect(authData ClientMessage) error
 	Close() error
 	Send(data ClientMessage) error
 	Receive() (ClientMessage, error)
+	ReceiveRaw() ([]byte, error)
 
 	onConnect()
 }
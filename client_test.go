@@ -1,8 +1,18 @@
 package broadcaster
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 import _ "net/http/pprof"
@@ -237,3 +247,2268 @@ func testCanSubscribe(t *testing.T, clientFn func(s *testServer, conf ...func(c
 		t.Errorf("Unexpected subscription count: %d", stats.LocalSubscriptions["test"])
 	}
 }
+
+func testIgnoreRefusedSubscribes(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel != "secret"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.IgnoreRefusedSubscribes = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"secret", "public"} {
+		err := client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := client.SubscribeWithID("secret", SubscribeOptions{})
+	if err != nil || id != "" {
+		t.Errorf("Expected no ID and no error, got %q, %v", id, err)
+	}
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["public"] > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, channel := range []string{"secret", "public"} {
+		err := server.Broadcaster.Publish(channel, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-client.Messages:
+		if m.Channel() != "public" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LocalSubscriptions["secret"] != 0 {
+		t.Errorf("Unexpected subscription count: %d", stats.LocalSubscriptions["secret"])
+	}
+}
+
+func testRawMessages(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.RawMode = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.sendMessage("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-client.RawMessages
+	m := ClientMessage{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Error("Wrong message payload")
+	}
+
+	select {
+	case <-client.Messages:
+		t.Error("Shouldn't receive decoded messages in raw mode")
+	default:
+	}
+}
+
+func testConnectionID(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	seen := ""
+	server, err := startServer(&Server{
+		NodeID: "node1",
+		CanConnect: func(data map[string]interface{}) bool {
+			seen, _ = data["__id"].(string)
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	id := client.ConnectionID()
+	if !strings.HasPrefix(id, "node1-") {
+		t.Fatalf("Unexpected connection ID: %s", id)
+	}
+	if seen != id {
+		t.Errorf("Expected CanConnect to see %s, got %s", id, seen)
+	}
+
+	found := false
+	for !found {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range stats.LocalConnections {
+			if v == id {
+				found = true
+			}
+		}
+		if !found {
+			// Long-polling connects in the background
+			<-time.After(100 * time.Millisecond)
+		}
+	}
+}
+
+func assertWireKeys(t *testing.T, m map[string]interface{}, keys ...string) {
+	if len(m) != len(keys) {
+		t.Errorf("Expected keys %v, got %v", keys, m)
+	}
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			t.Errorf("Missing key %s in %v", k, m)
+		}
+	}
+}
+
+// First frames that are close to an auth frame, sent as is by each
+// transport's test, with the code and reason of the reply.
+var authTypeFrames = []struct {
+	frame  string
+	code   string
+	reason string
+}{
+	{`{"type":"auth"}`, AuthErrorMissingType, `Auth expected, missing "__type" field (got "type")`},
+	{`{"user":"bob"}`, AuthErrorMissingType, `Auth expected, missing "__type" field`},
+	{`{"__type":"Auth"}`, AuthErrorWrongType, `Auth expected, "__type" is "Auth"`},
+	{`{"__type":1}`, AuthErrorWrongType, `Auth expected, "__type" is 1`},
+}
+
+func testPublish(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return channel == "test" || channel == "tset"
+		},
+		ChannelExists: func(channel string) bool {
+			return channel != "tset"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Published messages only come back with echo
+	err = client.SubscribeWith("test", SubscribeOptions{Echo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	id, err := client.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Error("Expected message ID")
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Error("Wrong message payload")
+	}
+	if m["id"] != id || m["seq"] != float64(1) {
+		t.Errorf("Unexpected id or sequence: %v", m)
+	}
+
+	_, err = client.Publish("other", "Test message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorRefused {
+		t.Errorf("Expected publish to be refused, got %v", err)
+	}
+
+	_, err = client.Publish("tset", "Test message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorUnknownChannel {
+		t.Errorf("Expected unknown channel, got %v", err)
+	}
+
+	err = server.Broadcaster.Publish("tset", "Server message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorUnknownChannel {
+		t.Errorf("Expected unknown channel, got %v", err)
+	}
+
+	err = server.Broadcaster.Publish("test", "Server message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = <-client.Messages
+	if m["body"] != "Server message" || m["seq"] != float64(2) {
+		t.Errorf("Unexpected message: %v", m)
+	}
+}
+
+func testAuthExpiry(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		AuthExpiry: func(data map[string]interface{}) time.Time {
+			exp, _ := data["exp"].(float64)
+			return time.Unix(0, int64(exp*float64(time.Second)))
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	exp := func(d time.Duration) float64 {
+		return float64(time.Now().Add(d).UnixNano()) / float64(time.Second)
+	}
+
+	_, err = clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"exp": exp(-time.Second)}
+	})
+	if err == nil {
+		t.Fatal("Expected expired auth data to be refused")
+	}
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"exp": exp(500 * time.Millisecond)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-client.AuthExpired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected auth to expire")
+	}
+
+	stats, _ := server.Broadcaster.Stats()
+	if stats.LocalSubscriptions["test"] != 0 {
+		t.Errorf("Expected subscription to be revoked, got %v", stats.LocalSubscriptions)
+	}
+
+	err = client.Subscribe("test")
+	if err == nil {
+		t.Fatal("Expected subscribe to be refused")
+	}
+
+	// Refreshing restores access
+	err = client.Reauthenticate(map[string]interface{}{"exp": exp(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testKick(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Last message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Kick(client.ConnectionID(), "Session ended: bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != MessageMessage || m["body"] != "Last message" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+
+	m = <-client.Messages
+	if m.Type() != KickMessage || m["body"] != "Session ended: bye" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+
+	err = client.Disconnect()
+	if err == nil || err.Error() != "Kicked: Session ended: bye" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, ok := <-client.Messages
+	if ok {
+		t.Error("Expected Messages to be closed")
+	}
+}
+
+func testSubscribeRateLimit(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		SubscribeRateLimit: RateLimit{Count: 6, Interval: time.Minute},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Flapping
+	for i := 0; i < 3; i++ {
+		err = client.Subscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Unsubscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = client.Subscribe("test")
+	if err == nil || err.Error() != "Subscribe error: Rate limited" {
+		t.Errorf("Expected to be rate limited, got %v", err)
+	}
+
+	// Other connections are not affected
+	other, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+
+	err = other.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSubscriptionTTL(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		SubscriptionTTL: func(data map[string]interface{}, channel string, requested time.Duration) time.Duration {
+			if requested > 300*time.Millisecond {
+				return 300 * time.Millisecond
+			}
+			return requested
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	expired := func() {
+		select {
+		case m := <-client.Messages:
+			if m.Type() != UnsubscribeOKMessage || m["reason"] != "expired" || m.Channel() != "test" {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected subscription to expire")
+		}
+	}
+
+	// Capped by the server
+	err = client.SubscribeTTL("test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired()
+
+	for {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.LocalSubscriptions["test"] == 0 {
+			if stats.ExpiredSubscriptions != 1 {
+				t.Errorf("Expected 1 expired subscription, got %d", stats.ExpiredSubscriptions)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Touching keeps it alive
+	err = client.SubscribeTTL("test", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		time.Sleep(100 * time.Millisecond)
+		err = client.Touch("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case m := <-client.Messages:
+		t.Fatalf("Unexpected message: %v", m)
+	default:
+	}
+	expired()
+}
+
+func testCallbackPanics(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			if data["panic"] == true {
+				panic("CanConnect")
+			}
+			return true
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			if channel == "boom" {
+				panic("CanSubscribe")
+			}
+			return true
+		},
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			panic("CanPublish")
+		},
+		ChannelConfig: func(channel string) ChannelConfig {
+			panic("ChannelConfig")
+		},
+		Identity: func(data map[string]interface{}) string {
+			panic("Identity")
+		},
+		SubscriptionTTL: func(data map[string]interface{}, channel string, requested time.Duration) time.Duration {
+			panic("SubscriptionTTL")
+		},
+		OnAuditEvent: func(e AuditEvent) {
+			panic("OnAuditEvent")
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	_, err = clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"panic": true}
+	})
+	if err == nil || err.Error() != "Auth error: Unauthorized" {
+		t.Fatalf("Expected to be denied, got %v", err)
+	}
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("boom")
+	if err == nil {
+		t.Fatal("Expected subscribe to be denied")
+	}
+
+	_, err = client.Publish("test", "Test message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorRefused {
+		t.Errorf("Expected publish to be refused, got %v", err)
+	}
+
+	// Still delivering
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = server.Broadcaster.Publish("test", "Still here")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "Still here" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected message")
+	}
+}
+
+func testPublishRateLimit(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+		ChannelConfig: func(channel string) ChannelConfig {
+			if channel == "slow" {
+				return ChannelConfig{PublishRate: PublishRate{PerSecond: 0.01, Burst: 1}}
+			}
+			return ChannelConfig{}
+		},
+		IdentityPublishRate: PublishRate{PerSecond: 0.01, Burst: 2},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for i := 0; i < 2; i++ {
+		_, err = client.Publish("test", "Test message")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = client.Publish("test", "Test message")
+	perr, ok := err.(*PublishError)
+	if !ok || perr.Code != PublishErrorRateLimited {
+		t.Fatalf("Expected to be rate limited, got %v", err)
+	}
+	if perr.RetryAfter < 90*time.Second || perr.RetryAfter > 100*time.Second {
+		t.Errorf("Unexpected retry after: %s", perr.RetryAfter)
+	}
+
+	// The identity limit only applies to clients
+	err = server.Broadcaster.Publish("test", "Server message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Broadcaster.Publish("slow", "Server message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("slow", "Server message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorRateLimited || perr.RetryAfter <= 0 {
+		t.Errorf("Expected to be rate limited, got %v", err)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ThrottledPublishes["test"] != 1 || stats.ThrottledPublishes["slow"] != 1 {
+		t.Errorf("Unexpected throttled publishes: %v", stats.ThrottledPublishes)
+	}
+}
+
+func testPublishValidation(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	validate, err := JSONSchemaValidator(map[string][]byte{
+		"orders.**": []byte(`{"type": "object", "required": ["id"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{SkipValidation: channel == "orders.raw"}
+		},
+		ValidateBody: validate,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	_, err = client.Publish("orders.eu", `{"id": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Publish("orders.eu", `{"total": 1}`)
+	perr, ok := err.(*PublishError)
+	if !ok || perr.Code != PublishErrorInvalidBody || perr.Reason != "Invalid body: Missing property id" {
+		t.Fatalf("Expected an invalid body, got %v", err)
+	}
+
+	err = server.Broadcaster.Publish("orders.eu", "Not JSON")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorInvalidBody {
+		t.Errorf("Expected an invalid body, got %v", err)
+	}
+
+	// Skipped, or without a schema
+	_, err = client.Publish("orders.raw", "Not JSON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Publish("test", "Not JSON")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := stats.BodyValidations["orders.eu"]; v.Passed != 1 || v.Failed != 2 {
+		t.Errorf("Unexpected validations: %v", stats.BodyValidations)
+	}
+	if _, ok := stats.BodyValidations["orders.raw"]; ok {
+		t.Errorf("Expected skipped channels not to be counted, got %v", stats.BodyValidations)
+	}
+}
+
+func testConnectionAttributes(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	lock := sync.Mutex{}
+	sawSecret := false
+	seen := []string{}
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			sawSecret = data["secret"] != nil
+			return true
+		},
+		SanitizeAuthData: func(data map[string]interface{}) map[string]interface{} {
+			delete(data, "secret")
+			return data
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			keys := []string{}
+			for k, _ := range data {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			lock.Lock()
+			defer lock.Unlock()
+			seen = append(seen, fmt.Sprintf("%s %v %v", channel, keys, data["user"]))
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice", "secret": "hunter2"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Reauthenticate(map[string]interface{}{"user": "bob", "secret": "hunter3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Subscribe("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !sawSecret {
+		t.Error("Expected CanConnect to see the auth packet as sent")
+	}
+	expected := "[first [__client __id user] alice second [__client __id user] bob]"
+	if fmt.Sprint(seen) != expected {
+		t.Errorf("Expected %s, got %v", expected, seen)
+	}
+}
+
+func testClientID(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	lock := sync.Mutex{}
+	seen := []string{}
+	server, err := startServer(&Server{
+		ClientIDKey: []byte("secret"),
+		CanConnect: func(data map[string]interface{}) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			seen = append(seen, ClientMessage(data).ClientID())
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	connect := func(clientID string) string {
+		client, err := clientFn(server, func(c *Client) {
+			c.clientID = clientID
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+
+		lock.Lock()
+		defer lock.Unlock()
+		if seen[len(seen)-1] != client.ClientID() {
+			t.Errorf("Expected CanConnect to see %s, got %s", client.ClientID(), seen[len(seen)-1])
+		}
+		return client.ClientID()
+	}
+
+	id := connect("")
+	if id == "" {
+		t.Fatal("Expected a client ID")
+	}
+
+	// Kept when reconnecting
+	if got := connect(id); got != id {
+		t.Errorf("Expected %s, got %s", id, got)
+	}
+
+	// Unless it wasn't issued by the server
+	if got := connect("forged"); got == "forged" || got == id || got == "" {
+		t.Errorf("Expected a new client ID, got %s", got)
+	}
+}
+
+func testPing(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		PingRateLimit: RateLimit{Count: 3, Interval: time.Minute},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if client.RTT() != 0 {
+		t.Errorf("Expected no RTT yet, got %s", client.RTT())
+	}
+
+	for i := 0; i < 3; i++ {
+		rtt, err := client.Ping(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 || rtt != client.RTT() {
+			t.Errorf("Unexpected RTT: %s, latest %s", rtt, client.RTT())
+		}
+	}
+
+	_, err = client.Ping(5 * time.Second)
+	if err == nil || err.Error() != "Ping rate limited" {
+		t.Errorf("Expected to be rate limited, got %v", err)
+	}
+
+	// Sampled in the background
+	sampled, err := clientFn(server, func(c *Client) {
+		c.RTTInterval = 10 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampled.Disconnect()
+
+	for i := 0; sampled.RTT() == 0; i++ {
+		if i == 500 {
+			t.Fatal("Expected an RTT sample")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testEcho(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	connect := func() *Client {
+		client, err := clientFn(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Subscribe("chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	alice := connect()
+	defer alice.Disconnect()
+	bob := connect()
+	defer bob.Disconnect()
+
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["chat"] == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expect := func(client *Client, body string, origin *Client) {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != body {
+				t.Errorf("Expected %q, got %v", body, m)
+			}
+			expected := ""
+			if origin != nil {
+				expected = origin.ConnectionID()
+			}
+			if m.Origin() != expected {
+				t.Errorf("Expected origin %q, got %v", expected, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q", body)
+		}
+	}
+
+	_, err = alice.Publish("chat", "Hi Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(bob, "Hi Bob", alice)
+
+	// Alice doesn't get her own message, the next one is from the server.
+	err = server.Broadcaster.Publish("chat", "Marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(alice, "Marker", nil)
+	expect(bob, "Marker", nil)
+
+	// Unless she asks for it
+	err = alice.SubscribeWith("chat", SubscribeOptions{Echo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = alice.Publish("chat", "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(alice, "Echo", alice)
+	expect(bob, "Echo", alice)
+
+	// Or suppresses it for a single message
+	_, err = alice.PublishWith("chat", "Suppressed", PublishOptions{SuppressEcho: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(bob, "Suppressed", alice)
+	err = server.Broadcaster.Publish("chat", "Marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(alice, "Marker", nil)
+	expect(bob, "Marker", nil)
+
+	// Bob can't pass his messages off as Alice's
+	err = bob.send(PublishMessage, ClientMessage{"channel": "chat", "body": "Spoofed", "origin": alice.ConnectionID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(alice, "Spoofed", bob)
+}
+
+func testMessageHeaders(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		NodeID:          "node1",
+		MessageMetadata: true,
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.SubscribeWith("test", SubscribeOptions{Echo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expect := func(body string) ClientMessage {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != body {
+				t.Errorf("Expected %q, got %v", body, m)
+			}
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q", body)
+		}
+		return nil
+	}
+
+	// Reserved names are dropped from client publishes
+	start := time.Now().Truncate(time.Millisecond)
+	_, err = client.PublishWith("test", "Client", PublishOptions{Headers: map[string]string{"trace-id": "abc", "__tenant": "forged"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := expect("Client")
+	if m.Header("trace-id") != "abc" || m.Header("__tenant") != "" {
+		t.Errorf("Unexpected headers: %v", m)
+	}
+	if m.Node() != "node1" || m.PublishedAt().Before(start) || m.PublishedAt().After(time.Now()) {
+		t.Errorf("Unexpected metadata: %v", m)
+	}
+
+	_, _, err = server.Broadcaster.PublishWith(context.Background(), "test", "Server", PublishOptions{Headers: map[string]string{"__tenant": "acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = expect("Server")
+	if m.Header("__tenant") != "acme" || m.Origin() != "" {
+		t.Errorf("Unexpected headers: %v", m)
+	}
+
+	// Refused when too large
+	_, err = client.PublishWith("test", "Large", PublishOptions{Headers: map[string]string{"large": strings.Repeat("x", 2000)}})
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorInvalidHeaders {
+		t.Errorf("Expected %s, got %v", PublishErrorInvalidHeaders, err)
+	}
+}
+
+func testMigrate(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server1, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+
+	// Second node, sharing the same Redis
+	server2 := &testServer{
+		Port:  nextPort(),
+		Redis: server1.Redis,
+	}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := clientFn(server1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server1.Broadcaster.Drain(MigrateOptions{
+		URL:       fmt.Sprintf("http://localhost:%d/broadcaster/", server2.Port),
+		Reconnect: true,
+		Hold:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m.Type() != MigrateMessage || !m.Reconnect() || !m.Hold() {
+			t.Errorf("Expected a migrate message, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a migrate message")
+	}
+
+	for i := 0; ; i++ {
+		if i == 500 {
+			t.Fatal("Expected the client to subscribe on the new server")
+		}
+		stats, _ := server2.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = server1.sendMessage("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m.Type() != MessageMessage || m["body"] != "Test message" {
+			t.Errorf("Wrong message payload: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected duplicate: %v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The old node let go once the client confirmed
+	for i := 0; ; i++ {
+		if i == 500 {
+			t.Fatal("Expected the old connection to close")
+		}
+		stats, _ := server1.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testDrainMode(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Broadcaster.EnterDrainMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m.Type() != DrainingMessage {
+			t.Errorf("Expected a draining message, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a draining message")
+	}
+
+	// New connections go elsewhere.
+	_, err = clientFn(server)
+	if err == nil {
+		t.Error("Expected new connections to be refused")
+	}
+	url := fmt.Sprintf("http://localhost:%d/broadcaster/", server.Port)
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"__type":"auth"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("Expected a retry hint, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	health := httptest.NewRecorder()
+	server.Broadcaster.ServeHTTP(health, httptest.NewRequest("GET", "/health", nil))
+	if health.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the health check to fail, got %d", health.Code)
+	}
+}
+
+func testTenantQuotas(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		Tenant: func(data map[string]interface{}) string {
+			team, _ := data["team"].(string)
+			return team
+		},
+		Quotas: Quotas{
+			Default: Quota{Connections: 1, Subscriptions: 1},
+			Tenants: map[string]Quota{
+				"big": {Connections: 10, PublishRate: PublishRate{PerSecond: 1}},
+			},
+		},
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	team := func(name string) func(c *Client) {
+		return func(c *Client) {
+			c.AuthData = map[string]interface{}{"team": name}
+		}
+	}
+
+	alice, err := clientFn(server, team("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Disconnect()
+
+	_, err = clientFn(server, team("small"))
+	if err == nil || !strings.Contains(err.Error(), "Quota exceeded: connections") {
+		t.Errorf("Expected to be over the connection quota, got %v", err)
+	}
+
+	err = alice.Subscribe("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.Subscribe("one")
+	if err != nil {
+		t.Errorf("Subscribing again shouldn't count: %s", err)
+	}
+	err = alice.Subscribe("two")
+	if err == nil || !strings.Contains(err.Error(), "Quota exceeded: subscriptions") {
+		t.Errorf("Expected to be over the subscription quota, got %v", err)
+	}
+
+	err = alice.Unsubscribe("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.Subscribe("two")
+	if err != nil {
+		t.Errorf("Expected room after unsubscribing, got %s", err)
+	}
+
+	// Other tenants have their own quotas
+	bob, err := clientFn(server, team("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Disconnect()
+
+	_, err = bob.Publish("two", "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.Publish("two", "Hi again")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != QuotaPublishRate || perr.RetryAfter <= 0 {
+		t.Errorf("Expected to be over the publish quota, got %v", err)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := stats.Tenants["small"]
+	if small.Connections != 1 || small.Subscriptions != 1 {
+		t.Errorf("Unexpected usage: %+v", small)
+	}
+	if small.Exceeded[QuotaConnections] != 1 || small.Exceeded[QuotaSubscriptions] != 1 {
+		t.Errorf("Unexpected exceeded counts: %v", small.Exceeded)
+	}
+	if stats.Tenants["big"].Exceeded[QuotaPublishRate] != 1 {
+		t.Errorf("Unexpected exceeded counts: %v", stats.Tenants["big"].Exceeded)
+	}
+
+	// Raised at runtime
+	err = server.Broadcaster.SetQuotas(Quotas{
+		Default: Quota{Connections: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := clientFn(server, team("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Disconnect()
+}
+
+func testWireTap(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	type frame struct {
+		connID    string
+		direction string
+		raw       string
+	}
+	frames := make(chan frame, 100)
+	server, err := startServer(&Server{
+		WireTap: func(connID, direction string, raw []byte) {
+			frames <- frame{connID, direction, string(raw)}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each of these should show up, for this connection.
+	expected := map[string]string{
+		`"auth"`:        WireInbound,
+		`"authOk"`:      WireOutbound,
+		`"subscribe"`:   WireInbound,
+		`"subscribeOk"`: WireOutbound,
+	}
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case f := <-frames:
+			if f.connID != client.ConnectionID() {
+				continue
+			}
+			for typ, direction := range expected {
+				if f.direction == direction && strings.Contains(f.raw, `"__type":`+typ) {
+					delete(expected, typ)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Didn't see frames: %v", expected)
+		}
+	}
+}
+
+// Receives messages in order, by body.
+func receiveBodies(t *testing.T, client *Client, expected ...string) {
+	t.Helper()
+	for _, body := range expected {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != body {
+				t.Fatalf("Expected %s, got %s", body, m["body"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Didn't receive %s", body)
+		}
+	}
+}
+
+// Publishes messages to a channel in order, server-side.
+func publishBodies(t *testing.T, server *testServer, channel string, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		err := server.Broadcaster.Publish(channel, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Waits for the server to store that an at-least-once subscriber
+// acknowledged the messages of a channel it received.
+func waitAcked(t *testing.T, server *testServer, client *Client, channel string) {
+	t.Helper()
+	seq, _ := client.Cursor(channel)
+	b := server.Broadcaster.current().redis
+	acked := func() int64 {
+		conn := b.conn.Get()
+		defer conn.Close()
+		n, _ := redis.Int64(conn.Do("GET", b.key("acked:%s:%s", client.ClientID(), channel)))
+		return n
+	}
+	for i := 0; acked() < seq; i++ {
+		if i == 100 {
+			t.Fatalf("Expected %s to be acknowledged up to %d", channel, seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testQoS(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	subscribe := func(clientID, qos string) *Client {
+		client, err := clientFn(server, func(c *Client) {
+			c.clientID = clientID
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SubscribeWith("test", SubscribeOptions{QoS: qos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	receive := func(client *Client, expected ...string) {
+		t.Helper()
+		receiveBodies(t, client, expected...)
+	}
+	publish := func(bodies ...string) {
+		t.Helper()
+		publishBodies(t, server, "test", bodies...)
+	}
+
+	reliable := subscribe("", QoSAtLeastOnce)
+	unreliable := subscribe("", QoSAtMostOnce)
+	reliableID, unreliableID := reliable.ClientID(), unreliable.ClientID()
+
+	publish("one")
+	receive(reliable, "one")
+	receive(unreliable, "one")
+
+	// The acknowledgement goes out after the message is handed over.
+	waitAcked(t, server, reliable, "test")
+	reliable.Disconnect()
+	unreliable.Disconnect()
+
+	publish("two", "three")
+
+	// Only what was missed, in order, then live messages.
+	reliable = subscribe(reliableID, QoSAtLeastOnce)
+	defer reliable.Disconnect()
+	publish("four")
+	receive(reliable, "two", "three", "four")
+
+	unreliable = subscribe(unreliableID, QoSAtMostOnce)
+	defer unreliable.Disconnect()
+	publish("five")
+	receive(unreliable, "five")
+	receive(reliable, "five")
+
+	// Unsubscribing forgets about it.
+	err = reliable.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("six")
+	// Delivered by the time it subscribes again
+	receive(unreliable, "six")
+	err = reliable.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("seven")
+	receive(reliable, "seven")
+}
+
+func testPause(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{PauseBufferSize: 2}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Pause("test")
+	if err == nil {
+		t.Error("Expected pausing to fail without a subscription")
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Pause("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"one", "two", "three", "four"} {
+		err := server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case m := <-client.Messages:
+		t.Fatalf("Unexpected message while paused: %v", m)
+	default:
+	}
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LocalPausedSubscriptions["test"] != 1 || stats.LocalSubscriptions["test"] != 1 {
+		t.Errorf("Expected a paused subscription, got %v", stats.LocalPausedSubscriptions)
+	}
+
+	err = client.Resume("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("test", "five")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest are kept, the marker stands in for the rest.
+	for _, expected := range []string{"one", "two", SkippedMessage, "five"} {
+		select {
+		case m := <-client.Messages:
+			if m.Type() == SkippedMessage {
+				if expected != SkippedMessage || m["count"] != 2.0 {
+					t.Fatalf("Expected %s, got %v", expected, m)
+				}
+			} else if m["body"] != expected {
+				t.Fatalf("Expected %s, got %v", expected, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Didn't receive %s", expected)
+		}
+	}
+
+	// Disconnecting cleans up paused subscriptions.
+	other, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Pause("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Disconnect()
+	for i := 0; i < 50; i++ {
+		stats, err = server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.LocalPausedSubscriptions["test"] == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the paused subscription to be gone, got %v", stats.LocalPausedSubscriptions)
+}
+
+func testSubscriptionID(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	a, err := client.SubscribeWithID("a", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := client.SubscribeWithID("b", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == "" || a == b {
+		t.Fatalf("Expected unique subscription IDs, got %q and %q", a, b)
+	}
+
+	// Updating a subscription keeps its ID
+	again, err := client.SubscribeWithID("a", SubscribeOptions{Echo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != a {
+		t.Errorf("Expected the ID to stay %s, got %s", a, again)
+	}
+
+	err = client.UnsubscribeID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UnsubscribeID(a)
+	if err == nil {
+		t.Error("Expected an unknown subscription to fail")
+	}
+
+	// Long polls only receive while a poll is held: send until a message
+	// arrives.
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		err = server.sendMessage("a", "Gone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.sendMessage("b", "Still here")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-client.Messages:
+			if m["channel"] != "b" || m["body"] != "Still here" {
+				t.Errorf("Unexpected message: %v", m)
+			}
+			received = true
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected a message on b")
+		}
+	}
+
+	// A new subscription gets a new ID
+	renewed, err := client.SubscribeWithID("a", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == a {
+		t.Error("Expected a new ID")
+	}
+}
+
+func testEnvelopeFields(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	fields := EnvelopeFields{"__type": "event", "body": "data"}
+	server, err := startServer(&Server{
+		EnvelopeFields: fields,
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.EnvelopeFields = fields
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	raw, err := clientFn(server, func(c *Client) {
+		c.EnvelopeFields = fields
+		c.RawMode = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Disconnect()
+
+	for _, c := range []*Client{client, raw} {
+		err = c.Subscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Publishers don't get their own messages
+	_, err = raw.Publish("test", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Publish("test", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoded with the broadcaster's names
+	select {
+	case m := <-client.Messages:
+		if m.Type() != MessageMessage || m["channel"] != "test" || m["body"] != "Hello" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+
+	// Sent with the mapped names
+	select {
+	case data := <-raw.RawMessages:
+		m := map[string]interface{}{}
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["event"] != MessageMessage || m["channel"] != "test" || m["data"] != "Hello" {
+			t.Errorf("Unexpected frame: %s", data)
+		}
+		if _, ok := m["__type"]; ok {
+			t.Errorf("Expected the type to be renamed: %s", data)
+		}
+		if _, ok := m["body"]; ok {
+			t.Errorf("Expected the body to be renamed: %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a raw message")
+	}
+}
+
+func testDisconnectRace(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribing and receiving while disconnecting, twice
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			channel := fmt.Sprintf("test%d", i)
+			for j := 0; j < 10; j++ {
+				err := client.Subscribe(channel)
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _ = range client.Messages {
+		}
+	}()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- client.Disconnect()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected calls to return after disconnecting")
+	}
+
+	closed := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == ErrClientClosed {
+				closed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected Disconnect to return")
+		}
+	}
+	if closed != 1 {
+		t.Errorf("Expected one Disconnect to find the client closed, got %d", closed)
+	}
+
+	// Fails right away afterwards
+	err = client.Subscribe("test")
+	if err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed, got %v", err)
+	}
+	_, err = client.Publish("test", "Hello")
+	if err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed, got %v", err)
+	}
+	err = client.Connect()
+	if err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed, got %v", err)
+	}
+}
+
+func testSubscribeChan(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	orders, err := client.SubscribeChan("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Long-polling applies subscriptions with the next poll
+	receive := func(channel string, messages <-chan ClientMessage) {
+		deadline := time.After(5 * time.Second)
+		for {
+			err := server.Broadcaster.Publish(channel, "Test "+channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-messages:
+				if m.Channel() != channel {
+					t.Fatalf("Expected only %s, got %v", channel, m)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("Expected a message on %s", channel)
+			}
+		}
+	}
+	receive("orders", orders)
+	receive("other", client.Messages)
+
+	// Probes may still be buffered
+	closed := func(messages <-chan ClientMessage) {
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case _, ok := <-messages:
+				if !ok {
+					return
+				}
+			case <-deadline:
+				t.Fatal("Expected the channel to be closed")
+			}
+		}
+	}
+
+	// Closed when unsubscribing, and when disconnecting
+	err = client.Unsubscribe("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed(orders)
+
+	other, err := client.SubscribeChan("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+	closed(other)
+}
+
+func testSessionResume(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	lock := sync.Mutex{}
+	connects := 0
+	users := []string{}
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			connects++
+			return true
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			users = append(users, data["user"].(string))
+			return true
+		},
+		Identity: func(data map[string]interface{}) string {
+			user, _ := data["user"].(string)
+			return user
+		},
+		SessionTTL: time.Minute,
+		SessionKey: []byte("secret"),
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	reconnect := func() {
+		id := client.ConnectionID()
+		client.transport.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for client.ConnectionID() == id {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the client to reconnect")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := client.sessionCredential()
+	if first == "" {
+		t.Fatal("Expected a session")
+	}
+	clientID := client.ClientID()
+	reconnect()
+
+	// Restored without asking CanConnect
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if connects != 1 || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("Expected the session to be resumed, got %d connects by %v", connects, users)
+	}
+	lock.Unlock()
+	if client.ClientID() != clientID {
+		t.Errorf("Expected client ID %s, got %s", clientID, client.ClientID())
+	}
+
+	// Once only
+	_, err = server.Broadcaster.resumeSession(first, "other")
+	if err != errNoSession {
+		t.Errorf("Expected a used credential to be refused, got %v", err)
+	}
+	forged := client.sessionCredential()
+	forged = forged[:strings.LastIndex(forged, ".")+1] + "00"
+	_, err = server.Broadcaster.resumeSession(forged, "other")
+	if err != errNoSession {
+		t.Errorf("Expected a forged credential to be refused, got %v", err)
+	}
+
+	// Falls back to the auth data when it can't be resumed
+	client.setSession("unknown.00")
+	reconnect()
+	lock.Lock()
+	if connects != 2 {
+		t.Errorf("Expected the client to authenticate in full, got %d connects", connects)
+	}
+	lock.Unlock()
+
+	// Kicking revokes it
+	session := client.sessionCredential()
+	err = server.Broadcaster.Kick(client.ConnectionID(), "Bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Broadcaster.resumeSession(session, "other")
+	if err != errNoSession {
+		t.Errorf("Expected a kicked session to be refused, got %v", err)
+	}
+}
+
+func testResubscribeOrder(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	lock := sync.Mutex{}
+	connects := 0
+	subscribed := []string{}
+	reconnecting := make(chan struct{})
+	release := make(chan struct{})
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			lock.Lock()
+			connects++
+			again := connects == 2
+			lock.Unlock()
+			if again {
+				// Holds up reconnecting
+				close(reconnecting)
+				<-release
+			}
+			return true
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			subscribed = append(subscribed, channel)
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lost connection
+	client.transport.Close()
+	select {
+	case <-reconnecting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to reconnect")
+	}
+
+	// Subscribes during the outage, applied after restoring: that can't
+	// finish before the release, however late the subscribe gets going.
+	restoring := func() bool {
+		client.deliverLock.Lock()
+		defer client.deliverLock.Unlock()
+		return client.restoring != nil
+	}
+	for i := 0; !restoring(); i++ {
+		if i == 500 {
+			t.Fatal("Expected the client to restore its subscriptions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Subscribe("new")
+	}()
+	lock.Lock()
+	// Recorded from here on
+	subscribed = nil
+	lock.Unlock()
+	close(release)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the subscribe to return")
+	}
+	lock.Lock()
+	if strings.Join(subscribed, " ") != "restored new" {
+		t.Errorf("Expected the restored subscription first, got %v", subscribed)
+	}
+	lock.Unlock()
+
+	// Both delivered, long-polling applies subscriptions with the next poll
+	for _, channel := range []string{"restored", "new"} {
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			err := server.Broadcaster.Publish(channel, "ready")
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-client.Messages:
+				if m.Type() == MessageMessage && m.Channel() == channel {
+					break wait
+				}
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("Expected messages on %s", channel)
+			}
+		}
+	}
+
+	// Nothing lost on either channel
+	for i := 0; i < 5; i++ {
+		for _, channel := range []string{"restored", "new"} {
+			err := server.Broadcaster.Publish(channel, fmt.Sprintf("%s %d", channel, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Long-polling may reorder them
+	got := map[string]bool{}
+	for len(got) < 10 {
+		select {
+		case m := <-client.Messages:
+			if body, _ := m["body"].(string); body != "ready" {
+				got[body] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 10 messages, got %v", got)
+		}
+	}
+}
+
+func testResubscribed(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"a", "b"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case m := <-client.Messages:
+		t.Fatalf("Expected nothing before reconnecting, got %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// One for each channel
+	id := client.ConnectionID()
+	client.transport.Close()
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case m := <-client.Messages:
+			if m.Type() != ResubscribedMessage {
+				t.Fatalf("Expected %s, got %v", ResubscribedMessage, m)
+			}
+			got[m.Channel()] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected both channels, got %v", got)
+		}
+	}
+	if !got["a"] || !got["b"] || client.ConnectionID() == id {
+		t.Errorf("Expected a and b on a new connection, got %v", got)
+	}
+
+	// Subscribed for real, long-polling applies it with the next poll
+	deadline := time.After(5 * time.Second)
+	for {
+		err := server.Broadcaster.Publish("a", "again")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-client.Messages:
+			if m["body"] == "again" {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected messages on a")
+		}
+	}
+}
+
+func testSubscribers(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Presence: channel == "room"}
+		},
+		PresenceKey: func(data map[string]interface{}) string {
+			user, _ := data["user"].(string)
+			return user
+		},
+		PresenceAttributes:   []string{"user"},
+		SubscribersRateLimit: RateLimit{Count: 3, Interval: time.Minute},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, user := range []string{"carol", "alice"} {
+		other, err := server.Broadcaster.LocalClient(map[string]interface{}{"user": user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Disconnect()
+		err = other.Subscribe("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = client.Subscribers("room")
+	if err == nil {
+		t.Error("Expected listing to fail without a subscription")
+	}
+
+	err = client.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := client.Subscribers("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(members) != "[{alice map[user:alice]} {carol map[user:carol]}]" {
+		t.Errorf("Unexpected members: %v", members)
+	}
+
+	err = client.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Subscribers("other")
+	if err == nil {
+		t.Error("Expected listing to fail without presence")
+	}
+
+	_, err = client.Subscribers("room")
+	if err == nil {
+		t.Error("Expected listing to be rate limited")
+	}
+}
@@ -0,0 +1,66 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Longest client ID accepted from a client.
+const maxClientIDLength = 128
+
+// Returns the client ID for an auth packet: the one the client presents
+// when it's acceptable, a new one otherwise.
+func (s *Server) assignClientID(auth ClientMessage) string {
+	id := auth.ClientID()
+	if s.validClientID(id) {
+		return id
+	}
+	return s.newClientID()
+}
+
+func (s *Server) newClientID() string {
+	id := randomId(16)
+	if len(s.ClientIDKey) == 0 {
+		return id
+	}
+	return id + "." + s.signClientID(id)
+}
+
+func (s *Server) signClientID(id string) string {
+	mac := hmac.New(sha256.New, s.ClientIDKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// With a key, only IDs signed by it are valid. Without one, anything
+// reasonably short and printable is taken at the client's word.
+func (s *Server) validClientID(id string) bool {
+	if id == "" || len(id) > maxClientIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	if len(s.ClientIDKey) == 0 {
+		return true
+	}
+
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(s.signClientID(parts[0])))
+}
+
+// Key for state that outlives a connection, such as the subscribe rate
+// limit: the client ID, or the connection ID for auth data without one.
+func clientKey(data ClientMessage) string {
+	if id := data.ClientID(); id != "" {
+		return id
+	}
+	return data.ConnectionID()
+}
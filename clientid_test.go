@@ -0,0 +1,39 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidClientID(t *testing.T) {
+	s := &Server{}
+	for id, valid := range map[string]bool{
+		"":                            false,
+		"abc-123_X.y":                 true,
+		"with space":                  false,
+		"<script>":                    false,
+		strings.Repeat("a", 128):      true,
+		strings.Repeat("a", 129):      false,
+		s.newClientID():               true,
+		s.newClientID() + ".unsigned": true,
+	} {
+		if s.validClientID(id) != valid {
+			t.Errorf("Expected %q valid=%v", id, valid)
+		}
+	}
+
+	s.ClientIDKey = []byte("secret")
+	signed := s.newClientID()
+	other := &Server{ClientIDKey: []byte("other")}
+	for id, valid := range map[string]bool{
+		signed:                        true,
+		strings.Split(signed, ".")[0]: false,
+		signed + "0":                  false,
+		"abc-123_X.y":                 false,
+		other.newClientID():           false,
+	} {
+		if s.validClientID(id) != valid {
+			t.Errorf("Expected %q valid=%v", id, valid)
+		}
+	}
+}
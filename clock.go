@@ -0,0 +1,69 @@
+package broadcaster
+
+import "time"
+
+// Source of time for everything that's driven by it: poll timeouts, auth
+// expiry, pings, reconnect backoff. Tests swap in a fake to control it.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	AfterFunc(d time.Duration, f func()) timer
+	NewTicker(d time.Duration) ticker
+}
+
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Like time.After.
+func after(c clock, d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
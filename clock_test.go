@@ -0,0 +1,268 @@
+package broadcaster
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+
+	sync.Mutex
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	period time.Duration
+	fn     func()
+	c      chan time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.add(d, 0, nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.add(d, 0, f)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.add(d, d, nil)}
+}
+
+func (c *fakeClock) add(d, period time.Duration, f func()) *fakeTimer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{
+		clock:  c,
+		when:   c.now.Add(d),
+		period: period,
+		fn:     f,
+		c:      make(chan time.Time, 1),
+		active: true,
+	}
+	if d <= 0 && period == 0 {
+		t.fire(c.now)
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Moves the clock forward, firing all timers that are due in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		c.now = next.when
+		next.fire(c.now)
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		}
+	}
+	c.now = end
+	c.prune()
+}
+
+// Time left until each of the pending timers fires, shortest first.
+func (c *fakeClock) Pending() []time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	c.prune()
+	result := []time.Duration{}
+	for _, t := range c.timers {
+		result = append(result, t.when.Sub(c.now))
+	}
+	sort.Sort(durations(result))
+	return result
+}
+
+// Waits until n timers are pending, for code running in the background.
+func (c *fakeClock) BlockUntil(n int) {
+	for len(c.Pending()) < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeClock) prune() {
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.active {
+			active = append(active, t)
+		}
+	}
+	c.timers = active
+}
+
+// Must hold the clock lock.
+func (t *fakeTimer) fire(now time.Time) {
+	if t.period == 0 {
+		t.active = false
+	}
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	active := t.active
+	t.active = false
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+
+	timer := c.NewTimer(2 * time.Second)
+	ticker := c.NewTicker(time.Second)
+	stopped := c.NewTimer(time.Second)
+	stopped.Stop()
+
+	c.Advance(1500 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Error("Timer fired too early")
+	case <-stopped.C():
+		t.Error("Stopped timer fired")
+	case now := <-ticker.C():
+		if now != start.Add(time.Second) {
+			t.Errorf("Unexpected tick time: %s", now)
+		}
+	}
+
+	c.Advance(500 * time.Millisecond)
+	now := <-timer.C()
+	if now != start.Add(2*time.Second) {
+		t.Errorf("Unexpected fire time: %s", now)
+	}
+
+	pending := c.Pending()
+	if len(pending) != 1 || pending[0] != time.Second {
+		t.Errorf("Expected the ticker to be pending, got %v", pending)
+	}
+}
+
+func TestWSAuthExpiryClock(t *testing.T) {
+	clock := newFakeClock()
+	server, err := startServer(&Server{
+		clock: clock,
+		AuthExpiry: func(data map[string]interface{}) time.Time {
+			return clock.Now().Add(time.Minute)
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.BlockUntil(1)
+	pending := clock.Pending()
+	if len(pending) != 1 || pending[0] != time.Minute {
+		t.Fatalf("Expected expiry in a minute, got %v", pending)
+	}
+
+	clock.Advance(time.Minute - time.Nanosecond)
+	if len(clock.Pending()) != 1 {
+		t.Fatal("Expired too early")
+	}
+
+	clock.Advance(time.Nanosecond)
+	select {
+	case <-client.AuthExpired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected auth to expire")
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	clock := newFakeClock()
+	client, err := NewClient("http://localhost:1/broadcaster/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mode = ClientModeWebsocket
+	client.clock = clock
+	client.ReconnectPolicy.Jitter = 0
+
+	go client.disconnected()
+
+	for i := 1; i <= 3; i++ {
+		clock.BlockUntil(1)
+		pending := clock.Pending()
+		expected := time.Duration(1<<uint(i-1)) * time.Second
+		if pending[0] != expected {
+			t.Fatalf("Expected attempt %d to wait %s, got %s", i+1, expected, pending[0])
+		}
+		clock.Advance(pending[0])
+	}
+}
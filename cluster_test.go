@@ -0,0 +1,433 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Nodes of one instance sharing a Redis server, for cross-node tests: a
+// client on one node, a publisher on another, a kick issued on a third.
+// Each node serves on a port of its own. Clients connect to any of them
+// over real transports, and are disconnected before the nodes stop.
+type testCluster struct {
+	t     *testing.T
+	name  string
+	Redis *testRedis
+	Nodes []*testServer
+
+	clients []*Client
+	stopped bool
+	sync.Mutex
+}
+
+// Starts a cluster of n nodes on a Redis server of its own. The nodes are
+// configured by conf when given, which returns nil for the defaults. The
+// cluster stops when the test ends.
+func startCluster(t *testing.T, n int, conf func(node int) *Server) *testCluster {
+	r, err := startRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run in reverse: after the cluster stopped.
+	t.Cleanup(r.Stop)
+	return startClusterOn(t, r, "", n, conf)
+}
+
+// Starts a cluster on a shared Redis server, its keys and pub/sub channels
+// namespaced by name (see Server.Name) so that it doesn't see any other.
+// Leaves the Redis server running when it stops.
+func startClusterOn(t *testing.T, r *testRedis, name string, n int, conf func(node int) *Server) *testCluster {
+	c := &testCluster{t: t, name: name, Redis: r}
+	t.Cleanup(c.stop)
+
+	for i := 0; i < n; i++ {
+		var s *Server
+		if conf != nil {
+			s = conf(i)
+		}
+		c.Join(s)
+	}
+	return c
+}
+
+// Adds a node to the cluster, with the given configuration (nil for the
+// defaults). Returns its index.
+func (c *testCluster) Join(s *Server) int {
+	if s == nil {
+		s = &Server{}
+	}
+	s.Name = c.name
+	if s.NodeID == "" {
+		s.NodeID = fmt.Sprintf("node%d", len(c.Nodes))
+	}
+
+	node := &testServer{
+		Port:        nextPort(),
+		Broadcaster: s,
+		Redis:       c.Redis,
+	}
+	err := node.Start()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.Nodes = append(c.Nodes, node)
+	return len(c.Nodes) - 1
+}
+
+// The server of a node, e.g. to publish or kick from there.
+func (c *testCluster) Server(node int) *Server {
+	return c.Nodes[node].Broadcaster
+}
+
+// Connects a client to a node over the given transport.
+func (c *testCluster) Connect(node int, mode ClientMode, conf ...func(c *Client)) *Client {
+	clientFn := newWSClient
+	if mode == ClientModeLongPoll {
+		clientFn = newLPClient
+	}
+	client, err := clientFn(c.Nodes[node], conf...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.Lock()
+	c.clients = append(c.clients, client)
+	c.Unlock()
+	return client
+}
+
+// Stops the cluster: clients first, so that no node is left serving them,
+// then all nodes at once.
+func (c *testCluster) stop() {
+	c.Lock()
+	clients, stopped := c.clients, c.stopped
+	c.clients, c.stopped = nil, true
+	c.Unlock()
+	if stopped {
+		return
+	}
+	for _, client := range clients {
+		client.Disconnect()
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range c.Nodes {
+		wg.Add(1)
+		go func(node *testServer) {
+			defer wg.Done()
+			node.Broadcaster.Close()
+			node.HTTPServer.Close()
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Stats of all nodes added up.
+type clusterStats struct {
+	// As counted in Redis, the same on every node: -1 when they disagree,
+	// it changed while collecting the stats.
+	Connections int
+
+	LocalConnections int
+	Subscriptions    map[string]int
+}
+
+func (c *testCluster) Stats() clusterStats {
+	total := clusterStats{Subscriptions: make(map[string]int)}
+	for i, node := range c.Nodes {
+		stats, err := node.Broadcaster.Stats()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if i == 0 {
+			total.Connections = stats.Connections
+		} else if stats.Connections != total.Connections {
+			total.Connections = -1
+		}
+		total.LocalConnections += len(stats.LocalConnections)
+		for channel, n := range stats.LocalSubscriptions {
+			total.Subscriptions[channel] += n
+		}
+	}
+	return total
+}
+
+// Waits until the stats of the cluster satisfy the condition, fails the test
+// after a few seconds. Nodes learn of what happens elsewhere through Redis,
+// so invariants only hold once things settled.
+func (c *testCluster) Settle(what string, condition func(stats clusterStats) bool) {
+	c.t.Helper()
+
+	var stats clusterStats
+	for i := 0; i < 500; i++ {
+		stats = c.Stats()
+		if condition(stats) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected %s, got %+v", what, stats)
+}
+
+// Waits until the channel has the given number of subscriptions across
+// all nodes.
+func (c *testCluster) SettleSubscriptions(channel string, n int) {
+	c.t.Helper()
+	c.Settle(fmt.Sprintf("%d subscriptions on %s", n, channel), func(stats clusterStats) bool {
+		return stats.Subscriptions[channel] == n
+	})
+}
+
+// Expects the client to receive the given messages next, in order, each
+// described as "type body" (or just the type when it has no body).
+func (c *testCluster) Expect(client *Client, expected ...string) {
+	c.t.Helper()
+
+	for _, e := range expected {
+		select {
+		case m, ok := <-client.Messages:
+			if !ok {
+				c.t.Fatalf("Expected %q, the client is gone", e)
+			}
+			got := m.Type()
+			if body, ok := m["body"]; ok {
+				got = fmt.Sprintf("%s %s", got, body)
+			}
+			if got != e {
+				c.t.Fatalf("Expected %q, got %q", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("Expected %q, got nothing", e)
+		}
+	}
+}
+
+// Expects the client to receive nothing for a moment.
+func (c *testCluster) ExpectNothing(client *Client) {
+	c.t.Helper()
+
+	select {
+	case m := <-client.Messages:
+		c.t.Errorf("Unexpected message: %v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+var clusterModes = map[string]ClientMode{
+	"websocket": ClientModeWebsocket,
+	"longpoll":  ClientModeLongPoll,
+}
+
+func TestClusterDelivery(t *testing.T) {
+	c := startCluster(t, 3, nil)
+
+	// Every transport on every node but the publisher's
+	var clients []*Client
+	for _, mode := range clusterModes {
+		for node := 1; node < 3; node++ {
+			client := c.Connect(node, mode)
+			err := client.Subscribe("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients = append(clients, client)
+		}
+	}
+	c.SettleSubscriptions("test", len(clients))
+	c.Settle("all connections counted", func(stats clusterStats) bool {
+		return stats.Connections == len(clients)
+	})
+
+	for _, body := range []string{"one", "two"} {
+		err := c.Server(0).Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, client := range clients {
+		c.Expect(client, "message one", "message two")
+	}
+	for _, client := range clients {
+		c.ExpectNothing(client)
+	}
+}
+
+func TestClusterPublishBatch(t *testing.T) {
+	c := startCluster(t, 2, func(node int) *Server {
+		return &Server{
+			Unrouted: UnroutedFail,
+			ChannelConfig: func(channel string) ChannelConfig {
+				if channel == "limited" {
+					return ChannelConfig{PublishRate: PublishRate{PerSecond: 0.01, Burst: 2}}
+				}
+				return ChannelConfig{}
+			},
+			ValidateBody: func(channel string, body []byte) error {
+				if string(body) == "bad" {
+					return errors.New("Bad body")
+				}
+				return nil
+			},
+		}
+	})
+
+	client := c.Connect(1, ClientModeWebsocket)
+	for _, channel := range []string{"test", "limited"} {
+		err := client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SettleSubscriptions("test", 1)
+	c.SettleSubscriptions("limited", 1)
+	s := c.Server(0)
+
+	// In order, on the other node
+	n, unrouted, err := s.PublishBatch("test", "one", "two", "three")
+	if err != nil || n != 3 || unrouted != 0 {
+		t.Fatalf("Expected 3 published, got %d (%d unrouted): %v", n, unrouted, err)
+	}
+	c.Expect(client, "message one", "message two", "message three")
+
+	// None of them when one is refused
+	n, _, err = s.PublishBatch("test", "four", "bad")
+	if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidBody || n != 0 {
+		t.Errorf("Expected an invalid body and none published, got %d: %v", n, err)
+	}
+	c.ExpectNothing(client)
+
+	// Up to the rate limit
+	n, _, err = s.PublishBatch("limited", "five", "six", "seven")
+	if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorRateLimited || n != 2 {
+		t.Errorf("Expected to be rate limited after 2, got %d: %v", n, err)
+	}
+	c.Expect(client, "message five", "message six")
+	c.ExpectNothing(client)
+
+	// All of them when nobody listens, counted
+	n, unrouted, err = s.PublishBatch("empty", "eight", "nine")
+	if err != nil || n != 2 || unrouted != 2 {
+		t.Errorf("Expected 2 published and unrouted, got %d (%d unrouted): %v", n, unrouted, err)
+	}
+}
+
+func TestClusterPresence(t *testing.T) {
+	c := startCluster(t, 3, func(node int) *Server {
+		return &Server{
+			ChannelConfig: func(channel string) ChannelConfig {
+				return ChannelConfig{Presence: true}
+			},
+			PresenceKey: func(data map[string]interface{}) string {
+				user, _ := data["user"].(string)
+				return user
+			},
+		}
+	})
+	user := func(name string) func(c *Client) {
+		return func(c *Client) {
+			c.AuthData = map[string]interface{}{"user": name}
+		}
+	}
+
+	observer := c.Connect(0, ClientModeWebsocket, user("observer"))
+	err := observer.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Expect(observer, "memberAdded")
+
+	members := func(expected string) {
+		t.Helper()
+		for node := range c.Nodes {
+			m, err := c.Server(node).Members("room")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(m) != expected {
+				t.Errorf("Expected members %s on node %d, got %v", expected, node, m)
+			}
+		}
+	}
+
+	// The same user on two nodes counts once.
+	for node, mode := range []ClientMode{ClientModeWebsocket, ClientModeLongPoll} {
+		client := c.Connect(node+1, mode, user("alice"))
+		err := client.Subscribe("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node == 0 {
+			c.Expect(observer, "memberAdded")
+		}
+	}
+	c.SettleSubscriptions("room", 3)
+	members("[alice observer]")
+	c.ExpectNothing(observer)
+}
+
+func TestClusterKick(t *testing.T) {
+	c := startCluster(t, 3, nil)
+
+	for name, mode := range clusterModes {
+		client := c.Connect(0, mode)
+		err := client.Subscribe(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SettleSubscriptions(name, 1)
+
+		// Published on one node, kicked from another
+		err = c.Server(1).Publish(name, "Last message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Server(2).Kick(client.ConnectionID(), "bye")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Expect(client, "message Last message", "kick bye")
+
+		err = client.Disconnect()
+		if err == nil || err.Error() != "Kicked: bye" {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		c.SettleSubscriptions(name, 0)
+	}
+}
+
+// Clusters sharing a Redis server don't see each other.
+func TestClusterIsolation(t *testing.T) {
+	r, err := startRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Stop)
+
+	blue := startClusterOn(t, r, "blue", 2, nil)
+	green := startClusterOn(t, r, "green", 2, nil)
+
+	var clients []*Client
+	for _, c := range []*testCluster{blue, green} {
+		client := c.Connect(1, ClientModeWebsocket)
+		err := client.Subscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SettleSubscriptions("test", 1)
+		clients = append(clients, client)
+	}
+
+	err = blue.Server(0).Publish("test", "Blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blue.Expect(clients[0], "message Blue")
+	green.ExpectNothing(clients[1])
+
+	green.Settle("one connection", func(stats clusterStats) bool {
+		return stats.Connections == 1
+	})
+}
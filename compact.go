@@ -0,0 +1,83 @@
+package broadcaster
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Longest compaction key accepted, see PublishOptions.CompactionKey.
+const maxCompactionKeyLength = 256
+
+// Marks the members of the pending store that stand for the latest message
+// with a compaction key, whose data is kept aside. Can't occur in an
+// envelope, see envelopePrefix.
+const compactedPrefix = "\x00key\x00"
+
+// Compaction key of a PublishMessage, or of a broadcast message published
+// with one. See PublishOptions.CompactionKey.
+func (c ClientMessage) CompactionKey() string {
+	s, _ := c["compactionKey"].(string)
+	return s
+}
+
+func validCompactionKey(key string) error {
+	if len(key) > maxCompactionKeyLength {
+		return errors.New("Compaction key too long")
+	}
+	return nil
+}
+
+// Keeps only the latest of the stored messages with the same compaction
+// key, in place: each key at the position of its latest message.
+func compactStored(stored [][]byte) [][]byte {
+	latest := make(map[string]int)
+	for i, data := range stored {
+		if e, ok := decodeEnvelope(data); ok && e.CompactionKey != "" {
+			latest[e.CompactionKey] = i
+		}
+	}
+	if len(latest) == 0 {
+		return stored
+	}
+
+	kept := stored[:0]
+	for i, data := range stored {
+		if e, ok := decodeEnvelope(data); ok && e.CompactionKey != "" && latest[e.CompactionKey] != i {
+			continue
+		}
+		kept = append(kept, data)
+	}
+	return kept
+}
+
+// Replaces the members of the pending store that stand for compacted
+// messages with their data. Those whose data is gone are left out.
+func (b *redisBackend) resolveCompacted(conn redis.Conn, channel string, members [][]byte) ([][]byte, error) {
+	var keys []interface{}
+	for _, m := range members {
+		if bytes.HasPrefix(m, []byte(compactedPrefix)) {
+			keys = append(keys, m[len(compactedPrefix):])
+		}
+	}
+	if len(keys) == 0 {
+		return members, nil
+	}
+
+	data, err := redis.ByteSlices(conn.Do("HMGET", append([]interface{}{b.key("pending-keys:%s", channel)}, keys...)...))
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([][]byte, 0, len(members))
+	for _, m := range members {
+		if bytes.HasPrefix(m, []byte(compactedPrefix)) {
+			m, data = data[0], data[1:]
+			if m == nil {
+				continue
+			}
+		}
+		resolved = append(resolved, m)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,98 @@
+package broadcaster
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactedReplay(t *testing.T) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	subscribe := func(clientID string) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			c.clientID = clientID
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce, Cursor: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	receive := func(client *Client, expected ...string) {
+		t.Helper()
+		for _, want := range expected {
+			select {
+			case m := <-client.Messages:
+				got := m.Type()
+				if got == MessageMessage {
+					got = m.CompactionKey() + "=" + m["body"].(string)
+				}
+				if got != want {
+					t.Fatalf("Expected %s, got %s", want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Didn't receive %s", want)
+			}
+		}
+	}
+	publisher, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Disconnect()
+	publish := func(updates ...string) {
+		t.Helper()
+		for _, update := range updates {
+			parts := strings.SplitN(update, "=", 2)
+			opts := PublishOptions{CompactionKey: parts[0]}
+			var err error
+			if opts.CompactionKey == "b" {
+				_, err = publisher.PublishWith("test", parts[1], opts)
+			} else {
+				_, _, err = server.Broadcaster.PublishWith(context.Background(), "test", parts[1], opts)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	client := subscribe("")
+	clientID := client.ClientID()
+	publish("a=1")
+	receive(client, "a=1")
+	waitAcked(t, server, client, "test")
+	client.Disconnect()
+
+	// Server-side and client publishes alike, unkeyed ones are all kept
+	publish("a=2", "b=1", "=x", "a=3", "b=2", "=y", "a=4")
+
+	client = subscribe(clientID)
+	defer client.Disconnect()
+	receive(client, "=x", "b=2", "=y", "a=4")
+	if seq, _ := client.Cursor("test"); seq != 8 {
+		t.Errorf("Expected to resume after 8, got %d", seq)
+	}
+
+	// Live messages aren't compacted
+	publish("a=5", "a=6")
+	receive(client, "a=5", "a=6")
+
+	_, err = publisher.PublishWith("test", "Too long", PublishOptions{CompactionKey: strings.Repeat("k", maxCompactionKeyLength+1)})
+	if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidKey {
+		t.Errorf("Expected an invalid key error, got %v", err)
+	}
+}
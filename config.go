@@ -0,0 +1,285 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The part of the configuration that can change while the server runs, see
+// Server.UpdateConfig. Each field works like the Server field of the same
+// name, which is where it starts out from. Zero values mean the defaults.
+//
+// Nothing in here is secret: it's included in state dumps.
+type RuntimeConfig struct {
+	MaxPublishRate       PublishRate   `json:"max_publish_rate"`
+	IdentityPublishRate  PublishRate   `json:"identity_publish_rate"`
+	SubscribeRateLimit   RateLimit     `json:"subscribe_rate_limit"`
+	PingRateLimit        RateLimit     `json:"ping_rate_limit"`
+	SubscribersRateLimit RateLimit     `json:"subscribers_rate_limit"`
+	PublishTimeout       time.Duration `json:"publish_timeout"`
+	WriteTimeout         time.Duration `json:"write_timeout"`
+	HandshakeTimeout     time.Duration `json:"handshake_timeout"`
+	PollTime             time.Duration `json:"poll_time"`
+	MaxBufferedBytes     int64         `json:"max_buffered_bytes"`
+	Quotas               Quotas        `json:"quotas"`
+	AllowedOrigins       []string      `json:"allowed_origins,omitempty"`
+	ChannelDefaults      ChannelConfig `json:"channel_defaults"`
+}
+
+// Takes the initial configuration from the Server fields, once the defaults
+// are filled in.
+func (s *Server) initialConfig() *RuntimeConfig {
+	return &RuntimeConfig{
+		MaxPublishRate:       s.MaxPublishRate,
+		IdentityPublishRate:  s.IdentityPublishRate,
+		SubscribeRateLimit:   s.SubscribeRateLimit,
+		PingRateLimit:        s.PingRateLimit,
+		SubscribersRateLimit: s.SubscribersRateLimit,
+		PublishTimeout:       s.PublishTimeout,
+		WriteTimeout:         s.WriteTimeout,
+		HandshakeTimeout:     s.HandshakeTimeout,
+		PollTime:             s.PollTime,
+		MaxBufferedBytes:     s.MaxBufferedBytes,
+		Quotas:               s.Quotas,
+		AllowedOrigins:       s.AllowedOrigins,
+		ChannelDefaults:      s.ChannelDefaults,
+	}
+}
+
+// The configuration in effect. Swapped as a whole, never modified: read it
+// once per check.
+func (s *Server) config() *RuntimeConfig {
+	if c, ok := s.runtimeConfig.Load().(*RuntimeConfig); ok {
+		return c
+	}
+	return s.initialConfig()
+}
+
+// Fills in the defaults, as PrepareContext does for the Server fields.
+func (c *RuntimeConfig) setDefaults() {
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = 10 * time.Second
+	}
+	if c.PollTime == 0 {
+		c.PollTime = 500 * time.Millisecond
+	}
+	if !c.PingRateLimit.enabled() {
+		c.PingRateLimit = defaultPingRateLimit
+	}
+	if !c.SubscribersRateLimit.enabled() {
+		c.SubscribersRateLimit = defaultSubscribersRateLimit
+	}
+}
+
+func (c *RuntimeConfig) validate(s *Server) error {
+	for name, d := range map[string]time.Duration{
+		"PublishTimeout":   c.PublishTimeout,
+		"WriteTimeout":     c.WriteTimeout,
+		"HandshakeTimeout": c.HandshakeTimeout,
+		"PollTime":         c.PollTime,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	if c.PollTime >= s.Timeout {
+		return errors.New("PollTime must be shorter than Timeout")
+	}
+	if c.MaxBufferedBytes < 0 {
+		return errors.New("MaxBufferedBytes can't be negative")
+	}
+
+	rates := map[string]PublishRate{
+		"MaxPublishRate":              c.MaxPublishRate,
+		"IdentityPublishRate":         c.IdentityPublishRate,
+		"ChannelDefaults.PublishRate": c.ChannelDefaults.PublishRate,
+		"Quotas.Default.PublishRate":  c.Quotas.Default.PublishRate,
+	}
+	quotas := map[string]Quota{"Quotas.Default": c.Quotas.Default}
+	for tenant, q := range c.Quotas.Tenants {
+		rates[fmt.Sprintf("Quotas.Tenants[%q].PublishRate", tenant)] = q.PublishRate
+		quotas[fmt.Sprintf("Quotas.Tenants[%q]", tenant)] = q
+	}
+	for name, r := range rates {
+		if r.PerSecond < 0 || r.Burst < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	for name, q := range quotas {
+		if q.Connections < 0 || q.Subscriptions < 0 || q.BufferedBytes < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	for name, l := range map[string]RateLimit{
+		"SubscribeRateLimit":   c.SubscribeRateLimit,
+		"PingRateLimit":        c.PingRateLimit,
+		"SubscribersRateLimit": c.SubscribersRateLimit,
+	} {
+		if l.Count < 0 || l.Interval < 0 || (l.Count > 0) != (l.Interval > 0) {
+			return fmt.Errorf("%s needs both a Count and an Interval", name)
+		}
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("Invalid origin: %q", origin)
+		}
+	}
+	return nil
+}
+
+// Replaces the runtime configuration on all nodes, e.g. to raise a limit,
+// without restarting and disconnecting everyone. Returns an error, and
+// changes nothing, when the configuration is invalid.
+//
+// The new values apply from the next check on: existing connections are
+// kept, even over a lowered limit, as with SetQuotas. Nodes that are
+// prepared later switch to the last configuration set this way, from their
+// Server fields, as soon as they read it from Redis. See OnConfigChange.
+func (s *Server) UpdateConfig(c RuntimeConfig) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+
+	// Copied, the caller keeps theirs.
+	c.AllowedOrigins = append([]string(nil), c.AllowedOrigins...)
+	tenants := make(map[string]Quota, len(c.Quotas.Tenants))
+	for tenant, q := range c.Quotas.Tenants {
+		tenants[tenant] = q
+	}
+	c.Quotas.Tenants = tenants
+
+	c.setDefaults()
+	err := c.validate(s)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	err = st.redis.StoreConfig(data)
+	if err != nil {
+		return err
+	}
+	s.applyConfig(&c, data)
+	return nil
+}
+
+// Takes the configuration another node stored, see UpdateConfig.
+func (s *Server) reloadConfig() {
+	st := s.current()
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	data, err := st.redis.LoadConfig()
+	if err != nil {
+		s.logf("Failed to load the configuration: %s", err)
+		return
+	}
+	if data == nil || bytes.Equal(data, s.configData) {
+		return
+	}
+
+	c := &RuntimeConfig{}
+	err = json.Unmarshal(data, c)
+	if err == nil {
+		c.setDefaults()
+		err = c.validate(s)
+	}
+	if err != nil {
+		s.logf("Ignoring invalid configuration: %s", err)
+		return
+	}
+	s.applyConfig(c, data)
+}
+
+// Must hold configLock.
+func (s *Server) applyConfig(c *RuntimeConfig, data []byte) {
+	old := s.config()
+	s.runtimeConfig.Store(c)
+	s.configData = data
+
+	s.limiter.SetGlobal(c.MaxPublishRate)
+	s.buffers.SetMax(c.MaxBufferedBytes)
+	s.tenants.SetQuotas(c.Quotas)
+
+	s.logf("Configuration changed")
+	s.audit(AuditEvent{Type: AuditConfigChanged})
+	if s.OnConfigChange != nil {
+		s.runCallback("OnConfigChange", func() {
+			s.OnConfigChange(*old, *c)
+		})
+	}
+}
+
+func (b *redisBackend) StoreConfig(data []byte) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", b.key("config"), data)
+	conn.Send("PUBLISH", b.controlChannel, "config")
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Returns nil when no configuration was stored.
+func (b *redisBackend) LoadConfig() ([]byte, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", b.key("config")))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Whether requests from the origin of r may be answered cross-origin, see
+// AllowedOrigins and CheckOrigin.
+func (s *Server) allowsOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		for _, allowed := range s.config().AllowedOrigins {
+			if strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+	}
+	return s.CheckOrigin != nil && s.checkOrigin(r)
+}
+
+// Default of Upgrader.CheckOrigin: allowed origins, and without a
+// CheckOrigin callback the same origin, as the Upgrader would.
+func (s *Server) checkUpgradeOrigin(r *http.Request) bool {
+	if s.allowsOrigin(r) {
+		return true
+	}
+	if s.CheckOrigin != nil {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,148 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	var lock sync.Mutex
+	changes := map[int]int{}
+	c := startCluster(t, 2, func(node int) *Server {
+		return &Server{
+			OnConfigChange: func(old, new RuntimeConfig) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes[node]++
+			},
+		}
+	})
+
+	client := c.Connect(1, ClientModeWebsocket)
+	err := client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SettleSubscriptions("test", 1)
+	id := client.ConnectionID()
+	go func() {
+		for range client.Messages {
+		}
+	}()
+
+	// Publishes on one node under load, while another changes the limit
+	limited := func(expected bool) {
+		t.Helper()
+		for i := 0; i < 500; i++ {
+			err := c.Server(1).Publish("test", fmt.Sprintf("Message %d", i))
+			e, ok := err.(*PublishError)
+			if err != nil && (!ok || e.Code != PublishErrorRateLimited) {
+				t.Fatal(err)
+			}
+			if (err != nil) == expected {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Expected limited publishes: %v", expected)
+	}
+	limited(false)
+
+	err = c.Server(0).UpdateConfig(RuntimeConfig{
+		MaxPublishRate:     PublishRate{PerSecond: 1},
+		SubscribeRateLimit: RateLimit{Count: 1, Interval: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited(true)
+
+	// Applies to the connection as it is
+	err = client.Subscribe("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("two")
+	if err == nil {
+		t.Error("Expected the subscribe to be rate limited")
+	}
+
+	err = c.Server(0).UpdateConfig(RuntimeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited(false)
+
+	if client.ConnectionID() != id {
+		t.Errorf("Expected the connection to stay, it's now %s", client.ConnectionID())
+	}
+	stats := c.Stats()
+	if stats.Connections != 1 || stats.LocalConnections != 1 {
+		t.Errorf("Expected one connection throughout, got %+v", stats)
+	}
+	lock.Lock()
+	if changes[0] != 2 || changes[1] != 2 {
+		t.Errorf("Expected two changes on each node, got %v", changes)
+	}
+	lock.Unlock()
+
+	// Invalid, nothing changes
+	for _, config := range []RuntimeConfig{
+		{MaxPublishRate: PublishRate{PerSecond: -1}},
+		{SubscribeRateLimit: RateLimit{Count: 1}},
+		{PollTime: time.Hour},
+		{AllowedOrigins: []string{"example.com"}},
+	} {
+		err := c.Server(0).UpdateConfig(config)
+		if err == nil {
+			t.Errorf("Expected %+v to be refused", config)
+		}
+	}
+
+	// Nodes that join later start out with it
+	err = c.Server(1).UpdateConfig(RuntimeConfig{
+		AllowedOrigins: []string{"https://example.com"},
+		Quotas:         Quotas{Default: Quota{Connections: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := c.Join(nil)
+
+	var config RuntimeConfig
+	for i := 0; i < 500; i++ {
+		var buf bytes.Buffer
+		err = c.Server(node).DumpState(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dump StateDump
+		err = json.Unmarshal(buf.Bytes(), &dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config = dump.Config
+		if len(config.AllowedOrigins) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(config.AllowedOrigins) != 1 || config.Quotas.Default.Connections != 10 || config.PollTime != 500*time.Millisecond {
+		t.Errorf("Unexpected configuration: %+v", config)
+	}
+
+	for origin, allowed := range map[string]bool{"https://example.com": true, "https://example.org": false} {
+		r := httptest.NewRequest("GET", "/health", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		c.Server(node).ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("%s: expected CORS to be allowed: %v", origin, allowed)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package broadcaster
+
+import (
+	"encoding/json"
+)
+
+// Queues a broadcast message at the priority of its channel, conflating it
+// if the channel or the client asks for it, see Client.MaxRate.
+func (s *Server) queueMessage(o *outbox, m ClientMessage) {
+	config := s.channelConfig(m.Channel())
+	key, ok := conflationKey(config, m)
+	if !ok && m.Type() == MessageMessage && o.Paced() {
+		key, ok = m.Channel(), true
+	}
+	if ok {
+		o.PushConflated(config.Priority, m, key)
+		return
+	}
+	o.Push(config.Priority, m)
+}
+
+// Messages with the same key replace each other while they're queued, see
+// ChannelConfig.Conflate. Only broadcast messages are conflated, those
+// without the ConflateKey field aren't.
+func conflationKey(config ChannelConfig, m ClientMessage) (string, bool) {
+	if !config.Conflate || m.Type() != MessageMessage {
+		return "", false
+	}
+	if config.ConflateKey == "" {
+		return m.Channel(), true
+	}
+
+	body, _ := m["body"].(string)
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(body), &fields)
+	if err != nil {
+		return "", false
+	}
+	value, ok := fields[config.ConflateKey]
+	if !ok {
+		return "", false
+	}
+	return m.Channel() + "\x00" + string(value), true
+}
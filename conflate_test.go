@@ -0,0 +1,114 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxConflation(t *testing.T) {
+	s := &Server{MaxBufferedBytes: 1 << 20}
+	s.buffers = newBufferAccount(s.MaxBufferedBytes)
+	o := s.newOutbox("", nil)
+
+	config := ChannelConfig{Conflate: true, ConflateKey: "symbol"}
+	push := func(seq int, body string) {
+		m := newBroadcastMessage("prices", body)
+		m["seq"] = int64(seq)
+		key, ok := conflationKey(config, m)
+		if ok {
+			o.PushConflated(PriorityNormal, m, key)
+		} else {
+			o.Push(PriorityNormal, m)
+		}
+	}
+
+	push(1, `{"symbol":"A","price":1}`)
+	push(2, `{"symbol":"B","price":1}`)
+	push(3, `{"symbol":"A","price":2}`)
+	push(4, `{"symbol":"A","price":3}`)
+	push(5, `not json`)
+
+	if o.Len() != 3 {
+		t.Errorf("Expected 3 queued messages, got %d", o.Len())
+	}
+
+	// The latest A went to the back, behind B.
+	messages := o.Drain()
+	expected := []struct {
+		seq       int64
+		conflated interface{}
+	}{{2, nil}, {4, 2}, {5, nil}}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %v", len(expected), messages)
+	}
+	for i, m := range messages {
+		if m.Seq() != expected[i].seq || m["conflated"] != expected[i].conflated {
+			t.Errorf("Unexpected message %d: %v", i, m)
+		}
+	}
+
+	if o.Bytes() != 0 || s.buffers.Stats().Used != 0 {
+		t.Errorf("Expected nothing buffered, got %d", o.Bytes())
+	}
+}
+
+func TestConflationSlowReader(t *testing.T) {
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Conflate: channel == "prices"}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := server.Broadcaster.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handedOver := watchHandover(t, server)
+
+	// Not reading while these arrive.
+	const n = 500
+	for i := 1; i <= n; i++ {
+		err := server.Broadcaster.Publish("prices", fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handedOver()
+
+	received := 0
+	last := int64(0)
+	for {
+		select {
+		case m := <-client.Messages:
+			received++
+			if m.Seq() <= last {
+				t.Fatalf("Out of order: %d after %d", m.Seq(), last)
+			}
+			last = m.Seq()
+			if m["body"] != fmt.Sprintf("%d", n) {
+				continue
+			}
+			if received > n/10 {
+				t.Errorf("Expected far fewer than %d messages, got %d", n, received)
+			}
+			if m["conflated"] == nil {
+				t.Errorf("Expected a conflation hint, got %v", m)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Didn't receive the latest message, got %d messages", received)
+		}
+	}
+}
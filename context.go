@@ -0,0 +1,64 @@
+package broadcaster
+
+import (
+	"context"
+	"sync"
+)
+
+// Returns a context that's cancelled once a connection on this node is gone,
+// for work tied to its lifetime, e.g. a goroutine feeding it messages. It's
+// created when the connection is authenticated and cancelled once, after
+// everything else about the connection was cleaned up. False if there's no
+// such connection on this node: it never existed, it already disconnected,
+// or it's a long-poll session, which moves between nodes and ends by
+// expiring in Redis.
+func (s *Server) ConnectionContext(connID string) (context.Context, bool) {
+	return s.contexts.Get(connID)
+}
+
+// Contexts of the connections on this node, by connection ID.
+type connectionContexts struct {
+	cancels  map[string]context.CancelFunc
+	contexts map[string]context.Context
+
+	sync.Mutex
+}
+
+func newConnectionContexts() *connectionContexts {
+	return &connectionContexts{
+		cancels:  make(map[string]context.CancelFunc),
+		contexts: make(map[string]context.Context),
+	}
+}
+
+// Called by the transports once a connection is authenticated.
+func (c *connectionContexts) Open(connID string) {
+	c.Lock()
+	defer c.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.contexts[connID] = ctx
+	c.cancels[connID] = cancel
+}
+
+func (c *connectionContexts) Get(connID string) (context.Context, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	ctx, ok := c.contexts[connID]
+	return ctx, ok
+}
+
+// Called by the transports at the very end of the cleanup. Only the first
+// call for a connection does anything.
+func (c *connectionContexts) Cancel(connID string) {
+	c.Lock()
+	cancel, ok := c.cancels[connID]
+	delete(c.cancels, connID)
+	delete(c.contexts, connID)
+	c.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
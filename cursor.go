@@ -0,0 +1,85 @@
+package broadcaster
+
+import "github.com/garyburd/redigo/redis"
+
+// LastSeq of a subscribe request that doesn't resume.
+const noCursor = -1
+
+// Sequence number a subscription resumes after, sent in the "lastSeq" field
+// of a SubscribeMessage, noCursor if there's none. Only at-least-once
+// subscriptions resume, see SubscribeOptions.Cursor.
+func (c ClientMessage) LastSeq() int64 {
+	var seq int64
+	switch v := c["lastSeq"].(type) {
+	case int64:
+		seq = v
+	case float64:
+		seq = int64(v)
+	default:
+		return noCursor
+	}
+	if seq < 0 {
+		return noCursor
+	}
+	return seq
+}
+
+// Whether the reply to a SubscribeMessage carries the current sequence
+// number of the channel: when asked with "cursor", or when resuming.
+func (c ClientMessage) wantsCursor() bool {
+	cursor, _ := c["cursor"].(bool)
+	return cursor || c.LastSeq() != noCursor
+}
+
+// Adds the current sequence number of the channel to a SubscribeOKMessage,
+// zero if nothing was published on it yet. Later messages have higher ones.
+// Left out when Redis fails: the subscription stands, the client starts
+// counting from the next message.
+func (s *Server) addCursor(reply ClientMessage, channel string) {
+	st := s.current()
+	seq, err := st.redis.ChannelSeq(channel)
+	if err != nil {
+		s.logf("Failed to get the sequence number of %s: %s", channel, err)
+		return
+	}
+	reply["seq"] = seq
+}
+
+// Returns the sequence number of the last message published on a channel,
+// zero if there's none.
+func (b *redisBackend) ChannelSeq(channel string) (int64, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	seq, err := redis.Int64(conn.Do("GET", b.key("seq:%s", channel)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Number of messages after the given sequence number that are missing from
+// those kept, up to the current one: published before the channel had
+// at-least-once subscribers, or trimmed since. See Server.PendingLimit.
+// None when any kept message has a compaction key, those missing might have
+// been superseded rather than lost, see PublishOptions.CompactionKey.
+func storedGap(stored [][]byte, after, current int64) int {
+	for _, data := range stored {
+		if e, ok := decodeEnvelope(data); ok && e.CompactionKey != "" {
+			return 0
+		}
+	}
+
+	first := current + 1
+	if len(stored) > 0 {
+		if e, ok := decodeEnvelope(stored[0]); ok && e.Seq > 0 {
+			first = e.Seq
+		} else {
+			return 0
+		}
+	}
+	if first > current+1 {
+		first = current + 1
+	}
+	return int(first - after - 1)
+}
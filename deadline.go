@@ -0,0 +1,69 @@
+package broadcaster
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Implemented by the http.ResponseWriter of net/http since Go 1.20, other
+// writers may not support deadlines.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Like http.Flusher, but reports errors (also since Go 1.20).
+type errorFlusher interface {
+	FlushError() error
+}
+
+// Returns the part of w that handles deadlines, looking through wrappers.
+// Nil when unsupported.
+func responseDeadliner(w http.ResponseWriter) writeDeadliner {
+	for {
+		switch t := w.(type) {
+		case writeDeadliner:
+			return t
+		case interface {
+			Unwrap() http.ResponseWriter
+		}:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Writes to an HTTP response within WriteTimeout and flushes it, so that a
+// client that stopped reading shows up as an error. The deadline is lifted
+// afterwards, the connection may serve other requests.
+func (s *Server) writeResponse(w http.ResponseWriter, write func() error) error {
+	if d := responseDeadliner(w); d != nil {
+		d.SetWriteDeadline(time.Now().Add(s.config().WriteTimeout))
+		defer d.SetWriteDeadline(time.Time{})
+	}
+
+	err := write()
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(errorFlusher); ok {
+		return f.FlushError()
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Counts a connection that's closed because its client stopped reading.
+func (s *Server) writeTimedOut(id string) {
+	atomic.AddUint64(&s.writeTimeouts, 1)
+	s.logf("Connection %s: write timed out", id)
+}
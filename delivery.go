@@ -0,0 +1,64 @@
+package broadcaster
+
+import (
+	"sync/atomic"
+)
+
+type delivery struct {
+	connID string
+	m      ClientMessage
+}
+
+// Passes deliveries to OnDeliver in the background. Deliveries are dropped
+// (and counted) when the queue is full, observing never blocks the
+// connection.
+type deliveryObserver struct {
+	dropped    uint64
+	deliveries chan delivery
+
+	fn   func(connID, channel string, m ClientMessage)
+	logf func(format string, args ...interface{})
+}
+
+func newDeliveryObserver(size int, fn func(connID, channel string, m ClientMessage), logf func(format string, args ...interface{})) *deliveryObserver {
+	o := &deliveryObserver{
+		deliveries: make(chan delivery, size),
+		fn:         fn,
+		logf:       logf,
+	}
+	go o.run()
+	return o
+}
+
+func (o *deliveryObserver) Emit(d delivery) {
+	select {
+	case o.deliveries <- d:
+	default:
+		atomic.AddUint64(&o.dropped, 1)
+	}
+}
+
+func (o *deliveryObserver) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+func (o *deliveryObserver) run() {
+	for d := range o.deliveries {
+		runCallback(o.logf, "OnDeliver", func() {
+			o.fn(d.connID, d.m.Channel(), d.m)
+		})
+	}
+}
+
+// Passes the messages written to a connection to OnDeliver, if set. Only
+// published messages count, not replies and notices.
+func (s *Server) delivered(connID string, messages ...ClientMessage) {
+	if s.deliveries == nil {
+		return
+	}
+	for _, m := range messages {
+		if m.Type() == MessageMessage {
+			s.deliveries.Emit(delivery{connID: connID, m: m})
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package broadcaster
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnDeliver(t *testing.T) {
+	var lock sync.Mutex
+	delivered := []string{}
+	server, err := startServer(&Server{
+		OnDeliver: func(connID, channel string, m ClientMessage) {
+			lock.Lock()
+			defer lock.Unlock()
+			delivered = append(delivered, connID+" "+channel+" "+m["body"].(string))
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	newLocalClient := func(s *testServer, conf ...func(c *Client)) (*Client, error) {
+		return s.Broadcaster.LocalClient(nil)
+	}
+
+	expected := []string{}
+	for _, clientFn := range []func(s *testServer, conf ...func(c *Client)) (*Client, error){newWSClient, newLPClient, newLocalClient} {
+		client, err := clientFn(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		err = client.Subscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, client.ConnectionID()+" test hello")
+	}
+	sort.Strings(expected)
+
+	for {
+		stats, _ := s.Stats()
+		if stats.LocalSubscriptions["test"] >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The next one follows on each connection, by then a second delivery
+	// of the first would have shown up.
+	for _, body := range []string{"hello", "bye"} {
+		err = s.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Published messages only, once each
+	for i := 0; ; i++ {
+		lock.Lock()
+		n := len(delivered)
+		lock.Unlock()
+		if n >= 2*len(expected) {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("Expected %d deliveries, got %d", 2*len(expected), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := []string{}
+	lock.Lock()
+	for _, d := range delivered {
+		if !strings.HasSuffix(d, " bye") {
+			got = append(got, d)
+		}
+	}
+	lock.Unlock()
+	sort.Strings(got)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, got)
+			break
+		}
+	}
+}
+
+func TestOnDeliverDrops(t *testing.T) {
+	block := make(chan struct{})
+	server, err := startServer(&Server{
+		OnDeliver: func(connID, channel string, m ClientMessage) {
+			<-block
+		},
+		DeliveryQueueSize: 1,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	defer close(block)
+	s := server.Broadcaster
+
+	client, err := s.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivery goes on regardless
+	for i := 0; i < 5; i++ {
+		err = s.Publish("test", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-client.Messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a message")
+		}
+	}
+
+	// At most one being handled, and one queued
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DeliveriesDropped < 3 {
+		t.Errorf("Expected at least 3 dropped, got %d", stats.DeliveriesDropped)
+	}
+}
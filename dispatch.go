@@ -0,0 +1,117 @@
+package broadcaster
+
+import (
+	"sort"
+	"strings"
+)
+
+// Handler for the messages of channels matching a pattern, see
+// Client.OnMessage.
+type messageHandler struct {
+	pattern  []string
+	order    int
+	callback func(m ClientMessage)
+}
+
+// Routes broadcast messages to a handler instead of Messages, for all
+// channels matching the pattern. Channel names are split into segments on
+// dots: in a pattern, "*" matches a single segment and a trailing "**" one
+// or more. For example "orders.*" matches "orders.eu" but not
+// "orders.eu.paid", which "orders.**" does match.
+//
+// When several patterns match, the most specific one gets the message:
+// comparing segments from the left, a literal segment beats "*", which beats
+// "**". Between equally specific patterns, the one registered first wins.
+// Registering a pattern again replaces its handler, a nil handler removes
+// it.
+//
+// Handlers are called one at a time, in the order messages arrive, and
+// should return quickly. They're not used in RawMode.
+func (c *Client) OnMessage(pattern string, handler func(m ClientMessage)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	segments := strings.Split(pattern, ".")
+	handlers := c.handlers[:0:0]
+	order := 0
+	for _, h := range c.handlers {
+		if strings.Join(h.pattern, ".") == pattern {
+			order = h.order
+			continue
+		}
+		handlers = append(handlers, h)
+	}
+
+	if handler != nil {
+		if order == 0 {
+			c.handlerOrder++
+			order = c.handlerOrder
+		}
+		handlers = append(handlers, messageHandler{
+			pattern:  segments,
+			order:    order,
+			callback: handler,
+		})
+	}
+
+	sort.Sort(bySpecificity(handlers))
+	c.handlers = handlers
+}
+
+// Returns the handler for a channel, nil if none matches.
+func (c *Client) handlerFor(channel string) func(m ClientMessage) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	if len(c.handlers) == 0 {
+		return nil
+	}
+
+	segments := strings.Split(channel, ".")
+	for _, h := range c.handlers {
+		if matchPattern(h.pattern, segments) {
+			return h.callback
+		}
+	}
+	return nil
+}
+
+func matchPattern(pattern, channel []string) bool {
+	for i, p := range pattern {
+		if p == "**" && i == len(pattern)-1 {
+			return len(channel) > i
+		}
+		if i >= len(channel) || (p != "*" && p != channel[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(channel)
+}
+
+func segmentRank(segment string) int {
+	switch segment {
+	case "*":
+		return 1
+	case "**":
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Most specific first, then in the order of registration.
+type bySpecificity []messageHandler
+
+func (h bySpecificity) Len() int      { return len(h) }
+func (h bySpecificity) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h bySpecificity) Less(i, j int) bool {
+	a, b := h[i].pattern, h[j].pattern
+	for k := 0; k < len(a) && k < len(b); k++ {
+		ra, rb := segmentRank(a[k]), segmentRank(b[k])
+		if ra != rb {
+			return ra < rb
+		}
+	}
+	return h[i].order < h[j].order
+}
@@ -0,0 +1,100 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	client := &Client{}
+	for _, pattern := range []string{"orders.**", "orders.*", "*.eu", "orders.eu", "**", "orders.*.paid"} {
+		pattern := pattern
+		client.OnMessage(pattern, func(m ClientMessage) {
+			m["pattern"] = pattern
+		})
+	}
+
+	for channel, expected := range map[string]string{
+		"orders.eu":      "orders.eu",
+		"orders.us":      "orders.*",
+		"orders.eu.paid": "orders.*.paid",
+		"orders.eu.sent": "orders.**",
+		"users.eu":       "*.eu",
+		"users":          "**",
+		"orders":         "**",
+	} {
+		handler := client.handlerFor(channel)
+		if handler == nil {
+			t.Errorf("Expected a handler for %s", channel)
+			continue
+		}
+		m := ClientMessage{}
+		handler(m)
+		if m["pattern"] != expected {
+			t.Errorf("Expected %s to go to %s, got %s", channel, expected, m["pattern"])
+		}
+	}
+
+	// Equally specific: first one wins, even when replaced
+	client.OnMessage("*.eu", func(m ClientMessage) {
+		m["pattern"] = "*.eu again"
+	})
+	client.OnMessage("**", nil)
+	m := ClientMessage{}
+	client.handlerFor("users.eu")(m)
+	if m["pattern"] != "*.eu again" {
+		t.Errorf("Unexpected handler: %s", m["pattern"])
+	}
+	if client.handlerFor("users") != nil {
+		t.Error("Expected the handler to be removed")
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	client, err := s.LocalClient(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	orders := make(chan ClientMessage, 10)
+	client.OnMessage("orders.*", func(m ClientMessage) {
+		orders <- m
+	})
+
+	for _, channel := range []string{"orders.eu", "news"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, channel := range []string{"orders.eu", "news"} {
+		err = s.Publish(channel, "Hello "+channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case m := <-orders:
+		if m["body"] != "Hello orders.eu" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected message in handler")
+	}
+
+	// Everything else still goes to Messages
+	m := <-client.Messages
+	if m["body"] != "Hello news" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+}
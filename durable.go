@@ -0,0 +1,266 @@
+package broadcaster
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Stream length of a durable channel when ChannelConfig doesn't set
+// DurableLength.
+const defaultDurableLength = 1000
+
+const (
+	// How long a stream consumer waits for new entries before checking
+	// whether it should stop.
+	streamBlockTime = time.Second
+
+	// Entries read from a stream at once
+	streamReadCount = 100
+)
+
+func (c ChannelConfig) durableLength() int {
+	if !c.Durable {
+		return 0
+	}
+	if c.DurableLength <= 0 {
+		return defaultDurableLength
+	}
+	return c.DurableLength
+}
+
+// Stream length of a durable channel, 0 for the others.
+func (b *redisBackend) streamLength(channel string) int {
+	if b.durable == nil {
+		return 0
+	}
+	return b.durable(channel)
+}
+
+// Reads the stream of a durable channel on behalf of this node, through a
+// consumer group of its own. Redis keeps the group's cursor along with the
+// entries it handed out that weren't acknowledged yet: after a failure, the
+// consumer picks up where it left off.
+//
+// Entries are passed on to the hub like pub/sub messages. Their sequence
+// numbers tell when the stream was trimmed past the cursor, the
+// subscribers then get a SkippedMessage with the number of messages lost.
+type streamConsumer struct {
+	b       *redisBackend
+	channel string
+	key     string
+	group   string
+
+	// Sequence number of the last message passed on, 0 before the first
+	last int64
+
+	quit chan struct{}
+}
+
+// Starts consuming the stream of a durable channel, from its current end.
+// Called with subscriptionsLock held.
+func (b *redisBackend) consumeStream(channel string) error {
+	if _, ok := b.streams[channel]; ok {
+		return nil
+	}
+
+	// A group per subscription: a consumer that's still winding down
+	// can't read from its successor's.
+	c := &streamConsumer{
+		b:       b,
+		channel: channel,
+		key:     b.key("stream:%s", channel),
+		group:   fmt.Sprintf("%s-%s", b.nodeID, randomId(4)),
+		quit:    make(chan struct{}),
+	}
+	err := c.createGroup()
+	if err != nil {
+		return err
+	}
+
+	b.streams[channel] = c
+	go c.Run()
+	return nil
+}
+
+// Stops consuming the stream of a channel, if it's durable. Called with
+// subscriptionsLock held.
+func (b *redisBackend) stopStream(channel string) error {
+	c, ok := b.streams[channel]
+	if !ok {
+		return nil
+	}
+	delete(b.streams, channel)
+	close(c.quit)
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "DESTROY", c.key, c.group)
+	return err
+}
+
+// Messages of durable channels lost because their stream was trimmed past
+// the cursor of this node.
+func (b *redisBackend) StreamSkipped() uint64 {
+	return atomic.LoadUint64(&b.streamSkipped)
+}
+
+// Creates the group at the end of the stream, and the stream if needed.
+func (c *streamConsumer) createGroup() error {
+	conn := c.b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "CREATE", c.key, c.group, "$", "MKSTREAM")
+	return err
+}
+
+func (c *streamConsumer) Run() {
+	from := ">"
+	for !c.stopped() {
+		next, err := c.Poll(from)
+		if err != nil {
+			if c.stopped() {
+				return
+			}
+			c.b.logf("Redis error reading stream of %s: %s", c.channel, err)
+			time.Sleep(redisSleep)
+
+			// The reply may have been lost with the connection, the
+			// entries are still pending.
+			next = "0"
+		}
+		from = next
+	}
+}
+
+func (c *streamConsumer) stopped() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reads and passes on the entries after the given ID: ">" for new ones, an
+// ID for those handed out before but not acknowledged. Returns where to
+// continue from.
+func (c *streamConsumer) Poll(from string) (string, error) {
+	conn := c.b.conn.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("XREADGROUP", "GROUP", c.group, c.group,
+		"COUNT", streamReadCount, "BLOCK", int64(streamBlockTime/time.Millisecond),
+		"STREAMS", c.key, from))
+	if err == redis.ErrNil {
+		return ">", nil
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") && !c.stopped() {
+		// The stream is gone, e.g. Redis lost its data. Start over, the
+		// sequence numbers may have too.
+		c.b.logf("Stream of %s is gone, consuming it again", c.channel)
+		c.last = 0
+		return ">", c.createGroup()
+	}
+	if err != nil {
+		return from, err
+	}
+
+	entries, err := readStreamEntries(reply)
+	if err != nil {
+		return from, err
+	}
+	if len(entries) == 0 {
+		// Caught up on pending ones
+		return ">", nil
+	}
+
+	ids := []interface{}{c.key, c.group}
+	for _, e := range entries {
+		ids = append(ids, e.id)
+		if e.data != nil {
+			c.deliver(e.data)
+		}
+	}
+	_, err = conn.Do("XACK", ids...)
+	if err != nil {
+		return from, err
+	}
+
+	if from == ">" {
+		return from, nil
+	}
+	return entries[len(entries)-1].id, nil
+}
+
+// Passes an entry on to the hub, after a SkippedMessage if messages were
+// lost since the last one. Entries that were already passed on are
+// dropped.
+func (c *streamConsumer) deliver(data []byte) {
+	e, ok := decodeEnvelope(data)
+	if ok && c.last > 0 {
+		if e.Seq <= c.last {
+			return
+		}
+		if skipped := e.Seq - c.last - 1; skipped > 0 {
+			c.b.logf("Stream of %s was trimmed, %d messages lost", c.channel, skipped)
+			atomic.AddUint64(&c.b.streamSkipped, uint64(skipped))
+			marker, err := encodeEnvelope(envelope{Event: SkippedMessage, Count: skipped})
+			if err == nil {
+				c.b.Messages <- redis.Message{Channel: c.channel, Data: marker}
+			}
+		}
+	}
+	if ok {
+		c.last = e.Seq
+	}
+	c.b.Messages <- redis.Message{Channel: c.channel, Data: data}
+}
+
+type streamEntry struct {
+	id string
+
+	// Nil for entries that were trimmed while pending
+	data []byte
+}
+
+// Reads the entries of a single stream from an XREADGROUP reply.
+func readStreamEntries(reply []interface{}) ([]streamEntry, error) {
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	stream, err := redis.Values(reply[0], nil)
+	if err != nil || len(stream) < 2 {
+		return nil, err
+	}
+	items, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		parts, err := redis.Values(item, nil)
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", item)
+		}
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		e := streamEntry{id: id}
+
+		fields, _ := redis.ByteSlices(parts[1], nil)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == "data" {
+				e.data = fields[i+1]
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,170 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestStreamConsumer(t *testing.T) {
+	b, r := newTestRedisBackend()
+	defer r.Stop()
+	b.nodeID = "node1"
+	b.durable = func(channel string) int {
+		return 3
+	}
+
+	c := &streamConsumer{
+		b:       b,
+		channel: "test",
+		key:     b.key("stream:test"),
+		group:   "node1-test",
+		quit:    make(chan struct{}),
+	}
+	err := c.createGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			_, _, _, err := b.Publish("test", "Test message", messageOptions{}, publishOrigin{}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(expected ...string) {
+		for _, e := range expected {
+			select {
+			case m := <-b.Messages:
+				msg, _, _ := decodeBroadcastMessage(m.Channel, m.Data, false)
+				got := msg.Type()
+				if got == MessageMessage {
+					got = fmt.Sprintf("seq %v", msg["seq"])
+				} else if got == SkippedMessage {
+					got = fmt.Sprintf("skipped %v", msg["count"])
+				}
+				if got != e {
+					t.Fatalf("Expected %s, got %s", e, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %s, got nothing", e)
+			}
+		}
+	}
+
+	publish(1)
+	_, err = c.Poll(">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("seq 1")
+
+	// Trimmed past the cursor
+	publish(5)
+	_, err = c.Poll(">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("skipped 2", "seq 4", "seq 5", "seq 6")
+	if n := b.StreamSkipped(); n != 2 {
+		t.Errorf("Expected 2 skipped messages, got %d", n)
+	}
+
+	// Entries handed out before a failure are read again
+	publish(1)
+	conn := b.conn.Get()
+	_, err = conn.Do("XREADGROUP", "GROUP", c.group, c.group, "STREAMS", c.key, ">")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := c.Poll("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("seq 7")
+	next, err = c.Poll(next)
+	if err != nil || next != ">" {
+		t.Errorf("Expected to continue with new entries, got %s (%v)", next, err)
+	}
+
+	// Nothing pending any more
+	conn = b.conn.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("XACK", c.key, c.group, "0-0"))
+	if err != nil || n != 0 {
+		t.Errorf("Unexpected XACK reply: %d (%v)", n, err)
+	}
+}
+
+func TestDurableChannel(t *testing.T) {
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Durable: channel == "durable"}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"durable", "other"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.Broadcaster.current().redis.State().ConsumedStreams; n != 1 {
+		t.Errorf("Expected one stream to be consumed, got %d", n)
+	}
+
+	for _, channel := range []string{"durable", "other"} {
+		err = server.Broadcaster.Publish(channel, "Test message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := <-client.Messages
+		if m.Type() != MessageMessage || m["channel"] != channel {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	}
+
+	conn := server.Broadcaster.current().redis.conn.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("XLEN", server.Broadcaster.current().redis.key("stream:durable")))
+	if err != nil || n != 1 {
+		t.Errorf("Expected the message in the stream, got %d (%v)", n, err)
+	}
+
+	// Other messages still come in through pub/sub
+	err = server.sendMessage("durable", "Raw message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := <-client.Messages
+	if m["body"] != "Raw message" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+
+	err = client.Unsubscribe("durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.Broadcaster.current().redis.State().ConsumedStreams != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the stream to no longer be consumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
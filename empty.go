@@ -0,0 +1,105 @@
+package broadcaster
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Most channels remembered as empty, see emptyChannels.Mark.
+const emptyChannelsLimit = 10000
+
+// Channels that had no subscribers on any node when they were last
+// published to, so that publishes to them can skip Redis. See
+// Server.SkipEmptyChannels.
+//
+// A publish that reached no one marks its channel. The mark is cleared when
+// a node subscribes to the channel and tells the others on the control
+// channel, or after the TTL in case that was missed. Publishes that race
+// with a subscribe don't mark the channel again: marks are only made if no
+// channel was cleared since the publish started, see Version.
+type emptyChannels struct {
+	clock clock
+	ttl   time.Duration
+
+	// Expiry of each mark
+	until map[string]time.Time
+
+	// Increased by each Clear
+	version uint64
+
+	// Accessed atomically
+	skipped uint64
+
+	sync.Mutex
+}
+
+func newEmptyChannels(clock clock, ttl time.Duration) *emptyChannels {
+	return &emptyChannels{
+		clock: clock,
+		ttl:   ttl,
+		until: make(map[string]time.Time),
+	}
+}
+
+// Taken before publishing, to pass on to Mark.
+func (e *emptyChannels) Version() uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.version
+}
+
+// Marks a channel as empty after publishing to it reached no one, unless a
+// channel was cleared since the version was taken. Marks nothing when too
+// many channels are marked already.
+func (e *emptyChannels) Mark(channel string, version uint64) {
+	e.Lock()
+	defer e.Unlock()
+
+	if version != e.version {
+		return
+	}
+	now := e.clock.Now()
+	if len(e.until) >= emptyChannelsLimit {
+		for c, until := range e.until {
+			if !now.Before(until) {
+				delete(e.until, c)
+			}
+		}
+		if len(e.until) >= emptyChannelsLimit {
+			return
+		}
+	}
+	e.until[channel] = now.Add(e.ttl)
+}
+
+// Forgets that a channel was empty, once a node subscribed to it.
+func (e *emptyChannels) Clear(channel string) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.version++
+	delete(e.until, channel)
+}
+
+// Whether publishing to a channel can be skipped. Counts the skipped
+// publish if so.
+func (e *emptyChannels) Skip(channel string) bool {
+	e.Lock()
+	until, ok := e.until[channel]
+	if ok && !e.clock.Now().Before(until) {
+		delete(e.until, channel)
+		ok = false
+	}
+	e.Unlock()
+
+	if ok {
+		atomic.AddUint64(&e.skipped, 1)
+	}
+	return ok
+}
+
+// Number of publishes skipped so far.
+func (e *emptyChannels) Skipped() uint64 {
+	return atomic.LoadUint64(&e.skipped)
+}
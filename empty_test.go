@@ -0,0 +1,150 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmptyChannels(t *testing.T) {
+	clock := newFakeClock()
+	e := newEmptyChannels(clock, time.Second)
+
+	e.Mark("test", e.Version())
+	if !e.Skip("test") || e.Skip("other") {
+		t.Error("Expected only the marked channel to be skipped")
+	}
+
+	// Subscribed to on some node
+	e.Clear("test")
+	if e.Skip("test") {
+		t.Error("Expected the channel to be published to again")
+	}
+
+	// A publish that raced with a subscribe doesn't mark it again
+	version := e.Version()
+	e.Clear("test")
+	e.Mark("test", version)
+	if e.Skip("test") {
+		t.Error("Expected a stale publish not to mark the channel")
+	}
+
+	// Marks run out
+	e.Mark("test", e.Version())
+	clock.Advance(time.Second)
+	if e.Skip("test") {
+		t.Error("Expected the mark to expire")
+	}
+
+	if e.Skipped() != 1 {
+		t.Errorf("Expected 1 skipped publish, got %d", e.Skipped())
+	}
+}
+
+func TestSkipEmptyChannels(t *testing.T) {
+	server1, err := startServer(&Server{SkipEmptyChannels: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+
+	// Second node, sharing the same Redis
+	server2 := &testServer{
+		Port:        nextPort(),
+		Broadcaster: &Server{SkipEmptyChannels: true},
+		Redis:       server1.Redis,
+	}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Broadcaster.Close()
+
+	skipped := func(server *testServer) uint64 {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.SkippedPublishes
+	}
+
+	// Nobody listens, only the first one goes to Redis
+	for i := 0; i < 3; i++ {
+		id, seq, err := server1.Broadcaster.PublishWithID("test", "Nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "" || (i > 0 && seq != 0) {
+			t.Errorf("Expected an ID without a sequence number, got %q %d", id, seq)
+		}
+	}
+	if n := skipped(server1); n != 2 {
+		t.Errorf("Expected 2 skipped publishes, got %d", n)
+	}
+
+	// Subscribed on the other node, published to again once it's heard of
+	client, err := newWSClient(server2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishUntil := func(server *testServer, body string) {
+		deadline := time.After(5 * time.Second)
+		for {
+			err := server.Broadcaster.Publish("test", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-client.Messages:
+				if m["body"] != body {
+					t.Fatalf("Expected %q, got %v", body, m)
+				}
+				return
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("Expected %q", body)
+			}
+		}
+	}
+	publishUntil(server1, "Heard of")
+
+	// The subscribing node knows right away
+	err = client.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for skipped(server2) == 0 {
+		err = server2.Broadcaster.Publish("test", "Nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected the channel to be skipped")
+		}
+	}
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server2.Broadcaster.Publish("test", "Right away")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case m := <-client.Messages:
+			if m["body"] == "Right away" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the message")
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var errInvalidUTF8 = errors.New("Invalid UTF-8")
+
+// Checks that a frame from a client is UTF-8, as JSON must be: decoding
+// wouldn't tell, it replaces what isn't. Returns the error reply when it's
+// not.
+func checkEncoding(data []byte) ClientMessage {
+	if utf8.Valid(data) {
+		return nil
+	}
+	return newProtocolErrorMessage(ProtocolErrorInvalidEncoding, "", errInvalidUTF8.Error())
+}
+
+// Like validateChannel, for channels named by clients. Those decoded from
+// JSON are UTF-8, those of local clients or from a URL might not be.
+func (s *Server) validateClientChannel(channel string) error {
+	if !utf8.ValidString(channel) {
+		return fmt.Errorf("Invalid channel name %q: not UTF-8", channel)
+	}
+	return s.validateChannel(channel)
+}
@@ -0,0 +1,93 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestInvalidUTF8(t *testing.T) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	subscriber, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Disconnect()
+	err = subscriber.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WebSocket, hung up on like malformed JSON
+	conn := dialStrict(t, server)
+	defer conn.Close()
+	runConformance(t, wsExchange(t, conn), []conformanceStep{
+		{`{"__type":"auth"}`, AuthOKMessage},
+	})
+	err = conn.WriteMessage(websocket.TextMessage, []byte("{\"__type\":\"publish\",\"channel\":\"test\",\"body\":\"h\xffi\"}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if err == nil || isTimeout(err) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	// Long-poll, refused
+	url := fmt.Sprintf("http://localhost:%d/broadcaster/", server.Port)
+	resp, err := http.Post(url, "application/json", strings.NewReader("{\"__type\":\"auth\",\"user\":\"\xc3\"}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", resp.StatusCode)
+	}
+
+	// Local, refused with the usual errors
+	local, err := server.Broadcaster.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Disconnect()
+	_, err = local.Publish("test", "h\xffi")
+	if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidBody {
+		t.Errorf("Expected an invalid body, got %v", err)
+	}
+	_, err = local.Publish("te\xffst", "hi")
+	if e, ok := err.(*PublishError); !ok || e.Code != PublishErrorInvalidChannel {
+		t.Errorf("Expected an invalid channel, got %v", err)
+	}
+	err = local.Subscribe("te\xffst")
+	if err == nil || !strings.Contains(err.Error(), "not UTF-8") {
+		t.Errorf("Expected the subscribe to be refused, got %v", err)
+	}
+
+	// Others carry on, none of it reached them
+	_, err = local.Publish("test", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-subscriber.Messages:
+		if m["body"] != "hi" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+}
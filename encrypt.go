@@ -0,0 +1,173 @@
+package broadcaster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const encryptedVersion = "bce1"
+
+const nonceSize = 12
+
+// Symmetric key of an end-to-end encrypted channel, see
+// ChannelConfig.Encrypted. The ID travels along with the ciphertext, which
+// allows rotating keys.
+//
+// Publishers encrypt with a symmetric key per channel, which the server never
+// sees: it passes the ciphertext on as is. Keys are handed out by the
+// application. An encrypted body is a string made up of four parts,
+// separated by dots:
+//
+//	bce1.<key ID>.<nonce>.<ciphertext>
+//
+// The nonce (12 random bytes) and the ciphertext are base64url encoded,
+// without padding. The ciphertext is AES-GCM (with a 16, 24 or 32 byte key)
+// over the UTF-8 body, including the 16 byte tag at the end. The additional
+// data is the channel name and the key ID, joined by a dot: a ciphertext
+// can't be replayed on another channel. Key IDs can't contain dots.
+//
+// The equivalent in JavaScript, using WebCrypto:
+//
+//	const b64 = (buf) => btoa(String.fromCharCode(...new Uint8Array(buf)))
+//	    .replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+//	const unb64 = (s) => Uint8Array.from(
+//	    atob(s.replace(/-/g, "+").replace(/_/g, "/")), (c) => c.charCodeAt(0));
+//
+//	async function encryptBody(key, keyId, channel, body) {
+//	    const nonce = crypto.getRandomValues(new Uint8Array(12));
+//	    const ct = await crypto.subtle.encrypt({
+//	        name: "AES-GCM",
+//	        iv: nonce,
+//	        additionalData: new TextEncoder().encode(channel + "." + keyId),
+//	    }, key, new TextEncoder().encode(body));
+//	    return ["bce1", keyId, b64(nonce), b64(ct)].join(".");
+//	}
+//
+//	async function decryptBody(key, channel, body) {
+//	    const [version, keyId, nonce, ct] = body.split(".");
+//	    const pt = await crypto.subtle.decrypt({
+//	        name: "AES-GCM",
+//	        iv: unb64(nonce),
+//	        additionalData: new TextEncoder().encode(channel + "." + keyId),
+//	    }, key, unb64(ct));
+//	    return new TextDecoder().decode(pt);
+//	}
+//
+// Where key is a CryptoKey, e.g. from crypto.subtle.importKey("raw", bytes,
+// "AES-GCM", false, ["encrypt", "decrypt"]).
+type ChannelKey struct {
+	ID  string
+	Key []byte
+}
+
+// Encrypts a message body for a channel, see ChannelKey for the format.
+func EncryptBody(key ChannelKey, channel, body string) (string, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return encryptBody(key, channel, body, nonce)
+}
+
+func encryptBody(key ChannelKey, channel, body string, nonce []byte) (string, error) {
+	if key.ID == "" || strings.Contains(key.ID, ".") {
+		return "", fmt.Errorf("Invalid key ID: %q", key.ID)
+	}
+
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := aead.Seal(nil, nonce, []byte(body), additionalData(channel, key.ID))
+	return strings.Join([]string{
+		encryptedVersion,
+		key.ID,
+		base64.RawURLEncoding.EncodeToString(nonce),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+	}, "."), nil
+}
+
+// Decrypts a body made by EncryptBody. Fails when the body was tampered with,
+// made for another channel or encrypted with another key.
+func DecryptBody(key ChannelKey, channel, body string) (string, error) {
+	keyID, nonce, ciphertext, err := parseEncryptedBody(body)
+	if err != nil {
+		return "", err
+	}
+	if keyID != key.ID {
+		return "", fmt.Errorf("Encrypted with key %s, expected %s", keyID, key.ID)
+	}
+
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(channel, keyID))
+	if err != nil {
+		return "", errors.New("Failed to decrypt body")
+	}
+	return string(plaintext), nil
+}
+
+// Returns the ID of the key an encrypted body was made with.
+func EncryptedKeyID(body string) (string, error) {
+	keyID, _, _, err := parseEncryptedBody(body)
+	return keyID, err
+}
+
+func parseEncryptedBody(body string) (string, []byte, []byte, error) {
+	parts := strings.Split(body, ".")
+	if len(parts) != 4 || parts[0] != encryptedVersion || parts[1] == "" {
+		return "", nil, nil, errors.New("Not an encrypted body")
+	}
+
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(nonce) != nonceSize {
+		return "", nil, nil, errors.New("Invalid nonce")
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, errors.New("Invalid ciphertext")
+	}
+	return parts[1], nonce, ciphertext, nil
+}
+
+func isEncryptedBody(body string) bool {
+	_, _, _, err := parseEncryptedBody(body)
+	return err == nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(channel, keyID string) []byte {
+	return []byte(channel + "." + keyID)
+}
+
+// Returns the key to decrypt a body with, from those of the channel.
+func findChannelKey(keys []ChannelKey, body string) (ChannelKey, error) {
+	keyID, err := EncryptedKeyID(body)
+	if err != nil {
+		return ChannelKey{}, err
+	}
+	for _, key := range keys {
+		if key.ID == keyID {
+			return key, nil
+		}
+	}
+	return ChannelKey{}, fmt.Errorf("Unknown key: %s", keyID)
+}
@@ -0,0 +1,205 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testChannelKey(id string) ChannelKey {
+	key := ChannelKey{ID: id, Key: make([]byte, 32)}
+	for i := range key.Key {
+		key.Key[i] = byte(i)
+	}
+	return key
+}
+
+// Made with the JavaScript code in the ChannelKey docs.
+func TestEncryptedBodyInterop(t *testing.T) {
+	key := testChannelKey("k1")
+	nonce := []byte{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111}
+	expected := "bce1.k1.ZGVmZ2hpamtsbW5v.ANh3ChWGer5JDS2EvhiGYp9P2do59C4t79VpCM0"
+
+	body, err := encryptBody(key, "secret", "Héllo, world", nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != expected {
+		t.Errorf("Expected %s, got %s", expected, body)
+	}
+
+	plaintext, err := DecryptBody(key, "secret", expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "Héllo, world" {
+		t.Errorf("Unexpected plaintext: %s", plaintext)
+	}
+}
+
+func TestEncryptedBody(t *testing.T) {
+	key := testChannelKey("k1")
+
+	body, err := EncryptBody(key, "secret", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := EncryptBody(key, "secret", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body == other {
+		t.Error("Expected a fresh nonce for every body")
+	}
+
+	if id, err := EncryptedKeyID(body); err != nil || id != "k1" {
+		t.Errorf("Expected key k1, got %s (%v)", id, err)
+	}
+
+	// Bound to the channel
+	_, err = DecryptBody(key, "other", body)
+	if err == nil {
+		t.Error("Expected decrypting for another channel to fail")
+	}
+
+	// Bound to the key ID
+	parts := strings.Split(body, ".")
+	parts[1] = "k2"
+	_, err = DecryptBody(testChannelKey("k2"), "secret", strings.Join(parts, "."))
+	if err == nil {
+		t.Error("Expected a changed key ID to fail")
+	}
+
+	// Tampering
+	parts = strings.Split(body, ".")
+	parts[3] = "A" + parts[3][1:]
+	if parts[3] == strings.Split(body, ".")[3] {
+		parts[3] = "B" + parts[3][1:]
+	}
+	_, err = DecryptBody(key, "secret", strings.Join(parts, "."))
+	if err == nil {
+		t.Error("Expected a tampered body to fail")
+	}
+
+	_, err = EncryptBody(ChannelKey{ID: "k.1", Key: key.Key}, "secret", "Hello")
+	if err == nil {
+		t.Error("Expected key IDs with dots to be refused")
+	}
+
+	for _, body := range []string{"Hello", "bce1.k1.x.y", "bce2.k1.ZGVmZ2hpamtsbW5v.AA"} {
+		if isEncryptedBody(body) {
+			t.Errorf("Not an encrypted body: %s", body)
+		}
+	}
+}
+
+func TestEncryptedChannel(t *testing.T) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel string) bool {
+			return true
+		},
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Encrypted: strings.HasPrefix(channel, "e2e:")}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	keys := func(c *Client) {
+		c.ChannelKeys = func(channel string) []ChannelKey {
+			if channel == "e2e:room" {
+				return []ChannelKey{testChannelKey("k2"), testChannelKey("k1")}
+			}
+			return nil
+		}
+	}
+
+	publisher, err := newWSClient(server, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Disconnect()
+
+	subscriber, err := newWSClient(server, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Disconnect()
+
+	outsider, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Disconnect()
+
+	for _, c := range []*Client{subscriber, outsider} {
+		err = c.Subscribe("e2e:room")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["e2e:room"] == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = publisher.Publish("e2e:room", "Secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Older keys still decrypt
+	old, err := EncryptBody(testChannelKey("k1"), "e2e:room", "Rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("e2e:room", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"Secret", "Rotated"} {
+		m := <-subscriber.Messages
+		if m["body"] != expected || m["decryptError"] != nil {
+			t.Errorf("Expected %s, got %v", expected, m)
+		}
+	}
+
+	// The server and clients without keys only see ciphertext
+	m := <-outsider.Messages
+	body, _ := m["body"].(string)
+	if !isEncryptedBody(body) || strings.Contains(body, "Secret") {
+		t.Errorf("Expected ciphertext, got %s", body)
+	}
+	<-outsider.Messages
+
+	// Plaintext is refused
+	_, err = outsider.Publish("e2e:room", "Oops")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorNotEncrypted {
+		t.Errorf("Expected plaintext to be refused, got %v", err)
+	}
+	err = server.Broadcaster.Publish("e2e:room", "Oops")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorNotEncrypted {
+		t.Errorf("Expected plaintext to be refused, got %v", err)
+	}
+
+	// Unknown keys are reported
+	unknown, err := EncryptBody(testChannelKey("k3"), "e2e:room", "Unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("e2e:room", unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = <-subscriber.Messages
+	if m["body"] != unknown || m["decryptError"] != "Unknown key: k3" {
+		t.Errorf("Expected a decrypt error, got %v", m)
+	}
+}
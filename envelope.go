@@ -0,0 +1,104 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Renames envelope fields on the wire, to speak the dialect of an existing
+// client library. Maps the names the broadcaster uses to the names sent and
+// received instead, e.g. a Pusher-like {event, channel, data}:
+//
+//	EnvelopeFields{"__type": "event", "body": "data"}
+//
+// The names to map are those of the envelope: "__type" for the message
+// type, "channel", "body", "id" and the other fields of ClientMessage. Only
+// top-level fields are renamed, the body itself is left alone. Fields that
+// aren't mapped keep their names. The nil mapping keeps all of them.
+type EnvelopeFields map[string]string
+
+// Renames the fields of an outgoing message, returns a copy when any of
+// them changes.
+func (f EnvelopeFields) encode(m ClientMessage) ClientMessage {
+	if len(f) == 0 || m == nil {
+		return m
+	}
+
+	out := make(ClientMessage, len(m))
+	for k, v := range m {
+		if name, ok := f[k]; ok {
+			k = name
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Renames the fields of outgoing messages.
+func (f EnvelopeFields) encodeAll(m []ClientMessage) []ClientMessage {
+	if len(f) == 0 {
+		return m
+	}
+
+	out := make([]ClientMessage, len(m))
+	for i, v := range m {
+		out[i] = f.encode(v)
+	}
+	return out
+}
+
+// Renames the fields of an incoming message back, returns a copy when any
+// of them changes.
+func (f EnvelopeFields) decode(m ClientMessage) ClientMessage {
+	if len(f) == 0 || m == nil {
+		return m
+	}
+
+	names := make(map[string]string, len(f))
+	for k, name := range f {
+		names[name] = k
+	}
+	out := make(ClientMessage, len(m))
+	for k, v := range m {
+		if name, ok := names[k]; ok {
+			k = name
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Decodes a received frame as far as needed to route it.
+func (f EnvelopeFields) header(data []byte) (frameHeader, error) {
+	h := frameHeader{}
+	if len(f) == 0 {
+		err := json.Unmarshal(data, &h)
+		return h, err
+	}
+
+	m := ClientMessage{}
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return h, err
+	}
+	m = f.decode(m)
+	h.Type = m.Type()
+	h.Channel = m.Channel()
+	h.Seq = m.Seq()
+	h.ID, _ = m["id"].(string)
+	return h, nil
+}
+
+// Encodes messages with renamed fields, one JSON value per line.
+type envelopeEncoder struct {
+	enc    *json.Encoder
+	fields EnvelopeFields
+}
+
+func newEnvelopeEncoder(w io.Writer, fields EnvelopeFields) envelopeEncoder {
+	return envelopeEncoder{enc: json.NewEncoder(w), fields: fields}
+}
+
+func (e envelopeEncoder) Encode(m ClientMessage) error {
+	return e.enc.Encode(e.fields.encode(m))
+}
@@ -0,0 +1,160 @@
+package broadcaster
+
+import (
+	"sync"
+	"time"
+)
+
+// Publish times further ahead of this node's clock can't be right, the
+// clocks of the nodes disagree. See messageTiming.deadline.
+const maxClockSkew = time.Second
+
+// When a broadcast message was published, zero if unknown, and the TTL it
+// was published with, zero for that of its channel. See PublishOptions.TTL.
+type messageTiming struct {
+	Published time.Time
+	TTL       time.Duration
+}
+
+func (e envelope) timing() messageTiming {
+	t := messageTiming{TTL: time.Duration(e.TTL) * time.Millisecond}
+	if e.Time != 0 {
+		t.Published = time.UnixMilli(e.Time)
+	}
+	return t
+}
+
+// When a message stops being worth delivering, zero if never: its TTL, or
+// else that of its channel, after it was published. The age counts from when
+// it arrived instead when the publish time is unknown or implausible.
+func (t messageTiming) deadline(channelTTL time.Duration, arrived time.Time) time.Time {
+	ttl := t.TTL
+	if ttl <= 0 {
+		ttl = channelTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	published := t.Published
+	if published.IsZero() || published.After(arrived.Add(maxClockSkew)) {
+		published = arrived
+	}
+	return published.Add(ttl)
+}
+
+// Deadline of a message that just arrived on this node, see
+// messageTiming.deadline.
+func (s *Server) messageDeadline(channel string, t messageTiming) time.Time {
+	var channelTTL time.Duration
+	if t.TTL <= 0 {
+		channelTTL = s.channelConfig(channel).MessageTTL
+	}
+	return t.deadline(channelTTL, s.clock.Now())
+}
+
+// Sets the "expiresAt" field of a broadcast message that has a deadline.
+func stampDeadline(m ClientMessage, deadline time.Time) {
+	if !deadline.IsZero() {
+		m["expiresAt"] = deadline.UnixMilli()
+	}
+}
+
+// When a broadcast message stops being worth delivering, in the "expiresAt"
+// field (milliseconds since the epoch, on the clock of the node that
+// received it). False when it doesn't expire. See PublishOptions.TTL.
+func (c ClientMessage) ExpiresAt() (time.Time, bool) {
+	switch v := c["expiresAt"].(type) {
+	case int64:
+		return time.UnixMilli(v), true
+	case float64:
+		return time.UnixMilli(int64(v)), true
+	}
+	return time.Time{}, false
+}
+
+// TTL of a queued message and whether the subscriber is told when it
+// expires, see ChannelConfig.MessageTTL. Only broadcast messages expire.
+func (s *Server) messageTTL(m ClientMessage) (time.Duration, bool) {
+	if m.Type() != MessageMessage {
+		return 0, false
+	}
+	config := s.channelConfig(m.Channel())
+	return config.MessageTTL, config.NotifyExpired
+}
+
+// Whether a message kept in Redis is past its deadline, see
+// messageTiming.deadline. Returns the deadline otherwise.
+func (s *Server) storedExpired(config ChannelConfig, data []byte) (time.Time, bool) {
+	e, ok := decodeEnvelope(data)
+	if !ok {
+		return time.Time{}, false
+	}
+	now := s.clock.Now()
+	deadline := e.timing().deadline(config.MessageTTL, now)
+	if deadline.IsZero() || now.Before(deadline) {
+		return deadline, false
+	}
+	return deadline, true
+}
+
+// Counts a message that expired before it reached a connection, and passes
+// it on to OnMessageExpired.
+func (s *Server) messageExpired(connectionID string, m ClientMessage) {
+	s.expired.Count(m.Channel())
+	if s.OnMessageExpired == nil {
+		return
+	}
+
+	id, _ := m["id"].(string)
+	s.runCallback("OnMessageExpired", func() {
+		s.OnMessageExpired(connectionID, m.Channel(), id)
+	})
+}
+
+// Takes the place of an expired message, see ChannelConfig.NotifyExpired.
+func newMessageExpiredMessage(m ClientMessage) ClientMessage {
+	reply := newChannelMessage(ExpiredMessage, m.Channel())
+	id, _ := m["id"].(string)
+	reply["id"] = id
+	return reply
+}
+
+// Counts expired messages per channel.
+type expiredCounter struct {
+	total    uint64
+	channels map[string]uint64
+
+	sync.Mutex
+}
+
+func newExpiredCounter() *expiredCounter {
+	return &expiredCounter{
+		channels: make(map[string]uint64),
+	}
+}
+
+func (c *expiredCounter) Count(channel string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.total++
+	c.channels[channel]++
+}
+
+func (c *expiredCounter) Total() uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.total
+}
+
+func (c *expiredCounter) Stats() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	result := make(map[string]uint64, len(c.channels))
+	for channel, n := range c.channels {
+		result[channel] = n
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package broadcaster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxExpiry(t *testing.T) {
+	clock := newFakeClock()
+	expired := []string{}
+
+	o := newOutbox()
+	o.clock = clock
+	o.ttl = func(m ClientMessage) (time.Duration, bool) {
+		if m.Channel() == "kept" {
+			return 0, false
+		}
+		return time.Second, m.Channel() == "notified"
+	}
+	o.onExpired = func(m ClientMessage) {
+		expired = append(expired, m.Channel())
+	}
+
+	for _, channel := range []string{"notified", "quiet", "kept"} {
+		m := newBroadcastMessage(channel, "Old")
+		m["id"] = channel
+		o.Push(PriorityNormal, m)
+	}
+	o.Push(priorityControl, newMessage(PongMessage))
+	clock.Advance(time.Second)
+	o.Push(PriorityNormal, newBroadcastMessage("notified", "New"))
+
+	messages := o.Drain()
+	expected := []string{PongMessage + " ", ExpiredMessage + " notified", MessageMessage + " kept", MessageMessage + " notified"}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %v", len(expected), messages)
+	}
+	for i, m := range messages {
+		if got := m.Type() + " " + m.Channel(); got != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], got)
+		}
+	}
+	if messages[1]["id"] != "notified" {
+		t.Errorf("Expected the ID of the expired message, got %v", messages[1])
+	}
+	if len(expired) != 2 || expired[0] != "notified" || expired[1] != "quiet" {
+		t.Errorf("Unexpected expired messages: %v", expired)
+	}
+}
+
+func TestExpiredReplay(t *testing.T) {
+	clock := newFakeClock()
+	expired := make(chan string, 10)
+	server, err := startServer(&Server{
+		clock:      clock,
+		PendingTTL: time.Hour,
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{MessageTTL: time.Minute, NotifyExpired: channel == "notified"}
+		},
+		OnMessageExpired: func(connectionID, channel, id string) {
+			expired <- channel + " " + id
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	channels := []string{"notified", "quiet"}
+	subscribe := func(clientID string) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			c.clientID = clientID
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, channel := range channels {
+			err = client.SubscribeWith(channel, SubscribeOptions{QoS: QoSAtLeastOnce})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return client
+	}
+	publish := func(body string) []string {
+		ids := []string{}
+		for _, channel := range channels {
+			id, _, err := server.Broadcaster.PublishWithID(channel, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	client := subscribe("")
+	clientID := client.ClientID()
+	client.Disconnect()
+
+	// Gone before publishing, or it would get the messages live and they
+	// would expire in its outbox
+	for i := 0; i < 500; i++ {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.LocalSubscriptions) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	old := publish("Old")
+	clock.Advance(time.Minute)
+	publish("New")
+
+	client = subscribe(clientID)
+	defer client.Disconnect()
+
+	expected := []string{ExpiredMessage + " notified " + old[0], MessageMessage + " notified New", MessageMessage + " quiet New"}
+	for _, e := range expected {
+		select {
+		case m := <-client.Messages:
+			got := m.Type() + " " + m.Channel() + " "
+			if m.Type() == ExpiredMessage {
+				got += m["id"].(string)
+			} else {
+				got += m["body"].(string)
+			}
+			if got != e {
+				t.Errorf("Expected %s, got %s", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s", e)
+		}
+	}
+
+	for i, channel := range channels {
+		select {
+		case e := <-expired:
+			if e != channel+" "+old[i] {
+				t.Errorf("Unexpected expired message: %s", e)
+			}
+		default:
+			t.Errorf("Expected the message on %s to expire", channel)
+		}
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ExpiredMessages != 2 {
+		t.Errorf("Expected 2 expired messages, got %d", stats.ExpiredMessages)
+	}
+}
+
+func TestMessageDeadline(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		timing     messageTiming
+		channelTTL time.Duration
+		expected   time.Time
+	}{
+		{messageTiming{Published: now.Add(-time.Second)}, 0, time.Time{}},
+		{messageTiming{Published: now.Add(-time.Second)}, time.Minute, now.Add(59 * time.Second)},
+		{messageTiming{Published: now.Add(-time.Second), TTL: 5 * time.Second}, time.Minute, now.Add(4 * time.Second)},
+		{messageTiming{TTL: 5 * time.Second}, 0, now.Add(5 * time.Second)},
+
+		// Skewed clocks: within the margin the publish time is kept,
+		// beyond it the age counts from the arrival.
+		{messageTiming{Published: now.Add(maxClockSkew), TTL: time.Second}, 0, now.Add(maxClockSkew + time.Second)},
+		{messageTiming{Published: now.Add(time.Hour), TTL: time.Second}, 0, now.Add(time.Second)},
+	} {
+		if got := c.timing.deadline(c.channelTTL, now); !got.Equal(c.expected) {
+			t.Errorf("%+v with %s: expected %s, got %s", c.timing, c.channelTTL, c.expected, got)
+		}
+	}
+}
+
+// A client that stopped reading while its buffer ages out: once it reads
+// again, it gets only what's still fresh.
+func TestExpiredWedgedReader(t *testing.T) {
+	clock := newFakeClock()
+	server, err := startServer(&Server{clock: clock}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Doesn't read its Messages, what doesn't fit stays in the outbox
+	client, err := server.Broadcaster.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handedOver := watchHandover(t, server)
+
+	const published = 50
+	stale := PublishOptions{TTL: 200 * time.Millisecond}
+	for i := 0; i < published; i++ {
+		_, _, err := server.Broadcaster.PublishWith(context.Background(), "cursors", fmt.Sprintf("Position %d", i), stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handedOver()
+	clock.Advance(500 * time.Millisecond)
+	_, _, err = server.Broadcaster.PublishWith(context.Background(), "cursors", "Fresh", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the client took before it stopped reading still arrives
+	received := 0
+	for {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != "Fresh" {
+				received++
+				continue
+			}
+			if _, ok := m.ExpiresAt(); !ok {
+				t.Errorf("Expected the deadline to be sent along, got %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the fresh message")
+		}
+		break
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := stats.ChannelExpiredMessages["cursors"]
+	if expired == 0 || received+int(expired) != published {
+		t.Errorf("Expected %d messages received or expired, got %d and %d", published, received, expired)
+	}
+	if stats.ExpiredMessages != expired {
+		t.Errorf("Expected %d expired messages in total, got %d", expired, stats.ExpiredMessages)
+	}
+}
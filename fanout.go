@@ -0,0 +1,138 @@
+package broadcaster
+
+import "sync"
+
+// Delivers broadcast messages in slices of connections, taking turns between
+// channels. A channel with many subscribers doesn't hold up the others, while
+// the messages of a channel are still delivered in order.
+//
+// Slices are delivered one at a time by Run, which is what keeps each
+// connection's messages in order. Spreading them over several goroutines
+// would mean routing all deliveries to a connection through the same one.
+type fanoutScheduler struct {
+	hub       *hub
+	sliceSize int
+
+	// Pending fan-outs per channel, the head is the one in progress. It
+	// stays queued until its last slice is delivered.
+	queues map[string][]*fanout
+
+	// Channels waiting for their turn.
+	ready []string
+
+	stopped bool
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+type fanout struct {
+	channel string
+	message ClientMessage
+	conns   []connection
+}
+
+func newFanoutScheduler(h *hub, sliceSize int) *fanoutScheduler {
+	f := &fanoutScheduler{
+		hub:       h,
+		sliceSize: sliceSize,
+		queues:    make(map[string][]*fanout),
+	}
+	f.cond = sync.NewCond(f)
+	return f
+}
+
+// Whether nothing is pending for a channel, in which case a small fan-out can
+// be delivered right away without breaking the order.
+func (f *fanoutScheduler) Idle(channel string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.queues[channel]) == 0
+}
+
+// Number of messages still being fanned out, per channel.
+func (f *fanoutScheduler) Pending() map[string]int {
+	f.Lock()
+	defer f.Unlock()
+
+	result := make(map[string]int, len(f.queues))
+	for channel, queue := range f.queues {
+		result[channel] = len(queue)
+	}
+	return result
+}
+
+func (f *fanoutScheduler) Add(channel string, m ClientMessage, conns []connection) {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.queues[channel]) == 0 {
+		f.ready = append(f.ready, channel)
+	}
+	f.queues[channel] = append(f.queues[channel], &fanout{
+		channel: channel,
+		message: m,
+		conns:   conns,
+	})
+	f.cond.Signal()
+}
+
+func (f *fanoutScheduler) Run() {
+	for {
+		job, slice, ok := f.next()
+		if !ok {
+			return
+		}
+
+		f.hub.deliver(job.channel, job.message, slice)
+		f.finish(job)
+	}
+}
+
+func (f *fanoutScheduler) Stop() {
+	f.Lock()
+	f.stopped = true
+	f.cond.Broadcast()
+	f.Unlock()
+}
+
+// Takes the next slice, from the channel whose turn it is.
+func (f *fanoutScheduler) next() (*fanout, []connection, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	for len(f.ready) == 0 && !f.stopped {
+		f.cond.Wait()
+	}
+	if f.stopped {
+		return nil, nil, false
+	}
+
+	channel := f.ready[0]
+	f.ready = f.ready[1:]
+
+	job := f.queues[channel][0]
+	n := f.sliceSize
+	if n > len(job.conns) {
+		n = len(job.conns)
+	}
+	slice := job.conns[:n]
+	job.conns = job.conns[n:]
+	return job, slice, true
+}
+
+// Puts the channel at the back of the line if there's more to deliver.
+func (f *fanoutScheduler) finish(job *fanout) {
+	f.Lock()
+	defer f.Unlock()
+
+	queue := f.queues[job.channel]
+	if len(job.conns) == 0 {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(f.queues, job.channel)
+		return
+	}
+	f.queues[job.channel] = queue
+	f.ready = append(f.ready, job.channel)
+}
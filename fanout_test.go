@@ -0,0 +1,240 @@
+package broadcaster
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Takes a while to deliver to, records the order of the messages.
+type slowConnection struct {
+	testConnection
+	delay time.Duration
+	seen  []int
+}
+
+func (c *slowConnection) Send(m ClientMessage) {
+	start := time.Now()
+	for time.Since(start) < c.delay {
+		runtime.Gosched() // Also on a single CPU
+	}
+	n, _ := strconv.Atoi(m["body"].(string))
+	c.seen = append(c.seen, n)
+}
+
+// Records when messages arrive.
+type timedConnection struct {
+	testConnection
+	received chan time.Time
+}
+
+func (c *timedConnection) Send(m ClientMessage) {
+	c.received <- time.Now()
+}
+
+func addSubscriber(h *hub, conn connection, channel string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.channels[channel] == nil {
+		h.channels[channel] = make(map[connection]bool)
+	}
+	h.subscriptions[conn] = map[string]subscriptionOptions{channel: {Echo: true}}
+	h.channels[channel][conn] = true
+}
+
+func TestFanoutFairness(t *testing.T) {
+	hub := &hub{
+		redis:     hubTestBackend,
+		sliceSize: 100,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+	defer hub.Stop()
+
+	// Messages arrive through Redis, like they would in production.
+	for _, channel := range []string{"large", "small"} {
+		conn := &testConnection{Messages: make(chan string, 100)}
+		err := hub.Connect(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = hub.Subscribe(conn, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each fan-out on the large channel takes about 100ms.
+	large := make([]*slowConnection, 5000)
+	for i := range large {
+		large[i] = &slowConnection{delay: 20 * time.Microsecond}
+		addSubscriber(hub, large[i], "large")
+	}
+
+	small := &timedConnection{received: make(chan time.Time, 100)}
+	addSubscriber(hub, small, "small")
+
+	publish := func(channel string, body int) {
+		err := hubTestRedis.sendMessage(channel, fmt.Sprint(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		publish("large", i)
+	}
+
+	latencies := []time.Duration{}
+	for i := 0; i < 50; i++ {
+		sent := time.Now()
+		publish("small", i)
+		latencies = append(latencies, (<-small.received).Sub(sent))
+		time.Sleep(5 * time.Millisecond)
+	}
+	sort.Sort(durations(latencies))
+
+	p99 := latencies[len(latencies)*99/100]
+	if p99 > 25*time.Millisecond {
+		t.Errorf("Small channel waited too long, p99 latency: %s", p99)
+	}
+
+	// The large channel still gets everything, in order.
+	deadline := time.After(10 * time.Second)
+	for !hub.fanout.Idle("large") {
+		select {
+		case <-deadline:
+			t.Fatal("Fan-out didn't finish")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	hub.Lock()
+	defer hub.Unlock()
+	for _, conn := range large {
+		if fmt.Sprint(conn.seen) != "[0 1 2 3 4]" {
+			t.Fatalf("Unexpected messages: %v", conn.seen)
+		}
+	}
+}
+
+func TestFanoutUnsubscribed(t *testing.T) {
+	hub := &hub{
+		redis:     hubTestBackend,
+		sliceSize: 1,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := []*testConnection{}
+	for i := 0; i < 3; i++ {
+		conn := &testConnection{Messages: make(chan string, 1)}
+		addSubscriber(hub, conn, testChannel)
+		conns = append(conns, conn)
+	}
+
+	// Nothing is delivered until the scheduler runs.
+	hub.handleMessage(redis.Message{Channel: testChannel, Data: []byte("1")})
+
+	hub.Lock()
+	delete(hub.channels[testChannel], conns[1])
+	hub.Unlock()
+
+	go hub.Run()
+	defer hub.Stop()
+
+	for i, conn := range conns {
+		select {
+		case <-conn.Messages:
+			if i == 1 {
+				t.Error("Unsubscribed connection received a message")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if i != 1 {
+				t.Errorf("Connection %d didn't receive the message", i)
+			}
+		}
+	}
+}
+
+func TestFanoutOrdering(t *testing.T) {
+	hub := &hub{
+		redis:     hubTestBackend,
+		sliceSize: 7,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+	defer hub.Stop()
+
+	const n = 200
+	conn := &testConnection{Messages: make(chan string, n)}
+	err = hub.Connect(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hub.Subscribe(conn, "ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Many small slices per message, queued up behind each other.
+	conns := make([]*slowConnection, 100)
+	for i := range conns {
+		conns[i] = &slowConnection{}
+		addSubscriber(hub, conns[i], "ordered")
+	}
+
+	for i := 0; i < n; i++ {
+		err := hubTestRedis.sendMessage("ordered", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.After(10 * time.Second)
+	for {
+		hub.Lock()
+		done := len(conns[len(conns)-1].seen) == n && hub.fanout.Idle("ordered")
+		hub.Unlock()
+		if done {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Fan-out didn't finish")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	hub.Lock()
+	defer hub.Unlock()
+	for i, conn := range conns {
+		if len(conn.seen) != n {
+			t.Fatalf("Connection %d received %d messages", i, len(conn.seen))
+		}
+		for j, body := range conn.seen {
+			if body != j {
+				t.Fatalf("Connection %d received %d as message %d", i, body, j)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Fault injection, for testing how the transports cope with bad network
+// conditions: see Server.Faults and Client.Faults. Faults only happen in
+// builds with the "faults" tag (go test -tags faults). In normal builds
+// Faults is empty, its methods do nothing and the checks compile away.
+//
+// Where each fault applies:
+//
+//   - DropNextWrite, DropWrites, DelayWrites and CloseNextWrite: frames
+//     written over WebSocket connections, by the server or the client
+//   - DelayReads: frames read from WebSocket connections by the server or
+//     the client, and long-poll responses read by the client
+//   - TruncateNextPoll and FailNextPolls: long-poll responses of the server
+
+// What to do with a frame that's about to be written.
+type faultAction int
+
+const (
+	faultNone faultAction = iota
+
+	// The frame is lost
+	faultDrop
+
+	// The connection is closed halfway through the frame
+	faultClose
+)
+
+// Writes the start of a frame, then closes the connection underneath: the
+// other side reads a frame that's cut off.
+func closeMidFrame(conn *websocket.Conn) {
+	// Final text frame of 5 bytes, of which only 1 arrives
+	conn.UnderlyingConn().Write([]byte{0x81, 0x05, '['})
+	conn.UnderlyingConn().Close()
+}
+
+// Like longpollReply, but only writes the first half of the body.
+func (s *Server) longpollReplyTruncated(w http.ResponseWriter, m ...ClientMessage) error {
+	if m == nil {
+		m = []ClientMessage{}
+	}
+	buf := &bytes.Buffer{}
+	err := json.NewEncoder(buf).Encode(s.EnvelopeFields.encodeAll(m))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes()[:buf.Len()/2])
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build !faults
+// +build !faults
+
+package broadcaster
+
+import "time"
+
+// Injects faults into the transports, for testing. Without the "faults"
+// build tag, this does nothing. See the notes on fault injection in
+// faults.go.
+type Faults struct{}
+
+func (f *Faults) DropNextWrite()                  {}
+func (f *Faults) DropWrites(probability float64)  {}
+func (f *Faults) DelayWrites(d time.Duration)     {}
+func (f *Faults) DelayReads(d time.Duration)      {}
+func (f *Faults) CloseNextWrite()                 {}
+func (f *Faults) TruncateNextPoll()               {}
+func (f *Faults) FailNextPolls(n int, status int) {}
+func (f *Faults) Reset()                          {}
+func (f *Faults) write() faultAction              { return faultNone }
+func (f *Faults) read()                           {}
+func (f *Faults) pollStatus() int                 { return 0 }
+func (f *Faults) truncatePoll() bool              { return false }
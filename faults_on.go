@@ -0,0 +1,144 @@
+//go:build faults
+// +build faults
+
+package broadcaster
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Injects faults into the transports, for testing. See the notes on fault
+// injection in faults.go. The zero value injects none, methods may be
+// called at any time.
+type Faults struct {
+	dropNext     bool
+	dropRate     float64
+	closeNext    bool
+	writeDelay   time.Duration
+	readDelay    time.Duration
+	truncateNext bool
+	failPolls    int
+	failStatus   int
+
+	sync.Mutex
+}
+
+// Loses the next frame written.
+func (f *Faults) DropNextWrite() {
+	f.Lock()
+	defer f.Unlock()
+	f.dropNext = true
+}
+
+// Loses each frame written with the given probability, from 0 to 1.
+func (f *Faults) DropWrites(probability float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.dropRate = probability
+}
+
+// Waits before writing each frame.
+func (f *Faults) DelayWrites(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.writeDelay = d
+}
+
+// Waits before reading each frame or long-poll response.
+func (f *Faults) DelayReads(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.readDelay = d
+}
+
+// Closes the connection halfway through writing the next frame.
+func (f *Faults) CloseNextWrite() {
+	f.Lock()
+	defer f.Unlock()
+	f.closeNext = true
+}
+
+// Cuts off the body of the next long-poll response halfway.
+func (f *Faults) TruncateNextPoll() {
+	f.Lock()
+	defer f.Unlock()
+	f.truncateNext = true
+}
+
+// Answers the next n polls with the given HTTP status, e.g. 503.
+func (f *Faults) FailNextPolls(n int, status int) {
+	f.Lock()
+	defer f.Unlock()
+	f.failPolls = n
+	f.failStatus = status
+}
+
+// Stops injecting faults.
+func (f *Faults) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.dropNext = false
+	f.dropRate = 0
+	f.closeNext = false
+	f.writeDelay = 0
+	f.readDelay = 0
+	f.truncateNext = false
+	f.failPolls = 0
+}
+
+// Called before writing a frame, which may be delayed first.
+func (f *Faults) write() faultAction {
+	f.Lock()
+	delay := f.writeDelay
+	action := faultNone
+	if f.closeNext {
+		f.closeNext = false
+		action = faultClose
+	} else if f.dropNext {
+		f.dropNext = false
+		action = faultDrop
+	} else if f.dropRate > 0 && rand.Float64() < f.dropRate {
+		action = faultDrop
+	}
+	f.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return action
+}
+
+// Called before reading a frame or a long-poll response.
+func (f *Faults) read() {
+	f.Lock()
+	delay := f.readDelay
+	f.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Status to fail a poll with, zero to handle it.
+func (f *Faults) pollStatus() int {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.failPolls == 0 {
+		return 0
+	}
+	f.failPolls--
+	return f.failStatus
+}
+
+// Whether to cut off the response to a poll.
+func (f *Faults) truncatePoll() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	truncate := f.truncateNext
+	f.truncateNext = false
+	return truncate
+}
@@ -0,0 +1,231 @@
+//go:build faults
+// +build faults
+
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Publishes until the client receives a message again, e.g. once it
+// reconnected and subscribed again.
+func publishUntilReceived(t *testing.T, server *testServer, client *Client, channel string) {
+	deadline := time.After(10 * time.Second)
+	for {
+		err := server.Broadcaster.Publish(channel, "Again")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-client.Messages:
+			if m["body"] == "Again" {
+				return
+			}
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected to receive messages again")
+		}
+	}
+}
+
+func TestFaultsReconnect(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := client.ConnectionID()
+
+	// Cut off while writing
+	server.Broadcaster.Faults.CloseNextWrite()
+	err = server.Broadcaster.Publish("test", "Lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishUntilReceived(t, server, client, "test")
+	if client.ConnectionID() == first {
+		t.Error("Expected the client to reconnect")
+	}
+}
+
+func TestFaultsReplay(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Never acknowledged, delivered again after reconnecting
+	server.Broadcaster.Faults.CloseNextWrite()
+	err = server.Broadcaster.Publish("test", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "one" {
+			t.Fatalf("Expected the message to be replayed, got %v", m)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the message to be replayed")
+	}
+
+	err = server.Broadcaster.Publish("test", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "two" {
+			t.Errorf("Expected live messages after the replay, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected live messages after the replay")
+	}
+}
+
+func TestFaultsSlowConsumer(t *testing.T) {
+	server, err := startServer(&Server{
+		MaxBufferedBytes: 4096,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Can't keep up, the buffer fills up
+	server.Broadcaster.Faults.DelayWrites(20 * time.Millisecond)
+	body := strings.Repeat("x", 500)
+	for i := 0; i < 50; i++ {
+		err := server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Broadcaster.Faults.Reset()
+
+	// Cut off or shed to stay within the limit, the client catches up
+	publishUntilReceived(t, server, client, "test")
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BufferDroppedMessages == 0 && stats.ShedConnections == 0 {
+		t.Error("Expected messages to be dropped or the connection to be shed")
+	}
+	if stats.BufferedBytesHighWater > 4096 {
+		t.Errorf("Buffered more than the limit: %d", stats.BufferedBytesHighWater)
+	}
+}
+
+func TestFaultsClientWrites(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	client.Timeout = 500 * time.Millisecond
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lost on the way, the publish times out
+	client.Faults.DropNextWrite()
+	_, err = client.Publish("test", "Lost")
+	if err == nil {
+		t.Fatal("Expected the publish to time out")
+	}
+
+	// Slow reads still get everything
+	client.Faults.DelayReads(50 * time.Millisecond)
+	for _, body := range []string{"one", "two"} {
+		err := server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range []string{"one", "two"} {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != body {
+				t.Errorf("Expected %s, got %v", body, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s", body)
+		}
+	}
+}
+
+func TestFaultsLongpoll(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newLPClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client reconnects after a failed poll
+	server.Broadcaster.Faults.FailNextPolls(1, 503)
+	publishUntilReceived(t, server, client, "test")
+
+	// A cut off response loses its messages, but not the session
+	server.Broadcaster.Faults.TruncateNextPoll()
+	publishUntilReceived(t, server, client, "test")
+}
@@ -0,0 +1,50 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	server, err := startServer(&Server{
+		SubscriptionFilter: func(data map[string]interface{}, channel string) func(m ClientMessage) bool {
+			return func(m ClientMessage) bool {
+				body, _ := m["body"].(string)
+				return !strings.HasPrefix(body, "skip")
+			}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	subscribe := func(clientID string) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			c.clientID = clientID
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SubscribeWith("test", SubscribeOptions{QoS: QoSAtLeastOnce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	// Live
+	client := subscribe("")
+	clientID := client.ClientID()
+	publishBodies(t, server, "test", "one", "skip two", "three")
+	receiveBodies(t, client, "one", "three")
+	waitAcked(t, server, client, "test")
+	client.Disconnect()
+
+	// Replayed, filtered the same way
+	publishBodies(t, server, "test", "four", "skip five", "six")
+	client = subscribe(clientID)
+	defer client.Disconnect()
+	publishBodies(t, server, "test", "skip seven", "eight")
+	receiveBodies(t, client, "four", "six", "eight")
+}
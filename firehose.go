@@ -0,0 +1,101 @@
+package broadcaster
+
+// Tracks the connections over Server.FirehoseThreshold, and switches the
+// backend to the firehose while there are any. Must hold the lock.
+func (h *hub) updateFirehose(conn connection) {
+	if h.firehoseThreshold == 0 {
+		return
+	}
+
+	was := len(h.firehose) > 0
+	switch n := len(h.subscriptions[conn]); {
+	case n > h.firehoseThreshold:
+		h.firehose[conn] = true
+	case n <= h.firehoseThreshold/2:
+		delete(h.firehose, conn)
+	}
+
+	on := len(h.firehose) > 0
+	if on == was {
+		return
+	}
+	err := h.redis.SetFirehose(on)
+	if err != nil {
+		h.redis.logf("Redis error switching the firehose: %s", err)
+	}
+}
+
+// Pattern of the pub/sub channels of this instance, see pubSubChannel.
+func (b *redisBackend) firehosePattern() string {
+	if b.name == "" {
+		return "*"
+	}
+	return globEscaper.Replace(b.name) + ":*"
+}
+
+// Replaces the subscriptions to each channel with one to the pattern of all
+// channels, or back. Redis handles the requests in order, so the channels
+// are covered throughout: what arrives twice in between is dropped by the
+// listening goroutine, see receive. Durable channels are still read from
+// their streams.
+func (b *redisBackend) SetFirehose(on bool) error {
+	for !b.listening {
+		b.controlWait.Wait()
+	}
+	b.subscriptionsLock.Lock()
+	defer b.subscriptionsLock.Unlock()
+
+	if b.firehose == on {
+		return nil
+	}
+	b.firehose = on
+
+	channels := make([]string, 0, len(b.subscriptions))
+	for channel, _ := range b.subscriptions {
+		channels = append(channels, b.pubSubChannel(channel))
+	}
+
+	if on {
+		b.firehoseConfirmed = make(chan struct{})
+		b.firehosePending++
+		err := b.pubSub.PSubscribe(b.firehosePattern())
+		if err != nil || len(channels) == 0 {
+			return err
+		}
+		return b.pubSub.Unsubscribe(channels...)
+	}
+
+	if len(channels) > 0 {
+		for channel, _ := range b.subscriptions {
+			b.pending[channel]++
+		}
+		err := b.pubSub.Subscribe(channels...)
+		if err != nil {
+			return err
+		}
+	}
+	return b.pubSub.PUnsubscribe(b.firehosePattern())
+}
+
+// Like confirm, for the pattern: confirms the channels subscribed to since
+// the firehose was switched on.
+func (b *redisBackend) confirmFirehose() {
+	b.subscriptionsLock.Lock()
+	defer b.subscriptionsLock.Unlock()
+
+	if b.firehosePending > 1 {
+		b.firehosePending--
+		return
+	}
+	b.firehosePending = 0
+
+	c := b.firehoseConfirmed
+	if c == nil {
+		return
+	}
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
@@ -0,0 +1,122 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFirehose(t *testing.T) {
+	server, err := startServer(&Server{
+		FirehoseThreshold: 4,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	other, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+	err = other.Subscribe("ch1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFirehose := func(on bool) {
+		t.Helper()
+		if s.current().redis.State().Firehose != on {
+			t.Errorf("Expected firehose %v", on)
+		}
+	}
+	// Publishes on each channel, and on one nobody subscribed to
+	publish := func(channels ...string) {
+		t.Helper()
+		for _, channel := range append([]string{"unknown"}, channels...) {
+			err := server.sendMessage(channel, "hello "+channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Each message exactly once, none of the channels not subscribed to
+	expectMessages := func(c *Client, channels ...string) {
+		t.Helper()
+		for _, channel := range channels {
+			select {
+			case m := <-c.Messages:
+				if m.Type() != MessageMessage || m.Channel() != channel {
+					t.Errorf("Expected a message on %s, got %v", channel, m)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected a message on %s", channel)
+			}
+		}
+		select {
+		case m := <-c.Messages:
+			t.Errorf("Unexpected message %v", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		err = client.Subscribe(fmt.Sprintf("ch%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectFirehose(false)
+
+	err = client.Subscribe("ch5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFirehose(true)
+	publish("ch1", "ch2", "ch3", "ch4", "ch5")
+	expectMessages(client, "ch1", "ch2", "ch3", "ch4", "ch5")
+	expectMessages(other, "ch1")
+
+	// Subscribing meanwhile, and unsubscribing down to half the threshold
+	err = client.Subscribe("ch6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		err = client.Unsubscribe(fmt.Sprintf("ch%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectFirehose(false)
+	publish("ch1", "ch5", "ch6")
+	expectMessages(client, "ch5", "ch6")
+	expectMessages(other, "ch1")
+
+	// Disconnecting switches it off too
+	err = client.Subscribe("ch7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		err = other.Subscribe(fmt.Sprintf("ch%d", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectFirehose(true)
+	other.Disconnect()
+	for i := 0; i < 500 && s.current().redis.State().Firehose; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectFirehose(false)
+	publish("ch1", "ch5", "ch6", "ch7")
+	expectMessages(client, "ch5", "ch6", "ch7")
+}
@@ -0,0 +1,90 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func newUnsubscribedMessage(channel, reason string) ClientMessage {
+	return ClientMessage{
+		typeField: UnsubscribedMessage,
+		"channel": channel,
+		"reason":  reason,
+	}
+}
+
+// Ends the subscription of a connection to a channel, on whichever node it
+// lives, e.g. when the channel was deleted. Unlike Kick, the connection
+// stays open. The client receives an UnsubscribedMessage with the reason
+// and doesn't resubscribe on its own.
+//
+// A long-poll session that isn't polling right now is unsubscribed by its
+// next poll, as long as that's within Timeout.
+func (s *Server) ForceUnsubscribe(id, channel, reason string) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	return st.redis.ForceUnsubscribe(id, channel, reason)
+}
+
+// Ends the subscriptions ForceUnsubscribe asked for, if any are left: the
+// connection may be in the hub twice, the first one takes them.
+func (s *Server) endForcedSubscriptions(c revocableConnection) error {
+	st := s.current()
+	channels, err := st.redis.TakeForcedUnsubscribes(c.GetID())
+	if err != nil {
+		return err
+	}
+	for channel, reason := range channels {
+		s.forgetSubscribeAccess(c.authData(), channel)
+		c.revokeSubscription(channel, newUnsubscribedMessage(channel, reason))
+		c.audit(AuditSubscriptionRevoked, channel, AuditReasonForced)
+	}
+	return nil
+}
+
+// Runs endForcedSubscriptions in the background, for connections told by
+// the hub: it holds its lock meanwhile.
+func (s *Server) processForcedUnsubscribes(c revocableConnection) {
+	go func() {
+		err := s.endForcedSubscriptions(c)
+		if err != nil {
+			s.logf("Connection %s: failed to unsubscribe: %s", c.GetID(), err)
+		}
+	}()
+}
+
+func (b *redisBackend) ForceUnsubscribe(id, channel, reason string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	// Kept for a long-poll session that isn't polling right now, see
+	// TakeForcedUnsubscribes.
+	key := b.key("unsubscribe-id:%s", id)
+	conn.Send("MULTI")
+	conn.Send("HSET", key, channel, reason)
+	conn.Send("EXPIRE", key, b.timeout)
+	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("unsubscribe-id %s", id))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Returns the channels the connection was unsubscribed from, with the
+// reasons, and forgets them.
+func (b *redisBackend) TakeForcedUnsubscribes(id string) (map[string]string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("unsubscribe-id:%s", id)
+	conn.Send("MULTI")
+	conn.Send("HGETALL", key)
+	conn.Send("DEL", key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	return redis.StringMap(values[0], nil)
+}
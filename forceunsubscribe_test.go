@@ -0,0 +1,107 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForceUnsubscribe(t *testing.T) {
+	c := startCluster(t, 2, nil)
+
+	local, err := c.Server(1).LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Disconnect()
+	clients := []*Client{
+		c.Connect(1, ClientModeWebsocket),
+		c.Connect(1, ClientModeLongPoll),
+		local,
+	}
+	for _, client := range clients {
+		for _, channel := range []string{"news", "lobby"} {
+			err := client.Subscribe(channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	c.SettleSubscriptions("news", 3)
+
+	// Asked on one node, ended on the other
+	for _, client := range clients {
+		err := c.Server(0).ForceUnsubscribe(client.ConnectionID(), "news", "Channel deleted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-client.Messages:
+			if m.Type() != UnsubscribedMessage || m.Channel() != "news" || m["reason"] != "Channel deleted" {
+				t.Fatalf("Expected news to be unsubscribed, got %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected news to be unsubscribed, got nothing")
+		}
+	}
+	c.SettleSubscriptions("news", 0)
+
+	err = c.Server(0).Publish("news", "Gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Server(0).Publish("lobby", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range clients {
+		c.Expect(client, "message Hello")
+	}
+
+	// The connection stays, and doesn't subscribe again when reconnecting
+	ws := clients[0]
+	id := ws.ConnectionID()
+	ws.transport.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for ws.ConnectionID() == id {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+wait:
+	for {
+		err := c.Server(0).Publish("lobby", "ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-ws.Messages:
+			if m.Channel() == "lobby" {
+				break wait
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected lobby to be subscribed again")
+		}
+	}
+	for _, channel := range []string{"news", "lobby"} {
+		err := c.Server(0).Publish(channel, "done")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		select {
+		case m := <-ws.Messages:
+			if m.Channel() == "news" {
+				t.Fatalf("Unexpected message: %v", m)
+			}
+			if m["body"] == "done" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the message on lobby")
+		}
+	}
+}
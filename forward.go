@@ -0,0 +1,251 @@
+package broadcaster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eapache/go-resiliency/retrier"
+)
+
+// Header of forwarded requests holding the signature of the body, see
+// Forward.Secret.
+const ForwardSignatureHeader = "X-Broadcaster-Signature"
+
+const (
+	// How long a single forwarding request may take
+	forwardTimeout = 10 * time.Second
+
+	// Wait before the first retry of a forward, doubled for each one after
+	// it up to forwardMaxBackoff
+	forwardBackoff    = 100 * time.Millisecond
+	forwardMaxBackoff = 10 * time.Second
+)
+
+// Forwards the messages published on some channels to a URL, see
+// Server.Forwards.
+type Forward struct {
+	// Channels to forward, a pattern as for Client.OnMessage: channel names
+	// are split into segments on dots, "*" matches a single segment and a
+	// trailing "**" one or more.
+	Channel string
+
+	// Receives a POST request per message, with the ForwardedMessage as
+	// JSON. Any status other than 2xx counts as a failure.
+	URL string
+
+	// Signs the requests, optional. The ForwardSignatureHeader then holds
+	// "sha256=" followed by the hex HMAC-SHA256 of the request body.
+	Secret []byte
+
+	// Requests of this forward in flight at once, defaults to 4. The
+	// messages of a channel are still sent one at a time.
+	MaxConcurrency int
+}
+
+// A message as it's forwarded, see Forward.
+//
+// The JSON encoding of this type is stable: fields may be added, but existing
+// ones won't be renamed or removed.
+type ForwardedMessage struct {
+	Channel string `json:"channel"`
+	ID      string `json:"id"`
+	Seq     int64  `json:"seq"`
+	Body    string `json:"body"`
+
+	// See PublishOptions.Headers
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type forwardTarget struct {
+	Forward
+	pattern []string
+
+	// Taken for each request in flight
+	slots chan struct{}
+}
+
+type forwardJob struct {
+	target  *forwardTarget
+	message ForwardedMessage
+}
+
+// Sends published messages to the forwards in the background, publishing
+// never waits for it. Each message is retried with backoff until it's
+// accepted or the retries run out. The messages of a channel are sent to a
+// URL one at a time, in the order they were published: each channel and URL
+// pair has a lane, drained by a goroutine while it holds messages. Up to
+// size messages are queued (or being sent) across all lanes, past that new
+// ones are dropped and counted.
+type forwarder struct {
+	targets  []*forwardTarget
+	size     int
+	retries  int
+	client   *http.Client
+	onFailed func(f Forward, m ForwardedMessage, err error)
+	logf     func(format string, args ...interface{})
+
+	// Accessed atomically
+	dropped uint64
+	failed  uint64
+
+	queued int
+	lanes  map[string][]forwardJob
+
+	sync.Mutex
+}
+
+func newForwarder(forwards []Forward, size, retries int, onFailed func(f Forward, m ForwardedMessage, err error), logf func(format string, args ...interface{})) (*forwarder, error) {
+	f := &forwarder{
+		size:     size,
+		retries:  retries,
+		client:   &http.Client{Timeout: forwardTimeout},
+		onFailed: onFailed,
+		logf:     logf,
+		lanes:    make(map[string][]forwardJob),
+	}
+	for _, fw := range forwards {
+		if fw.URL == "" {
+			return nil, fmt.Errorf("Forward of %s has no URL", fw.Channel)
+		}
+		if fw.MaxConcurrency <= 0 {
+			fw.MaxConcurrency = 4
+		}
+		f.targets = append(f.targets, &forwardTarget{
+			Forward: fw,
+			pattern: strings.Split(fw.Channel, "."),
+			slots:   make(chan struct{}, fw.MaxConcurrency),
+		})
+	}
+	return f, nil
+}
+
+// Queues a published message for the forwards of its channel.
+func (f *forwarder) Enqueue(m ForwardedMessage) {
+	segments := strings.Split(m.Channel, ".")
+	for _, t := range f.targets {
+		if matchPattern(t.pattern, segments) {
+			f.add(forwardJob{target: t, message: m})
+		}
+	}
+}
+
+func (f *forwarder) add(j forwardJob) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.queued >= f.size {
+		atomic.AddUint64(&f.dropped, 1)
+		return
+	}
+	f.queued++
+
+	key := j.target.URL + " " + j.message.Channel
+	jobs, busy := f.lanes[key]
+	f.lanes[key] = append(jobs, j)
+	if !busy {
+		go f.drain(key)
+	}
+}
+
+// Sends the messages of a lane in order, until it's empty.
+func (f *forwarder) drain(key string) {
+	for {
+		f.Lock()
+		jobs := f.lanes[key]
+		if len(jobs) == 0 {
+			delete(f.lanes, key)
+			f.Unlock()
+			return
+		}
+		j := jobs[0]
+		f.lanes[key] = jobs[1:]
+		f.Unlock()
+
+		err := f.deliver(j)
+		if err != nil {
+			atomic.AddUint64(&f.failed, 1)
+			if f.onFailed != nil {
+				runCallback(f.logf, "OnForwardFailed", func() {
+					f.onFailed(j.target.Forward, j.message, err)
+				})
+			}
+		}
+
+		f.Lock()
+		f.queued--
+		f.Unlock()
+	}
+}
+
+func (f *forwarder) deliver(j forwardJob) error {
+	body, err := json.Marshal(j.message)
+	if err != nil {
+		return err
+	}
+
+	waits := limitWait(retrier.ExponentialBackoff(f.retries, forwardBackoff), forwardMaxBackoff)
+	return retrier.New(waits, nil).Run(func() error {
+		return f.post(j.target, body)
+	})
+}
+
+func (f *forwarder) post(t *forwardTarget, body []byte) error {
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+
+	req, err := http.NewRequest("POST", t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(t.Secret) > 0 {
+		req.Header.Set(ForwardSignatureHeader, "sha256="+signForward(t.Secret, body))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("Forward refused: " + resp.Status)
+	}
+	return nil
+}
+
+func (f *forwarder) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+func (f *forwarder) Failed() uint64 {
+	return atomic.LoadUint64(&f.failed)
+}
+
+// Hex HMAC-SHA256 of a forwarded request body.
+func signForward(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queues a published message for forwarding, if there are forwards.
+func (s *Server) forward(m ForwardedMessage) {
+	if s.forwarder == nil {
+		return
+	}
+	s.forwarder.Enqueue(m)
+}
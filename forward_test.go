@@ -0,0 +1,176 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	secret := []byte("secret")
+
+	var lock sync.Mutex
+	received := map[string][]string{}
+	attempts := map[string]int{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(ForwardSignatureHeader) != "sha256="+signForward(secret, body) {
+			t.Errorf("Invalid signature: %s", r.Header.Get(ForwardSignatureHeader))
+		}
+		m := ForwardedMessage{}
+		err := json.Unmarshal(body, &m)
+		if err != nil {
+			t.Error(err)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		// The first message of each channel fails twice
+		attempts[m.ID]++
+		if m.Body == "1" && attempts[m.ID] <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received[m.Channel] = append(received[m.Channel], m.Body)
+	}))
+	defer receiver.Close()
+
+	server, err := startServer(&Server{
+		Forwards: []Forward{
+			{Channel: "orders.*", URL: receiver.URL, Secret: secret},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	channels := []string{"orders.a", "orders.b"}
+	for i := 1; i <= 5; i++ {
+		for _, channel := range channels {
+			err := server.Broadcaster.Publish(channel, strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = server.Broadcaster.Publish("other", "Not forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		done := len(received["orders.a"]) == 5 && len(received["orders.b"]) == 5
+		lock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all messages to be forwarded, got %v", received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, channel := range channels {
+		for i, body := range received[channel] {
+			if body != strconv.Itoa(i+1) {
+				t.Errorf("Unexpected order on %s: %v", channel, received[channel])
+				break
+			}
+		}
+	}
+	if len(received) != 2 {
+		t.Errorf("Unexpected channels forwarded: %v", received)
+	}
+}
+
+func TestForwardFailed(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	failed := make(chan ForwardedMessage, 1)
+	server, err := startServer(&Server{
+		Forwards:       []Forward{{Channel: "**", URL: receiver.URL}},
+		ForwardRetries: 2,
+		OnForwardFailed: func(f Forward, m ForwardedMessage, err error) {
+			if f.URL != receiver.URL || err == nil {
+				t.Errorf("Unexpected failure: %v, %v", f, err)
+			}
+			failed <- m
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	_, seq, err := server.Broadcaster.PublishWithID("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-failed:
+		if m.Channel != "test" || m.Seq != seq || m.Body != "Test message" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the forward to fail")
+	}
+
+	lock.Lock()
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	lock.Unlock()
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ForwardsFailed != 1 {
+		t.Errorf("Expected 1 failed forward, got %d", stats.ForwardsFailed)
+	}
+}
+
+func TestForwarderQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	f, err := newForwarder([]Forward{{Channel: "test", URL: receiver.URL}}, 2, 0, nil, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		f.Enqueue(ForwardedMessage{Channel: "test", Body: strconv.Itoa(i)})
+	}
+	if n := f.Dropped(); n != 1 {
+		t.Errorf("Expected 1 dropped message, got %d", n)
+	}
+
+	_, err = newForwarder([]Forward{{Channel: "test"}}, 2, 0, nil, t.Logf)
+	if err == nil {
+		t.Error("Expected an error for a forward without URL")
+	}
+}
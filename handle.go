@@ -0,0 +1,151 @@
+package broadcaster
+
+import (
+	"errors"
+)
+
+var errChannelRefused = errors.New("Channel refused")
+
+// What handling client messages needs from a connection, implemented by
+// each transport. WebSocket and local connections keep their subscriptions
+// in the hub, long-poll sessions in Redis between polls. Errors are those of
+// the backend, the transport fails the request.
+type protocolConn interface {
+	authData() ClientMessage
+	audit(t, channel, reason string)
+
+	// Take a token from the subscribe rate limit, see
+	// Server.SubscribeRateLimit, from the ping rate limit and from that of
+	// listing members.
+	allowSubscribe() (bool, error)
+	allowPing() (bool, error)
+	allowSubscribers() (bool, error)
+
+	// Subscribes to a channel CanSubscribe allowed, returns the ID of the
+	// subscription. Fails with errAuthExpired once the auth data expired.
+	handleSubscribe(channel string, m ClientMessage) (string, error)
+
+	// Unsubscribes from a channel, the subscriptions it counts towards a
+	// quota are released after.
+	handleUnsubscribe(channel string) error
+
+	// Returns the channel of a subscription ID, false if there's none.
+	lookupSubscription(id string) (string, bool, error)
+
+	// Whether the connection is subscribed to a channel.
+	isSubscribed(channel string) (bool, error)
+
+	// Renews the TTL of a subscription, returns false if there's none.
+	handleTouch(channel string) (bool, error)
+
+	// Answers an AuthMessage on an authenticated connection, and a
+	// MigratedMessage.
+	handleAuth(m ClientMessage) (ClientMessage, error)
+	handleMigrated() (ClientMessage, error)
+
+	// The connection in the hub, for pausing and acknowledging. Nil for
+	// transports that don't support those.
+	hubConnection() connection
+}
+
+// Handles a message of an authenticated client, returns the reply if there
+// is one. Used by all transports, so that they behave the same.
+func (s *Server) handleClientMessage(c protocolConn, m ClientMessage) (ClientMessage, error) {
+	st := s.current()
+	t := m.Type()
+	if t == SubscribeMessage || t == UnsubscribeMessage {
+		ok, err := c.allowSubscribe()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return newSubscribeRateLimitedMessage(m), nil
+		}
+	}
+
+	switch t {
+	case SubscribeMessage:
+		channel := m.Channel()
+		if err := s.validateClientChannel(channel); err != nil {
+			return newInvalidChannelMessage(channel, err), nil
+		}
+		if !s.authorizeSubscribe(c.authData(), channel) {
+			c.audit(AuditSubscribeRefused, channel, AuditReasonRefused)
+			return newChannelErrorMessage(SubscribeErrorMessage, channel, errChannelRefused), nil
+		}
+
+		id, err := c.handleSubscribe(channel, m)
+		if err == errAuthExpired {
+			c.audit(AuditSubscribeRefused, channel, AuditReasonAuthExpired)
+		}
+		if err != nil {
+			return withQuotaCode(newChannelErrorMessage(SubscribeErrorMessage, channel, err), err), nil
+		}
+		reply := newSubscribeOKMessage(channel, id)
+		if m.wantsCursor() {
+			s.addCursor(reply, channel)
+		}
+		return reply, nil
+
+	case UnsubscribeMessage:
+		channel, reply, err := unsubscribeChannel(m, c.lookupSubscription)
+		if err != nil || reply != nil {
+			return reply, err
+		}
+
+		err = c.handleUnsubscribe(channel)
+		if err != nil {
+			return newChannelErrorMessage(UnsubscribeErrorMessage, channel, err), nil
+		}
+		s.releaseSubscriptions(c.authData(), channel)
+		return newUnsubscribeOKMessage(m, channel), nil
+
+	case TouchMessage:
+		channel := m.Channel()
+		ok, err := c.handleTouch(channel)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return newChannelErrorMessage(SubscribeErrorMessage, channel, errNotSubscribed), nil
+		}
+		return nil, nil
+
+	case PublishMessage:
+		return s.clientPublish(c.authData(), m), nil
+
+	case AuthMessage:
+		return c.handleAuth(m)
+
+	case PingMessage:
+		var err error
+		reply := answerPing(m, func() bool {
+			var ok bool
+			ok, err = c.allowPing()
+			return ok
+		})
+		return reply, err
+
+	case MigratedMessage:
+		return c.handleMigrated()
+
+	case SubscribersMessage:
+		return s.subscribersRequest(c, m.Channel())
+
+	case PauseMessage, ResumeMessage:
+		if conn := c.hubConnection(); conn != nil {
+			return s.pauseRequest(conn, m), nil
+		}
+
+	case AckMessage:
+		if conn := c.hubConnection(); conn != nil {
+			channel := m.Channel()
+			if st.hub.isReliable(conn, channel) {
+				s.ackPending(c.authData(), channel, m.Seq())
+			}
+			return nil, nil
+		}
+	}
+
+	return newMessage(UnknownMessage), nil
+}
@@ -0,0 +1,150 @@
+package broadcaster
+
+import (
+	"errors"
+	"testing"
+)
+
+// Records what the dispatcher asks of a connection.
+type fakeProtocolConn struct {
+	rateLimited bool
+	failing     error
+	subscribed  map[string]bool
+	calls       []string
+}
+
+func (c *fakeProtocolConn) authData() ClientMessage {
+	return ClientMessage{idField: "conn"}
+}
+
+func (c *fakeProtocolConn) audit(t, channel, reason string) {
+	c.calls = append(c.calls, "audit "+t+" "+reason)
+}
+
+func (c *fakeProtocolConn) allowSubscribe() (bool, error) {
+	return !c.rateLimited, nil
+}
+
+func (c *fakeProtocolConn) allowPing() (bool, error) {
+	return !c.rateLimited, nil
+}
+
+func (c *fakeProtocolConn) allowSubscribers() (bool, error) {
+	return !c.rateLimited, nil
+}
+
+func (c *fakeProtocolConn) handleSubscribe(channel string, m ClientMessage) (string, error) {
+	c.calls = append(c.calls, "subscribe "+channel)
+	if c.failing != nil {
+		return "", c.failing
+	}
+	c.subscribed[channel] = true
+	return "s-" + channel, nil
+}
+
+func (c *fakeProtocolConn) handleUnsubscribe(channel string) error {
+	c.calls = append(c.calls, "unsubscribe "+channel)
+	if c.failing != nil {
+		return c.failing
+	}
+	delete(c.subscribed, channel)
+	return nil
+}
+
+func (c *fakeProtocolConn) lookupSubscription(id string) (string, bool, error) {
+	for channel := range c.subscribed {
+		if "s-"+channel == id {
+			return channel, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (c *fakeProtocolConn) isSubscribed(channel string) (bool, error) {
+	return c.subscribed[channel], c.failing
+}
+
+func (c *fakeProtocolConn) handleTouch(channel string) (bool, error) {
+	c.calls = append(c.calls, "touch "+channel)
+	return c.subscribed[channel], c.failing
+}
+
+func (c *fakeProtocolConn) handleAuth(m ClientMessage) (ClientMessage, error) {
+	c.calls = append(c.calls, "auth")
+	return newMessage(AuthOKMessage), nil
+}
+
+func (c *fakeProtocolConn) handleMigrated() (ClientMessage, error) {
+	c.calls = append(c.calls, "migrated")
+	return nil, nil
+}
+
+func (c *fakeProtocolConn) hubConnection() connection {
+	return nil
+}
+
+func TestHandleClientMessage(t *testing.T) {
+	s := &Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel != "private"
+		},
+	}
+	failure := errors.New("Backend down")
+
+	for _, c := range []struct {
+		name        string
+		message     ClientMessage
+		rateLimited bool
+		failing     error
+		reply       string
+		calls       []string
+		err         error
+	}{
+		{"subscribe", ClientMessage{typeField: SubscribeMessage, "channel": "test"}, false, nil, SubscribeOKMessage, []string{"subscribe test"}, nil},
+		{"subscribe refused", ClientMessage{typeField: SubscribeMessage, "channel": "private"}, false, nil, SubscribeErrorMessage, []string{"audit " + AuditSubscribeRefused + " " + AuditReasonRefused}, nil},
+		{"subscribe expired", ClientMessage{typeField: SubscribeMessage, "channel": "test"}, false, errAuthExpired, SubscribeErrorMessage, []string{"subscribe test", "audit " + AuditSubscribeRefused + " " + AuditReasonAuthExpired}, nil},
+		{"subscribe rate limited", ClientMessage{typeField: SubscribeMessage, "channel": "test"}, true, nil, RateLimitedMessage, nil, nil},
+		{"unsubscribe", ClientMessage{typeField: UnsubscribeMessage, "channel": "old"}, false, nil, UnsubscribeOKMessage, []string{"unsubscribe old"}, nil},
+		{"unsubscribe by ID", ClientMessage{typeField: UnsubscribeMessage, "subscription": "s-old"}, false, nil, UnsubscribeOKMessage, []string{"unsubscribe old"}, nil},
+		{"unsubscribe unknown ID", ClientMessage{typeField: UnsubscribeMessage, "subscription": "s-none"}, false, nil, UnsubscribeErrorMessage, nil, nil},
+		{"unsubscribe failed", ClientMessage{typeField: UnsubscribeMessage, "channel": "old"}, false, failure, UnsubscribeErrorMessage, []string{"unsubscribe old"}, nil},
+		{"unsubscribe rate limited", ClientMessage{typeField: UnsubscribeMessage, "channel": "old"}, true, nil, RateLimitedMessage, nil, nil},
+		{"touch", ClientMessage{typeField: TouchMessage, "channel": "old"}, false, nil, "", []string{"touch old"}, nil},
+		{"touch not subscribed", ClientMessage{typeField: TouchMessage, "channel": "test"}, false, nil, SubscribeErrorMessage, []string{"touch test"}, nil},
+		{"touch failed", ClientMessage{typeField: TouchMessage, "channel": "old"}, false, failure, "", []string{"touch old"}, failure},
+		{"ping", ClientMessage{typeField: PingMessage, refField: "1"}, false, nil, PongMessage, nil, nil},
+		{"ping rate limited", ClientMessage{typeField: PingMessage, refField: "1"}, true, nil, RateLimitedMessage, nil, nil},
+		{"ping without ref", ClientMessage{typeField: PingMessage}, false, nil, "", nil, nil},
+		{"auth", ClientMessage{typeField: AuthMessage}, false, nil, AuthOKMessage, []string{"auth"}, nil},
+		{"migrated", ClientMessage{typeField: MigratedMessage}, false, nil, "", []string{"migrated"}, nil},
+		{"pause unsupported", ClientMessage{typeField: PauseMessage, "channel": "old"}, false, nil, UnknownMessage, nil, nil},
+		{"ack unsupported", ClientMessage{typeField: AckMessage, "channel": "old"}, false, nil, UnknownMessage, nil, nil},
+		{"unknown", ClientMessage{typeField: "bogus"}, false, nil, UnknownMessage, nil, nil},
+	} {
+		conn := &fakeProtocolConn{
+			rateLimited: c.rateLimited,
+			failing:     c.failing,
+			subscribed:  map[string]bool{"old": true},
+		}
+		reply, err := s.handleClientMessage(conn, c.message)
+		if err != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.name, c.err, err)
+		}
+		if c.reply == "" && reply != nil {
+			t.Errorf("%s: expected no reply, got %v", c.name, reply)
+		}
+		if c.reply != "" && (reply == nil || reply.Type() != c.reply) {
+			t.Errorf("%s: expected %s, got %v", c.name, c.reply, reply)
+		}
+		if len(conn.calls) != len(c.calls) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.calls, conn.calls)
+			continue
+		}
+		for i := range c.calls {
+			if conn.calls[i] != c.calls[i] {
+				t.Errorf("%s: expected %v, got %v", c.name, c.calls, conn.calls)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package broadcaster
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// Size of the headers of a message at most, names and values together
+	maxHeadersSize = 1024
+
+	// Header names with this prefix are reserved for server-side publishes.
+	// Clients can't set them, so subscribers can trust them.
+	reservedHeaderPrefix = "__"
+)
+
+var errHeadersTooLarge = errors.New("Headers too large")
+
+// Checks the headers of a published message. Those of clients arrive as
+// decoded JSON (local clients pass a map[string]string), their reserved
+// names are dropped.
+func publishHeaders(v interface{}, client bool) (map[string]string, error) {
+	var headers map[string]string
+	switch h := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]string:
+		headers = make(map[string]string, len(h))
+		for k, v := range h {
+			headers[k] = v
+		}
+	case map[string]interface{}:
+		headers = make(map[string]string, len(h))
+		for k, v := range h {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("Header values must be strings")
+			}
+			headers[k] = s
+		}
+	default:
+		return nil, errors.New("Headers must be an object")
+	}
+
+	size := 0
+	for k, v := range headers {
+		if client && strings.HasPrefix(k, reservedHeaderPrefix) {
+			delete(headers, k)
+			continue
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxHeadersSize {
+		return nil, errHeadersTooLarge
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return headers, nil
+}
+
+// Header of a broadcast message, see PublishOptions.Headers. Empty if it
+// doesn't have it.
+func (c ClientMessage) Header(name string) string {
+	switch h := c["headers"].(type) {
+	case map[string]string:
+		return h[name]
+	case map[string]interface{}:
+		s, _ := h[name].(string)
+		return s
+	}
+	return ""
+}
+
+// When a broadcast message was published, according to the node that
+// published it. Zero unless the server delivers it, see
+// Server.MessageMetadata.
+func (c ClientMessage) PublishedAt() time.Time {
+	var ms int64
+	switch t := c["publishedAt"].(type) {
+	case int64:
+		ms = t
+	case float64:
+		ms = int64(t)
+	}
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// Node that published a broadcast message, see Server.NodeID. Empty unless
+// the server delivers it, see Server.MessageMetadata.
+func (c ClientMessage) Node() string {
+	s, _ := c["node"].(string)
+	return s
+}
@@ -0,0 +1,34 @@
+package broadcaster
+
+import (
+	"net/http"
+)
+
+// Whether a request came over HTTP/2 or later, e.g. from a front proxy that
+// speaks h2 to the backends. Such connections carry many requests at once
+// and can't be upgraded to a WebSocket.
+func isHTTP2(r *http.Request) bool {
+	return r.ProtoMajor >= 2
+}
+
+// Refuses a WebSocket handshake that arrived over HTTP/2, telling the client
+// to use long-polling instead. See HTTPErrorWebsocketUnsupported.
+func (s *Server) refuseWebsocketHTTP2(w http.ResponseWriter) {
+	s.httpError(w, &HTTPError{
+		Status:  http.StatusUpgradeRequired,
+		Code:    HTTPErrorWebsocketUnsupported,
+		Message: "WebSocket isn't supported over HTTP/2, use long-polling",
+	})
+}
+
+// Sends the headers of a response that's held open ahead of its body, so
+// that an HTTP/2 proxy in front passes them on right away rather than
+// holding back the stream, or timing out waiting for it. The status can't
+// change afterwards.
+func (s *Server) commitHeaders(w http.ResponseWriter, contentType string) error {
+	w.Header().Set("Content-Type", contentType)
+	return s.writeResponse(w, func() error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+}
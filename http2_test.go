@@ -0,0 +1,248 @@
+package broadcaster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves the broadcaster over TLS with HTTP/2, like behind an h2 proxy.
+func startHTTP2(server *testServer) *httptest.Server {
+	srv := httptest.NewUnstartedServer(server.Broadcaster.Handler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+func TestHTTP2LongPoll(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	srv := startHTTP2(server)
+	defer srv.Close()
+	client := srv.Client()
+
+	post := func(body string) (*http.Response, []ClientMessage) {
+		resp, err := client.Post(srv.URL+"/", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+		}
+
+		result := []ClientMessage{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, result
+	}
+
+	_, replies := post(`{"__type":"auth"}`)
+	if len(replies) != 1 || replies[0].Type() != AuthOKMessage {
+		t.Fatalf("Expected auth to succeed, got %v", replies)
+	}
+	token := replies[0].Token()
+	_, replies = post(fmt.Sprintf(`{"__type":"subscribe","__token":"%s","channel":"test"}`, token))
+	if len(replies) != 1 || replies[0].Type() != SubscribeOKMessage {
+		t.Fatalf("Expected subscribe to succeed, got %v", replies)
+	}
+
+	// Held until there's a message
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.Broadcaster.Publish("test", "Test message")
+	}()
+	resp, replies := post(fmt.Sprintf(`{"__type":"poll","__token":"%s","seq":"1"}`, token))
+	if len(replies) != 1 || replies[0]["body"] != "Test message" {
+		t.Fatalf("Expected the message, got %v", replies)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected content type: %s", ct)
+	}
+}
+
+func TestHTTP2Stream(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	srv := startHTTP2(server)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/stream?channel=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() ClientMessage {
+		if !lines.Scan() {
+			t.Fatalf("Stream ended: %v", lines.Err())
+		}
+		m := ClientMessage{}
+		err := json.Unmarshal(lines.Bytes(), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if m := next(); m.Type() != AuthOKMessage {
+		t.Fatalf("Expected auth to succeed, got %v", m)
+	}
+	if m := next(); m.Type() != SubscribeOKMessage {
+		t.Fatalf("Expected subscribe to succeed, got %v", m)
+	}
+
+	// Each arrives as it's published, nothing is held back
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("Message %d", i)
+		err := server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := next(); m.Type() != MessageMessage || m["body"] != body {
+			t.Errorf("Expected %s, got %v", body, m)
+		}
+	}
+}
+
+func TestHTTP2WebsocketRefused(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	srv := startHTTP2(server)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Expected status 426, got %d", resp.StatusCode)
+	}
+	result := map[string]*HTTPError{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := result["error"]; e == nil || e.Code != HTTPErrorWebsocketUnsupported {
+		t.Errorf("Unexpected error: %v", result)
+	}
+}
+
+// The client falls back to long-polling, and doesn't try upgrading again when
+// reconnecting.
+func TestHTTP2ClientFallback(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// The WebSocket client speaks HTTP/1, pretend the proxy in front
+	// passes its requests on over HTTP/2.
+	var upgrades int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&upgrades, 1)
+		}
+		r.ProtoMajor, r.ProtoMinor, r.Proto = 2, 0, "HTTP/2.0"
+		server.Broadcaster.Handler().ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if _, ok := client.transport.(*longpollClientTransport); !ok {
+		t.Fatalf("Expected long-polling, got %T", client.transport)
+	}
+
+	// Websocket mode gets the error
+	ws, err := NewClient(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Mode = ClientModeWebsocket
+	err = ws.Connect()
+	if err != ErrWebsocketUnsupported {
+		t.Errorf("Expected ErrWebsocketUnsupported, got %v", err)
+	}
+
+	id := client.ConnectionID()
+	client.transport.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.ConnectionID() == id {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&upgrades); n != 2 {
+		t.Errorf("Expected two upgrade attempts, got %d", n)
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Long-polling applies it with the next poll
+	for {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.LocalSubscriptions["test"] > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscription to be applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "Test message" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+}
@@ -0,0 +1,112 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes of HTTP error responses, see HTTPError. Failures that have a
+// code of their own use it instead, e.g. a quota (QuotaConnections), an
+// AuthError or a ProtocolError.
+const (
+	// Malformed request, status 400
+	HTTPErrorBadRequest = "bad_request"
+
+	// Refused auth data, status 401
+	HTTPErrorUnauthorized = "unauthorized"
+
+	// Not allowed, e.g. by the StateHandler, status 403
+	HTTPErrorForbidden = "forbidden"
+
+	// No such endpoint, status 404
+	HTTPErrorNotFound = "not_found"
+
+	// WebSocket handshake over HTTP/2, which can't upgrade connections:
+	// use long-polling. Status 426.
+	HTTPErrorWebsocketUnsupported = "websocket_unsupported"
+
+	// Over a rate limit or a quota, status 429
+	HTTPErrorRateLimited = "rate_limited"
+
+	// Server failure, might succeed when retried, status 500
+	HTTPErrorInternal = "internal"
+
+	// Not prepared or no connection to Redis, status 503
+	HTTPErrorUnavailable = "unavailable"
+
+	// Draining, try another node after Retry-After, status 503. See
+	// Server.EnterDrainMode.
+	HTTPErrorDraining = "draining"
+)
+
+// A failed HTTP request, sent as {"error": {"code": ..., "message": ...}}
+// with the status, see Server.WriteHTTPError. WebSocket connections that fail
+// the same way are closed with the status as close code (400 or 401), or
+// 1008 (policy violation) where HTTP answers 429.
+type HTTPError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// Codes of failures without a code of their own, by status.
+var httpErrorCodes = map[int]string{
+	http.StatusBadRequest:          HTTPErrorBadRequest,
+	http.StatusUnauthorized:        HTTPErrorUnauthorized,
+	http.StatusForbidden:           HTTPErrorForbidden,
+	http.StatusNotFound:            HTTPErrorNotFound,
+	http.StatusTooManyRequests:     HTTPErrorRateLimited,
+	http.StatusInternalServerError: HTTPErrorInternal,
+	http.StatusServiceUnavailable:  HTTPErrorUnavailable,
+}
+
+func newHTTPError(status int, message string) *HTTPError {
+	code, ok := httpErrorCodes[status]
+	if !ok {
+		code = HTTPErrorInternal
+	}
+	return &HTTPError{Status: status, Code: code, Message: message}
+}
+
+// Takes the code and reason of a protocol message that refuses a request.
+func replyHTTPError(status int, reply ClientMessage) *HTTPError {
+	reason, _ := reply["reason"].(string)
+	e := newHTTPError(status, reason)
+	if code, ok := reply["code"].(string); ok && code != "" {
+		e.Code = code
+	}
+	return e
+}
+
+// Answers a failed request, see WriteHTTPError.
+func (s *Server) httpError(w http.ResponseWriter, e *HTTPError) {
+	if s.WriteHTTPError != nil {
+		s.runCallback("WriteHTTPError", func() {
+			s.WriteHTTPError(w, e)
+		})
+		return
+	}
+	writeHTTPError(w, e)
+}
+
+func writeHTTPError(w http.ResponseWriter, e *HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(map[string]*HTTPError{"error": e})
+}
+
+// Answers a long-poll request refused with a protocol message, or with the
+// equivalent HTTPError, see Server.HTTPErrorObjects.
+func (s *Server) longpollFailure(w http.ResponseWriter, status int, reply ClientMessage) {
+	if s.HTTPErrorObjects {
+		s.httpError(w, replyHTTPError(status, reply))
+		return
+	}
+	w.WriteHeader(status)
+	s.longpollReply(w, reply)
+}
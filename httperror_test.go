@@ -0,0 +1,104 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPErrors(t *testing.T) {
+	server, err := startServer(&Server{
+		HTTPErrorObjects: true,
+		CanConnect: func(data map[string]interface{}) bool {
+			return data["user"] != "mallory"
+		},
+		Tenant: func(data map[string]interface{}) string {
+			return "acme"
+		},
+		Quotas: Quotas{Default: Quota{Connections: 1}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for _, test := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"unauthorized", "POST", "/", `{"__type": "auth", "user": "mallory"}`, http.StatusUnauthorized, HTTPErrorUnauthorized},
+		{"auth expected", "POST", "/", `{"__type": "subscribe"}`, http.StatusUnauthorized, AuthErrorWrongType},
+		{"stream unauthorized", "GET", "/stream?channel=test&user=mallory", "", http.StatusUnauthorized, HTTPErrorUnauthorized},
+		{"bad request", "GET", "/stream", "", http.StatusBadRequest, HTTPErrorBadRequest},
+		{"not found", "PUT", "/nothing", "", http.StatusNotFound, HTTPErrorNotFound},
+		{"not a websocket", "GET", "/", "", http.StatusBadRequest, HTTPErrorBadRequest},
+		{"connected", "POST", "/", `{"__type": "auth", "user": "alice"}`, http.StatusOK, ""},
+		{"rate limited", "POST", "/", `{"__type": "auth", "user": "bob"}`, http.StatusTooManyRequests, QuotaConnections},
+	} {
+		w := httptest.NewRecorder()
+		server.Broadcaster.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+			continue
+		}
+		if test.code == "" {
+			continue
+		}
+
+		var reply struct {
+			Error *HTTPError `json:"error"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &reply)
+		if err != nil || reply.Error == nil {
+			t.Errorf("%s: expected an error object, got %q", test.name, w.Body.String())
+			continue
+		}
+		if reply.Error.Code != test.code || reply.Error.Message == "" {
+			t.Errorf("%s: unexpected error: %#v", test.name, reply.Error)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: unexpected content type %s", test.name, ct)
+		}
+	}
+}
+
+func TestHTTPErrorsProtocol(t *testing.T) {
+	var written *HTTPError
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return false
+		},
+		WriteHTTPError: func(w http.ResponseWriter, e *HTTPError) {
+			written = e
+			w.WriteHeader(e.Status)
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Refused with a protocol message by default
+	w := httptest.NewRecorder()
+	server.Broadcaster.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"__type": "auth"}`)))
+	var messages []ClientMessage
+	err = json.Unmarshal(w.Body.Bytes(), &messages)
+	if w.Code != http.StatusUnauthorized || err != nil || len(messages) != 1 || messages[0].Type() != AuthFailedMessage {
+		t.Errorf("Expected an auth failure, got %d %q", w.Code, w.Body.String())
+	}
+	if written != nil {
+		t.Errorf("Unexpected HTTP error: %#v", written)
+	}
+
+	w = httptest.NewRecorder()
+	server.Broadcaster.ServeHTTP(w, httptest.NewRequest("PUT", "/nothing", nil))
+	if w.Code != http.StatusNotFound || written == nil || written.Code != HTTPErrorNotFound {
+		t.Errorf("Expected the error to be written by WriteHTTPError, got %d %#v", w.Code, written)
+	}
+}
@@ -0,0 +1,143 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of signed requests to the publish endpoint, see Server.PublishKey.
+const (
+	PublishSignatureHeader = "X-Broadcaster-Signature"
+	PublishTimestampHeader = "X-Broadcaster-Timestamp"
+)
+
+const (
+	// Largest request body the publish endpoint reads
+	publishRequestLimit = 1 << 20
+
+	// How far the timestamp of a signed publish request may be off
+	publishSignatureMaxAge = 5 * time.Minute
+)
+
+// A request to the publish endpoint, see Server.PublishKey.
+//
+// The JSON encoding of this type is stable: fields may be added, but existing
+// ones won't be renamed or removed.
+type PublishRequest struct {
+	Channel string `json:"channel"`
+	Body    string `json:"body"`
+
+	// See PublishOptions
+	Headers       map[string]string `json:"headers,omitempty"`
+	CompactionKey string            `json:"compactionKey,omitempty"`
+}
+
+// Answer of the publish endpoint to a successful request.
+type PublishResponse struct {
+	ID  string `json:"id"`
+	Seq int64  `json:"seq"`
+
+	// Published, but the message reached no subscriber on any node. Only
+	// told with UnroutedFail, see Server.Unrouted.
+	NoSubscribers bool `json:"noSubscribers,omitempty"`
+}
+
+// Serves POST /publish, see Server.PublishKey.
+func (s *Server) handleHTTPPublish(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, publishRequestLimit))
+	if err != nil {
+		s.httpError(w, newHTTPError(http.StatusBadRequest, "Request body too large"))
+		return
+	}
+	if !s.publishAuthorized(r, data) {
+		s.httpError(w, newHTTPError(http.StatusUnauthorized, "Unauthorized"))
+		return
+	}
+
+	req := PublishRequest{}
+	err = json.Unmarshal(data, &req)
+	if err != nil {
+		s.httpError(w, newHTTPError(http.StatusBadRequest, "Invalid JSON: "+err.Error()))
+		return
+	}
+
+	opts := PublishOptions{Headers: req.Headers, CompactionKey: req.CompactionKey}
+	id, seq, err := s.PublishWith(r.Context(), req.Channel, req.Body, opts)
+	unrouted := err == ErrNoSubscribers
+	if err != nil && !unrouted {
+		s.httpError(w, publishHTTPError(w, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PublishResponse{ID: id, Seq: seq, NoSubscribers: unrouted})
+}
+
+// Whether a publish request carries the key, or is signed with it.
+func (s *Server) publishAuthorized(r *http.Request, body []byte) bool {
+	st := s.current()
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), s.PublishKey) == 1
+	}
+
+	timestamp := r.Header.Get(PublishTimestampHeader)
+	signature := strings.TrimPrefix(r.Header.Get(PublishSignatureHeader), "sha256=")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return false
+	}
+	age := s.clock.Now().Sub(time.Unix(seconds, 0))
+	if age > publishSignatureMaxAge || age < -publishSignatureMaxAge {
+		return false
+	}
+	if !hmac.Equal([]byte(signature), []byte(signPublish(s.PublishKey, timestamp, body))) {
+		return false
+	}
+
+	// Only once, for as long as the timestamp is accepted either way
+	first, err := st.redis.ConsumePublishSignature(signature, publishSignatureMaxAge-age)
+	if err != nil {
+		s.logf("Failed to check a publish signature: %s", err)
+		return false
+	}
+	return first
+}
+
+// Hex HMAC-SHA256 of a publish request, see Server.PublishKey.
+func signPublish(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The HTTPError answering a failed publish, with its code.
+func publishHTTPError(w http.ResponseWriter, err error) *HTTPError {
+	perr, ok := err.(*PublishError)
+	if !ok {
+		return newHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	status := http.StatusBadRequest
+	switch perr.Code {
+	case PublishErrorRateLimited:
+		status = http.StatusTooManyRequests
+		retry := int(math.Ceil(perr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	case PublishErrorUnknownChannel:
+		status = http.StatusNotFound
+	case PublishErrorBackend, PublishErrorTimeout:
+		status = http.StatusServiceUnavailable
+	}
+	return &HTTPError{Status: status, Code: perr.Code, Message: perr.Reason}
+}
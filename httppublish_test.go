@@ -0,0 +1,146 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPPublish(t *testing.T) {
+	server, err := startServer(&Server{
+		PublishKey: []byte("secret"),
+		Unrouted:   UnroutedFail,
+		ChannelExists: func(channel string) bool {
+			return channel != "unknown"
+		},
+		ChannelConfig: func(channel string) ChannelConfig {
+			if channel == "limited" {
+				return ChannelConfig{PublishRate: PublishRate{PerSecond: 0.01, Burst: 1}}
+			}
+			return ChannelConfig{}
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(body string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest("POST", "/publish", strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.Broadcaster.ServeHTTP(w, req)
+		return w.Result()
+	}
+	bearer := map[string]string{"Authorization": "Bearer secret"}
+	expectError := func(resp *http.Response, status int, code string) {
+		t.Helper()
+		defer resp.Body.Close()
+		result := map[string]HTTPError{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if resp.StatusCode != status || result["error"].Code != code {
+			t.Errorf("Expected %d %s, got %d %v", status, code, resp.StatusCode, result)
+		}
+	}
+	expectMessage := func(id, body string) {
+		t.Helper()
+		select {
+		case m := <-client.Messages:
+			if m["id"] != id || m["body"] != body {
+				t.Errorf("Expected %s with ID %s, got %v", body, id, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s", body)
+		}
+	}
+
+	// With the key
+	resp := post(`{"channel":"test","body":"one"}`, bearer)
+	result := PublishResponse{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || result.ID == "" || result.Seq != 1 || result.NoSubscribers {
+		t.Fatalf("Expected to publish, got %d %+v", resp.StatusCode, result)
+	}
+	expectMessage(result.ID, "one")
+
+	// Signed, only once
+	body := `{"channel":"test","body":"two"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := map[string]string{
+		PublishTimestampHeader: now,
+		PublishSignatureHeader: "sha256=" + signPublish([]byte("secret"), now, []byte(body)),
+	}
+	resp = post(body, signed)
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to publish, got %d", resp.StatusCode)
+	}
+	expectMessage(result.ID, "two")
+	expectError(post(body, signed), http.StatusUnauthorized, HTTPErrorUnauthorized)
+
+	// Published all the same
+	resp = post(`{"channel":"nobody","body":"x"}`, bearer)
+	result = PublishResponse{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || result.ID == "" || !result.NoSubscribers {
+		t.Errorf("Expected to publish to no one, got %d %+v", resp.StatusCode, result)
+	}
+
+	// Refused
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	for _, headers := range []map[string]string{
+		nil,
+		{"Authorization": "Bearer wrong"},
+		{PublishTimestampHeader: now, PublishSignatureHeader: "sha256=" + signPublish([]byte("wrong"), now, []byte(body))},
+		{PublishTimestampHeader: stale, PublishSignatureHeader: "sha256=" + signPublish([]byte("secret"), stale, []byte(body))},
+	} {
+		expectError(post(body, headers), http.StatusUnauthorized, HTTPErrorUnauthorized)
+	}
+	expectError(post(`{"channel":`, bearer), http.StatusBadRequest, HTTPErrorBadRequest)
+	expectError(post(`{"channel":"unknown","body":"x"}`, bearer), http.StatusNotFound, PublishErrorUnknownChannel)
+
+	resp = post(`{"channel":"limited","body":"x"}`, bearer)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to publish, got %d", resp.StatusCode)
+	}
+	resp = post(`{"channel":"limited","body":"x"}`, bearer)
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After")
+	}
+	expectError(resp, http.StatusTooManyRequests, PublishErrorRateLimited)
+
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHTTPPublishOff(t *testing.T) {
+	s := &Server{}
+	for _, route := range s.Routes() {
+		if route.Path == "/publish" {
+			t.Error("Expected no publish endpoint without a key")
+		}
+	}
+}
@@ -2,31 +2,83 @@ package broadcaster
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type connection interface {
-	Send(channel, message string)
+	// Delivers a broadcast message, which is shared by all receivers and
+	// should not be modified.
+	Send(m ClientMessage)
 	Process(t string, args []string)
 	GetToken() string
+	GetID() string
+	GetTransport() string
 }
 
+var errSubscriptionUnconfirmed = errors.New("Subscription not confirmed by Redis")
+
 type subscriptionRequest struct {
 	Connection connection
 	Channel    string
+	Options    subscriptionOptions
 	Done       chan error
+
+	// When it was handed to the hub loop, see hub.latency
+	Queued time.Time
 }
 
+type subscriptionOptions struct {
+	// Receives the messages the connection publishes itself
+	Echo bool
+
+	// See QoSAtLeastOnce
+	QoS string
+
+	// Messages it passes are delivered, all of them when nil. See
+	// Server.SubscriptionFilter.
+	Filter func(m ClientMessage) bool
+
+	// Assigned when subscribing, kept when the subscription is updated.
+	// See subscriptionID.
+	ID string
+}
+
+// Whether a message goes to the connection subscribed with these options:
+// its own only with echo, see publishOrigin.delivers, and if the filter
+// passes it.
+func (o subscriptionOptions) delivers(connID string, m ClientMessage, origin publishOrigin) bool {
+	return origin.delivers(connID, o.Echo) && (o.Filter == nil || o.Filter(m))
+}
+
+var errHubStopped = errors.New("Server closed")
+
 type hub struct {
 	quit chan struct{}
 
+	// Closed once Run returned, requests fail from then on.
+	stopped chan struct{}
+
 	redis *redisBackend
 
-	// Keeps track of all channels a connection is subscribed to.
-	subscriptions map[connection]map[string]bool
+	// Connections per slice when fanning out, defaults to 500.
+	sliceSize int
+	fanout    *fanoutScheduler
+
+	// See Server.MessageMetadata
+	metadata bool
+
+	// When a broadcast message stops being worth delivering, see
+	// Server.messageDeadline. Optional.
+	deadline func(channel string, t messageTiming) time.Time
+
+	// Keeps track of all channels a connection is subscribed to, and the
+	// options it subscribed with.
+	subscriptions map[connection]map[string]subscriptionOptions
 
 	// Allows mapping channels to subscribers.
 	channels map[string]map[connection]bool
@@ -34,35 +86,78 @@ type hub struct {
 	// Makes tokens to connections
 	connections map[string]connection
 
+	// Channels whose number of subscribers changed since the last
+	// ChangedCounts, see channelReporter.
+	changed map[string]bool
+
+	// Paused subscriptions and what they hold back, see Pause. Accounted
+	// for in buffers, when set.
+	paused  map[connection]map[string]*pauseBuffer
+	buffers *bufferAccount
+
+	// See Server.LocalCacheSize, nil when disabled
+	cache *recentCache
+
+	// See Server.WarmStartWindow, nil when disabled
+	warm *warmBuffers
+
+	// Connections with more subscriptions than firehoseThreshold, the
+	// backend receives all channels while there are any. See
+	// Server.FirehoseThreshold, zero disables it.
+	firehoseThreshold int
+	firehose          map[connection]bool
+
 	newSubscriptions   chan subscriptionRequest
 	newUnsubscriptions chan subscriptionRequest
 
+	// Time requests spend queued and handled, per message type. Recorded
+	// outside of the lock.
+	latency map[string]*latencyRecorder
+
 	sync.Mutex
 }
 
 func (h *hub) Prepare() error {
 	h.quit = make(chan struct{})
+	h.stopped = make(chan struct{})
 
-	h.subscriptions = make(map[connection]map[string]bool)
+	h.subscriptions = make(map[connection]map[string]subscriptionOptions)
 	h.channels = make(map[string]map[connection]bool)
 	h.connections = make(map[string]connection)
+	h.changed = make(map[string]bool)
+	h.paused = make(map[connection]map[string]*pauseBuffer)
+	h.firehose = make(map[connection]bool)
 
 	h.newSubscriptions = make(chan subscriptionRequest, 100)
 	h.newUnsubscriptions = make(chan subscriptionRequest, 100)
+	h.latency = map[string]*latencyRecorder{
+		SubscribeMessage:   newLatencyRecorder(),
+		UnsubscribeMessage: newLatencyRecorder(),
+	}
+
+	if h.sliceSize == 0 {
+		h.sliceSize = 500
+	}
+	h.fanout = newFanoutScheduler(h, h.sliceSize)
 
 	return nil
 }
 
 func (h *hub) Run() {
+	go h.fanout.Run()
+
 	for {
 		select {
 		case r := <-h.newSubscriptions:
 			h.handleSubscribe(r)
+			h.latency[SubscribeMessage].Record(time.Since(r.Queued))
 		case r := <-h.newUnsubscriptions:
 			h.handleUnsubscribe(r)
+			h.latency[UnsubscribeMessage].Record(time.Since(r.Queued))
 		case m := <-h.redis.Messages:
 			h.handleMessage(m)
 		case <-h.quit:
+			close(h.stopped)
 			return
 		}
 	}
@@ -70,13 +165,14 @@ func (h *hub) Run() {
 
 func (h *hub) Stop() {
 	h.quit <- struct{}{}
+	h.fanout.Stop()
 }
 
 func (h *hub) Connect(conn connection) error {
 	h.Lock()
 	defer h.Unlock()
 
-	h.subscriptions[conn] = make(map[string]bool)
+	h.subscriptions[conn] = make(map[string]subscriptionOptions)
 	h.connections[conn.GetToken()] = conn
 	return nil
 }
@@ -90,19 +186,29 @@ func (h *hub) Disconnect(conn connection) error {
 	channels := h.subscriptions[conn]
 	h.Unlock()
 
-	// Unsubscribe from all channels
+	// Unsubscribe from all channels. The connection is gone even when that
+	// fails, it's no longer counted.
+	var err error
 	for channel, _ := range channels {
-		err := h.Unsubscribe(conn, channel)
-		if err != nil {
-			return err
+		if e := h.Unsubscribe(conn, channel); e != nil && err == nil {
+			err = e
 		}
 	}
 
 	h.Lock()
 	defer h.Unlock()
 	delete(h.subscriptions, conn)
-	delete(h.connections, conn.GetToken())
-	return nil
+	h.updateFirehose(conn)
+	for _, b := range h.paused[conn] {
+		b.Release()
+	}
+	delete(h.paused, conn)
+
+	// A newer poll of the same long-poll session may have taken over.
+	if h.connections[conn.GetToken()] == conn {
+		delete(h.connections, conn.GetToken())
+	}
+	return err
 }
 
 func (h *hub) hasConnection(conn connection) bool {
@@ -126,18 +232,129 @@ func (h *hub) hasSubscription(conn connection, channel string) bool {
 	return ok
 }
 
+// Returns the channels a connection is subscribed to.
+func (h *hub) Channels(conn connection) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	channels := make([]string, 0, len(h.subscriptions[conn]))
+	for channel, _ := range h.subscriptions[conn] {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Returns the channels a connection is subscribed to at least once.
+func (h *hub) ReliableChannels(conn connection) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	channels := []string{}
+	for channel, opts := range h.subscriptions[conn] {
+		if opts.QoS == QoSAtLeastOnce {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Whether a connection is subscribed to a channel at least once.
+func (h *hub) isReliable(conn connection, channel string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.subscriptions[conn][channel].QoS == QoSAtLeastOnce
+}
+
+// Returns the connections subscribed to a channel.
+func (h *hub) Subscribers(channel string) []connection {
+	h.Lock()
+	defer h.Unlock()
+
+	conns := make([]connection, 0, len(h.channels[channel]))
+	for conn, _ := range h.channels[channel] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (h *hub) Connections() []connection {
+	h.Lock()
+	defer h.Unlock()
+
+	conns := make([]connection, 0, len(h.subscriptions))
+	for conn, _ := range h.subscriptions {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 func (h *hub) Subscribe(conn connection, channel string) error {
+	return h.SubscribeEcho(conn, channel, false)
+}
+
+// Subscribes, with echo the connection also receives the messages it
+// publishes on the channel. Subscribing again updates it.
+func (h *hub) SubscribeEcho(conn connection, channel string, echo bool) error {
+	return h.SubscribeQoS(conn, channel, echo, QoSAtMostOnce)
+}
+
+// Like SubscribeEcho, with the given delivery guarantee. Connections that
+// don't implement reliableConnection get their messages at most once.
+//
+// Subscribing is a barrier: once it returns, every message published on the
+// channel is delivered to the connection. The hub loop registers the
+// subscription in between handling messages, then Redis confirms it on the
+// pub/sub connection, ahead of anything published later. Messages published
+// before it returns may or may not be delivered. When Redis doesn't confirm
+// in time, a new subscription is undone and an error returned.
+func (h *hub) SubscribeQoS(conn connection, channel string, echo bool, qos string) error {
+	return h.SubscribeWith(conn, channel, subscriptionOptions{Echo: echo, QoS: qos})
+}
+
+// Like SubscribeQoS, with a filter as well. The ID is assigned by the hub.
+func (h *hub) SubscribeWith(conn connection, channel string, opts subscriptionOptions) error {
 	if !h.hasConnection(conn) {
 		return errors.New("Unknown connection")
 	}
+	existing := h.hasSubscription(conn, channel)
 
 	r := subscriptionRequest{
 		Connection: conn,
 		Channel:    channel,
+		Options:    opts,
 		Done:       make(chan error),
 	}
-	h.newSubscriptions <- r
-	return <-r.Done
+	err := h.request(h.newSubscriptions, r)
+	if err != nil {
+		return err
+	}
+
+	// Outside of the hub loop: Redis confirms while messages keep flowing.
+	if !h.redis.WaitSubscribed(channel, redisWriteTimeout) {
+		if !existing {
+			h.Unsubscribe(conn, channel)
+		}
+		return errSubscriptionUnconfirmed
+	}
+
+	// Publishes before the confirmation might have found it empty.
+	if h.redis.empty != nil {
+		h.redis.empty.Clear(channel)
+	}
+	return nil
+}
+
+// Tells the other nodes to publish to a channel again, once Redis confirmed
+// the subscription: publishes before that might find it empty anyway.
+func (h *hub) announceSubscribed(channel string) {
+	if !h.redis.WaitSubscribed(channel, redisWriteTimeout) {
+		return
+	}
+	err := h.redis.AnnounceSubscribed(channel)
+	if err != nil {
+		h.redis.logf("Redis error announcing %s: %s", channel, err)
+	}
 }
 
 func (h *hub) handleSubscribe(r subscriptionRequest) {
@@ -153,10 +370,28 @@ func (h *hub) handleSubscribe(r subscriptionRequest) {
 		}
 
 		h.channels[r.Channel] = make(map[connection]bool)
+		if h.cache != nil {
+			h.cache.Active(r.Channel)
+		}
+
+		if empty := h.redis.empty; empty != nil {
+			empty.Clear(r.Channel)
+			go h.announceSubscribed(r.Channel)
+		}
 	}
 
-	h.subscriptions[r.Connection][r.Channel] = true
+	if s, ok := h.subscriptions[r.Connection][r.Channel]; ok {
+		r.Options.ID = s.ID
+	} else {
+		r.Options.ID = randomId(8)
+	}
+	h.subscriptions[r.Connection][r.Channel] = r.Options
 	h.channels[r.Channel][r.Connection] = true
+	if h.warm != nil {
+		h.warm.Claim(r.Connection, r.Channel, r.Options)
+	}
+	h.changed[r.Channel] = true
+	h.updateFirehose(r.Connection)
 	r.Done <- nil
 }
 
@@ -176,8 +411,24 @@ func (h *hub) Unsubscribe(conn connection, channel string) error {
 		Channel:    channel,
 		Done:       make(chan error),
 	}
-	h.newUnsubscriptions <- r
-	return <-r.Done
+	return h.request(h.newUnsubscriptions, r)
+}
+
+// Hands a request to the hub loop and waits until it's handled.
+func (h *hub) request(requests chan subscriptionRequest, r subscriptionRequest) error {
+	r.Queued = time.Now()
+	select {
+	case requests <- r:
+	case <-h.stopped:
+		return errHubStopped
+	}
+
+	select {
+	case err := <-r.Done:
+		return err
+	case <-h.stopped:
+		return errHubStopped
+	}
 }
 
 func (h *hub) handleUnsubscribe(r subscriptionRequest) {
@@ -186,6 +437,12 @@ func (h *hub) handleUnsubscribe(r subscriptionRequest) {
 
 	delete(h.subscriptions[r.Connection], r.Channel)
 	delete(h.channels[r.Channel], r.Connection)
+	h.changed[r.Channel] = true
+	h.updateFirehose(r.Connection)
+	if b, ok := h.paused[r.Connection][r.Channel]; ok {
+		b.Release()
+		delete(h.paused[r.Connection], r.Channel)
+	}
 
 	if len(h.channels[r.Channel]) == 0 {
 		// Last subscriber, release it.
@@ -196,17 +453,74 @@ func (h *hub) handleUnsubscribe(r subscriptionRequest) {
 		}
 
 		delete(h.channels, r.Channel)
+		if h.cache != nil {
+			h.cache.Idle(r.Channel)
+		}
 	}
 
 	r.Done <- nil
 }
 
+// Stops delivering a channel to a connection, while keeping it subscribed.
+// Up to size messages are held back until Resume, past that the oldest ones
+// are kept, or the latest with keepLatest. Pausing again changes nothing.
+func (h *hub) Pause(conn connection, channel string, size int, keepLatest bool) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.subscriptions[conn][channel]; !ok {
+		return errNotSubscribed
+	}
+	if h.paused[conn] == nil {
+		h.paused[conn] = make(map[string]*pauseBuffer)
+	}
+	if _, ok := h.paused[conn][channel]; !ok {
+		h.paused[conn][channel] = newAccountedPauseBuffer(size, keepLatest, h.buffers)
+	}
+	return nil
+}
+
+// Delivers what a paused subscription held back, with a SkippedMessage for
+// what it dropped, then carries on as before. Resuming a subscription that
+// isn't paused changes nothing.
+func (h *hub) Resume(conn connection, channel string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.subscriptions[conn][channel]; !ok {
+		return errNotSubscribed
+	}
+	b, ok := h.paused[conn][channel]
+	if !ok {
+		return nil
+	}
+	delete(h.paused[conn], channel)
+	if len(h.paused[conn]) == 0 {
+		delete(h.paused, conn)
+	}
+
+	// The messages move to the outbound buffer, and are accounted there.
+	b.Release()
+	b.Flush(channel, func(m ClientMessage) {
+		h.send(conn, channel, m)
+	})
+	return nil
+}
+
 func (h *hub) processClient(t, token string, args []string) {
 	if c, ok := h.connections[token]; ok {
 		c.Process(t, args)
 	}
 }
 
+func (h *hub) processConnection(t, id string, args []string) {
+	for _, c := range h.connections {
+		if c.GetID() == id {
+			c.Process(t, args)
+		}
+	}
+}
+
 func (h *hub) handleMessage(m redis.Message) {
 	h.Lock()
 	defer h.Unlock()
@@ -220,20 +534,152 @@ func (h *hub) handleMessage(m redis.Message) {
 			h.processClient(args[0], args[1], args[2:])
 		case "unsubscribe":
 			h.processClient(args[0], args[1], args[2:])
+		case "kick":
+			h.processConnection(args[0], args[1], args[2:])
+		case "unsubscribe-id":
+			h.processConnection(args[0], args[1], args[2:])
+		case "subscribed":
+			if h.redis.empty != nil {
+				h.redis.empty.Clear(strings.Join(args[1:], " "))
+			}
+		case "revalidate":
+			if len(args) > 2 && h.redis.revalidate != nil {
+				h.redis.revalidate(args[1], strings.Join(args[2:], " "))
+			}
+		case "config":
+			if h.redis.configChanged != nil {
+				h.redis.configChanged()
+			}
+		case "scheduled":
+			ms, err := strconv.ParseInt(args[1], 10, 64)
+			if err == nil && h.redis.scheduled != nil {
+				h.redis.scheduled(time.UnixMilli(ms))
+			}
 		}
 	} else {
 		if _, ok := h.channels[m.Channel]; !ok {
-			return // No longer subscribed?
+			return // No longer subscribed, or from the firehose
+		}
+
+		msg, origin, timing := decodeBroadcastMessage(m.Channel, m.Data, h.metadata)
+		if h.deadline != nil {
+			stampDeadline(msg, h.deadline(m.Channel, timing))
+		}
+		if seq := msg.Seq(); h.cache != nil && seq > 0 {
+			h.cache.Add(m.Channel, seq, m.Data)
+		}
+		if h.warm != nil {
+			h.warm.Add(m.Channel, msg, origin)
+		}
+		subscribers := h.channels[m.Channel]
+		if len(subscribers) <= h.sliceSize && h.fanout.Idle(m.Channel) {
+			for conn, _ := range subscribers {
+				if h.receives(conn, m.Channel, msg, origin) {
+					h.send(conn, m.Channel, msg)
+				}
+			}
+			return
+		}
+
+		// Too large to deliver in one go, or queued behind one that is.
+		conns := make([]connection, 0, len(subscribers))
+		for conn, _ := range subscribers {
+			if h.receives(conn, m.Channel, msg, origin) {
+				conns = append(conns, conn)
+			}
+		}
+		h.fanout.Add(m.Channel, msg, conns)
+	}
+}
+
+// Must hold the lock. See subscriptionOptions.delivers.
+func (h *hub) receives(conn connection, channel string, m ClientMessage, origin publishOrigin) bool {
+	return h.subscriptions[conn][channel].delivers(conn.GetID(), m, origin)
+}
+
+// Must hold the lock. Honors the QoS of the subscription, and holds the
+// message back if it's paused.
+func (h *hub) send(conn connection, channel string, m ClientMessage) {
+	if b, ok := h.paused[conn][channel]; ok {
+		b.Add(m)
+		return
+	}
+	if h.subscriptions[conn][channel].QoS == QoSAtLeastOnce {
+		if rc, ok := conn.(reliableConnection); ok {
+			rc.SendReliable(m)
+			return
 		}
+	}
+	conn.Send(m)
+}
 
-		for conn, _ := range h.channels[m.Channel] {
-			conn.Send(m.Channel, string(m.Data))
+// Delivers a slice of a fan-out, skipping connections that unsubscribed in
+// the meantime.
+func (h *hub) deliver(channel string, m ClientMessage, conns []connection) {
+	h.Lock()
+	defer h.Unlock()
+
+	subscribers := h.channels[channel]
+	for _, conn := range conns {
+		if subscribers[conn] {
+			h.send(conn, channel, m)
 		}
 	}
 }
 
 type hubStats struct {
-	LocalSubscriptions map[string]int
+	LocalConnections         []string
+	LocalTransports          map[string]int
+	LocalSubscriptions       map[string]int
+	LocalPausedSubscriptions map[string]int
+}
+
+// Time requests spent in the hub loop, per message type.
+func (h *hub) Latency() map[string]LatencyHistogram {
+	latency := make(map[string]LatencyHistogram, len(h.latency))
+	for t, r := range h.latency {
+		latency[t] = r.Histogram()
+	}
+	return latency
+}
+
+// Number of connections, a long-poll session counts once.
+func (h *hub) ConnectionCount() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.connections)
+}
+
+// Number of subscribers on this node of each of the channels, at once.
+func (h *hub) SubscriberCounts(channels []string) map[string]int {
+	h.Lock()
+	defer h.Unlock()
+
+	counts := make(map[string]int, len(channels))
+	for _, channel := range channels {
+		counts[channel] = len(h.channels[channel])
+	}
+	return counts
+}
+
+// Number of subscribers of the channels whose count changed since the last
+// call, zero for those that have none left. With all, of every channel.
+func (h *hub) ChangedCounts(all bool) map[string]int {
+	h.Lock()
+	defer h.Unlock()
+
+	counts := make(map[string]int, len(h.changed))
+	for channel, _ := range h.changed {
+		counts[channel] = len(h.channels[channel])
+	}
+	if all {
+		for channel, conns := range h.channels {
+			counts[channel] = len(conns)
+		}
+	}
+	h.changed = make(map[string]bool)
+	return counts
 }
 
 func (h *hub) Stats() (hubStats, error) {
@@ -245,7 +691,29 @@ func (h *hub) Stats() (hubStats, error) {
 		subscriptions[k] = len(v)
 	}
 
+	connections := make([]string, 0, len(h.subscriptions))
+	for conn, _ := range h.subscriptions {
+		connections = append(connections, conn.GetID())
+	}
+
+	// By token: a long-poll session counts once, also while a poll takes
+	// over from the previous one.
+	transports := make(map[string]int)
+	for _, conn := range h.connections {
+		transports[conn.GetTransport()]++
+	}
+
+	paused := make(map[string]int)
+	for _, channels := range h.paused {
+		for channel, _ := range channels {
+			paused[channel]++
+		}
+	}
+
 	return hubStats{
-		LocalSubscriptions: subscriptions,
+		LocalConnections:         connections,
+		LocalTransports:          transports,
+		LocalSubscriptions:       subscriptions,
+		LocalPausedSubscriptions: paused,
 	}, nil
 }
@@ -2,6 +2,10 @@ package broadcaster
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,8 +19,8 @@ type testConnection struct {
 	Messages chan string
 }
 
-func (t *testConnection) Send(channel, message string) {
-	t.Messages <- fmt.Sprintf("%s - %s", channel, message)
+func (t *testConnection) Send(m ClientMessage) {
+	t.Messages <- fmt.Sprintf("%s - %s", m.Channel(), m["body"])
 }
 
 func (c *testConnection) Process(t string, args []string) {
@@ -26,6 +30,14 @@ func (c *testConnection) GetToken() string {
 	return "test"
 }
 
+func (c *testConnection) GetID() string {
+	return "test"
+}
+
+func (c *testConnection) GetTransport() string {
+	return "test"
+}
+
 func TestHubConnectDisconnect(t *testing.T) {
 	hub := &hub{
 		redis: hubTestBackend,
@@ -196,3 +208,136 @@ func TestHubMessage(t *testing.T) {
 		t.Errorf("Should have received a message!")
 	}
 }
+
+func TestHubStopped(t *testing.T) {
+	hub := &hub{
+		redis: hubTestBackend,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.Run()
+
+	conn := &testConnection{}
+	err = hub.Connect(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hub.Subscribe(conn, testChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections that go away later don't wait for it
+	hub.Stop()
+	err = hub.Disconnect(conn)
+	if err != errHubStopped {
+		t.Errorf("Expected the hub to be stopped, got %v", err)
+	}
+}
+
+func TestHubSubscribeBarrier(t *testing.T) {
+	hub := &hub{
+		redis: hubTestBackend,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+	defer hub.Stop()
+
+	channel := "barrier"
+
+	// A single publisher: messages are numbered in the order they're
+	// published.
+	var started, published int64
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n := atomic.AddInt64(&started, 1)
+			_, _, _, err := hubTestBackend.Publish(channel, strconv.FormatInt(n, 10), messageOptions{}, publishOrigin{}, time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.StoreInt64(&published, n)
+		}
+	}()
+
+	// Subscribers come and go concurrently, the channel is released and
+	// subscribed again along the way.
+	round := func() error {
+		conn := &testConnection{
+			Messages: make(chan string, 10000),
+		}
+		err := hub.Connect(conn)
+		if err != nil {
+			return err
+		}
+		defer hub.Disconnect(conn)
+
+		err = hub.Subscribe(conn, channel)
+		if err != nil {
+			return err
+		}
+		after := atomic.LoadInt64(&started)
+		time.Sleep(2 * time.Millisecond)
+		until := atomic.LoadInt64(&published)
+		deadline := time.Now().Add(2 * time.Second)
+		for until <= after {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Nothing published after message %d", after)
+			}
+			time.Sleep(time.Millisecond)
+			until = atomic.LoadInt64(&published)
+		}
+
+		received := map[int64]bool{}
+		timeout := time.After(2 * time.Second)
+		for !received[until] {
+			select {
+			case m := <-conn.Messages:
+				n, _ := strconv.ParseInt(strings.TrimPrefix(m, channel+" - "), 10, 64)
+				received[n] = true
+			case <-timeout:
+				return fmt.Errorf("Didn't receive message %d", until)
+			}
+		}
+		for n := after + 1; n <= until; n++ {
+			if !received[n] {
+				return fmt.Errorf("Missed message %d, published after subscribing (%d)", n, after)
+			}
+		}
+		return hub.Unsubscribe(conn, channel)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := round()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-stopped
+}
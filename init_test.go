@@ -24,6 +24,19 @@ type testRedis struct {
 }
 
 var portSource = rand.New(rand.NewSource(26))
+var usedPorts = make(map[int]bool)
+
+// Random port for a test server, never hands out the same one twice.
+func nextPort() int {
+	for {
+		// Fixed seed to reproducably get random ports
+		port := 25000 + portSource.Intn(1000)
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port
+		}
+	}
+}
 
 func TestMain(m *testing.M) {
 	hubTestBackend, hubTestRedis = newTestRedisBackend()
@@ -35,9 +48,14 @@ func TestMain(m *testing.M) {
 func startRedis() (*testRedis, error) {
 	s := &testRedis{}
 
-	// Get random port for redis
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	s.Port = 24000 + r.Intn(1000)
+	// Get a free port for redis, a random one could be taken by another
+	// test redis that's still running
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	s.Port = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
 
 	// Log files
 	serverOut, err := os.OpenFile("/tmp/broadcaster-redis-server.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
@@ -129,8 +147,7 @@ func startServer(s *Server, port int) (*testServer, error) {
 	}
 
 	if port == 0 {
-		// Fixed seed to reproducably get random ports
-		port = 25000 + portSource.Intn(1000)
+		port = nextPort()
 	}
 	server := &testServer{
 		Port:        port,
@@ -176,6 +193,7 @@ func (s *testServer) Start() error {
 }
 
 func (s *testServer) Stop() {
+	s.Broadcaster.Close()
 	s.Redis.Stop()
 }
 
@@ -183,13 +201,45 @@ func (s *testServer) sendMessage(channel, message string) error {
 	return s.Redis.sendMessage(channel, message)
 }
 
+// Subscribes a local client to a channel of its own. The returned function
+// waits for the hub to hand over what was published before calling it to
+// the subscribers of this node: it does so in order, so once the client gets
+// a message published after them, they're queued.
+func watchHandover(t *testing.T, s *testServer) func() {
+	t.Helper()
+	watcher, err := s.Broadcaster.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		watcher.Disconnect()
+	})
+	err = watcher.Subscribe("handover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		t.Helper()
+		err := s.Broadcaster.Publish("handover", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-watcher.Messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the messages to be handed over")
+		}
+	}
+}
+
 func newTestRedisBackend() (*redisBackend, *testRedis) {
 	s, err := startRedis()
 	if err != nil {
 		panic(err)
 	}
 	u := fmt.Sprintf("localhost:%d", s.Port)
-	b, err := newRedisBackend(u, u, "broadcaster", "bc:", 1*time.Second)
+	b, err := newRedisBackend(u, u, "", "broadcaster", "bc:", 1*time.Second, 250)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,455 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Builds a Server.ValidateBody that checks JSON bodies against a JSON Schema
+// per channel pattern. Patterns are as for Client.OnMessage: channel names
+// are split into segments on dots, "*" matches a single segment and a
+// trailing "**" one or more. When several patterns match a channel, the
+// most specific one applies. Bodies of channels that match none aren't
+// checked, others fail when they aren't JSON.
+//
+// Supports the validation keywords of JSON Schema that don't refer to other
+// schemas by URI: type, enum, const, properties, required,
+// additionalProperties, items (a single schema), minItems, maxItems,
+// minLength, maxLength, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum (as numbers), pattern, allOf, anyOf, oneOf and not, as
+// well as true and false as schemas. Annotations such as title and
+// description are ignored. Schemas with other keywords, e.g. $ref, are
+// refused rather than half checked.
+func JSONSchemaValidator(schemas map[string][]byte) (func(channel string, body []byte) error, error) {
+	patterns := make([]schemaPattern, 0, len(schemas))
+	for pattern, doc := range schemas {
+		var v interface{}
+		err := json.Unmarshal(doc, &v)
+		if err != nil {
+			return nil, fmt.Errorf("JSON Schema of %s: %s", pattern, err)
+		}
+		schema, err := parseJSONSchema(v)
+		if err != nil {
+			return nil, fmt.Errorf("JSON Schema of %s: %s", pattern, err)
+		}
+		patterns = append(patterns, schemaPattern{
+			name:    pattern,
+			pattern: strings.Split(pattern, "."),
+			schema:  schema,
+		})
+	}
+	sort.Sort(bySchemaSpecificity(patterns))
+
+	return func(channel string, body []byte) error {
+		segments := strings.Split(channel, ".")
+		for _, p := range patterns {
+			if matchPattern(p.pattern, segments) {
+				return p.schema.validateJSON(body)
+			}
+		}
+		return nil
+	}, nil
+}
+
+type schemaPattern struct {
+	name    string
+	pattern []string
+	schema  *jsonSchema
+}
+
+// Most specific first, as for message handlers. Equally specific patterns
+// can't both match a channel, they're sorted by name to be deterministic.
+type bySchemaSpecificity []schemaPattern
+
+func (p bySchemaSpecificity) Len() int      { return len(p) }
+func (p bySchemaSpecificity) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p bySchemaSpecificity) Less(i, j int) bool {
+	a, b := p[i].pattern, p[j].pattern
+	for k := 0; k < len(a) && k < len(b); k++ {
+		ra, rb := segmentRank(a[k]), segmentRank(b[k])
+		if ra != rb {
+			return ra < rb
+		}
+	}
+	return p[i].name < p[j].name
+}
+
+// Keywords that don't affect validation.
+var jsonSchemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"readOnly":    true,
+	"writeOnly":   true,
+	"deprecated":  true,
+}
+
+// A parsed JSON Schema, see JSONSchemaValidator.
+type jsonSchema struct {
+	// The true or false schema, when not nil
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties map[string]*jsonSchema
+	required   []string
+	additional *jsonSchema
+
+	items    *jsonSchema
+	minItems int
+	maxItems int
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+// Refuses a body, the path is a JSON Pointer to the offending value.
+type schemaError struct {
+	path   string
+	reason string
+}
+
+func (e *schemaError) Error() string {
+	if e.path == "" {
+		return "Invalid body: " + e.reason
+	}
+	return fmt.Sprintf("Invalid body at %s: %s", e.path, e.reason)
+}
+
+func parseJSONSchema(v interface{}) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected an object or a boolean, got %v", v)
+	}
+
+	s := &jsonSchema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	var err error
+	for k, v := range doc {
+		switch k {
+		case "type":
+			s.types, err = schemaStrings(k, v)
+		case "enum":
+			values, ok := v.([]interface{})
+			if !ok {
+				err = fmt.Errorf("Expected an array for enum")
+			}
+			s.enum = values
+		case "const":
+			s.constant = v
+			s.hasConst = true
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("Expected an object for properties")
+				break
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, prop := range props {
+				s.properties[name], err = parseJSONSchema(prop)
+				if err != nil {
+					break
+				}
+			}
+		case "required":
+			s.required, err = schemaStrings(k, v)
+		case "additionalProperties":
+			s.additional, err = parseJSONSchema(v)
+		case "items":
+			s.items, err = parseJSONSchema(v)
+		case "minItems":
+			s.minItems, err = schemaCount(k, v)
+		case "maxItems":
+			s.maxItems, err = schemaCount(k, v)
+		case "minLength":
+			s.minLength, err = schemaCount(k, v)
+		case "maxLength":
+			s.maxLength, err = schemaCount(k, v)
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("Expected a string for pattern")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "minimum":
+			s.minimum, err = schemaNumber(k, v)
+		case "maximum":
+			s.maximum, err = schemaNumber(k, v)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = schemaNumber(k, v)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = schemaNumber(k, v)
+		case "allOf":
+			s.allOf, err = parseJSONSchemas(k, v)
+		case "anyOf":
+			s.anyOf, err = parseJSONSchemas(k, v)
+		case "oneOf":
+			s.oneOf, err = parseJSONSchemas(k, v)
+		case "not":
+			s.not, err = parseJSONSchema(v)
+		default:
+			if !jsonSchemaAnnotations[k] {
+				err = fmt.Errorf("Unsupported keyword %s", k)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func parseJSONSchemas(keyword string, v interface{}) ([]*jsonSchema, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("Expected a non-empty array for %s", keyword)
+	}
+	schemas := make([]*jsonSchema, len(list))
+	for i, item := range list {
+		s, err := parseJSONSchema(item)
+		if err != nil {
+			return nil, err
+		}
+		schemas[i] = s
+	}
+	return schemas, nil
+}
+
+// A string or an array of them.
+func schemaStrings(keyword string, v interface{}) ([]string, error) {
+	if s, ok := v.(string); ok {
+		return []string{s}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected strings for %s", keyword)
+	}
+	result := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected strings for %s", keyword)
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+func schemaCount(keyword string, v interface{}) (int, error) {
+	n, ok := v.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("Expected a non-negative integer for %s", keyword)
+	}
+	return int(n), nil
+}
+
+func schemaNumber(keyword string, v interface{}) (*float64, error) {
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("Expected a number for %s", keyword)
+	}
+	return &n, nil
+}
+
+func (s *jsonSchema) validateJSON(body []byte) error {
+	var v interface{}
+	err := json.Unmarshal(body, &v)
+	if err != nil {
+		return &schemaError{reason: "Not JSON: " + err.Error()}
+	}
+	return s.validate(v, "")
+}
+
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		return &schemaError{path: path, reason: fmt.Sprintf(format, args...)}
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			return fail("Not allowed")
+		}
+		return nil
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fail("Expected %s", strings.Join(s.types, " or "))
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		return fail("Not one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		return fail("Expected %v", s.constant)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("Missing property %s", name)
+			}
+		}
+		// Sorted, to report the same error each time.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.properties[name]
+			if !ok {
+				prop = s.additional
+			}
+			if prop == nil {
+				continue
+			}
+			err := prop.validate(v[name], path+"/"+escapePointer(name))
+			if err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if s.minItems >= 0 && len(v) < s.minItems {
+			return fail("Expected at least %d items", s.minItems)
+		}
+		if s.maxItems >= 0 && len(v) > s.maxItems {
+			return fail("Expected at most %d items", s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				err := s.items.validate(item, fmt.Sprintf("%s/%d", path, i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength >= 0 && n < s.minLength {
+			return fail("Expected at least %d characters", s.minLength)
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			return fail("Expected at most %d characters", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("Doesn't match %s", s.pattern)
+		}
+
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return fail("Expected at least %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return fail("Expected at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			return fail("Expected more than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			return fail("Expected less than %v", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		err := sub.validate(v, path)
+		if err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil && countValid(s.anyOf, v, path) == 0 {
+		return fail("Doesn't match any of the allowed schemas")
+	}
+	if s.oneOf != nil && countValid(s.oneOf, v, path) != 1 {
+		return fail("Doesn't match exactly one of the allowed schemas")
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fail("Matches a schema that isn't allowed")
+	}
+	return nil
+}
+
+func (s *jsonSchema) hasType(v interface{}) bool {
+	for _, t := range s.types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func countValid(schemas []*jsonSchema, v interface{}, path string) int {
+	n := 0
+	for _, s := range schemas {
+		if s.validate(v, path) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if reflect.DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Escapes a property name for a JSON Pointer.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,73 @@
+package broadcaster
+
+import (
+	"testing"
+)
+
+func TestJSONSchemaValidator(t *testing.T) {
+	validate, err := JSONSchemaValidator(map[string][]byte{
+		"orders.**": []byte(`{
+			"title": "Order",
+			"type": "object",
+			"required": ["id", "items"],
+			"properties": {
+				"id": {"type": "integer", "minimum": 1},
+				"status": {"enum": ["new", "paid"]},
+				"items": {
+					"type": "array",
+					"minItems": 1,
+					"items": {
+						"type": "object",
+						"properties": {"sku": {"type": "string", "pattern": "^[A-Z]+$"}},
+						"additionalProperties": false
+					}
+				}
+			}
+		}`),
+		"orders.drafts": []byte(`true`),
+		"*.tags":        []byte(`{"type": "array", "items": {"anyOf": [{"type": "string", "maxLength": 3}, {"type": "null"}]}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		channel, body, err string
+	}{
+		{"orders.eu", `{"id": 1, "items": [{"sku": "AB"}]}`, ""},
+		{"orders.eu", `{"id": 1.5, "items": [{}]}`, "Invalid body at /id: Expected integer"},
+		{"orders.eu", `{"id": 1}`, "Invalid body: Missing property items"},
+		{"orders.eu", `{"id": 1, "items": []}`, "Invalid body at /items: Expected at least 1 items"},
+		{"orders.eu", `{"id": 1, "items": [{"sku": "AB"}, {"sku": "ab"}]}`, "Invalid body at /items/1/sku: Doesn't match ^[A-Z]+$"},
+		{"orders.eu", `{"id": 1, "items": [{"qty": 1}]}`, "Invalid body at /items/0/qty: Not allowed"},
+		{"orders.eu", `{"id": 1, "items": [{}], "status": "lost"}`, "Invalid body at /status: Not one of the allowed values"},
+		{"orders.eu", `not json`, "Invalid body: Not JSON: invalid character 'o' in literal null (expecting 'u')"},
+		{"orders.drafts", `["anything"]`, ""},
+		{"users.tags", `["a", null]`, ""},
+		{"users.tags", `["abcd"]`, "Invalid body at /0: Doesn't match any of the allowed schemas"},
+		{"users", `not json`, ""},
+	} {
+		err := validate(c.channel, []byte(c.body))
+		if c.err == "" && err != nil {
+			t.Errorf("Expected %s on %s to pass, got %s", c.body, c.channel, err)
+		}
+		if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("Expected %s on %s to fail with %q, got %v", c.body, c.channel, c.err, err)
+		}
+	}
+}
+
+func TestJSONSchemaUnsupported(t *testing.T) {
+	for _, schema := range []string{
+		`{"$ref": "#/definitions/order"}`,
+		`{"properties": {"id": {"format": "uuid"}}}`,
+		`{"type": 1}`,
+		`{"pattern": "("}`,
+		`[]`,
+	} {
+		_, err := JSONSchemaValidator(map[string][]byte{"test": []byte(schema)})
+		if err == nil {
+			t.Errorf("Expected %s to be refused", schema)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package broadcaster
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets of a LatencyHistogram.
+var latencyBounds = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// Distribution of durations, see Stats.HubLatency. Counts[i] is the number
+// of durations up to Bounds[i], and above the bound before it. The extra
+// last count is of those above all bounds.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+
+	// Number of durations, and their sum
+	Count uint64
+	Sum   time.Duration
+}
+
+// Estimates a quantile from 0 to 1, e.g. 0.99, as the upper bound of the
+// bucket it falls in. Above all bounds, that's the last bound. Zero when
+// empty.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	seen := uint64(0)
+	for i, n := range h.Counts {
+		seen += n
+		if seen > rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Records durations into a histogram. Safe for concurrent use without a
+// lock, each bucket is counted atomically.
+type latencyRecorder struct {
+	counts []uint64
+
+	// Nanoseconds, accessed atomically
+	sum int64
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{
+		counts: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+func (r *latencyRecorder) Record(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool {
+		return d <= latencyBounds[i]
+	})
+	atomic.AddUint64(&r.counts[i], 1)
+	atomic.AddInt64(&r.sum, int64(d))
+}
+
+// The durations recorded so far. Taken while recording goes on, the sum may
+// be a little ahead of or behind the counts.
+func (r *latencyRecorder) Histogram() LatencyHistogram {
+	h := LatencyHistogram{
+		Bounds: append([]time.Duration(nil), latencyBounds...),
+		Counts: make([]uint64, len(r.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&r.sum)),
+	}
+	for i := range r.counts {
+		h.Counts[i] = atomic.LoadUint64(&r.counts[i])
+		h.Count += h.Counts[i]
+	}
+	return h
+}
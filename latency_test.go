@@ -0,0 +1,93 @@
+package broadcaster
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	r := newLatencyRecorder()
+	if q := r.Histogram().Quantile(0.99); q != 0 {
+		t.Errorf("Expected nothing when empty, got %s", q)
+	}
+
+	for i := 0; i < 98; i++ {
+		r.Record(80 * time.Microsecond)
+	}
+	r.Record(3 * time.Millisecond)
+	r.Record(time.Minute)
+
+	h := r.Histogram()
+	if h.Count != 100 {
+		t.Errorf("Expected 100 durations, got %d", h.Count)
+	}
+	if h.Counts[len(h.Counts)-1] != 1 {
+		t.Errorf("Expected one duration above all bounds, got %v", h.Counts)
+	}
+	if want := 98*80*time.Microsecond + 3*time.Millisecond + time.Minute; h.Sum != want {
+		t.Errorf("Expected a sum of %s, got %s", want, h.Sum)
+	}
+
+	for q, want := range map[float64]time.Duration{
+		0.5:  100 * time.Microsecond,
+		0.98: 5 * time.Millisecond,
+		0.99: 2500 * time.Millisecond,
+		1:    2500 * time.Millisecond,
+	} {
+		if got := h.Quantile(q); got != want {
+			t.Errorf("Expected %s at %v, got %s", want, q, got)
+		}
+	}
+}
+
+func TestSubscribeLatency(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	lock := sync.Mutex{}
+	timed := []string{}
+	client, err := newWSClient(server, func(c *Client) {
+		c.SubscribeLatency = func(msgType, channel string, d time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			if d <= 0 {
+				t.Errorf("Expected a duration, got %s", d)
+			}
+			timed = append(timed, msgType+" "+channel)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	if len(timed) != 2 || timed[0] != "subscribe test" || timed[1] != "unsubscribe test" {
+		t.Errorf("Expected both calls to be timed, got %v", timed)
+	}
+	lock.Unlock()
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msgType := range []string{SubscribeMessage, UnsubscribeMessage} {
+		h := stats.HubLatency[msgType]
+		if h.Count != 1 || h.Sum <= 0 {
+			t.Errorf("Expected one %s in the hub, got %+v", msgType, h)
+		}
+	}
+}
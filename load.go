@@ -0,0 +1,93 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+)
+
+// Levels at which a node counts as fully loaded, see Server.LoadThresholds.
+// Zero leaves a signal out of the load.
+type LoadThresholds struct {
+	// Connections on this node, counted like Stats.LocalTransports
+	Connections int
+
+	// Goroutines of the process, a rough measure of CPU and scheduling
+	// pressure: each connection runs a few
+	Goroutines int
+
+	// Bytes held in outbound buffers, defaults to MaxBufferedBytes
+	BufferedBytes int64
+}
+
+// The current load of a node, served at /load for load balancers. See
+// Server.LoadThresholds.
+type LoadReport struct {
+	Connections   int   `json:"connections"`
+	Goroutines    int   `json:"goroutines"`
+	BufferedBytes int64 `json:"buffered_bytes"`
+
+	// See Server.EnterDrainMode
+	Draining bool `json:"draining"`
+
+	// Highest share of its threshold a signal reached: 0 when idle, 1 or
+	// more when overloaded. Zero without thresholds.
+	Load float64 `json:"load"`
+}
+
+// Whether new connections should go elsewhere.
+func (r LoadReport) Overloaded() bool {
+	return r.Draining || r.Load >= 1
+}
+
+// Takes the current load of this node. Cheap enough to be polled often: it
+// doesn't walk the connections.
+func (s *Server) Load() LoadReport {
+	st := s.current()
+	thresholds := s.LoadThresholds
+	if thresholds.BufferedBytes == 0 {
+		thresholds.BufferedBytes = s.config().MaxBufferedBytes
+	}
+
+	r := LoadReport{
+		Connections:   st.hub.ConnectionCount(),
+		Goroutines:    runtime.NumGoroutine(),
+		BufferedBytes: s.buffers.Stats().Used,
+		Draining:      s.inDrainMode(),
+	}
+	share := func(n, limit int64) {
+		if limit > 0 {
+			r.Load = math.Max(r.Load, float64(n)/float64(limit))
+		}
+	}
+	share(int64(r.Connections), int64(thresholds.Connections))
+	share(int64(r.Goroutines), int64(thresholds.Goroutines))
+	share(r.BufferedBytes, thresholds.BufferedBytes)
+	return r
+}
+
+// Answers with the LoadReport as JSON, with 503 Service Unavailable when
+// overloaded or draining, so that a plain health check takes the node out
+// of rotation. With "format=text", a single line as an HAProxy agent check
+// expects: "drain", or the spare capacity as a percentage, e.g. "75%".
+func (s *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+	report := s.Load()
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		if report.Overloaded() {
+			fmt.Fprintln(w, "drain")
+			return
+		}
+		fmt.Fprintf(w, "%d%%\n", int(math.Ceil((1-report.Load)*100)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Overloaded() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,88 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	server, err := startServer(&Server{
+		LoadThresholds: LoadThresholds{Connections: 2},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	get := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/load"+query, nil))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	expect := func(code int, text string) LoadReport {
+		t.Helper()
+		got, body := get("")
+		if got != code {
+			t.Errorf("Expected %d, got %d", code, got)
+		}
+		report := LoadReport{}
+		err := json.Unmarshal([]byte(body), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, body := get("?format=text"); body != text {
+			t.Errorf("Expected %q, got %q", text, body)
+		}
+		return report
+	}
+	// Counted once authenticated, in the background
+	waitConnections := func(n int) {
+		t.Helper()
+		for i := 0; i < 500 && s.Load().Connections != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	report := expect(http.StatusOK, "100%")
+	if report.Connections != 0 || report.Load != 0 || report.Goroutines == 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	waitConnections(1)
+	report = expect(http.StatusOK, "50%")
+	if report.Connections != 1 || report.Load != 0.5 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	// Full, new connections should go elsewhere
+	other, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnections(2)
+	report = expect(http.StatusServiceUnavailable, "drain")
+	if !report.Overloaded() || report.Draining {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	other.Disconnect()
+	waitConnections(1)
+	err = s.EnterDrainMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = expect(http.StatusServiceUnavailable, "drain")
+	if !report.Draining || report.Load != 0.5 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
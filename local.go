@@ -0,0 +1,443 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Connection from within the same process, see Server.LocalClient. Messages
+// are passed as-is, nothing gets serialized.
+type localConnection struct {
+	activity
+
+	ID       string
+	Token    string
+	Server   *Server
+	AuthData ClientMessage
+
+	// The hub and the backend of Server when the connection started
+	*preparedState
+
+	outbox           *outbox
+	subscribeLimiter *rateLimiter
+	pingLimiter      *rateLimiter
+	membersLimiter   *rateLimiter
+
+	// See websocketConnection, guarded by the mutex.
+	ttlGenerations map[string]int
+
+	replay replayGate
+
+	sync.Mutex
+}
+
+// Returns a client that's connected to the server without a network hop.
+// It behaves like any other client: CanConnect and CanSubscribe apply, it's
+// counted in the Stats and subject to the buffer limits.
+//
+// Messages are delivered as they are published: unlike remote clients, the
+// "seq" field is an int64. They're shared with other receivers, so they
+// shouldn't be modified.
+func (s *Server) LocalClient(authData map[string]interface{}) (*Client, error) {
+	if !s.isPrepared() {
+		return nil, errors.New("Prepare() not called on broadcaster.Server")
+	}
+
+	c, err := NewClient("")
+	if err != nil {
+		return nil, err
+	}
+	c.AuthData = authData
+	c.local = s
+
+	err = c.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newLocalConnection(s *Server, authData ClientMessage) *localConnection {
+	c := &localConnection{
+		Server:        s,
+		preparedState: s.current(),
+		ID:            s.newConnectionId(),
+		Token:         uuid.New(),
+		AuthData:      authData,
+	}
+	c.outbox = s.newOutbox(c.ID, func() {
+		// Shed while the hub is busy delivering
+		go c.Cleanup()
+	})
+	return c
+}
+
+// Replies are queued, the client receives them like any other message.
+func (c *localConnection) handshake() error {
+	c.AuthData[idField] = c.ID
+	c.AuthData[clientIDField] = c.Server.assignClientID(c.AuthData)
+	c.outbox.SetMaxRate(maxRate(c.AuthData))
+	c.subscribeLimiter = c.Server.subscribeLimiters.Get(clientKey(c.AuthData), c.Server.config().SubscribeRateLimit)
+	c.pingLimiter = newRateLimiter(c.Server.clock)
+	c.membersLimiter = newRateLimiter(c.Server.clock)
+
+	if !c.Server.canConnect(c.AuthData) {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		c.outbox.CloseWith(newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")))
+		return nil
+	}
+	c.AuthData = c.Server.connectionAttributes(c.AuthData)
+	if c.Server.authExpired(c.AuthData) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		c.outbox.CloseWith(newErrorMessage(AuthFailedMessage, errAuthExpired))
+		return nil
+	}
+
+	err := c.Server.claimConnection(c.AuthData, 0)
+	if qerr, ok := err.(*quotaError); ok {
+		c.outbox.CloseWith(withQuotaCode(newErrorMessage(AuthFailedMessage, qerr), qerr))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.Server.chargeTenant(c.outbox, c.AuthData)
+
+	err = c.redis.StoreSession(c.Token, c.AuthData)
+	if err != nil {
+		c.Server.releaseConnection(c.AuthData)
+		return err
+	}
+
+	err = c.hub.Connect(c)
+	if err != nil {
+		c.redis.DeleteSession(c.Token)
+		c.Server.releaseConnection(c.AuthData)
+		return err
+	}
+	c.Server.contexts.Open(c.ID)
+
+	c.reply(ClientMessage{typeField: AuthOKMessage, idField: c.ID, clientIDField: c.AuthData.ClientID()})
+	return nil
+}
+
+func (c *localConnection) reply(m ClientMessage) {
+	c.outbox.Push(priorityControl, m)
+}
+
+func (c *localConnection) Handle(m ClientMessage) {
+	c.touch(c.Server.clock.Now())
+
+	reply, err := c.Server.handleClientMessage(c, m)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to handle %s: %s", c.ID, m.Type(), err)
+		reply = newErrorMessage(ServerErrorMessage, err)
+	}
+	if reply != nil {
+		c.reply(reply)
+	}
+}
+
+func (c *localConnection) authData() ClientMessage {
+	return c.AuthData
+}
+
+func (c *localConnection) allowSubscribe() (bool, error) {
+	return c.subscribeLimiter.Allow(c.Server.config().SubscribeRateLimit), nil
+}
+
+func (c *localConnection) allowPing() (bool, error) {
+	return c.pingLimiter.Allow(c.Server.config().PingRateLimit), nil
+}
+
+func (c *localConnection) allowSubscribers() (bool, error) {
+	return c.membersLimiter.Allow(c.Server.config().SubscribersRateLimit), nil
+}
+
+func (c *localConnection) handleSubscribe(channel string, m ClientMessage) (string, error) {
+	err := c.subscribe(channel, m.TTL(), m.Echo(), m.QoS(), m.LastSeq())
+	if err != nil {
+		return "", err
+	}
+	c.Server.joinPresence(c.AuthData, channel)
+	return c.hub.subscriptionID(c, channel), nil
+}
+
+func (c *localConnection) handleUnsubscribe(channel string) error {
+	hub := c.hub
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		return err
+	}
+	c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	c.Server.leavePresence(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	return nil
+}
+
+func (c *localConnection) lookupSubscription(id string) (string, bool, error) {
+	channel, ok := c.hub.subscriptionChannel(c, id)
+	return channel, ok, nil
+}
+
+func (c *localConnection) isSubscribed(channel string) (bool, error) {
+	return c.hub.hasSubscription(c, channel), nil
+}
+
+func (c *localConnection) handleTouch(channel string) (bool, error) {
+	if !c.hub.hasSubscription(c, channel) {
+		return false, nil
+	}
+	c.Server.expiries.Renew(subscriptionKey(c, channel))
+	return true, nil
+}
+
+// Local clients don't reauthenticate or migrate.
+func (c *localConnection) handleAuth(m ClientMessage) (ClientMessage, error) {
+	return newMessage(UnknownMessage), nil
+}
+
+func (c *localConnection) handleMigrated() (ClientMessage, error) {
+	return newMessage(UnknownMessage), nil
+}
+
+func (c *localConnection) hubConnection() connection {
+	return c
+}
+
+// Subscribing again renews or replaces the TTL, echo and QoS.
+func (c *localConnection) subscribe(channel string, requested time.Duration, echo bool, qos string, after int64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.Server.claimSubscription(c.AuthData, channel, 0)
+	if err != nil {
+		return err
+	}
+
+	hub := c.hub
+	wasReliable := hub.isReliable(c, channel)
+	if qos == QoSAtLeastOnce {
+		c.replay.Hold(channel)
+	}
+	opts := c.Server.subscriptionOptions(c.AuthData, channel, echo, qos)
+	err = hub.SubscribeWith(c, channel, opts)
+	if err != nil {
+		c.replay.Release(channel, nil, 0, c.pushReliable)
+		c.Server.releaseSubscriptions(c.AuthData, channel)
+		return err
+	}
+	if qos == QoSAtLeastOnce {
+		c.Server.replayPending(c.AuthData, channel, opts, after, &c.replay, c.pushReliable)
+	} else if wasReliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+
+	if c.ttlGenerations == nil {
+		c.ttlGenerations = make(map[string]int)
+	}
+	c.ttlGenerations[channel]++
+	generation := c.ttlGenerations[channel]
+
+	key := subscriptionKey(c, channel)
+	ttl := c.Server.subscriptionTTL(c.AuthData, channel, requested)
+	if ttl > 0 {
+		c.Server.expiries.Schedule(key, ttl, func() {
+			c.expireSubscription(channel, generation)
+		})
+	} else {
+		c.Server.expiries.Cancel(key)
+	}
+	return nil
+}
+
+func (c *localConnection) expireSubscription(channel string, generation int) {
+	c.Lock()
+	defer c.Unlock()
+
+	hub := c.hub
+	if generation != c.ttlGenerations[channel] || !hub.hasSubscription(c, channel) {
+		return // Renewed or gone in the meantime
+	}
+
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to expire %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.leavePresence(c.AuthData, channel)
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	c.reply(newExpiredMessage(channel))
+}
+
+func (c *localConnection) revokeSubscription(channel string, notice ClientMessage) {
+	c.Lock()
+	defer c.Unlock()
+
+	hub := c.hub
+	if !hub.hasSubscription(c, channel) {
+		return
+	}
+
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to revoke %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	c.Server.leavePresence(c.AuthData, channel)
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	c.reply(notice)
+}
+
+func (c *localConnection) Cleanup() {
+	c.outbox.Close()
+
+	if !c.hub.hasConnection(c) {
+		return
+	}
+
+	err := c.redis.DeleteSession(c.Token)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to delete session: %s", c.ID, err)
+	}
+
+	channels := c.hub.Channels(c)
+	for _, channel := range channels {
+		c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	}
+	reliable := c.hub.ReliableChannels(c)
+	err = c.hub.Disconnect(c)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to disconnect: %s", c.ID, err)
+	}
+	c.Server.leavePresence(c.AuthData, channels...)
+	c.Server.releaseConnection(c.AuthData, channels...)
+	c.Server.releasePending(c.AuthData, reliable...)
+	c.Server.contexts.Cancel(c.ID)
+}
+
+func (c *localConnection) Send(m ClientMessage) {
+	c.Server.queueMessage(c.outbox, m)
+}
+
+func (c *localConnection) SendReliable(m ClientMessage) {
+	c.replay.Deliver(m, c.pushReliable)
+}
+
+func (c *localConnection) pushReliable(m ClientMessage) {
+	p := c.Server.channelConfig(m.Channel()).Priority
+	c.outbox.PushReliable(p, m)
+}
+
+func (c *localConnection) Process(t string, args []string) {
+	switch t {
+	case "kick":
+		c.outbox.CloseWith(newKickMessage(strings.Join(args, " ")))
+	case "unsubscribe-id":
+		c.Server.processForcedUnsubscribes(c)
+	default:
+		panic("Local connections don't use control messages!")
+	}
+}
+
+func (c *localConnection) inspect() ConnectionState {
+	return ConnectionState{
+		ID:               c.ID,
+		Transport:        c.GetTransport(),
+		AuthData:         c.AuthData,
+		BufferedMessages: c.outbox.Len(),
+		BufferedBytes:    c.outbox.Bytes(),
+		LastActivity:     c.lastActivity(),
+	}
+}
+
+func (c *localConnection) GetToken() string {
+	return c.Token
+}
+
+func (c *localConnection) GetID() string {
+	return c.ID
+}
+
+func (c *localConnection) GetTransport() string {
+	return "local"
+}
+
+func (c *localConnection) audit(t, channel, reason string) {
+	c.Server.audit(AuditEvent{
+		Type:         t,
+		ConnectionID: c.ID,
+		Identity:     c.Server.identity(c.AuthData),
+		Transport:    c.GetTransport(),
+		Channel:      channel,
+		Reason:       reason,
+	})
+}
+
+// Client transport
+type localClientTransport struct {
+	server *Server
+	conn   *localConnection
+}
+
+func (t *localClientTransport) Connect(authData ClientMessage) error {
+	data := make(ClientMessage)
+	for k, v := range authData {
+		data[k] = v
+	}
+	data[typeField] = AuthMessage
+
+	t.conn = newLocalConnection(t.server, data)
+	return t.conn.handshake()
+}
+
+func (t *localClientTransport) Close() error {
+	if t.conn != nil {
+		t.conn.Cleanup()
+	}
+	return nil
+}
+
+func (t *localClientTransport) Send(data ClientMessage) error {
+	t.conn.Handle(data)
+	return nil
+}
+
+func (t *localClientTransport) Receive() (ClientMessage, error) {
+	m, ok := t.conn.outbox.Pop()
+	if !ok {
+		return nil, io.EOF
+	}
+	t.conn.Server.delivered(t.conn.ID, m)
+	return m, nil
+}
+
+// Only used in raw mode, which needs the encoded form.
+func (t *localClientTransport) ReceiveRaw() ([]byte, error) {
+	m, err := t.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func (t *localClientTransport) onConnect() {
+}
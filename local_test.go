@@ -0,0 +1,62 @@
+package broadcaster
+
+import "testing"
+
+func TestLocalClient(t *testing.T) {
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return data["token"] == "abcdefg"
+		},
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel == "test"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	_, err = server.Broadcaster.LocalClient(map[string]interface{}{"token": "wrong"})
+	if err == nil || err.Error() != "Auth error: Unauthorized" {
+		t.Fatalf("Expected auth error, got %v", err)
+	}
+
+	client, err := server.Broadcaster.LocalClient(map[string]interface{}{"token": "abcdefg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("secret")
+	if err == nil {
+		t.Error("Expected subscribe to be refused")
+	}
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LocalTransports["local"] != 1 || stats.Connections != 1 {
+		t.Errorf("Expected local connection in stats, got %#v", stats)
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != MessageMessage || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Errorf("Wrong message payload: %v", m)
+	}
+
+	// Never serialized
+	if m["seq"] != int64(1) {
+		t.Errorf("Expected unencoded sequence number, got %#v", m["seq"])
+	}
+}
@@ -3,157 +3,512 @@ package broadcaster
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pborman/uuid"
 )
 
 type longpollConnection struct {
-	Token    string
-	Server   *Server
-	AuthData ClientMessage
+	activity
+
+	// Set while collecting messages for the next poll, accessed
+	// atomically.
+	waiting int32
+
+	ID         string
+	Token      string
+	Server     *Server
+	AuthData   ClientMessage
+	RemoteAddr string
+
+	// The hub and the backend of Server when the connection started
+	*preparedState
+
+	// Over HTTP/2, see commitHeaders
+	http2 bool
 
 	combining bool
 	messages  chan ClientMessage
 	deadline  <-chan time.Time
+	expires   <-chan time.Time
+	expired   bool
+	kicked    bool
+
+	transfer chan string
+	kick     chan string
 
-	subscribe   chan string
-	unsubscribe chan string
-	transfer    chan string
+	// Subscriptions changed by other requests while polling, in order.
+	// Queued rather than handed over: the hub holds its lock meanwhile,
+	// which subscribing takes too. Guarded by changesLock.
+	changes     []longpollSubscription
+	changed     chan struct{}
+	changesLock sync.Mutex
+}
+
+// Subscription made or undone by another request while polling.
+type longpollSubscription struct {
+	channel     string
+	echo        bool
+	unsubscribe bool
+
+	// Tells the client, see revokeSubscription
+	notice ClientMessage
 }
 
 func handleLongpollConnection(w http.ResponseWriter, r *http.Request, s *Server) error {
+	st := s.current()
+	// Tapped once we know whose request it is.
+	var tap *wireTapWriter
+	if s.wireTap != nil {
+		tap = &wireTapWriter{ResponseWriter: w, server: s}
+		w = tap
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if tap != nil {
+		tap.receive(data)
+	}
+
 	m := ClientMessage{}
-	json.NewDecoder(r.Body).Decode(&m)
+	if s.StrictProtocol {
+		var reply ClientMessage
+		m, reply = decodeStrict(longpollSchemas, s.EnvelopeFields, data)
+		if reply != nil {
+			return longpollProtocolError(w, s, m.Token(), reply)
+		}
+	} else {
+		if !utf8.Valid(data) {
+			s.httpError(w, newHTTPError(http.StatusBadRequest, errInvalidUTF8.Error()))
+			return nil
+		}
+		json.Unmarshal(data, &m)
+		m = s.EnvelopeFields.decode(m)
+	}
 
-	redis := s.redis
+	redis := st.redis
 
-	token := m.Token()
-	connected := false
+	var auth ClientMessage
 	if m.Token() != "" {
-		c, err := redis.IsConnected(token)
+		a, err := redis.GetSession(m.Token())
 		if err != nil {
 			return err
 		}
-		connected = c
+		auth = a
 	}
 
-	if !connected {
+	if auth == nil {
+		if s.inDrainMode() {
+			s.refuseDraining(w)
+			return nil
+		}
+		if s.StrictProtocol && m.Type() != AuthMessage {
+			reply := newProtocolErrorMessage(ProtocolErrorUnexpected, m.Type(), "Auth expected")
+			return longpollProtocolError(w, s, "", reply)
+		}
+
 		conn := &longpollConnection{
-			Server:   s,
-			Token:    uuid.New(),
-			AuthData: m,
+			Server:        s,
+			preparedState: st,
+			ID:            s.newConnectionId(),
+			Token:         uuid.New(),
+			AuthData:      m,
+			RemoteAddr:    r.RemoteAddr,
 		}
+		tap.attach(conn.ID)
 		return conn.handshake(w, r, m)
 	}
 
 	// Existing connection
 	conn := &longpollConnection{
-		Server: s,
-		Token:  m.Token(),
+		Server:        s,
+		preparedState: st,
+		ID:            auth.ConnectionID(),
+		Token:         m.Token(),
+		AuthData:      auth,
+		RemoteAddr:    r.RemoteAddr,
+		http2:         isHTTP2(r),
 	}
+	tap.attach(conn.ID)
 
 	if m.Type() == PollMessage {
-		return conn.poll(w, m["seq"].(string))
+		if status := s.Faults.pollStatus(); status != 0 {
+			w.WriteHeader(status)
+			return nil
+		}
+		short, _ := m["short"].(bool)
+		return conn.poll(w, m["seq"].(string), short)
+	}
+
+	reply, err := s.handleClientMessage(conn, m)
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		s.longpollReply(w, reply)
 	} else {
-		switch m.Type() {
-		case SubscribeMessage:
-			auth, err := redis.GetSession(m.Token())
-			if err != nil {
-				return err
-			}
+		s.longpollReply(w)
+	}
+	return nil
+}
 
-			channel := m.Channel()
-			if s.CanSubscribe != nil && !s.CanSubscribe(auth, channel) {
-				longpollReply(w, ClientMessage{
-					"__type":  SubscribeErrorMessage,
-					"channel": channel,
-					"reason":  "Channel refused",
-				})
-				return nil
-			}
+func (c *longpollConnection) authData() ClientMessage {
+	return c.AuthData
+}
 
-			err = redis.LongpollSubscribe(m.Token(), channel)
-			if err != nil {
-				longpollReply(w, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
-				return nil
-			}
+func (c *longpollConnection) allowSubscribe() (bool, error) {
+	limit := c.Server.config().SubscribeRateLimit
+	if !limit.enabled() {
+		return true, nil
+	}
+	return c.redis.RateLimit("subscribe:"+clientKey(c.AuthData), limit)
+}
 
-			longpollReply(w, newChannelMessage(SubscribeOKMessage, channel))
+func (c *longpollConnection) allowPing() (bool, error) {
+	return c.redis.RateLimit("ping:"+c.ID, c.Server.config().PingRateLimit)
+}
 
-		case UnsubscribeMessage:
-			channel := m.Channel()
-			err := redis.LongpollUnsubscribe(m.Token(), channel)
-			if err != nil {
-				longpollReply(w, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
-				return nil
-			}
+func (c *longpollConnection) allowSubscribers() (bool, error) {
+	return c.redis.RateLimit("subscribers:"+c.ID, c.Server.config().SubscribersRateLimit)
+}
 
-			longpollReply(w, newChannelMessage(UnsubscribeOKMessage, channel))
+// Subscribes the session, the next poll listens to the channel.
+func (c *longpollConnection) handleSubscribe(channel string, m ClientMessage) (string, error) {
+	s := c.Server
+	if s.authExpired(c.AuthData) {
+		return "", errAuthExpired
+	}
+	err := s.claimSubscription(c.AuthData, channel, s.longpollLease())
+	if err != nil {
+		return "", err
+	}
 
-		default:
-			longpollReply(w, newMessage(UnknownMessage))
-		}
+	ttl := s.subscriptionTTL(c.AuthData, channel, m.TTL())
+	id, err := c.redis.LongpollSubscribe(c.Token, channel, ttl, m.Echo(), s.clock.Now())
+	if err != nil {
+		s.releaseSubscriptions(c.AuthData, channel)
+		return "", err
+	}
+	return id, nil
+}
+
+func (c *longpollConnection) handleUnsubscribe(channel string) error {
+	return c.redis.LongpollUnsubscribe(c.Token, channel)
+}
+
+func (c *longpollConnection) lookupSubscription(id string) (string, bool, error) {
+	return c.redis.LongpollSubscriptionChannel(c.Token, id)
+}
+
+func (c *longpollConnection) isSubscribed(channel string) (bool, error) {
+	channels, err := c.redis.LongpollGetSubscriptions(c.Token)
+	if err != nil {
+		return false, err
 	}
+	_, ok := channels[channel]
+	return ok, nil
+}
 
+func (c *longpollConnection) handleTouch(channel string) (bool, error) {
+	return c.redis.LongpollTouch(c.Token, channel, c.Server.clock.Now())
+}
+
+func (c *longpollConnection) handleAuth(m ClientMessage) (ClientMessage, error) {
+	return c.reauthenticate(m)
+}
+
+func (c *longpollConnection) handleMigrated() (ClientMessage, error) {
+	return nil, c.Server.endLongpollSession(c.Token, c.AuthData)
+}
+
+// Pausing and acknowledging make no difference between polls.
+func (c *longpollConnection) hubConnection() connection {
 	return nil
 }
 
 func (c *longpollConnection) handshake(w http.ResponseWriter, r *http.Request, auth ClientMessage) error {
 	// Expect auth packet first.
-	if auth.Type() != AuthMessage {
-		w.WriteHeader(401)
-		longpollReply(w, ClientMessage{"__type": AuthFailedMessage, "reason": "Auth expected"})
+	if reply := c.Server.checkAuthType(auth); reply != nil {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpected)
+		c.Server.longpollFailure(w, http.StatusUnauthorized, reply)
+		return nil
+	}
+
+	if c.Server.RequireNonce {
+		ok, err := c.checkNonce(w, auth)
+		if !ok || err != nil {
+			return err
+		}
+	}
+	auth[idField] = c.ID
+
+	if credential, ok := auth[sessionField].(string); ok {
+		// Accepted before, see Server.SessionTTL.
+		data, err := c.Server.resumeSession(credential, c.ID)
+		if err == errNoSession {
+			c.audit(AuditAuthFailed, "", AuditReasonNoSession)
+			c.Server.longpollFailure(w, http.StatusUnauthorized, newErrorMessage(AuthFailedMessage, err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		auth = data
+	} else {
+		auth[clientIDField] = c.Server.assignClientID(auth)
+
+		if !c.Server.canConnect(auth) {
+			c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+			c.Server.longpollFailure(w, http.StatusUnauthorized, ClientMessage{typeField: AuthFailedMessage, "reason": "Unauthorized"})
+			return nil
+		}
+		auth = c.Server.connectionAttributes(auth)
+	}
+	c.AuthData = auth
+
+	if c.Server.authExpired(auth) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		c.Server.longpollFailure(w, http.StatusUnauthorized, newErrorMessage(AuthFailedMessage, errAuthExpired))
 		return nil
 	}
 
-	if c.Server.CanConnect != nil && !c.Server.CanConnect(auth) {
-		w.WriteHeader(401)
-		longpollReply(w, ClientMessage{"__type": AuthFailedMessage, "reason": "Unauthorized"})
+	err := c.Server.claimConnection(auth, c.Server.longpollLease())
+	if qerr, ok := err.(*quotaError); ok {
+		c.Server.longpollFailure(w, http.StatusTooManyRequests, withQuotaCode(newErrorMessage(AuthFailedMessage, qerr), qerr))
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
 	// Store session
-	err := c.Server.redis.StoreSession(c.Token, auth)
+	err = c.redis.StoreSession(c.Token, auth)
 	if err != nil {
+		c.Server.releaseConnection(auth)
 		return err
 	}
 
-	longpollReply(w, ClientMessage{"__type": AuthOKMessage, "__token": c.Token})
+	reply := c.Server.newAuthOKMessage(auth)
+	reply[tokenField] = c.Token
+	c.Server.longpollReply(w, reply)
 
 	return nil
 }
 
-func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
-	redis := c.Server.redis
-	err := redis.LongpollPing(c.Token)
+// Replaces the auth data of the session, e.g. to refresh a token, returns
+// the reply. The session keeps its ID and subscriptions. When refused, the
+// previous auth data stays in effect.
+func (c *longpollConnection) reauthenticate(m ClientMessage) (ClientMessage, error) {
+	packet := make(ClientMessage, len(m))
+	for k, v := range m {
+		packet[k] = v
+	}
+	delete(packet, tokenField)
+	packet[idField] = c.ID
+	packet[clientIDField] = c.AuthData.ClientID()
+
+	if !c.Server.canConnect(packet) {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		return newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")), nil
+	}
+	data := c.Server.connectionAttributes(packet)
+	if c.Server.authExpired(data) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		return newErrorMessage(AuthFailedMessage, errAuthExpired), nil
+	}
+	if data.Tenant() != c.AuthData.Tenant() {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		return newErrorMessage(AuthFailedMessage, errTenantChanged), nil
+	}
+
+	err := c.redis.StoreSession(c.Token, data)
+	if err != nil {
+		return nil, err
+	}
+	c.Server.forgetSubscribeAccess(c.AuthData, "")
+	c.Server.forgetSubscribeAccess(data, "")
+
+	reply := c.Server.newAuthOKMessage(data)
+	reply[tokenField] = c.Token
+	return reply, nil
+}
+
+// Returns true if the auth packet carries a valid nonce. Otherwise the
+// client is sent a new challenge or an error.
+func (c *longpollConnection) checkNonce(w http.ResponseWriter, auth ClientMessage) (bool, error) {
+	redis := c.redis
+
+	nonce, _ := auth[nonceField].(string)
+	if nonce == "" {
+		nonce = randomId(16)
+		err := redis.StoreNonce(nonce, c.Server.NonceTimeout)
+		if err != nil {
+			return false, err
+		}
+
+		c.Server.longpollReply(w, ClientMessage{typeField: AuthChallengeMessage, "nonce": nonce})
+		return false, nil
+	}
+
+	// Consume it first: it's gone, whatever the outcome.
+	valid, err := redis.ConsumeNonce(nonce)
+	if err != nil {
+		return false, err
+	}
+	if !valid {
+		c.audit(AuditAuthFailed, "", AuditReasonInvalidNonce)
+		c.Server.longpollFailure(w, http.StatusUnauthorized, ClientMessage{typeField: AuthFailedMessage, "reason": "Invalid nonce"})
+		return false, nil
+	}
+
+	if auth[proofField] != authProof(nonce, auth) {
+		c.audit(AuditAuthFailed, "", AuditReasonInvalidProof)
+		c.Server.longpollFailure(w, http.StatusUnauthorized, ClientMessage{typeField: AuthFailedMessage, "reason": "Invalid proof"})
+		return false, nil
+	}
+
+	delete(auth, nonceField)
+	delete(auth, proofField)
+	return true, nil
+}
+
+// Holds the poll until messages arrive or it times out. Short polls only
+// wait for what's already queued.
+func (c *longpollConnection) poll(w http.ResponseWriter, seq string, short bool) error {
+	c.touch(c.Server.clock.Now())
+
+	redis := c.redis
+
+	// Kicked while not polling? Deliver the final message and end it.
+	final, kicked, err := redis.LongpollTakeKick(c.Token, c.ID)
 	if err != nil {
 		return err
 	}
+	if kicked {
+		err := c.Server.endLongpollSession(c.Token, c.AuthData)
+		if err != nil {
+			return err
+		}
+		c.Server.longpollReply(w, newKickMessage(final))
+		return nil
+	}
 
-	c.deadline = time.After(c.Server.Timeout - c.Server.PollTime)
-	c.messages = make(chan ClientMessage, 10)
-	c.subscribe = make(chan string, 1)
-	c.unsubscribe = make(chan string, 1)
-	c.transfer = make(chan string, 1)
+	err = redis.LongpollPing(c.Token)
+	if err != nil {
+		return err
+	}
+	c.Server.renewSession(c.AuthData, c.Server.Timeout)
 
-	hub := c.Server.hub
+	// Draining? Ask the client to move, once. The session ends when it
+	// confirms, or expires.
+	if opts, ok := c.Server.draining(); ok {
+		first, err := redis.LongpollMigrate(c.Token)
+		if err != nil {
+			return err
+		}
+		if first {
+			c.Server.longpollReply(w, newMigrateMessage(opts))
+			return nil
+		}
+	} else if c.Server.inDrainMode() {
+		first, err := redis.LongpollDraining(c.Token)
+		if err != nil {
+			return err
+		}
+		if first {
+			c.Server.longpollReply(w, newMessage(DrainingMessage))
+			return nil
+		}
+	}
 
-	err = hub.Connect(c)
+	// Drop subscriptions whose TTL passed, the client hears about it right
+	// away.
+	expired, err := redis.LongpollExpiredChannels(c.Token, c.Server.clock.Now())
 	if err != nil {
 		return err
 	}
+	if len(expired) > 0 {
+		replies := []ClientMessage{}
+		for _, channel := range expired {
+			err := redis.LongpollUnsubscribe(c.Token, channel)
+			if err != nil {
+				return err
+			}
+			c.Server.releaseSubscriptions(c.AuthData, channel)
+			replies = append(replies, newExpiredMessage(channel))
+		}
+		c.Server.expiries.countExpired(len(expired))
+		c.Server.longpollReply(w, replies...)
+		return nil
+	}
+
+	if short {
+		c.deadline = after(c.Server.clock, c.Server.config().PollTime)
+	} else {
+		c.deadline = after(c.Server.clock, c.Server.Timeout-c.Server.config().PollTime)
+	}
+	c.messages = make(chan ClientMessage, c.Server.LongPollBufferSize)
+	c.changed = make(chan struct{}, 1)
+	c.transfer = make(chan string, 1)
+	c.kick = make(chan string, 1)
+
+	// Unsubscribed by the server while not polling? The notices go out with
+	// this poll.
+	err = c.Server.endForcedSubscriptions(c)
+	if err != nil {
+		return err
+	}
+
+	hub := c.hub
 
 	// Resubscribe to all the channels that are tracked by this connection.
-	channels, err := redis.LongpollGetChannels(c.Token)
+	channels, err := redis.LongpollGetSubscriptions(c.Token)
 	if err != nil {
 		return err
 	}
-	for _, channel := range channels {
-		err := hub.Subscribe(c, channel)
+	err = c.Server.renewLongpollQuotas(c.AuthData, channels)
+	if err != nil {
+		return err
+	}
+
+	// Revoke everything once the auth data expires. When it expires while
+	// waiting, we stop listening and do so on the next poll.
+	expires := c.Server.authExpiry(c.AuthData)
+	if !expires.IsZero() {
+		if now := c.Server.clock.Now(); expires.After(now) {
+			c.expires = after(c.Server.clock, expires.Sub(now))
+		} else if len(channels) > 0 {
+			for channel, _ := range channels {
+				err := redis.LongpollUnsubscribe(c.Token, channel)
+				if err != nil {
+					return err
+				}
+				c.Server.releaseSubscriptions(c.AuthData, channel)
+			}
+			c.Server.longpollReply(w, newMessage(AuthExpiredMessage))
+			return nil
+		}
+	}
+
+	err = hub.Connect(c)
+	if err != nil {
+		return err
+	}
+
+	for channel, echo := range channels {
+		err := hub.SubscribeWith(c, channel, c.Server.subscriptionOptions(c.AuthData, channel, echo, QoSAtMostOnce))
 		if err != nil {
 			hub.Disconnect(c)
 			return err
@@ -163,8 +518,27 @@ func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
 	// Kill other listeners
 	go redis.LongpollTransfer(c.Token, seq)
 
-	// Ensure we broadcast the backlog
-	go redis.LongpollGetBacklog(c.Token, c.messages)
+	// Ensure we broadcast the backlog, then what this node kept for the
+	// session since it started (see Server.WarmStartWindow).
+	go func() {
+		redis.LongpollGetBacklog(c.Token, c.messages)
+		if hub.warm != nil {
+			for _, m := range hub.warm.Take(c.Token) {
+				c.messages <- m
+			}
+		}
+	}()
+
+	// Over HTTP/2 the answer is on its way already, so that proxies don't
+	// sit on the stream for the whole poll.
+	if c.http2 && !short {
+		err := c.Server.commitHeaders(w, "application/json")
+		if isTimeout(err) {
+			c.Server.writeTimedOut(c.ID)
+			c.evict()
+			return nil
+		}
+	}
 
 	// Wait until we either time-out or until the message deadline hits.
 	// The initial deadline is configured to the polling Timeout length.
@@ -172,15 +546,33 @@ func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
 	//
 	// Also handles notifications of (un)subscription which may have happend
 	// while waiting.
-	messages := []ClientMessage{}
+	//
+	// Combined messages are sent in order of priority.
+	messages := c.Server.newOutbox(c.ID, nil)
+	c.Server.chargeTenant(messages, c.AuthData)
 	transferred := c.listen(seq, func(m ClientMessage) {
 		if !c.combining {
-			c.deadline = time.After(c.Server.PollTime)
+			c.deadline = after(c.Server.clock, c.Server.config().PollTime)
 			c.combining = true
 		}
-		messages = append(messages, m)
+		messages.Push(c.Server.channelConfig(m.Channel()).Priority, m)
 	})
-	longpollReply(w, messages...)
+	replies := messages.Drain()
+	err = c.Server.writeResponse(w, func() error {
+		if c.Server.Faults.truncatePoll() {
+			return c.Server.longpollReplyTruncated(w, replies...)
+		}
+		return c.Server.longpollReply(w, replies...)
+	})
+	messages.Close()
+	if isTimeout(err) {
+		c.Server.writeTimedOut(c.ID)
+		c.evict()
+		return nil
+	}
+	if err == nil {
+		c.Server.delivered(c.ID, replies...)
+	}
 
 	if transferred {
 		hub.Disconnect(c)
@@ -190,27 +582,79 @@ func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
 	go func() {
 		// Listens for new messages until a new client connects. This ensures we
 		// don't lose any messages
-		c.deadline = time.After(c.Server.Timeout)
-		c.listen(seq, func(m ClientMessage) {
-			redis.LongpollBacklog(c.Token, m)
-		})
-		hub.Disconnect(c)
+		if !c.expired && !c.kicked {
+			atomic.StoreInt32(&c.waiting, 1)
+			c.deadline = after(c.Server.clock, c.Server.Timeout)
+			c.listen(seq, func(m ClientMessage) {
+				redis.LongpollBacklog(c.Token, m)
+			})
+		}
+		err := hub.Disconnect(c)
+		if err != nil {
+			c.Server.logf("Connection %s: failed to disconnect: %s", c.ID, err)
+		}
 	}()
 
 	return nil
 }
 
+// Ends the session of a client that stopped reading, rather than keeping a
+// backlog for it. Drains while disconnecting: the hub may be blocked handing
+// this connection a message.
+func (c *longpollConnection) evict() {
+	err := c.Server.endLongpollSession(c.Token, c.AuthData)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to delete session: %s", c.ID, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c.messages:
+			case <-c.transfer:
+			case <-c.kick:
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = c.hub.Disconnect(c)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to disconnect: %s", c.ID, err)
+	}
+	close(done)
+}
+
 func (c *longpollConnection) listen(seq string, onMessage func(m ClientMessage)) bool {
-	hub := c.Server.hub
+	hub := c.hub
 
 	for {
 		select {
 		case <-c.deadline:
 			return false
-		case channel := <-c.subscribe:
-			hub.Subscribe(c, channel)
-		case channel := <-c.unsubscribe:
-			hub.Unsubscribe(c, channel)
+		case <-c.expires:
+			c.expired = true
+			return false
+		case message := <-c.kick:
+			// Picked up by the next poll, which ends the session.
+			err := c.redis.LongpollKick(c.Token, message)
+			if err != nil {
+				c.Server.logf("Connection %s: failed to kick: %s", c.ID, err)
+			}
+			c.kicked = true
+			return false
+		case <-c.changed:
+			for _, s := range c.takeChanges() {
+				if s.unsubscribe {
+					hub.Unsubscribe(c, s.channel)
+					if s.notice != nil {
+						onMessage(s.notice)
+					}
+				} else {
+					hub.SubscribeWith(c, s.channel, c.Server.subscriptionOptions(c.AuthData, s.channel, s.echo, QoSAtMostOnce))
+				}
+			}
 		case s := <-c.transfer:
 			if s != seq {
 				return true
@@ -221,12 +665,101 @@ func (c *longpollConnection) listen(seq string, onMessage func(m ClientMessage))
 	}
 }
 
-func longpollReply(w http.ResponseWriter, m ...ClientMessage) {
-	json.NewEncoder(w).Encode(m)
+// Ends a session, along with what it counts towards the quotas of its
+// tenant.
+func (s *Server) endLongpollSession(token string, auth ClientMessage) error {
+	st := s.current()
+	channels := []string{}
+	if auth.Tenant() != "" {
+		subscriptions, err := st.redis.LongpollGetSubscriptions(token)
+		if err != nil {
+			return err
+		}
+		for channel, _ := range subscriptions {
+			channels = append(channels, channel)
+		}
+	}
+
+	err := st.redis.DeleteSession(token)
+	if err != nil {
+		return err
+	}
+	s.releaseConnection(auth, channels...)
+	return nil
+}
+
+// Replies with a protocol error in strict mode, ends the session if asked to.
+func longpollProtocolError(w http.ResponseWriter, s *Server, token string, reply ClientMessage) error {
+	st := s.current()
+	if s.DisconnectOnProtocolError && token != "" {
+		auth, err := st.redis.GetSession(token)
+		if err != nil {
+			return err
+		}
+		if auth != nil {
+			err := s.endLongpollSession(token, auth)
+			if err != nil {
+				return err
+			}
+
+			// Ends a poll that's in progress.
+			err = st.redis.Kick(auth.ConnectionID(), reply["reason"].(string))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	status := http.StatusBadRequest
+	if reply["code"] == ProtocolErrorUnexpected {
+		status = http.StatusUnauthorized
+	}
+	s.longpollFailure(w, status, reply)
+	return nil
+}
+
+func (s *Server) longpollReply(w http.ResponseWriter, m ...ClientMessage) error {
+	if m == nil {
+		m = []ClientMessage{}
+	}
+	return json.NewEncoder(w).Encode(s.EnvelopeFields.encodeAll(m))
+}
+
+func (c *longpollConnection) Send(m ClientMessage) {
+	c.messages <- m
 }
 
-func (c *longpollConnection) Send(channel, message string) {
-	c.messages <- newBroadcastMessage(channel, message)
+// Queues a subscription change for the poll to make, without blocking.
+func (c *longpollConnection) queueChange(s longpollSubscription) {
+	c.changesLock.Lock()
+	c.changes = append(c.changes, s)
+	c.changesLock.Unlock()
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Ends the subscription for the session. The poll in progress delivers the
+// notice, or keeps it for the next one.
+func (c *longpollConnection) revokeSubscription(channel string, notice ClientMessage) {
+	err := c.redis.LongpollUnsubscribe(c.Token, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to revoke %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	c.queueChange(longpollSubscription{channel: channel, unsubscribe: true, notice: notice})
+}
+
+func (c *longpollConnection) takeChanges() []longpollSubscription {
+	c.changesLock.Lock()
+	defer c.changesLock.Unlock()
+
+	changes := c.changes
+	c.changes = nil
+	return changes
 }
 
 func (c *longpollConnection) Process(t string, args []string) {
@@ -234,9 +767,25 @@ func (c *longpollConnection) Process(t string, args []string) {
 	case "transfer":
 		c.transfer <- args[0]
 	case "subscribe":
-		c.subscribe <- args[0]
+		c.queueChange(longpollSubscription{channel: args[0], echo: len(args) > 1 && args[1] == "echo"})
 	case "unsubscribe":
-		c.unsubscribe <- args[0]
+		c.queueChange(longpollSubscription{channel: args[0], unsubscribe: true})
+	case "kick":
+		c.kick <- strings.Join(args, " ")
+	case "unsubscribe-id":
+		c.Server.processForcedUnsubscribes(c)
+	}
+}
+
+func (c *longpollConnection) inspect() ConnectionState {
+	return ConnectionState{
+		ID:               c.ID,
+		Transport:        c.GetTransport(),
+		RemoteAddr:       c.RemoteAddr,
+		AuthData:         c.AuthData,
+		BufferedMessages: len(c.messages),
+		LastActivity:     c.lastActivity(),
+		WaitingForPoll:   atomic.LoadInt32(&c.waiting) == 1,
 	}
 }
 
@@ -244,22 +793,76 @@ func (c *longpollConnection) GetToken() string {
 	return c.Token
 }
 
+func (c *longpollConnection) GetID() string {
+	return c.ID
+}
+
+func (c *longpollConnection) GetTransport() string {
+	return "longpoll"
+}
+
+func (c *longpollConnection) audit(t, channel, reason string) {
+	c.Server.audit(AuditEvent{
+		Type:         t,
+		ConnectionID: c.ID,
+		Identity:     c.Server.identity(c.AuthData),
+		RemoteAddr:   c.RemoteAddr,
+		Transport:    c.GetTransport(),
+		Channel:      channel,
+		Reason:       reason,
+	})
+}
+
+// The client decides that the server can't hold polls open after this many
+// premature answers in a row: empty ones that came back within
+// longpollMinHold, or gateway timeouts (504) from a proxy in between. From
+// then on it polls every Client.PollInterval, asking for short polls.
+const (
+	longpollHoldFailures = 3
+	longpollMinHold      = 500 * time.Millisecond
+)
+
+// Broadcast messages remembered by the client to drop duplicates. While a
+// new poll takes over, the previous one still stores what it receives in
+// the backlog, so a message can arrive directly and again from the backlog.
+const longpollDedupSize = 1000
+
 // Client transport
 type longpollClientTransport struct {
-	running    bool
 	client     *Client
-	messages   chan ClientMessage
-	err        error
+	messages   chan json.RawMessage
+	closed     bool
+	lock       sync.Mutex
 	token      string
 	httpClient http.Client
-	httpReq    *http.Request
 	call       int
+
+	// Poll loop state, also changed by Close. Guarded by stateLock rather
+	// than lock, which is held while handing over messages.
+	running   bool
+	stopped   bool
+	err       error
+	httpReq   *http.Request
+	stateLock sync.Mutex
+
+	// Closed by Close, lets go of a poll stuck handing over messages that
+	// nobody reads anymore.
+	done chan struct{}
+
+	// Premature answers in a row, and whether that made it fall back to
+	// short polls
+	premature int
+	short     bool
+
+	// See longpollDedupSize, guarded by the lock
+	dedup messageDedup
 }
 
 func newlongpollClientTransport(c *Client) *longpollClientTransport {
 	return &longpollClientTransport{
 		client:   c,
-		messages: make(chan ClientMessage, 10),
+		messages: make(chan json.RawMessage, 10),
+		done:     make(chan struct{}),
 		httpClient: http.Client{
 			Transport: http.DefaultTransport,
 		},
@@ -271,7 +874,7 @@ func (t *longpollClientTransport) Connect(authData ClientMessage) error {
 	if data == nil {
 		data = make(ClientMessage)
 	}
-	data["__type"] = AuthMessage
+	data[typeField] = AuthMessage
 
 	if t.client.skip_auth {
 		data = ClientMessage{}
@@ -280,7 +883,17 @@ func (t *longpollClientTransport) Connect(authData ClientMessage) error {
 	return t.Send(data)
 }
 
+// Stops polling, Receive returns what's queued and then io.EOF. Can be called
+// more than once, from any goroutine.
 func (t *longpollClientTransport) Close() error {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if t.stopped {
+		return nil
+	}
+	t.stopped = true
+	close(t.done)
 	t.running = false
 	if t.httpReq != nil {
 		if transport, ok := t.httpClient.Transport.(*http.Transport); ok {
@@ -291,10 +904,38 @@ func (t *longpollClientTransport) Close() error {
 	return nil
 }
 
+// Whether the poll loop should go on.
+func (t *longpollClientTransport) isRunning() bool {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.running
+}
+
+// Stops the poll loop because of an error, unless it was closed already.
+func (t *longpollClientTransport) fail(err error) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if t.running {
+		t.running = false
+		t.err = err
+	}
+}
+
+// Remembers the poll in flight, for Close to cancel.
+func (t *longpollClientTransport) setRequest(req *http.Request) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	t.httpReq = req
+}
+
 func (t *longpollClientTransport) Send(data ClientMessage) error {
-	data["__token"] = t.token
+	if data.Type() == MigratedMessage {
+		// Ends the session, stop polling first.
+		t.Close()
+	}
+	data[tokenField] = t.token
 
-	buf, err := json.Marshal(data)
+	buf, err := json.Marshal(t.client.EnvelopeFields.encode(data))
 	if err != nil {
 		return err
 	}
@@ -306,71 +947,190 @@ func (t *longpollClientTransport) Send(data ClientMessage) error {
 	}
 	defer resp.Body.Close()
 
-	result := []ClientMessage{}
+	result := []json.RawMessage{}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
 		return err
 	}
-	for _, v := range result {
-		t.messages <- v
+	if !t.deliver(result) {
+		return io.EOF
 	}
 	return nil
 }
 
+// Queues received messages for Receive, unless the poll loop is already
+// gone. Once closed, what doesn't fit anymore is dropped rather than waiting
+// for a reader that may be gone too.
+func (t *longpollClientTransport) deliver(result []json.RawMessage) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	for _, v := range result {
+		if !t.isNew(v) {
+			continue
+		}
+		select {
+		case t.messages <- v:
+			continue
+		default:
+		}
+		select {
+		case t.messages <- v:
+		case <-t.done:
+			return false
+		}
+	}
+	return true
+}
+
+// Ends Receive once the queued messages are read, must hold the lock.
+func (t *longpollClientTransport) closeMessages() {
+	if !t.closed {
+		t.closed = true
+		close(t.messages)
+	}
+}
+
+// Returns false for a broadcast message that was already received, must
+// hold the lock.
+func (t *longpollClientTransport) isNew(data json.RawMessage) bool {
+	h, err := t.client.EnvelopeFields.header(data)
+	if err != nil || h.Type != MessageMessage || h.ID == "" {
+		return true
+	}
+	return t.dedup.isNew(ClientMessage{"channel": h.Channel, "id": h.ID}, longpollDedupSize)
+}
+
 func (t *longpollClientTransport) Receive() (ClientMessage, error) {
-	m, ok := <-t.messages
-	if !ok {
-		return nil, t.err
+	data, err := t.ReceiveRaw()
+	if err != nil {
+		return nil, err
 	}
+
+	m := ClientMessage{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	m = t.client.EnvelopeFields.decode(m)
 	if m.Type() == AuthOKMessage {
 		t.token = m.Token()
 	}
 	return m, nil
 }
 
+func (t *longpollClientTransport) ReceiveRaw() ([]byte, error) {
+	m, ok := <-t.messages
+	if !ok {
+		t.stateLock.Lock()
+		defer t.stateLock.Unlock()
+		return nil, t.err
+	}
+	return m, nil
+}
+
+// Counts a premature answer to a poll, falls back to short polls after
+// longpollHoldFailures.
+func (t *longpollClientTransport) holdFailed() {
+	if t.short {
+		return
+	}
+	t.premature++
+	if t.premature >= longpollHoldFailures {
+		t.client.logf("Long-poll server doesn't hold polls, polling every %s instead", t.client.PollInterval)
+		t.short = true
+	}
+}
+
 func (t *longpollClientTransport) onConnect() {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if t.stopped {
+		// Closed before polling, there's nothing more to come
+		t.lock.Lock()
+		t.closeMessages()
+		t.lock.Unlock()
+		return
+	}
 	t.running = true
 	go t.poll()
 }
 
 func (t *longpollClientTransport) poll() {
 	data := ClientMessage{
-		"__type":  PollMessage,
-		"__token": t.token,
-		"seq":     strconv.Itoa(t.call),
+		typeField:  PollMessage,
+		tokenField: t.token,
+		"seq":      strconv.Itoa(t.call),
 	}
 	t.call++
 
-	buf, _ := json.Marshal(data)
+	wait := false
+	for t.isRunning() {
+		if t.short {
+			// Nothing came of the last one, give it some time.
+			if wait {
+				<-after(t.client.clock, t.client.PollInterval)
+			}
+			data["short"] = true
+		}
+		buf, err := json.Marshal(t.client.EnvelopeFields.encode(data))
+		if err != nil {
+			t.fail(err)
+			continue
+		}
 
-	for t.running {
+		start := t.client.clock.Now()
 		url := t.client.url(ClientModeLongPoll)
 		req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
 		if err != nil {
-			t.client.disconnected()
+			t.fail(err)
 			continue
 		}
 
-		t.httpReq = req
-		t.httpReq.Header.Set("Content-Type", "application/json")
-		resp, err := t.httpClient.Do(t.httpReq)
+		req.Header.Set("Content-Type", "application/json")
+		t.setRequest(req)
+		resp, err := t.httpClient.Do(req)
+		if err == nil && resp.StatusCode == http.StatusGatewayTimeout {
+			// Cut off by a proxy, poll again.
+			resp.Body.Close()
+			t.holdFailed()
+			wait = true
+			continue
+		}
 		if err != nil || resp.StatusCode != 200 {
-			t.client.disconnected()
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("Poll failed: %s", resp.Status)
+			}
+			// Not when closed: that cancels the request. Stops polling,
+			// the listener reconnects once the messages run out.
+			t.fail(err)
 			continue
 		}
 		defer resp.Body.Close()
 
-		if !t.running {
+		if !t.isRunning() {
 			continue
 		}
 
-		result := []ClientMessage{}
+		t.client.Faults.read()
+		result := []json.RawMessage{}
 		json.NewDecoder(resp.Body).Decode(&result)
-		for _, v := range result {
-			t.messages <- v
+		t.deliver(result)
+
+		wait = len(result) == 0
+		if len(result) > 0 {
+			t.premature = 0
+		} else if t.client.clock.Now().Sub(start) < longpollMinHold {
+			t.holdFailed()
 		}
 	}
 
-	t.httpReq = nil
-	close(t.messages)
+	t.setRequest(nil)
+	t.lock.Lock()
+	t.closeMessages()
+	t.lock.Unlock()
 }
@@ -1,6 +1,19 @@
 package broadcaster
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestLPClient(t *testing.T) {
 	testClient(t, newLPClient)
@@ -20,5 +33,472 @@ func TestLPCanSubscribe(t *testing.T) {
 	testCanSubscribe(t, newLPClient)
 }
 
+func TestLPIgnoreRefusedSubscribes(t *testing.T) {
+	testIgnoreRefusedSubscribes(t, newLPClient)
+}
+
+func TestLPRawMessages(t *testing.T) {
+	testRawMessages(t, newLPClient)
+}
+
+func TestLPConnectionID(t *testing.T) {
+	testConnectionID(t, newLPClient)
+}
+
+func TestLPPublish(t *testing.T) {
+	testPublish(t, newLPClient)
+}
+
+func TestLPAuthExpiry(t *testing.T) {
+	testAuthExpiry(t, newLPClient)
+}
+
+func TestLPKick(t *testing.T) {
+	testKick(t, newLPClient)
+}
+
+func TestLPSubscribeRateLimit(t *testing.T) {
+	testSubscribeRateLimit(t, newLPClient)
+}
+
+func TestLPSubscriptionTTL(t *testing.T) {
+	testSubscriptionTTL(t, newLPClient)
+}
+
+func TestLPCallbackPanics(t *testing.T) {
+	testCallbackPanics(t, newLPClient)
+}
+
+func TestLPPublishRateLimit(t *testing.T) {
+	testPublishRateLimit(t, newLPClient)
+}
+
+func TestLPPublishValidation(t *testing.T) {
+	testPublishValidation(t, newLPClient)
+}
+
+func TestLPConnectionAttributes(t *testing.T) {
+	testConnectionAttributes(t, newLPClient)
+}
+
+func TestLPClientID(t *testing.T) {
+	testClientID(t, newLPClient)
+}
+
+func TestLPPing(t *testing.T) {
+	testPing(t, newLPClient)
+}
+
+func TestLPEcho(t *testing.T) {
+	testEcho(t, newLPClient)
+}
+
+func TestLPMessageHeaders(t *testing.T) {
+	testMessageHeaders(t, newLPClient)
+}
+
+func TestLPMigrate(t *testing.T) {
+	testMigrate(t, newLPClient)
+}
+
+func TestLPDrainMode(t *testing.T) {
+	testDrainMode(t, newLPClient)
+}
+
+func TestLPTenantQuotas(t *testing.T) {
+	testTenantQuotas(t, newLPClient)
+}
+
+func TestLPSubscriptionID(t *testing.T) {
+	testSubscriptionID(t, newLPClient)
+}
+
+func TestLPEnvelopeFields(t *testing.T) {
+	testEnvelopeFields(t, newLPClient)
+}
+
+func TestLPDisconnectRace(t *testing.T) {
+	testDisconnectRace(t, newLPClient)
+}
+
+func TestLPResubscribeOrder(t *testing.T) {
+	testResubscribeOrder(t, newLPClient)
+}
+
+func TestLPResubscribed(t *testing.T) {
+	testResubscribed(t, newLPClient)
+}
+
+func TestLPSubscribers(t *testing.T) {
+	testSubscribers(t, newLPClient)
+}
+
+func TestLPSessionResume(t *testing.T) {
+	testSessionResume(t, newLPClient)
+}
+
+func TestLPSubscribeChan(t *testing.T) {
+	testSubscribeChan(t, newLPClient)
+}
+
+func TestLPWireTap(t *testing.T) {
+	testWireTap(t, newLPClient)
+}
+
 // TODO: Test switching between servers, known tokens from other server should be accepted and transferred.
 // TODO: Keep listening after longpoll disconnect, until transferred to different request.
+
+func TestLPAuthType(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for _, c := range authTypeFrames {
+		m := longpollPost(t, server, c.frame)
+		if m["__type"] != AuthFailedMessage || m["code"] != c.code || m["reason"] != c.reason {
+			t.Errorf("Unexpected reply to %s: %v", c.frame, m)
+		}
+	}
+}
+
+func TestLPWireKeys(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	exchange := func(frame string, keys ...string) map[string]interface{} {
+		m := longpollPost(t, server, frame)
+		assertWireKeys(t, m, keys...)
+		return m
+	}
+
+	m := exchange(`{"__type":"auth"}`, "__type", "__token", "__id", "__client")
+	if m["__type"] != AuthOKMessage {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+
+	m = exchange(fmt.Sprintf(`{"__type":"subscribe","__token":"%s","channel":"test"}`, m["__token"]), "__type", "channel", "subscription")
+	if m["__type"] != SubscribeOKMessage {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+}
+
+func TestLPKickBetweenPolls(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	m := longpollPost(t, server, `{"__type":"auth"}`)
+	if m["__type"] != AuthOKMessage {
+		t.Fatalf("Unexpected reply: %v", m)
+	}
+
+	// No poll is held, the next one gets it
+	err = server.Broadcaster.Kick(m["__id"].(string), "Session ended: bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = longpollPost(t, server, fmt.Sprintf(`{"__type":"poll","__token":"%s","seq":"1"}`, m["__token"]))
+	if m["__type"] != KickMessage || m["body"] != "Session ended: bye" {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+}
+
+func TestLPForceUnsubscribeBetweenPolls(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	m := longpollPost(t, server, `{"__type":"auth"}`)
+	token := m["__token"]
+	err = server.Broadcaster.ForceUnsubscribe(m["__id"].(string), "test", "Channel deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = longpollPost(t, server, fmt.Sprintf(`{"__type":"subscribe","__token":"%s","channel":"test"}`, token))
+	if m["__type"] != SubscribeOKMessage {
+		t.Fatalf("Unexpected reply: %v", m)
+	}
+
+	// No poll is held, the next one gets it
+	m = longpollPost(t, server, fmt.Sprintf(`{"__type":"poll","__token":"%s","seq":"1"}`, token))
+	if m["__type"] != UnsubscribedMessage || m["channel"] != "test" || m["reason"] != "Channel deleted" {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.LocalSubscriptions["test"]; n != 0 {
+		t.Errorf("Expected no subscriptions, got %d", n)
+	}
+}
+
+func TestLPRequireNonce(t *testing.T) {
+	server1, err := startServer(&Server{RequireNonce: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+
+	// Second node, sharing the same Redis
+	server2 := &testServer{
+		Port:        nextPort(),
+		Broadcaster: &Server{RequireNonce: true},
+		Redis:       server1.Redis,
+	}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Regular clients answer the challenge
+	client, err := newLPClient(server1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+
+	m := longpollPost(t, server1, `{"__type":"auth","user":"alice"}`)
+	if m["__type"] != AuthChallengeMessage {
+		t.Fatalf("Expected challenge, got %v", m)
+	}
+	nonce := m["nonce"].(string)
+
+	auth := ClientMessage{"user": "alice"}
+	proof := authProof(nonce, auth)
+
+	// Wrong proof
+	m = longpollPost(t, server1, fmt.Sprintf(`{"__type":"auth","user":"bob","__nonce":"%s","__proof":"%s"}`, nonce, proof))
+	if m["__type"] != AuthFailedMessage || m["reason"] != "Invalid proof" {
+		t.Errorf("Expected invalid proof, got %v", m)
+	}
+
+	// Nonce is gone now, even though the proof was wrong
+	m = longpollPost(t, server1, `{"__type":"auth","user":"alice"}`)
+	nonce = m["nonce"].(string)
+	proof = authProof(nonce, auth)
+
+	request := fmt.Sprintf(`{"__type":"auth","user":"alice","__nonce":"%s","__proof":"%s"}`, nonce, proof)
+	m = longpollPost(t, server1, request)
+	if m["__type"] != AuthOKMessage {
+		t.Errorf("Expected auth to succeed, got %v", m)
+	}
+
+	// Replaying on another node fails
+	m = longpollPost(t, server2, request)
+	if m["__type"] != AuthFailedMessage || m["reason"] != "Invalid nonce" {
+		t.Errorf("Expected replay to fail, got %v", m)
+	}
+}
+
+func TestLPShortPollFallback(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// A proxy that gives up on requests that take a while.
+	var shortPolls int32
+	upstream := fmt.Sprintf("http://localhost:%d/broadcaster/", server.Port)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), `"short":true`) {
+			atomic.AddInt32(&shortPolls, 1)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 300*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequest("POST", upstream, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(proxy.URL + "/broadcaster/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mode = ClientModeLongPoll
+	client.PollInterval = 50 * time.Millisecond
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&shortPolls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to fall back to short polls")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Long polls the proxy cut off may still be waiting on the server.
+	time.Sleep(time.Second)
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("test", "through")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m["body"] != "through" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive the message")
+	}
+}
+
+func TestLPClientDropsDuplicates(t *testing.T) {
+	transport := newlongpollClientTransport(&Client{})
+	transport.deliver([]json.RawMessage{
+		json.RawMessage(`{"__type":"message","channel":"test","id":"a","body":"1"}`),
+		json.RawMessage(`{"__type":"message","channel":"test","id":"b","body":"2"}`),
+	})
+
+	// Again from the backlog of the previous poll
+	transport.deliver([]json.RawMessage{
+		json.RawMessage(`{"__type":"message","channel":"test","id":"b","body":"2"}`),
+		json.RawMessage(`{"__type":"message","channel":"other","id":"b","body":"3"}`),
+		json.RawMessage(`{"__type":"subscribeOk","channel":"test"}`),
+		json.RawMessage(`{"__type":"subscribeOk","channel":"test"}`),
+	})
+
+	if n := len(transport.messages); n != 5 {
+		t.Errorf("Expected 5 messages, got %d", n)
+	}
+}
+
+// Closing stops a poll that's stuck handing over messages nobody reads, and
+// closing again does nothing. Meant to run with -race.
+func TestLPCloseWhilePolling(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := NewClient(fmt.Sprintf("http://localhost:%d/broadcaster/", server.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newlongpollClientTransport(client)
+	err = transport.Connect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := transport.Receive(); err != nil || m.Type() != AuthOKMessage {
+		t.Fatalf("Expected auth to succeed, got %v, %v", m, err)
+	}
+	err = transport.Send(ClientMessage{typeField: SubscribeMessage, "channel": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := transport.Receive(); err != nil || m.Type() != SubscribeOKMessage {
+		t.Fatalf("Expected subscribe to succeed, got %v, %v", m, err)
+	}
+	transport.onConnect()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a poll")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// More than fit, nothing reads them
+	capacity := cap(transport.messages)
+	for i := 0; i < 2*capacity; i++ {
+		err := server.Broadcaster.Publish("test", fmt.Sprintf("Message %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(transport.messages) < capacity {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the messages to queue up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		transport.Close()
+		close(closed)
+	}()
+	transport.Close()
+	<-closed
+
+	received := 0
+	for {
+		_, err := transport.ReceiveRaw()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received++
+	}
+	if received != capacity {
+		t.Errorf("Expected the %d queued messages, got %d", capacity, received)
+	}
+
+	transport.Close()
+	if _, err := transport.ReceiveRaw(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+// Posts a single long-poll request, expecting a single reply.
+func longpollPost(t *testing.T, server *testServer, body string) map[string]interface{} {
+	url := fmt.Sprintf("http://localhost:%d/broadcaster/", server.Port)
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := []map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("Expected one reply, got %d", len(result))
+	}
+	return result[0]
+}
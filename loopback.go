@@ -0,0 +1,168 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pborman/uuid"
+)
+
+// Returns a client that doesn't talk to any server, for testing message
+// handlers. It subscribes and publishes locally: what's published on a
+// channel it's subscribed to goes straight to its own Messages or OnMessage
+// handlers. Call Connect before using it, as with any other client.
+//
+// A published message is delivered before Publish returns, so tests can
+// check its effects right after. The client is the only subscriber, its own
+// messages are always delivered, regardless of SubscribeOptions.Echo.
+// Pausing isn't supported.
+func NewLoopbackClient() (*Client, error) {
+	c, err := NewClient("")
+	if err != nil {
+		return nil, err
+	}
+	c.loopback = true
+	return c, nil
+}
+
+// Client transport that answers its own requests, see NewLoopbackClient.
+type loopbackClientTransport struct {
+	outbox *outbox
+
+	// Subscription IDs by channel
+	subscriptions map[string]string
+	seqs          map[string]int64
+
+	sync.Mutex
+}
+
+func (t *loopbackClientTransport) Connect(authData ClientMessage) error {
+	t.outbox = newOutbox()
+	t.subscriptions = make(map[string]string)
+	t.seqs = make(map[string]int64)
+
+	clientID := authData.ClientID()
+	if clientID == "" {
+		clientID = randomId(16)
+	}
+	t.reply(ClientMessage{typeField: AuthOKMessage, idField: "loopback-" + randomId(8), clientIDField: clientID})
+	return nil
+}
+
+// Messages and replies share the control queue, to arrive in the order
+// they were queued.
+func (t *loopbackClientTransport) reply(m ClientMessage) {
+	t.outbox.Push(priorityControl, m)
+}
+
+func (t *loopbackClientTransport) Close() error {
+	if t.outbox != nil {
+		t.outbox.Close()
+	}
+	return nil
+}
+
+func (t *loopbackClientTransport) Send(m ClientMessage) error {
+	t.Lock()
+	defer t.Unlock()
+
+	switch m.Type() {
+	case SubscribeMessage:
+		channel := m.Channel()
+		id, ok := t.subscriptions[channel]
+		if !ok {
+			id = randomId(8)
+			t.subscriptions[channel] = id
+		}
+		t.reply(newSubscribeOKMessage(channel, id))
+
+	case UnsubscribeMessage:
+		channel, reply, _ := unsubscribeChannel(m, func(id string) (string, bool, error) {
+			for channel, s := range t.subscriptions {
+				if s == id {
+					return channel, true, nil
+				}
+			}
+			return "", false, nil
+		})
+		if reply != nil {
+			t.reply(reply)
+			return nil
+		}
+		delete(t.subscriptions, channel)
+		t.reply(newUnsubscribeOKMessage(m, channel))
+
+	case TouchMessage:
+		channel := m.Channel()
+		if _, ok := t.subscriptions[channel]; !ok {
+			t.reply(newChannelErrorMessage(SubscribeErrorMessage, channel, errors.New("Not subscribed")))
+		}
+
+	case PublishMessage:
+		channel := m.Channel()
+		body, _ := m["body"].(string)
+		id := uuid.New()
+		t.seqs[channel]++
+		seq := t.seqs[channel]
+
+		// Delivered ahead of the reply, before Publish returns.
+		if _, ok := t.subscriptions[channel]; ok {
+			msg := newBroadcastMessage(channel, body)
+			msg["id"] = id
+			msg["seq"] = seq
+			if headers, ok := m["headers"]; ok {
+				msg["headers"] = headers
+			}
+			t.reply(msg)
+		}
+
+		if ref, ok := m[refField]; ok {
+			reply := newChannelMessage(PublishOKMessage, channel)
+			reply[refField] = ref
+			reply["id"] = id
+			reply["seq"] = seq
+			t.reply(reply)
+		}
+
+	case PingMessage:
+		reply := answerPing(m, func() bool { return true })
+		if reply != nil {
+			t.reply(reply)
+		}
+
+	case PauseMessage:
+		t.reply(newChannelErrorMessage(PauseErrorMessage, m.Channel(), errors.New("Not supported by the loopback client")))
+
+	case ResumeMessage:
+		t.reply(newChannelErrorMessage(ResumeErrorMessage, m.Channel(), errors.New("Not supported by the loopback client")))
+
+	case AckMessage:
+		// Nothing is kept for redelivery
+
+	default:
+		t.reply(newMessage(UnknownMessage))
+	}
+	return nil
+}
+
+func (t *loopbackClientTransport) Receive() (ClientMessage, error) {
+	m, ok := t.outbox.Pop()
+	if !ok {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+// Only used in raw mode, which needs the encoded form.
+func (t *loopbackClientTransport) ReceiveRaw() ([]byte, error) {
+	m, err := t.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func (t *loopbackClientTransport) onConnect() {
+}
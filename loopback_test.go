@@ -0,0 +1,73 @@
+package broadcaster
+
+import "testing"
+
+func TestLoopbackClient(t *testing.T) {
+	client, err := NewLoopbackClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	handled := []string{}
+	client.OnMessage("orders.*", func(m ClientMessage) {
+		handled = append(handled, m["body"].(string))
+	})
+
+	for _, channel := range []string{"test", "orders.new"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := client.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m["channel"] != "test" || m["body"] != "Test message" || m["id"] != id || m.Seq() != 1 {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	default:
+		t.Fatal("Expected the message to be delivered before Publish returned")
+	}
+
+	// Handlers run before Publish returns
+	_, err = client.Publish("orders.new", "Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != "Order" {
+		t.Errorf("Expected the handler to run, got %v", handled)
+	}
+
+	// Not subscribed
+	_, err = client.Publish("other", "Not delivered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Publish("test", "Not delivered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected message: %v", m)
+	default:
+	}
+
+	err = client.Pause("orders.new")
+	if err == nil {
+		t.Error("Expected pausing to fail")
+	}
+}
@@ -0,0 +1,64 @@
+package broadcaster
+
+import (
+	"time"
+)
+
+// Delivery rate a client asked for in its auth packet, see Client.MaxRate.
+// Zero when it didn't, or asked for something that isn't a rate.
+func maxRate(auth ClientMessage) float64 {
+	rate, ok := auth[maxRateField].(float64)
+	if !ok || rate <= 0 {
+		return 0
+	}
+	return rate
+}
+
+// Spaces out the broadcast messages of a connection to at most rate per
+// second. Replies aren't held back. Zero means no limit.
+func (o *outbox) SetMaxRate(rate float64) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.interval = 0
+	if rate > 0 {
+		o.interval = time.Duration(float64(time.Second) / rate)
+	}
+}
+
+// Whether the connection asked for a delivery rate. Its broadcast messages
+// are then all conflated, only the latest of a channel waits for its turn.
+func (o *outbox) Paced() bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.interval > 0
+}
+
+// Whether the next message has to wait for its turn. Schedules a wakeup
+// for Pop when it does. Once closed, the rest goes out right away. Must
+// hold the lock.
+func (o *outbox) throttled() bool {
+	if o.interval == 0 || o.closed {
+		return false
+	}
+	now := o.clock.Now()
+	if !now.Before(o.nextAt) {
+		return false
+	}
+	if o.wakeup == nil {
+		o.wakeup = o.clock.AfterFunc(o.nextAt.Sub(now), func() {
+			o.Lock()
+			o.wakeup = nil
+			o.cond.Broadcast()
+			o.Unlock()
+		})
+	}
+	return true
+}
+
+// Starts the wait for the next message, must hold the lock.
+func (o *outbox) paced() {
+	if o.interval > 0 {
+		o.nextAt = o.clock.Now().Add(o.interval)
+	}
+}
@@ -0,0 +1,79 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMaxRate(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newWSClient(server, func(c *Client) {
+		c.MaxRate = 10
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"prices", "status"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const n = 100
+	for i := 1; i <= n; i++ {
+		err := server.Broadcaster.Publish("prices", fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = server.Broadcaster.Publish("status", "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replies aren't held back
+	_, err = client.Ping(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := 0
+	latest, status := false, false
+	var first, last time.Time
+	for !latest || !status {
+		select {
+		case m := <-client.Messages:
+			received++
+			last = time.Now()
+			if first.IsZero() {
+				first = last
+			}
+			if m.Channel() == "status" {
+				status = true
+			} else if m["body"] == fmt.Sprintf("%d", n) {
+				latest = true
+				if m["conflated"] == nil {
+					t.Errorf("Expected a conflation hint, got %v", m)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Didn't receive the latest messages, got %d messages", received)
+		}
+	}
+
+	if received > n/4 {
+		t.Errorf("Expected far fewer than %d messages, got %d", n, received)
+	}
+	if gap := last.Sub(first); gap < time.Duration(received-1)*50*time.Millisecond {
+		t.Errorf("Expected %d messages to take longer than %v", received, gap)
+	}
+}
@@ -0,0 +1,202 @@
+package broadcaster
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Where and how clients move when draining a node, see Server.Drain.
+type MigrateOptions struct {
+	// URL of the server to move to, in the form passed to NewClient.
+	URL string
+
+	// Ask clients to connect to URL and subscribe there again. Without it,
+	// clients only receive the MigrateMessage and reconnect as after any
+	// other disconnect, e.g. through a load balancer that no longer routes
+	// to this node.
+	Reconnect bool
+
+	// Keep connections open until the client confirms it reconnected,
+	// instead of closing them right after the MigrateMessage. Messages keep
+	// flowing on the old connection in the meantime. Only used with
+	// Reconnect.
+	Hold bool
+
+	// How long a connection is held at most, defaults to Server.Timeout.
+	HoldTimeout time.Duration
+}
+
+// Number of messages remembered by a migrating client to drop duplicates.
+const migrationDedupSize = 1000
+
+// Connections that can be asked to move to another server.
+type migrator interface {
+	migrate(opts MigrateOptions)
+}
+
+// Asks all clients of this node to move to another server, e.g. ahead of
+// planned maintenance. Clients that connect later are asked right away, the
+// node keeps draining until it's shut down.
+//
+// With Hold, a client is connected to both servers for a while: it
+// subscribes on the new one before it confirms, and the old one delivers
+// everything it queued before hanging up. Messages published in this overlap
+// window arrive on both connections, the client drops the duplicates based
+// on their ID (or channel and body, for messages published directly on
+// Redis). Raw mode clients receive both copies. Without Hold, messages
+// published between the old connection closing and the client subscribing
+// again are lost.
+//
+// Long-poll clients are asked on their next poll to this node, their session
+// ends when they confirm or expires. Stream connections can't move, they're
+// closed with the MigrateMessage. Local clients are left alone.
+func (s *Server) Drain(opts MigrateOptions) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	if opts.HoldTimeout == 0 {
+		opts.HoldTimeout = s.Timeout
+	}
+
+	s.migrationLock.Lock()
+	s.migration = &opts
+	s.migrationLock.Unlock()
+
+	for _, conn := range st.hub.Connections() {
+		if m, ok := conn.(migrator); ok {
+			m.migrate(opts)
+		}
+	}
+	return nil
+}
+
+// Connections that can be told the node is about to shut down.
+type drainNotifier interface {
+	notifyDraining()
+}
+
+// Tells clients that this node is about to shut down, ahead of Drain or
+// Close: a softer, earlier signal than being asked to move. Nothing is
+// closed. Connected clients get a DrainingMessage and move when it suits
+// them, those of NewClient reconnect right away (see Client.ReconnectPolicy).
+// New connections are refused with a 503 and a Retry-After of
+// DrainRetryAfter, and the health check fails, so that load balancers send
+// them elsewhere.
+//
+// Long-poll clients are told on their next poll to this node. Local clients
+// are left alone. There's no way back: the node is expected to be shut down
+// after.
+func (s *Server) EnterDrainMode() error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+
+	s.migrationLock.Lock()
+	s.drainMode = true
+	s.migrationLock.Unlock()
+
+	for _, conn := range st.hub.Connections() {
+		if n, ok := conn.(drainNotifier); ok {
+			n.notifyDraining()
+		}
+	}
+	return nil
+}
+
+func (s *Server) inDrainMode() bool {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+	return s.drainMode
+}
+
+// Refuses a new connection in drain mode, with a hint when to try again.
+func (s *Server) refuseDraining(w http.ResponseWriter) {
+	retry := int((s.DrainRetryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	s.httpError(w, &HTTPError{Status: http.StatusServiceUnavailable, Code: HTTPErrorDraining, Message: "Draining"})
+}
+
+// Returns the migration options while draining.
+func (s *Server) draining() (MigrateOptions, bool) {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+
+	if s.migration == nil {
+		return MigrateOptions{}, false
+	}
+	return *s.migration, true
+}
+
+func newMigrateMessage(opts MigrateOptions) ClientMessage {
+	return ClientMessage{
+		typeField:   MigrateMessage,
+		"url":       opts.URL,
+		"reconnect": opts.Reconnect,
+		"hold":      opts.Reconnect && opts.Hold,
+	}
+}
+
+// Moves to the server named in a MigrateMessage: connects there and
+// subscribes again, then lets go of the old transport, once its server hung
+// up when it's held. Messages are deduplicated until a while after. Without
+// a URL, connects to the same one again, see DrainingMessage.
+func (c *Client) migrate(old clientTransport, oldDone chan struct{}, u *url.URL, hold bool) {
+	dedup := &messageDedup{}
+	c.deliverLock.Lock()
+	c.dedup = dedup
+	c.deliverLock.Unlock()
+
+	defer func() {
+		old.Close()
+
+		// Late copies may still arrive on the new connection.
+		select {
+		case <-after(c.clock, c.Timeout):
+		case <-c.stopping:
+		}
+		c.deliverLock.Lock()
+		if c.dedup == dedup {
+			c.dedup = nil
+		}
+		c.deliverLock.Unlock()
+	}()
+
+	if u != nil {
+		c.host = u.Host
+		c.path = u.Path
+		c.secure = u.Scheme == "https"
+	}
+
+	err := c.Connect()
+	if err != nil {
+		// Keeps trying, like after a disconnect.
+		c.disconnected()
+	}
+
+	if hold {
+		// The old server hangs up once it delivered what it queued.
+		old.Send(newMessage(MigratedMessage))
+		select {
+		case <-oldDone:
+		case <-after(c.clock, c.Timeout):
+		}
+	}
+}
+
+// Returns the URL to move to, if a MigrateMessage asks to reconnect.
+func migrationURL(m ClientMessage) (*url.URL, bool) {
+	if !m.Reconnect() {
+		return nil, false
+	}
+	s, _ := m["url"].(string)
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
@@ -0,0 +1,201 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A MultiClient connects to several servers at once for redundancy. Messages
+// are delivered from whichever server is first, duplicates are dropped.
+//
+// Messages are considered duplicates when they carry the same channel and
+// message id. Messages without an id are compared on channel and body, so
+// identical messages published in quick succession are only delivered once.
+type MultiClient struct {
+	// Underlying clients, configure these before calling Connect.
+	Clients []*Client
+
+	// Incoming messages, merged
+	Messages chan ClientMessage
+
+	// Number of recent messages remembered for deduplication
+	DedupSize int
+
+	connected []*Client
+	dedup     messageDedup
+	done      sync.WaitGroup
+
+	sync.Mutex
+}
+
+func NewMultiClient(urls ...string) (*MultiClient, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("No servers given")
+	}
+
+	m := &MultiClient{
+		Messages:  make(messageChan, 10),
+		DedupSize: 1000,
+	}
+	for _, u := range urls {
+		c, err := NewClient(u)
+		if err != nil {
+			return nil, err
+		}
+		m.Clients = append(m.Clients, c)
+	}
+	return m, nil
+}
+
+// Connects to all servers. Only fails when none of them can be reached,
+// delivery continues as long as one server is up.
+func (m *MultiClient) Connect() error {
+	var lastErr error
+	for _, c := range m.Clients {
+		err := c.Connect()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		m.Lock()
+		m.connected = append(m.connected, c)
+		m.Unlock()
+
+		m.done.Add(1)
+		go m.forward(c)
+	}
+
+	if len(m.connected) == 0 {
+		return fmt.Errorf("Could not connect to any server: %s", lastErr)
+	}
+	return nil
+}
+
+func (m *MultiClient) Disconnect() error {
+	var lastErr error
+	for _, c := range m.clients() {
+		err := c.Disconnect()
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	m.done.Wait()
+	close(m.Messages)
+	return lastErr
+}
+
+// Subscribes on all connected servers, succeeds if at least one of them
+// accepts the subscription.
+func (m *MultiClient) Subscribe(channel string) error {
+	return m.each(func(c *Client) error {
+		return c.Subscribe(channel)
+	})
+}
+
+func (m *MultiClient) Unsubscribe(channel string) error {
+	return m.each(func(c *Client) error {
+		return c.Unsubscribe(channel)
+	})
+}
+
+func (m *MultiClient) each(fn func(c *Client) error) error {
+	clients := m.clients()
+	if len(clients) == 0 {
+		return errors.New("Not connected")
+	}
+
+	var lastErr error
+	ok := false
+	for _, c := range clients {
+		err := fn(c)
+		if err != nil {
+			lastErr = err
+		} else {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return lastErr
+	}
+	return nil
+}
+
+func (m *MultiClient) clients() []*Client {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]*Client{}, m.connected...)
+}
+
+func (m *MultiClient) forward(c *Client) {
+	defer m.done.Done()
+
+	for {
+		select {
+		case msg, ok := <-c.Messages:
+			if !ok {
+				return
+			}
+			if m.isNew(msg) {
+				m.Messages <- msg
+			}
+		case <-c.Disconnected:
+			// Gave up reconnecting, the other servers take over.
+			m.remove(c)
+		}
+	}
+}
+
+func (m *MultiClient) remove(c *Client) {
+	m.Lock()
+	defer m.Unlock()
+
+	for i, v := range m.connected {
+		if v == c {
+			m.connected = append(m.connected[:i], m.connected[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *MultiClient) isNew(msg ClientMessage) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.dedup.isNew(msg, m.DedupSize)
+}
+
+// Remembers recent messages to drop duplicates. Messages are considered
+// duplicates when they carry the same channel and message id, or the same
+// channel and body when they have no id.
+type messageDedup struct {
+	seen   map[string]bool
+	recent []string
+}
+
+// Returns false for a duplicate, size is the number of messages remembered.
+func (d *messageDedup) isNew(msg ClientMessage, size int) bool {
+	key := fmt.Sprintf("%s\x00%v", msg.Channel(), msg["body"])
+	if id, ok := msg["id"]; ok {
+		key = fmt.Sprintf("%s\x00%v", msg.Channel(), id)
+	}
+
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	if d.seen[key] {
+		return false
+	}
+
+	d.seen[key] = true
+	d.recent = append(d.recent, key)
+	if len(d.recent) > size {
+		delete(d.seen, d.recent[0])
+		d.recent = d.recent[1:]
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMultiClient(t *testing.T) {
+	c := startCluster(t, 2, nil)
+	server1, server2 := c.Nodes[0], c.Nodes[1]
+
+	// Third node is down
+	client, err := NewMultiClient(
+		fmt.Sprintf("http://localhost:%d/broadcaster/", server1.Port),
+		fmt.Sprintf("http://localhost:%d/broadcaster/", server2.Port),
+		"http://localhost:1/broadcaster/",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nodeClient := range client.Clients {
+		nodeClient.Mode = ClientModeWebsocket
+	}
+
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SettleSubscriptions("test", 2)
+
+	err = server1.sendMessage("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Error("Wrong message payload")
+	}
+
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected duplicate: %v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,475 @@
+package broadcaster
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Internal priority for protocol replies, always drained first.
+const priorityControl Priority = PriorityHigh + 1
+
+// Number of messages taken from each channel priority per scheduling round.
+// Lower priorities always get a share of each round, so they can't starve.
+var priorityWeights = map[Priority]int{
+	PriorityHigh:   4,
+	PriorityNormal: 2,
+	PriorityLow:    1,
+}
+
+var priorityOrder = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// An entry of the outbox queues. Conflated messages are looked up by their
+// key when they come up, an entry is stale once a newer one replaced it.
+type queuedMessage struct {
+	m ClientMessage
+	expiry
+
+	key string
+	gen int
+}
+
+type conflation struct {
+	m ClientMessage
+	expiry
+
+	skipped int
+	gen     int
+}
+
+// When a queued message expires, see ChannelConfig.MessageTTL and
+// PublishOptions.TTL. The zero value never does.
+type expiry struct {
+	expires time.Time
+	notify  bool
+}
+
+// Outbound message queue of a single connection.
+//
+// Messages of the same priority are delivered in order, which keeps ordering
+// within a channel intact as long as the priority of a channel is fixed.
+type outbox struct {
+	// Bytes held, accessed atomically
+	bytes int64
+
+	control []ClientMessage
+	queues  map[Priority][]queuedMessage
+	credit  map[Priority]int
+	closed  bool
+	final   ClientMessage
+
+	// Latest message per conflation key, see PushConflated. Superseded
+	// entries stay in the queues until they come up, and are skipped.
+	conflated map[string]*conflation
+	stale     int
+
+	// Server-wide accounting, optional. Shedding closes the outbox and
+	// calls onShed, which should drop the connection.
+	account *bufferAccount
+	onShed  func()
+
+	// Tenant accounting, optional, see Server.chargeTenant.
+	tenant *tenantUsage
+
+	// Message expiry, optional. Expired messages are collected while
+	// holding the lock and passed to onExpired after releasing it.
+	clock     clock
+	ttl       func(m ClientMessage) (time.Duration, bool)
+	onExpired func(m ClientMessage)
+	expired   []ClientMessage
+
+	// Pacing of broadcast messages, optional, see SetMaxRate.
+	interval time.Duration
+	nextAt   time.Time
+	wakeup   timer
+
+	cond *sync.Cond
+	sync.Mutex
+}
+
+func newOutbox() *outbox {
+	o := &outbox{
+		queues:    make(map[Priority][]queuedMessage),
+		credit:    make(map[Priority]int),
+		conflated: make(map[string]*conflation),
+		clock:     realClock{},
+	}
+	o.cond = sync.NewCond(&o.Mutex)
+	return o
+}
+
+// Like newOutbox, but accounted for in the server-wide buffer limit, and
+// messages expire as configured for their channel.
+func (s *Server) newOutbox(connectionID string, onShed func()) *outbox {
+	o := newOutbox()
+	o.account = s.buffers
+	o.onShed = onShed
+	o.clock = s.clock
+	o.ttl = s.messageTTL
+	o.onExpired = func(m ClientMessage) {
+		s.messageExpired(connectionID, m)
+	}
+	s.buffers.Register(o)
+	return o
+}
+
+// Queues a message, returns false if the outbox was closed or the message
+// was dropped to stay within the buffer limit.
+func (o *outbox) Push(p Priority, m ClientMessage) bool {
+	var size int64
+	if o.account != nil {
+		size = messageSize(m)
+		if p < priorityControl && !o.account.Admit(o, size) {
+			return false
+		}
+		if p < priorityControl && o.tenant != nil && !o.tenant.Admit(size) {
+			return false
+		}
+	}
+	return o.enqueue(p, m, size, "", o.expiryOf(p, m))
+}
+
+// Like Push, but replaces a message with the same key that's still queued,
+// see ChannelConfig.Conflate. It goes to the back of the queue, so messages
+// of a channel stay in order. Replacing is never refused by the buffer
+// limits, the latest message always gets through.
+func (o *outbox) PushConflated(p Priority, m ClientMessage, key string) bool {
+	o.Lock()
+	_, queued := o.conflated[key]
+	o.Unlock()
+
+	var size int64
+	if o.account != nil {
+		size = messageSize(m)
+		if !queued && !o.account.Admit(o, size) {
+			return false
+		}
+		if !queued && o.tenant != nil && !o.tenant.Admit(size) {
+			return false
+		}
+	}
+	return o.enqueue(p, m, size, key, o.expiryOf(p, m))
+}
+
+// Like Push, but the message isn't dropped while there's room under the
+// limits. When there isn't, the outbox is shed rather than losing it: the
+// client catches up once it's back, see QoSAtLeastOnce.
+func (o *outbox) PushReliable(p Priority, m ClientMessage) bool {
+	o.Lock()
+	closed := o.closed
+	o.Unlock()
+	if closed {
+		return false
+	}
+
+	var size int64
+	if o.account != nil {
+		size = messageSize(m)
+		if !o.account.AdmitReliable(size) || o.tenant != nil && !o.tenant.Admit(size) {
+			o.Shed()
+			return false
+		}
+	}
+	return o.enqueue(p, m, size, "", o.expiryOf(p, m))
+}
+
+// When a message expires, protocol replies never do. Looks up the TTL
+// without holding the lock, it may call back into the application.
+func (o *outbox) expiryOf(p Priority, m ClientMessage) expiry {
+	if o.ttl == nil || p >= priorityControl {
+		return expiry{}
+	}
+	ttl, notify := o.ttl(m)
+	if deadline, ok := m.ExpiresAt(); ok {
+		return expiry{deadline, notify}
+	}
+	if ttl <= 0 {
+		return expiry{}
+	}
+	return expiry{o.clock.Now().Add(ttl), notify}
+}
+
+func (o *outbox) enqueue(p Priority, m ClientMessage, size int64, key string, e expiry) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return false
+	}
+	o.charge(size)
+
+	if p >= priorityControl {
+		o.control = append(o.control, m)
+	} else if key != "" {
+		c, ok := o.conflated[key]
+		if ok {
+			o.release(c.m)
+			c.m = m
+			c.expiry = e
+			c.skipped++
+			c.gen++
+			o.stale++
+		} else {
+			c = &conflation{m: m, expiry: e}
+			o.conflated[key] = c
+		}
+		p = normalizePriority(p)
+		o.queues[p] = append(o.queues[p], queuedMessage{key: key, gen: c.gen})
+	} else {
+		p = normalizePriority(p)
+		o.queues[p] = append(o.queues[p], queuedMessage{m: m, expiry: e})
+	}
+	o.cond.Signal()
+	return true
+}
+
+// Waits for the next message. Once closed, the remaining messages are still
+// returned, after which ok is false.
+func (o *outbox) Pop() (m ClientMessage, ok bool) {
+	o.Lock()
+	for {
+		m, ok = o.next()
+		if ok || o.closed {
+			break
+		}
+		o.cond.Wait()
+	}
+	expired := o.takeExpired()
+	o.Unlock()
+
+	o.reportExpired(expired)
+	return m, ok
+}
+
+// Returns all queued messages, in delivery order.
+func (o *outbox) Drain() []ClientMessage {
+	o.Lock()
+	result := []ClientMessage{}
+	for {
+		m, ok := o.next()
+		if !ok {
+			break
+		}
+		result = append(result, m)
+	}
+	expired := o.takeExpired()
+	o.Unlock()
+
+	o.reportExpired(expired)
+	return result
+}
+
+// Must hold the lock.
+func (o *outbox) takeExpired() []ClientMessage {
+	expired := o.expired
+	o.expired = nil
+	return expired
+}
+
+func (o *outbox) reportExpired(expired []ClientMessage) {
+	if o.onExpired == nil {
+		return
+	}
+	for _, m := range expired {
+		o.onExpired(m)
+	}
+}
+
+func (o *outbox) Close() {
+	o.Lock()
+	o.closed = true
+	if o.wakeup != nil {
+		o.wakeup.Stop()
+		o.wakeup = nil
+	}
+	o.cond.Broadcast()
+	o.Unlock()
+
+	if o.account != nil {
+		o.account.Unregister(o)
+	}
+}
+
+// Closes the outbox, m is delivered after everything that's still queued.
+func (o *outbox) CloseWith(m ClientMessage) {
+	o.Lock()
+	if !o.closed {
+		o.final = m
+	}
+	o.Unlock()
+
+	o.Close()
+}
+
+// Discards all queued messages and closes the outbox, to free memory.
+func (o *outbox) Shed() {
+	o.Lock()
+	for _, m := range o.control {
+		o.release(m)
+	}
+	for _, q := range o.queues {
+		for _, qm := range q {
+			if qm.key == "" {
+				o.release(qm.m)
+			}
+		}
+	}
+	for _, c := range o.conflated {
+		o.release(c.m)
+	}
+	o.control = nil
+	o.queues = make(map[Priority][]queuedMessage)
+	o.conflated = make(map[string]*conflation)
+	o.stale = 0
+	o.final = nil
+	o.closed = true
+	o.cond.Broadcast()
+	o.Unlock()
+
+	o.Close()
+	if o.onShed != nil {
+		o.onShed()
+	}
+}
+
+// Number of bytes held, only tracked when accounted.
+func (o *outbox) Bytes() int64 {
+	return atomic.LoadInt64(&o.bytes)
+}
+
+// Must hold the lock.
+func (o *outbox) charge(size int64) {
+	if o.account == nil {
+		return
+	}
+	atomic.AddInt64(&o.bytes, size)
+	o.account.Add(size)
+	if o.tenant != nil {
+		o.tenant.Add(size)
+	}
+}
+
+func (o *outbox) release(m ClientMessage) {
+	if o.account == nil {
+		return
+	}
+	size := messageSize(m)
+	atomic.AddInt64(&o.bytes, -size)
+	o.account.Release(size)
+	if o.tenant != nil {
+		o.tenant.Release(size)
+	}
+}
+
+func (o *outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	n := len(o.control) - o.stale
+	for _, q := range o.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Like pop, but skips expired messages, or replaces them with a notification
+// when asked to. Must hold the lock.
+func (o *outbox) next() (ClientMessage, bool) {
+	for {
+		m, e, ok := o.pop()
+		if !ok || e.expires.IsZero() || o.clock.Now().Before(e.expires) {
+			return m, ok
+		}
+
+		o.expired = append(o.expired, m)
+		if e.notify {
+			return newMessageExpiredMessage(m), true
+		}
+	}
+}
+
+// Weighted round robin over the priorities, must hold the lock.
+func (o *outbox) pop() (ClientMessage, expiry, bool) {
+	if len(o.control) > 0 {
+		m := o.control[0]
+		o.control = o.control[1:]
+		o.release(m)
+		return m, expiry{}, true
+	}
+	if o.throttled() {
+		return nil, expiry{}, false
+	}
+
+	for round := 0; round < 2; round++ {
+		for _, p := range priorityOrder {
+			q := o.dropStale(o.queues[p])
+			o.queues[p] = q
+			if len(q) == 0 || o.credit[p] == 0 {
+				continue
+			}
+
+			o.credit[p]--
+			o.queues[p] = q[1:]
+			m, e := o.take(q[0])
+			o.paced()
+			return m, e, true
+		}
+
+		// Out of credit (or out of messages), start a new round.
+		for _, p := range priorityOrder {
+			o.credit[p] = priorityWeights[p]
+		}
+	}
+
+	if o.final != nil {
+		m := o.final
+		o.final = nil
+		return m, expiry{}, true
+	}
+	return nil, expiry{}, false
+}
+
+// Skips the superseded messages at the head of a queue, must hold the lock.
+func (o *outbox) dropStale(q []queuedMessage) []queuedMessage {
+	for len(q) > 0 && q[0].key != "" {
+		c, ok := o.conflated[q[0].key]
+		if ok && c.gen == q[0].gen {
+			break
+		}
+		q = q[1:]
+		o.stale--
+	}
+	return q
+}
+
+// Must hold the lock. Conflated messages that replaced others are copied,
+// to tell the client how many it missed.
+func (o *outbox) take(qm queuedMessage) (ClientMessage, expiry) {
+	if qm.key == "" {
+		o.release(qm.m)
+		return qm.m, qm.expiry
+	}
+
+	c := o.conflated[qm.key]
+	delete(o.conflated, qm.key)
+	o.release(c.m)
+	if c.skipped == 0 {
+		return c.m, c.expiry
+	}
+	m := make(ClientMessage, len(c.m)+1)
+	for k, v := range c.m {
+		m[k] = v
+	}
+	m["conflated"] = c.skipped
+	return m, c.expiry
+}
+
+func normalizePriority(p Priority) Priority {
+	if p > PriorityHigh {
+		return PriorityHigh
+	}
+	if p < PriorityLow {
+		return PriorityLow
+	}
+	return p
+}
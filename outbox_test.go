@@ -0,0 +1,119 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxOrdering(t *testing.T) {
+	o := newOutbox()
+
+	for i := 0; i < 10; i++ {
+		o.Push(PriorityNormal, newBroadcastMessage("test", fmt.Sprintf("%d", i)))
+	}
+
+	messages := o.Drain()
+	if len(messages) != 10 {
+		t.Fatalf("Expected 10 messages, got %d", len(messages))
+	}
+	for i, m := range messages {
+		if m["body"] != fmt.Sprintf("%d", i) {
+			t.Errorf("Expected message %d, got %s", i, m["body"])
+		}
+	}
+}
+
+func TestOutboxPriority(t *testing.T) {
+	o := newOutbox()
+
+	for i := 0; i < 1000; i++ {
+		o.Push(PriorityLow, newBroadcastMessage("cursors", "low"))
+	}
+	o.Push(PriorityHigh, newBroadcastMessage("calls", "high"))
+	o.Push(priorityControl, newChannelMessage(SubscribeOKMessage, "calls"))
+
+	m, _ := o.Pop()
+	if m.Type() != SubscribeOKMessage {
+		t.Errorf("Expected protocol reply first, got %s", m.Type())
+	}
+
+	m, _ = o.Pop()
+	if m["body"] != "high" {
+		t.Errorf("Expected high priority message, got %s", m["body"])
+	}
+}
+
+func TestOutboxNoStarvation(t *testing.T) {
+	o := newOutbox()
+
+	for i := 0; i < 100; i++ {
+		o.Push(PriorityHigh, newBroadcastMessage("high", "high"))
+		o.Push(PriorityNormal, newBroadcastMessage("normal", "normal"))
+		o.Push(PriorityLow, newBroadcastMessage("low", "low"))
+	}
+
+	// Every round of 7 messages has room for one low priority message.
+	seen := map[string]int{}
+	for i := 0; i < 7; i++ {
+		m, _ := o.Pop()
+		seen[m.Channel()]++
+	}
+	if seen["high"] != 4 || seen["normal"] != 2 || seen["low"] != 1 {
+		t.Errorf("Unexpected distribution: %v", seen)
+	}
+}
+
+func TestOutboxCloseDrains(t *testing.T) {
+	o := newOutbox()
+	o.Push(PriorityNormal, newBroadcastMessage("test", "last"))
+	o.Close()
+
+	if o.Push(PriorityNormal, newBroadcastMessage("test", "too late")) {
+		t.Error("Shouldn't accept messages after close")
+	}
+
+	m, ok := o.Pop()
+	if !ok || m["body"] != "last" {
+		t.Error("Expected queued message after close")
+	}
+
+	_, ok = o.Pop()
+	if ok {
+		t.Error("Expected closed outbox")
+	}
+}
+
+// Floods a slow writer with low priority traffic and checks how long a high
+// priority message has to wait.
+func TestOutboxHighPriorityLatency(t *testing.T) {
+	measure := func(p Priority) time.Duration {
+		o := newOutbox()
+		for i := 0; i < 200; i++ {
+			o.Push(PriorityLow, newBroadcastMessage("cursors", "low"))
+		}
+
+		sent := time.Now()
+		o.Push(p, newBroadcastMessage("calls", "critical"))
+		o.Close()
+
+		for {
+			m, ok := o.Pop()
+			if !ok {
+				t.Fatal("Message got lost")
+			}
+			if m["body"] == "critical" {
+				return time.Now().Sub(sent)
+			}
+
+			// Slow connection
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+
+	same := measure(PriorityLow)
+	high := measure(PriorityHigh)
+	if high*10 > same {
+		t.Errorf("Expected high priority to be much faster: %s vs %s", high, same)
+	}
+}
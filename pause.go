@@ -0,0 +1,208 @@
+package broadcaster
+
+import (
+	"errors"
+	"sync"
+)
+
+// Buffered messages of a paused subscription when ChannelConfig doesn't set
+// PauseBufferSize.
+const defaultPauseBufferSize = 100
+
+var errNotSubscribed = errors.New("Not subscribed")
+
+func (c ChannelConfig) pauseBufferSize() int {
+	if c.PauseBufferSize <= 0 {
+		return defaultPauseBufferSize
+	}
+	return c.PauseBufferSize
+}
+
+// Handles a PauseMessage or ResumeMessage for a connection, returns the
+// reply.
+func (s *Server) pauseRequest(conn connection, m ClientMessage) ClientMessage {
+	st := s.current()
+	channel := m.Channel()
+	if m.Type() == PauseMessage {
+		config := s.channelConfig(channel)
+		err := st.hub.Pause(conn, channel, config.pauseBufferSize(), config.PauseKeepLatest)
+		if err != nil {
+			return newChannelErrorMessage(PauseErrorMessage, channel, err)
+		}
+		return newChannelMessage(PauseOKMessage, channel)
+	}
+
+	err := st.hub.Resume(conn, channel)
+	if err != nil {
+		return newChannelErrorMessage(ResumeErrorMessage, channel, err)
+	}
+	return newChannelMessage(ResumeOKMessage, channel)
+}
+
+// Messages held back while a subscription is paused. Past the size, either
+// the oldest or the newest ones are dropped and counted.
+type pauseBuffer struct {
+	size       int
+	keepLatest bool
+
+	messages []heldMessage
+	skipped  int
+
+	// Server-wide accounting, optional. The oldest messages are trimmed to
+	// stay within the limit, and counted apart from those dropped past the
+	// size: they come before the messages still held.
+	account  *bufferAccount
+	bytes    int64
+	trimmed  int
+	released bool
+
+	sync.Mutex
+}
+
+type heldMessage struct {
+	m    ClientMessage
+	size int64
+
+	// Orders messages across buffers, see bufferAccount.NextHeld
+	seq uint64
+}
+
+func newPauseBuffer(size int, keepLatest bool) *pauseBuffer {
+	return &pauseBuffer{
+		size:       size,
+		keepLatest: keepLatest,
+	}
+}
+
+// Like newPauseBuffer, but accounted for in the server-wide buffer limit.
+func newAccountedPauseBuffer(size int, keepLatest bool, account *bufferAccount) *pauseBuffer {
+	b := newPauseBuffer(size, keepLatest)
+	if account != nil {
+		b.account = account
+		account.RegisterHeld(b)
+	}
+	return b
+}
+
+func (b *pauseBuffer) Add(m ClientMessage) {
+	b.Lock()
+	if len(b.messages) >= b.size && !b.keepLatest {
+		b.skipped++
+		b.Unlock()
+		return
+	}
+	b.Unlock()
+
+	held := heldMessage{m: m}
+	if b.account != nil {
+		// Not holding the lock, making room may trim this buffer too.
+		held.size = messageSize(m)
+		if !b.account.AdmitHeld(held.size) {
+			b.Lock()
+			b.trimmed++
+			b.Unlock()
+			return
+		}
+		held.seq = b.account.NextHeld()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) < b.size {
+		b.messages = append(b.messages, held)
+		b.charge(held.size)
+		return
+	}
+
+	// Full, keeping the latest
+	b.skipped++
+	b.charge(held.size - b.messages[0].size)
+	copy(b.messages, b.messages[1:])
+	b.messages[len(b.messages)-1] = held
+}
+
+// Must hold the lock.
+func (b *pauseBuffer) charge(n int64) {
+	if b.account == nil || b.released {
+		return
+	}
+	b.bytes += n
+	if n > 0 {
+		b.account.Add(n)
+	} else {
+		b.account.Release(-n)
+	}
+}
+
+// Sequence number of the oldest message held, false when there's none.
+func (b *pauseBuffer) Oldest() (uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) == 0 || b.released {
+		return 0, false
+	}
+	return b.messages[0].seq, true
+}
+
+// Drops the oldest message held to make room, returns false when there was
+// none.
+func (b *pauseBuffer) TrimOldest() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) == 0 || b.released {
+		return false
+	}
+	b.charge(-b.messages[0].size)
+	b.messages[0] = heldMessage{}
+	b.messages = b.messages[1:]
+	b.trimmed++
+	return true
+}
+
+// Gives back what the buffer accounted for, once it's no longer in use.
+// Flush still works.
+func (b *pauseBuffer) Release() {
+	if b.account == nil {
+		return
+	}
+	b.account.UnregisterHeld(b)
+
+	b.Lock()
+	defer b.Unlock()
+	b.account.Release(b.bytes)
+	b.bytes = 0
+	b.released = true
+}
+
+// Passes on the buffered messages in order, with a SkippedMessage where the
+// dropped ones would have been.
+func (b *pauseBuffer) Flush(channel string, push func(m ClientMessage)) {
+	b.Lock()
+	messages := b.messages
+	leading, trailing := b.trimmed, 0
+	if b.keepLatest {
+		leading += b.skipped
+	} else {
+		trailing = b.skipped
+	}
+	b.Unlock()
+
+	if leading > 0 {
+		push(newSkippedMessage(channel, leading))
+	}
+	for _, held := range messages {
+		push(held.m)
+	}
+	if trailing > 0 {
+		push(newSkippedMessage(channel, trailing))
+	}
+}
+
+func newSkippedMessage(channel string, count int) ClientMessage {
+	m := newChannelMessage(SkippedMessage, channel)
+	m["count"] = count
+	return m
+}
@@ -0,0 +1,42 @@
+package broadcaster
+
+import (
+	"testing"
+)
+
+func TestPauseBuffer(t *testing.T) {
+	flush := func(b *pauseBuffer) []string {
+		result := []string{}
+		b.Flush("test", func(m ClientMessage) {
+			if m.Type() == SkippedMessage {
+				result = append(result, SkippedMessage)
+			} else {
+				result = append(result, m["body"].(string))
+			}
+		})
+		return result
+	}
+
+	oldest := newPauseBuffer(2, false)
+	latest := newPauseBuffer(2, true)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		oldest.Add(newBroadcastMessage("test", body))
+		latest.Add(newBroadcastMessage("test", body))
+	}
+
+	if got := flush(oldest); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != SkippedMessage {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+	if got := flush(latest); len(got) != 3 || got[0] != SkippedMessage || got[1] != "c" || got[2] != "d" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+	if latest.skipped != 2 {
+		t.Errorf("Expected 2 skipped, got %d", latest.skipped)
+	}
+
+	none := newPauseBuffer(2, false)
+	none.Add(newBroadcastMessage("test", "a"))
+	if got := flush(none); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+}
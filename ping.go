@@ -0,0 +1,29 @@
+package broadcaster
+
+import "time"
+
+// Default limit of latency probes per connection, see Server.PingRateLimit.
+var defaultPingRateLimit = RateLimit{Count: 10, Interval: 10 * time.Second}
+
+// Answers a PingMessage. Keepalives get no answer (nil), latency probes a
+// PongMessage, or a RateLimitedMessage when allow refuses them.
+func answerPing(m ClientMessage, allow func() bool) ClientMessage {
+	ref, ok := m[refField]
+	if !ok {
+		return nil
+	}
+
+	if !allow() {
+		reply := newRateLimitedMessage(PingMessage, "")
+		reply[refField] = ref
+		return reply
+	}
+
+	reply := ClientMessage{typeField: PongMessage, refField: ref}
+	for _, k := range []string{"ts", "payload"} {
+		if v, ok := m[k]; ok {
+			reply[k] = v
+		}
+	}
+	return reply
+}
@@ -0,0 +1,150 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Default limit of member listings per connection, see
+// Server.SubscribersRateLimit.
+var defaultSubscribersRateLimit = RateLimit{Count: 10, Interval: 10 * time.Second}
+
+// Error codes of a SubscribersErrorMessage.
+const (
+	subscribersErrorNotPresence   = "not_presence"
+	subscribersErrorNotSubscribed = "not_subscribed"
+)
+
+var (
+	errNotPresence = errors.New("Not a presence channel")
+	errNotListed   = errors.New("Not subscribed")
+)
+
+// A member of a presence channel, see Client.Subscribers.
+type Member struct {
+	// Presence key, see Server.PresenceKey
+	Key string `json:"key"`
+
+	// Those of the connection it joined with, see Server.PresenceAttributes
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Returns the presence keys of the members of a presence channel, across all
+// nodes. See ChannelConfig.Presence.
+func (s *Server) Members(channel string) ([]string, error) {
+	if !s.isPrepared() {
+		return nil, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+
+	members, err := st.redis.PresenceMembers(channel)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// Answers a SubscribersMessage: the members of a presence channel the
+// connection is subscribed to, across all nodes.
+func (s *Server) subscribersRequest(c protocolConn, channel string) (ClientMessage, error) {
+	st := s.current()
+	ok, err := c.allowSubscribers()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return newRateLimitedMessage(SubscribersMessage, channel), nil
+	}
+
+	if !s.channelConfig(channel).Presence {
+		reply := newChannelErrorMessage(SubscribersErrorMessage, channel, errNotPresence)
+		reply["code"] = subscribersErrorNotPresence
+		return reply, nil
+	}
+	subscribed, err := c.isSubscribed(channel)
+	if err != nil {
+		return nil, err
+	}
+	if !subscribed {
+		reply := newChannelErrorMessage(SubscribersErrorMessage, channel, errNotListed)
+		reply["code"] = subscribersErrorNotSubscribed
+		return reply, nil
+	}
+
+	members, err := st.redis.PresenceMemberList(channel)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Key < members[j].Key
+	})
+	if members == nil {
+		members = []Member{}
+	}
+	reply := newChannelMessage(SubscribersOKMessage, channel)
+	reply["members"] = members
+	return reply, nil
+}
+
+// Takes the "members" of a SubscribersOKMessage, as sent or decoded from
+// JSON.
+func decodeMembers(v interface{}) ([]Member, error) {
+	if members, ok := v.([]Member); ok {
+		return members, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	members := []Member{}
+	err = json.Unmarshal(data, &members)
+	return members, err
+}
+
+func (s *Server) presenceKey(data ClientMessage) string {
+	if s.PresenceKey != nil {
+		key := ""
+		s.runCallback("PresenceKey", func() {
+			key = s.PresenceKey(data)
+		})
+		if key != "" {
+			return key
+		}
+	}
+	if id := s.identity(data); id != "" {
+		return id
+	}
+	return clientKey(data)
+}
+
+// Called by the transports once subscribed, failures are logged: presence
+// is informational and never fails a subscription.
+func (s *Server) joinPresence(auth ClientMessage, channel string) {
+	st := s.current()
+	if !s.channelConfig(channel).Presence {
+		return
+	}
+
+	err := st.redis.PresenceJoin(channel, s.presenceKey(auth), auth.ConnectionID(), s.presenceAttributes(auth))
+	if err != nil {
+		s.logf("Connection %s: failed to join presence on %s: %s", auth.ConnectionID(), channel, err)
+	}
+}
+
+// Called by the transports after unsubscribing or disconnecting.
+func (s *Server) leavePresence(auth ClientMessage, channels ...string) {
+	st := s.current()
+	for _, channel := range channels {
+		if !s.channelConfig(channel).Presence {
+			continue
+		}
+
+		err := st.redis.PresenceLeave(channel, s.presenceKey(auth), auth.ConnectionID())
+		if err != nil {
+			s.logf("Connection %s: failed to leave presence on %s: %s", auth.ConnectionID(), channel, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Presence: channel == "room"}
+		},
+		PresenceKey: func(data map[string]interface{}) string {
+			user, _ := data["user"].(string)
+			return user
+		},
+		PresenceAttributes: []string{"user", "missing"},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	connect := func(user string) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			c.AuthData = map[string]interface{}{"user": user}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	observer := connect("observer")
+	defer observer.Disconnect()
+
+	// Presence events and messages arrive in order, a message marks that
+	// nothing else happened in between.
+	expect := func(events ...string) {
+		err := s.Publish("room", "marker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, "message marker")
+
+		for _, e := range events {
+			select {
+			case m := <-observer.Messages:
+				got := fmt.Sprintf("%s %s", m.Type(), m["member"])
+				if m.Type() == MessageMessage {
+					got = fmt.Sprintf("%s %s", m.Type(), m["body"])
+				}
+				if attrs, ok := m["attributes"]; ok {
+					got = fmt.Sprintf("%s %v", got, attrs)
+				}
+				if got != e {
+					t.Fatalf("Expected %q, got %q", e, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected %q", e)
+			}
+		}
+	}
+
+	members := func(expected string) {
+		m, err := s.Members("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(m) != expected {
+			t.Errorf("Expected members %s, got %v", expected, m)
+		}
+	}
+
+	// Waits until the server cleaned up after a client hung up.
+	disconnect := func(client *Client) {
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := stats.Connections
+
+		client.Disconnect()
+		for stats.Connections == n {
+			time.Sleep(10 * time.Millisecond)
+			stats, err = s.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = observer.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("memberAdded observer map[user:observer]")
+
+	// Two tabs of the same user count once, whatever the transport.
+	tab1 := connect("alice")
+	err = tab1.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("memberAdded alice map[user:alice]")
+
+	tab2, err := s.LocalClient(map[string]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tab2.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect()
+	members("[alice observer]")
+
+	// Other channels don't track presence.
+	err = tab2.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members("[alice observer]")
+
+	// Leaving with one tab left changes nothing.
+	disconnect(tab1)
+	expect()
+	members("[alice observer]")
+
+	// The last one does.
+	err = tab2.Unsubscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("memberRemoved alice")
+	members("[observer]")
+
+	// Rejoining announces again, disconnecting counts as leaving.
+	err = tab2.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("memberAdded alice map[user:alice]")
+
+	disconnect(tab2)
+	expect("memberRemoved alice")
+	members("[observer]")
+}
+
+func TestPresenceKey(t *testing.T) {
+	s := &Server{}
+	data := ClientMessage{idField: "node-1", "user": "alice"}
+	if key := s.presenceKey(data); key != "node-1" {
+		t.Errorf("Expected the connection ID, got %s", key)
+	}
+
+	s.Identity = func(data map[string]interface{}) string {
+		return data["user"].(string)
+	}
+	if key := s.presenceKey(data); key != "alice" {
+		t.Errorf("Expected the identity, got %s", key)
+	}
+
+	s.PresenceKey = func(data map[string]interface{}) string {
+		return "team"
+	}
+	if key := s.presenceKey(data); key != "team" {
+		t.Errorf("Expected the presence key, got %s", key)
+	}
+}
@@ -1,6 +1,14 @@
 package broadcaster
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // Message types used between server and client.
 const (
@@ -13,55 +21,252 @@ const (
 	// Server: Authentication failed
 	AuthFailedMessage = "authError"
 
-	// Client: Subscribe to channel
+	// Client: Subscribe to channel. Messages the connection publishes aren't
+	// delivered back to it, unless "echo" is true. The "qos" is one of
+	// QoSAtMostOnce (the default) and QoSAtLeastOnce. With "cursor" true,
+	// the reply carries the sequence number of the channel. At least once,
+	// "lastSeq" resumes after the given sequence number, rather than after
+	// what the client ID acknowledged: the messages the server still has are
+	// delivered first, after a SkippedMessage for those it hasn't
 	SubscribeMessage = "subscribe"
 
-	// Server: Subscribe succeeded
+	// Server: Subscribe succeeded. The "subscription" is its ID, see
+	// UnsubscribeMessage. Messages published after this reply are all
+	// delivered, earlier ones may or may not be. Long polls only receive
+	// while a poll is held: for them, this holds from the next poll on. When
+	// asked with "cursor" or "lastSeq", "seq" is the sequence number of the
+	// last message published on the channel (0 if there's none), those
+	// published later have higher ones
 	SubscribeOKMessage = "subscribeOk"
 
 	// Server: Subscribe failed
 	SubscribeErrorMessage = "subscribeError"
 
-	// Server: Broadcast message
+	// Server: Broadcast message. With "conflated", the number of earlier
+	// ones it replaced, see ChannelConfig.Conflate. The "headers" and
+	// "compactionKey" are those of the publish, "expiresAt" is there for
+	// messages with a TTL. "publishedAt" and "node" are only there with
+	// Server.MessageMetadata
 	MessageMessage = "message"
 
-	// Client: Unsubscribe from channel
+	// Client: Unsubscribe from channel, or from the subscription with the
+	// ID in "subscription". The reply passes that ID back
 	UnsubscribeMessage = "unsubscribe"
 
-	// Server: Unsubscribe succeeded
+	// Server: Unsubscribe succeeded, or the subscription expired (with
+	// "expired" as the reason) or was revoked ("revoked", see
+	// Server.RevalidateSubscriptions)
 	UnsubscribeOKMessage = "unsubscribeOk"
 
 	// Server: Unsubscribe failed
 	UnsubscribeErrorMessage = "unsubscribeError"
 
-	// Client: Send me more messages
+	// Server: The server ended the subscription, the connection stays open.
+	// The "reason" is the one given to Server.ForceUnsubscribe. The client
+	// doesn't resubscribe on its own
+	UnsubscribedMessage = "unsubscribed"
+
+	// Client: Send me more messages. With "short", right away rather than
+	// waiting for some to arrive
 	PollMessage = "poll"
 
-	// Client: I'm still alive
+	// Client: I'm still alive. With a "__ref", a latency probe: the server
+	// answers right away with a PongMessage
 	PingMessage = "ping"
 
+	// Server: Answer to a latency probe, with its "__ref", "ts" and "payload"
+	PongMessage = "pong"
+
+	// Client: Renew the TTL of a subscription
+	TouchMessage = "touch"
+
 	// Server: Unknown message
 	UnknownMessage = "unknown"
 
 	// Server: Server error
 	ServerErrorMessage = "serverError"
+
+	// Server: Repeat authentication with the enclosed nonce
+	AuthChallengeMessage = "authChallenge"
+
+	// Client: Publish a message
+	PublishMessage = "publish"
+
+	// Server: Publish succeeded
+	PublishOKMessage = "publishOk"
+
+	// Server: Publish failed
+	PublishErrorMessage = "publishError"
+
+	// Server: Auth data expired, all subscriptions were revoked
+	AuthExpiredMessage = "authExpired"
+
+	// Server: Connection closed by the server, with a final message
+	KickMessage = "kick"
+
+	// Server: Request refused because of a rate limit, the request type is
+	// in the "request" field
+	RateLimitedMessage = "rateLimited"
+
+	// Server: Invalid message, only sent in strict mode. The error code is
+	// in the "code" field, the request type (if known) in "request"
+	ProtocolErrorMessage = "protocolError"
+
+	// Server: A member joined a presence channel, the presence key is in
+	// the "member" field, see Server.PresenceAttributes for "attributes"
+	MemberAddedMessage = "memberAdded"
+
+	// Server: The last connection of a member left a presence channel
+	MemberRemovedMessage = "memberRemoved"
+
+	// Client: List the current members of a presence channel the
+	// connection is subscribed to, see Server.SubscribersRateLimit
+	SubscribersMessage = "subscribers"
+
+	// Server: The members of the channel, in "members": each with its
+	// presence "key" and "attributes", ordered by key
+	SubscribersOKMessage = "subscribersOk"
+
+	// Server: Listing the members failed. The "code" is "not_presence" for
+	// channels without presence, "not_subscribed" when the connection isn't
+	// subscribed to the channel
+	SubscribersErrorMessage = "subscribersError"
+
+	// Server: Move to the server in the "url" field, see Server.Drain. With
+	// "reconnect", the client connects there and subscribes again. With
+	// "hold", the server keeps the connection open until the client
+	// confirms with a MigratedMessage
+	MigrateMessage = "migrate"
+
+	// Client: Reconnected elsewhere, the server closes the connection once
+	// everything queued is delivered
+	MigratedMessage = "migrated"
+
+	// Server: The node is about to shut down, the client should move when
+	// convenient. The connection stays open until then, see
+	// Server.EnterDrainMode
+	DrainingMessage = "draining"
+
+	// Client: Received the messages of an at-least-once subscription up to
+	// the "seq" in this message, see QoSAtLeastOnce
+	AckMessage = "ack"
+
+	// Client: Stop delivering a channel while staying subscribed, see
+	// ChannelConfig.PauseBufferSize. Pauses end with the connection
+	PauseMessage = "pause"
+
+	// Server: Pause succeeded
+	PauseOKMessage = "pauseOk"
+
+	// Server: Pause failed
+	PauseErrorMessage = "pauseError"
+
+	// Client: Deliver a paused channel again, starting with what it held
+	// back
+	ResumeMessage = "resume"
+
+	// Server: Resume succeeded
+	ResumeOKMessage = "resumeOk"
+
+	// Server: Resume failed
+	ResumeErrorMessage = "resumeError"
+
+	// Server: Messages of a paused channel were dropped because too many
+	// were held back, or messages of a durable channel were trimmed from
+	// its stream before this node read them, or those a resumed
+	// subscription missed are gone (see SubscribeMessage). The number is in
+	// "count"
+	SkippedMessage = "skipped"
+
+	// Server: A message expired before it could be delivered, see
+	// ChannelConfig.MessageTTL and PublishOptions.TTL. Its ID is in "id", empty for messages that
+	// weren't published through the broadcaster
+	ExpiredMessage = "messageExpired"
+
+	// Never sent: the Client hands it to the application once the "channel"
+	// is subscribed to again after the connection dropped (not after moving
+	// on a MigrateMessage). Messages published in between may be missing,
+	// unless the subscription is at-least-once or has a cursor
+	ResubscribedMessage = "resubscribed"
+)
+
+// Envelope fields, these are the same for all transports.
+const (
+	// Message type, one of the message types above
+	typeField = "__type"
+
+	// Long-poll session token
+	tokenField = "__token"
+
+	// Connection ID, sent in the AuthOKMessage
+	idField = "__id"
+
+	// Client ID, sent in the AuthOKMessage and presented by the client when
+	// reconnecting, see Server.ClientIDKey
+	clientIDField = "__client"
+
+	// Session credential, sent in the AuthOKMessage and presented by the
+	// client instead of its auth data when reconnecting, see
+	// Server.SessionTTL
+	sessionField = "__session"
+
+	// Nonce and proof, sent in response to an AuthChallengeMessage
+	nonceField = "__nonce"
+	proofField = "__proof"
+
+	// Correlates a PublishMessage with its reply
+	refField = "__ref"
+
+	// Tenant of a connection, kept with its auth data. See Server.Tenant.
+	tenantField = "__tenant"
+
+	// Messages per second a client can take, sent in the auth packet. See
+	// Client.MaxRate.
+	maxRateField = "__maxRate"
 )
 
 type ClientMessage map[string]interface{}
 
 func (c ClientMessage) ResultId() string {
 	t := c.Type()
+	if t == RateLimitedMessage {
+		t, _ = c["request"].(string)
+	}
+	if t == AuthOKMessage || t == AuthFailedMessage {
+		return AuthMessage
+	}
+	if t == PingMessage || t == PongMessage {
+		return fmt.Sprintf("%s_%s", PingMessage, c[refField])
+	}
 	if t == SubscribeOKMessage || t == SubscribeErrorMessage {
 		t = SubscribeMessage
 	}
+	if t == UnsubscribeMessage || t == UnsubscribeOKMessage || t == UnsubscribeErrorMessage {
+		// Requested by subscription ID
+		if id := c.SubscriptionID(); id != "" {
+			return fmt.Sprintf("%s_#%s", UnsubscribeMessage, id)
+		}
+	}
 	if t == UnsubscribeOKMessage {
 		t = UnsubscribeMessage
 	}
+	if t == PauseOKMessage || t == PauseErrorMessage {
+		t = PauseMessage
+	}
+	if t == ResumeOKMessage || t == ResumeErrorMessage {
+		t = ResumeMessage
+	}
+	if t == SubscribersOKMessage || t == SubscribersErrorMessage {
+		t = SubscribersMessage
+	}
+	if t == PublishOKMessage || t == PublishErrorMessage {
+		return fmt.Sprintf("%s_%s", PublishMessage, c[refField])
+	}
 	return fmt.Sprintf("%s_%s", t, c["channel"])
 }
 
 func (c ClientMessage) Type() string {
-	s, ok := c["__type"].(string)
+	s, ok := c[typeField].(string)
 	if !ok {
 		return ""
 	}
@@ -69,13 +274,116 @@ func (c ClientMessage) Type() string {
 }
 
 func (c ClientMessage) Token() string {
-	s, ok := c["__token"].(string)
+	s, ok := c[tokenField].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+func (c ClientMessage) ConnectionID() string {
+	s, ok := c[idField].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+func (c ClientMessage) ClientID() string {
+	s, ok := c[clientIDField].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// Session credential of an AuthOKMessage, see Server.SessionTTL.
+func (c ClientMessage) Session() string {
+	s, ok := c[sessionField].(string)
 	if !ok {
 		return ""
 	}
 	return s
 }
 
+func (c ClientMessage) Tenant() string {
+	s, ok := c[tenantField].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// Requested TTL of a subscription, or of a published message, in seconds on
+// the wire.
+func (c ClientMessage) TTL() time.Duration {
+	s, ok := c["ttl"].(float64)
+	if !ok || s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// Whether a subscription includes the messages the connection publishes.
+func (c ClientMessage) Echo() bool {
+	b, _ := c["echo"].(bool)
+	return b
+}
+
+// Whether a published message should skip its own connection, even if it
+// subscribed with echo.
+func (c ClientMessage) SuppressEcho() bool {
+	b, _ := c["suppressEcho"].(bool)
+	return b
+}
+
+// Connection that published a broadcast message, compare with
+// Client.ConnectionID. Empty for messages published by the server.
+func (c ClientMessage) Origin() string {
+	s, _ := c["origin"].(string)
+	return s
+}
+
+// Delivery guarantee of a subscription, QoSAtMostOnce unless it asks for
+// QoSAtLeastOnce.
+func (c ClientMessage) QoS() string {
+	if c["qos"] == QoSAtLeastOnce {
+		return QoSAtLeastOnce
+	}
+	return QoSAtMostOnce
+}
+
+// Sequence number of a broadcast message, or of the last one acknowledged.
+// Zero if there's none. Decoded JSON has it as a float64, local clients
+// get the int64.
+func (c ClientMessage) Seq() int64 {
+	switch seq := c["seq"].(type) {
+	case int64:
+		return seq
+	case float64:
+		return int64(seq)
+	}
+	return 0
+}
+
+// ID of a subscription, assigned by the server. Empty if there's none.
+func (c ClientMessage) SubscriptionID() string {
+	s, _ := c["subscription"].(string)
+	return s
+}
+
+// Whether the client should follow a MigrateMessage.
+func (c ClientMessage) Reconnect() bool {
+	b, _ := c["reconnect"].(bool)
+	return b
+}
+
+// Whether the server waits for a MigratedMessage.
+func (c ClientMessage) Hold() bool {
+	b, _ := c["hold"].(bool)
+	return b
+}
+
 func (c ClientMessage) Channel() string {
 	s, ok := c["channel"].(string)
 	if !ok {
@@ -86,36 +394,196 @@ func (c ClientMessage) Channel() string {
 
 func newMessage(t string) ClientMessage {
 	return ClientMessage{
-		"__type": t,
+		typeField: t,
 	}
 }
 
 func newErrorMessage(t string, err error) ClientMessage {
 	return ClientMessage{
-		"__type": t,
-		"reason": err.Error(),
+		typeField: t,
+		"reason":  err.Error(),
 	}
 }
 
 func newChannelMessage(t, channel string) ClientMessage {
 	return ClientMessage{
-		"__type":  t,
+		typeField: t,
 		"channel": channel,
 	}
 }
 
 func newBroadcastMessage(channel, body string) ClientMessage {
 	return ClientMessage{
-		"__type":  MessageMessage,
+		typeField: MessageMessage,
 		"channel": channel,
 		"body":    body,
 	}
 }
 
+// Message as received from the backend, along with where it was published.
+// The message names the origin connection in its "origin" field, the server
+// always sets it: clients can't pass one off as another. With metadata, it
+// also tells when and on which node it was published.
+func decodeBroadcastMessage(channel string, data []byte, metadata bool) (ClientMessage, publishOrigin, messageTiming) {
+	e, ok := decodeEnvelope(data)
+	if !ok {
+		return newBroadcastMessage(channel, string(data)), publishOrigin{}, messageTiming{}
+	}
+
+	if e.Event == SkippedMessage {
+		return newSkippedMessage(channel, int(e.Count)), publishOrigin{}, messageTiming{}
+	}
+	if e.Event != "" {
+		m := ClientMessage{
+			typeField: e.Event,
+			"channel": channel,
+			"member":  e.Member,
+		}
+		if e.Attributes != nil {
+			m["attributes"] = e.Attributes
+		}
+		return m, publishOrigin{}, messageTiming{}
+	}
+
+	m := newBroadcastMessage(channel, e.Body)
+	m["id"] = e.ID
+	m["seq"] = e.Seq
+	if e.Origin != "" {
+		m["origin"] = e.Origin
+	}
+	if e.Headers != nil {
+		m["headers"] = e.Headers
+	}
+	if e.CompactionKey != "" {
+		m["compactionKey"] = e.CompactionKey
+	}
+	if metadata && e.Time != 0 {
+		m["publishedAt"] = e.Time
+		m["node"] = e.Node
+	}
+	return m, publishOrigin{ConnectionID: e.Origin, SuppressEcho: e.SuppressEcho}, e.timing()
+}
+
+// Connection that published a message, empty for server-side publishes.
+type publishOrigin struct {
+	ConnectionID string
+
+	// See PublishOptions.SuppressEcho
+	SuppressEcho bool
+}
+
+// Whether a connection receives a message from this origin. Its own
+// messages only if it subscribed with echo, and the publish didn't opt out.
+func (o publishOrigin) delivers(connectionID string, echo bool) bool {
+	if o.ConnectionID == "" || o.ConnectionID != connectionID {
+		return true
+	}
+	return echo && !o.SuppressEcho
+}
+
+func newKickMessage(body string) ClientMessage {
+	return ClientMessage{
+		typeField: KickMessage,
+		"body":    body,
+	}
+}
+
+func newRateLimitedMessage(request, channel string) ClientMessage {
+	return ClientMessage{
+		typeField: RateLimitedMessage,
+		"request": request,
+		"channel": channel,
+		"reason":  "Rate limited",
+	}
+}
+
 func newChannelErrorMessage(t, channel string, err error) ClientMessage {
 	return ClientMessage{
-		"__type":  t,
+		typeField: t,
 		"channel": channel,
 		"reason":  err.Error(),
 	}
 }
+
+// Binds a nonce to the auth data: hex encoded SHA-256 of the nonce, a colon
+// and the JSON encoded auth data, without envelope fields and sorted by key.
+func authProof(nonce string, auth ClientMessage) string {
+	data := make(map[string]interface{})
+	for k, v := range auth {
+		if !strings.HasPrefix(k, "__") {
+			data[k] = v
+		}
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write([]byte(nonce + ":"))
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Messages published through the broadcaster are wrapped in an envelope, to
+// carry metadata. Anything else published on Redis is delivered as-is.
+// Presence events use the same envelope, with the message type in Event.
+type envelope struct {
+	ID     string `json:"id"`
+	Seq    int64  `json:"seq"`
+	Body   string `json:"body"`
+	Event  string `json:"event,omitempty"`
+	Member string `json:"member,omitempty"`
+
+	// Presence attributes of a joining member
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+
+	// Connection that published the message, which doesn't get it back
+	// unless it asked for it. Connection IDs are unique across nodes.
+	Origin string `json:"origin,omitempty"`
+
+	// Not delivered back to the origin even if it subscribed with echo
+	SuppressEcho bool `json:"suppressEcho,omitempty"`
+
+	// When it was published, in milliseconds since the epoch, and by which
+	// node
+	Time int64  `json:"time,omitempty"`
+	Node string `json:"node,omitempty"`
+
+	// See PublishOptions.Headers
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// See PublishOptions.TTL, in milliseconds
+	TTL int64 `json:"ttl,omitempty"`
+
+	// See PublishOptions.CompactionKey
+	CompactionKey string `json:"compactionKey,omitempty"`
+
+	// Messages lost, for a SkippedMessage event
+	Count int64 `json:"count,omitempty"`
+}
+
+// Marks enveloped messages, can't occur in valid text.
+const envelopePrefix = "\x00bc\x00"
+
+func encodeEnvelope(e envelope) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(envelopePrefix), data...), nil
+}
+
+func decodeEnvelope(data []byte) (envelope, bool) {
+	e := envelope{}
+	if !bytes.HasPrefix(data, []byte(envelopePrefix)) {
+		return e, false
+	}
+
+	err := json.Unmarshal(data[len(envelopePrefix):], &e)
+	if err != nil {
+		return e, false
+	}
+	return e, true
+}
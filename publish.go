@@ -0,0 +1,356 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Error codes of publish errors.
+const (
+	// Denied by CanPublish
+	PublishErrorRefused = "refused"
+
+	// Backend failure, might succeed when retried
+	PublishErrorBackend = "backend"
+
+	// Channel not known to ChannelExists
+	PublishErrorUnknownChannel = "unknown_channel"
+
+	// Plaintext body on an encrypted channel
+	PublishErrorNotEncrypted = "not_encrypted"
+
+	// Over a publish rate limit, retry after RetryAfter
+	PublishErrorRateLimited = "rate_limited"
+
+	// Redis didn't accept the publish in time, see Server.PublishTimeout.
+	// The message might still go out.
+	PublishErrorTimeout = "timeout"
+
+	// Body refused by Server.ValidateBody, the reason tells why, or sent by
+	// a client that isn't UTF-8
+	PublishErrorInvalidBody = "invalid_body"
+
+	// Headers too large or not a map of strings, see PublishOptions.Headers
+	PublishErrorInvalidHeaders = "invalid_headers"
+
+	// Compaction key too long, see PublishOptions.CompactionKey
+	PublishErrorInvalidKey = "invalid_key"
+
+	// Negative TTL, see PublishOptions.TTL
+	PublishErrorInvalidTTL = "invalid_ttl"
+
+	// Malformed hierarchical channel name, see Server.ChannelSeparator
+	PublishErrorInvalidChannel = "invalid_channel"
+)
+
+// Returned when a publish failed, the code tells why. Throttled publishes
+// (PublishErrorRateLimited) should be retried after RetryAfter, backend
+// failures (PublishErrorBackend) with a backoff.
+type PublishError struct {
+	Code   string
+	Reason string
+
+	// Only set for PublishErrorRateLimited
+	RetryAfter time.Duration
+}
+
+func newRateLimitedError(wait time.Duration) *PublishError {
+	return &PublishError{
+		Code:       PublishErrorRateLimited,
+		Reason:     "Rate limited",
+		RetryAfter: wait,
+	}
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("Publish error (%s): %s", e.Code, e.Reason)
+}
+
+// Broadcasts a message to all subscribers of a channel, on all nodes.
+func (s *Server) Publish(channel, body string) error {
+	_, _, err := s.PublishWithID(channel, body)
+	return err
+}
+
+// Like Publish, but also returns the ID and sequence number assigned to the
+// message. These are passed on to subscribers as the "id" and "seq" fields.
+func (s *Server) PublishWithID(channel, body string) (string, int64, error) {
+	return s.PublishContext(context.Background(), channel, body)
+}
+
+// Like PublishWithID, but gives up once the context is done, e.g. when
+// publishing from an HTTP handler on behalf of a producer. Fails with a
+// PublishError with code PublishErrorTimeout, which can be answered with a
+// 503 status.
+func (s *Server) PublishContext(ctx context.Context, channel, body string) (string, int64, error) {
+	return s.PublishWith(ctx, channel, body, PublishOptions{})
+}
+
+// Like PublishContext, with the given options. Server-side publishes may use
+// reserved header names, SuppressEcho doesn't apply to them.
+func (s *Server) PublishWith(ctx context.Context, channel, body string, opts PublishOptions) (string, int64, error) {
+	if !s.isPrepared() {
+		return "", 0, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	if err := s.checkPublish(channel, body); err != nil {
+		return "", 0, err
+	}
+	headers, err := publishHeaders(opts.Headers, false)
+	if err != nil {
+		return "", 0, &PublishError{Code: PublishErrorInvalidHeaders, Reason: err.Error()}
+	}
+	if err := validCompactionKey(opts.CompactionKey); err != nil {
+		return "", 0, &PublishError{Code: PublishErrorInvalidKey, Reason: err.Error()}
+	}
+	if opts.TTL < 0 {
+		return "", 0, &PublishError{Code: PublishErrorInvalidTTL, Reason: "TTL can't be negative"}
+	}
+	if wait := s.throttlePublish(channel, ""); wait > 0 {
+		return "", 0, newRateLimitedError(wait)
+	}
+
+	stored := messageOptions{Headers: headers, CompactionKey: opts.CompactionKey, TTL: opts.TTL}
+	return s.publish(ctx, channel, body, stored, publishOrigin{}, s.unroutedPolicy(opts) == UnroutedFail)
+}
+
+// Publishes messages to a channel in order, e.g. a backlog of updates, as
+// Publish would one by one. All of them are checked before any goes out: a
+// channel or body Publish would refuse fails the whole batch. Otherwise it
+// stops at the first that fails, e.g. when rate limited. Returns the number
+// of messages that went out and, with UnroutedFail, how many of those reached
+// no subscriber. These don't stop the batch.
+func (s *Server) PublishBatch(channel string, bodies ...string) (published, unrouted int, err error) {
+	if !s.isPrepared() {
+		return 0, 0, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	if err := s.checkPublish(channel, bodies...); err != nil {
+		return 0, 0, err
+	}
+	failUnrouted := s.unroutedPolicy(PublishOptions{}) == UnroutedFail
+	for i, body := range bodies {
+		if wait := s.throttlePublish(channel, ""); wait > 0 {
+			return i, unrouted, newRateLimitedError(wait)
+		}
+		_, _, err := s.publish(context.Background(), channel, body, messageOptions{}, publishOrigin{}, failUnrouted)
+		if err == ErrNoSubscribers {
+			unrouted++
+			continue
+		}
+		if err != nil {
+			return i, unrouted, err
+		}
+	}
+	return len(bodies), unrouted, nil
+}
+
+// Refuses server-side publishes to channels that don't take them, and
+// bodies the channel doesn't accept.
+func (s *Server) checkPublish(channel string, bodies ...string) error {
+	if err := s.validateChannel(channel); err != nil {
+		return &PublishError{Code: PublishErrorInvalidChannel, Reason: err.Error()}
+	}
+	if !s.channelExists(channel) {
+		return &PublishError{Code: PublishErrorUnknownChannel, Reason: "Unknown channel: " + channel}
+	}
+	for _, body := range bodies {
+		if !s.acceptsBody(channel, body) {
+			return &PublishError{Code: PublishErrorNotEncrypted, Reason: "Body not encrypted"}
+		}
+		if err := s.validateBody(channel, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// What's stored along with the body of a published message, see
+// PublishOptions.
+type messageOptions struct {
+	Headers       map[string]string
+	CompactionKey string
+	TTL           time.Duration
+}
+
+type publishResult struct {
+	id        string
+	seq       int64
+	receivers int
+	err       error
+}
+
+// Hands the message to Redis, within PublishTimeout. The origin is the
+// connection that publishes it, empty for server-side publishes. Fails with
+// ErrNoSubscribers if the message reached no one and failUnrouted is set.
+func (s *Server) publish(ctx context.Context, channel, body string, opts messageOptions, origin publishOrigin, failUnrouted bool) (string, int64, error) {
+	st := s.current()
+	if timeout := s.config().PublishTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if st.redis.empty != nil && st.redis.empty.Skip(channel) {
+		id := randomId(8)
+		s.forward(ForwardedMessage{Channel: channel, ID: id, Body: body, Headers: opts.Headers})
+		s.messageUnrouted(channel, id, body)
+		if failUnrouted {
+			return id, 0, ErrNoSubscribers
+		}
+		return id, 0, nil
+	}
+
+	var r publishResult
+	if ctx.Done() == nil {
+		r.id, r.seq, r.receivers, r.err = st.redis.Publish(channel, body, opts, origin, s.clock.Now())
+	} else {
+		// Left to finish in the background when giving up, bounded by
+		// the Redis timeouts.
+		done := make(chan publishResult, 1)
+		go func() {
+			id, seq, receivers, err := st.redis.Publish(channel, body, opts, origin, s.clock.Now())
+			done <- publishResult{id, seq, receivers, err}
+		}()
+
+		select {
+		case r = <-done:
+		case <-ctx.Done():
+			return "", 0, &PublishError{Code: PublishErrorTimeout, Reason: "Publish timed out"}
+		}
+	}
+
+	if r.err != nil {
+		return "", 0, &PublishError{Code: PublishErrorBackend, Reason: r.err.Error()}
+	}
+
+	s.forward(ForwardedMessage{Channel: channel, ID: r.id, Seq: r.seq, Body: body, Headers: opts.Headers})
+	if r.receivers == 0 {
+		s.messageUnrouted(channel, r.id, body)
+		if failUnrouted {
+			return r.id, r.seq, ErrNoSubscribers
+		}
+	}
+	return r.id, r.seq, nil
+}
+
+func (s *Server) channelExists(channel string) bool {
+	if s.ChannelExists == nil {
+		return true
+	}
+	exists := false
+	s.runCallback("ChannelExists", func() {
+		exists = s.ChannelExists(channel)
+	})
+	return exists
+}
+
+// Encrypted channels only take bodies in the encrypted format. Those are
+// passed on as is, the server can't read them.
+func (s *Server) acceptsBody(channel, body string) bool {
+	return !s.channelConfig(channel).Encrypted || isEncryptedBody(body)
+}
+
+// Takes a token from the publish rate limits, returns how long to wait when
+// there's none. Client publishes are also limited per identity.
+func (s *Server) throttlePublish(channel, identity string) time.Duration {
+	return s.limiter.Allow(channel, s.channelConfig(channel).PublishRate, identity, s.config().IdentityPublishRate)
+}
+
+// Handles a PublishMessage sent by a client. Returns the reply, or nil when
+// the client didn't ask for one.
+func (s *Server) clientPublish(auth ClientMessage, m ClientMessage) ClientMessage {
+	channel := m.Channel()
+	body, _ := m["body"].(string)
+	ref, wantsReply := m[refField]
+
+	fail := func(code string, err error) ClientMessage {
+		if !wantsReply {
+			return nil
+		}
+		reply := newChannelErrorMessage(PublishErrorMessage, channel, err)
+		reply["code"] = code
+		reply[refField] = ref
+		return reply
+	}
+
+	if err := s.validateClientChannel(channel); err != nil {
+		return fail(PublishErrorInvalidChannel, err)
+	}
+	if !utf8.ValidString(body) {
+		return fail(PublishErrorInvalidBody, errInvalidUTF8)
+	}
+
+	if !s.canPublish(auth, channel) {
+		s.audit(AuditEvent{
+			Type:         AuditPublishRefused,
+			ConnectionID: auth.ConnectionID(),
+			Identity:     s.identity(auth),
+			Channel:      channel,
+			Reason:       AuditReasonRefused,
+		})
+		return fail(PublishErrorRefused, errors.New("Publish refused"))
+	}
+
+	if !s.channelExists(channel) {
+		return fail(PublishErrorUnknownChannel, errors.New("Unknown channel: "+channel))
+	}
+
+	if !s.acceptsBody(channel, body) {
+		return fail(PublishErrorNotEncrypted, errors.New("Body not encrypted"))
+	}
+
+	if err := s.validateBody(channel, body); err != nil {
+		return fail(err.Code, errors.New(err.Reason))
+	}
+
+	headers, err := publishHeaders(m["headers"], true)
+	if err != nil {
+		return fail(PublishErrorInvalidHeaders, err)
+	}
+
+	key := m.CompactionKey()
+	if err := validCompactionKey(key); err != nil {
+		return fail(PublishErrorInvalidKey, err)
+	}
+	if ttl, ok := m["ttl"].(float64); ok && ttl < 0 {
+		return fail(PublishErrorInvalidTTL, errors.New("TTL can't be negative"))
+	}
+
+	identity := s.identity(auth)
+	if identity == "" {
+		identity = clientKey(auth)
+	}
+	tenant := auth.Tenant()
+	tenantRate := s.tenants.Quota(tenant).PublishRate
+	if wait, quota := s.limiter.AllowTenant(channel, s.channelConfig(channel).PublishRate, identity, s.config().IdentityPublishRate, tenant, tenantRate); wait > 0 {
+		reply := fail(PublishErrorRateLimited, errors.New("Rate limited"))
+		if quota {
+			s.tenants.Exceeded(tenant, QuotaPublishRate)
+			err := &quotaError{QuotaPublishRate}
+			reply = fail(err.code, err)
+		}
+		if reply != nil {
+			reply["retryAfter"] = wait.Seconds()
+		}
+		return reply
+	}
+
+	origin := publishOrigin{ConnectionID: auth.ConnectionID(), SuppressEcho: m.SuppressEcho()}
+	stored := messageOptions{Headers: headers, CompactionKey: key, TTL: m.TTL()}
+	id, seq, err := s.publish(context.Background(), channel, body, stored, origin, false)
+	if err != nil {
+		perr := err.(*PublishError)
+		return fail(perr.Code, errors.New(perr.Reason))
+	}
+
+	if !wantsReply {
+		return nil
+	}
+	reply := newChannelMessage(PublishOKMessage, channel)
+	reply[refField] = ref
+	reply["id"] = id
+	reply["seq"] = seq
+	return reply
+}
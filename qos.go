@@ -0,0 +1,195 @@
+package broadcaster
+
+import (
+	"sync"
+)
+
+// Delivery guarantees of a subscription, requested with the "qos" field of
+// a SubscribeMessage.
+const (
+	// Messages are dropped when the connection can't keep up, see
+	// Server.MaxBufferedBytes. The default.
+	QoSAtMostOnce = "atMostOnce"
+
+	// Messages aren't dropped to make room: a connection that falls too far
+	// behind is closed instead. The client acknowledges messages with an
+	// AckMessage, those it didn't are delivered again (in order) when it
+	// subscribes again, e.g. after reconnecting with the same client ID
+	// within Server.PendingTTL.
+	//
+	// This costs memory in two places. Slow subscribers hold on to their
+	// messages until they hit Server.MaxBufferedBytes, rather than giving
+	// way to others as soon as buffers fill up. And Redis keeps the last
+	// Server.PendingLimit messages of every channel with such subscribers,
+	// for Server.PendingTTL after they were published.
+	//
+	// Only messages published through the broadcaster can be acknowledged,
+	// anything else is delivered at most once. Long-poll sessions keep all
+	// messages in Redis between polls anyway, the level makes no difference
+	// to them.
+	QoSAtLeastOnce = "atLeastOnce"
+)
+
+// Implemented by the transports that support at-least-once subscriptions,
+// the hub uses Send for the others.
+type reliableConnection interface {
+	// Like Send, see QoSAtLeastOnce.
+	SendReliable(m ClientMessage)
+}
+
+// Queues what the client missed on an at-least-once subscription, then lets
+// live messages through. Failing that, only live messages are delivered.
+func (s *Server) replayPending(auth ClientMessage, channel string, opts subscriptionOptions, after int64, gate *replayGate, push func(m ClientMessage)) {
+	missed, last, err := s.pendingMessages(auth, channel, opts, after)
+	if err != nil {
+		s.logf("Connection %s: failed to replay %s: %s", auth.ConnectionID(), channel, err)
+	}
+	gate.Release(channel, missed, last, push)
+}
+
+// Registers an at-least-once subscriber, returns the messages the client
+// didn't acknowledge yet and the sequence number they go up to. A client
+// that resumes after a sequence number gets what came after it instead,
+// preceded by a SkippedMessage for those that are gone. Those the options
+// of the subscription hold back are left out, as live.
+func (s *Server) pendingMessages(auth ClientMessage, channel string, opts subscriptionOptions, after int64) ([]ClientMessage, int64, error) {
+	st := s.current()
+	acked, current, err := st.redis.PendingJoin(channel, clientKey(auth))
+	if err != nil {
+		return nil, acked, err
+	}
+	if after != noCursor {
+		acked = after
+		if acked > current {
+			acked = current
+		}
+	}
+	if acked >= current {
+		return nil, acked, nil
+	}
+
+	// Cached on this node unless the client was gone for long
+	var stored [][]byte
+	ok := false
+	if s.cache != nil {
+		stored, ok = s.cache.Since(channel, acked, current)
+	}
+	if !ok {
+		stored, err = st.redis.PendingMessages(channel, acked)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	stored = compactStored(stored)
+
+	config := s.channelConfig(channel)
+	last := acked
+	missed := make([]ClientMessage, 0, len(stored)+1)
+	if after != noCursor {
+		if gone := storedGap(stored, acked, current); gone > 0 {
+			missed = append(missed, newSkippedMessage(channel, gone))
+		}
+	}
+	for _, data := range stored {
+		m, origin, _ := decodeBroadcastMessage(channel, data, s.MessageMetadata)
+		last = m.Seq()
+		if !opts.delivers(auth.ConnectionID(), m, origin) {
+			continue
+		}
+		deadline, expired := s.storedExpired(config, data)
+		stampDeadline(m, deadline)
+		if expired {
+			s.messageExpired(auth.ConnectionID(), m)
+			if config.NotifyExpired {
+				missed = append(missed, newMessageExpiredMessage(m))
+			}
+			continue
+		}
+		missed = append(missed, m)
+	}
+	return missed, last, nil
+}
+
+func (s *Server) ackPending(auth ClientMessage, channel string, seq int64) {
+	st := s.current()
+	err := st.redis.PendingAck(channel, clientKey(auth), seq)
+	if err != nil {
+		s.logf("Connection %s: failed to acknowledge %s: %s", auth.ConnectionID(), channel, err)
+	}
+}
+
+// Called by the transports after disconnecting, with the channels subscribed
+// at least once. What the client didn't acknowledge is kept for PendingTTL.
+func (s *Server) releasePending(auth ClientMessage, channels ...string) {
+	st := s.current()
+	if len(channels) == 0 {
+		return
+	}
+	err := st.redis.PendingRelease(clientKey(auth), s.clock.Now().Add(s.PendingTTL), channels...)
+	if err != nil {
+		s.logf("Connection %s: failed to release pending messages: %s", auth.ConnectionID(), err)
+	}
+}
+
+// Called by the transports when an at-least-once subscription ends, or
+// changes to at most once.
+func (s *Server) dropPending(auth ClientMessage, channels ...string) {
+	st := s.current()
+	if len(channels) == 0 {
+		return
+	}
+	err := st.redis.PendingDrop(clientKey(auth), channels...)
+	if err != nil {
+		s.logf("Connection %s: failed to drop pending messages: %s", auth.ConnectionID(), err)
+	}
+}
+
+// Holds back the live messages of at-least-once subscriptions while the ones
+// the client missed are queued, so that they arrive in order and once. The
+// zero value is ready to use.
+type replayGate struct {
+	held map[string][]ClientMessage
+
+	sync.Mutex
+}
+
+func (g *replayGate) Hold(channel string) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.held == nil {
+		g.held = make(map[string][]ClientMessage)
+	}
+	if _, ok := g.held[channel]; !ok {
+		g.held[channel] = []ClientMessage{}
+	}
+}
+
+// Passes a live message on, unless its channel is held.
+func (g *replayGate) Deliver(m ClientMessage, push func(m ClientMessage)) {
+	g.Lock()
+	defer g.Unlock()
+
+	if held, ok := g.held[m.Channel()]; ok {
+		g.held[m.Channel()] = append(held, m)
+		return
+	}
+	push(m)
+}
+
+// Passes on the missed messages, then the held ones that came after them.
+func (g *replayGate) Release(channel string, missed []ClientMessage, last int64, push func(m ClientMessage)) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, m := range missed {
+		push(m)
+	}
+	for _, m := range g.held[channel] {
+		if seq := m.Seq(); seq == 0 || seq > last {
+			push(m)
+		}
+	}
+	delete(g.held, channel)
+}
@@ -0,0 +1,77 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplayGate(t *testing.T) {
+	g := replayGate{}
+	seen := []int64{}
+	push := func(m ClientMessage) {
+		seen = append(seen, m.Seq())
+	}
+
+	live := func(seq int64) ClientMessage {
+		m := newBroadcastMessage("test", "")
+		m["seq"] = seq
+		return m
+	}
+
+	g.Hold("test")
+	g.Deliver(live(3), push)
+	g.Deliver(live(4), push)
+	if len(seen) != 0 {
+		t.Fatalf("Expected live messages to be held, got %v", seen)
+	}
+
+	// Other channels go through
+	other := newBroadcastMessage("other", "")
+	other["seq"] = int64(1)
+	g.Deliver(other, push)
+
+	g.Release("test", []ClientMessage{live(2), live(3)}, 3, push)
+	g.Deliver(live(5), push)
+
+	expected := []int64{1, 2, 3, 4, 5}
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, seen)
+	}
+	for i, seq := range expected {
+		if seen[i] != seq {
+			t.Fatalf("Expected %v, got %v", expected, seen)
+		}
+	}
+}
+
+func TestOutboxPushReliable(t *testing.T) {
+	s := &Server{buffers: newBufferAccount(10000)}
+
+	shed := false
+	reliable := s.newOutbox("", func() {
+		shed = true
+	})
+	small := s.newOutbox("", nil)
+
+	m := newBroadcastMessage("test", strings.Repeat("x", 1000))
+	small.Push(PriorityNormal, m)
+	for i := 0; i < 7; i++ {
+		reliable.Push(PriorityNormal, m)
+	}
+
+	// Under pressure, at-most-once messages are dropped, these aren't.
+	if reliable.Push(PriorityNormal, m) {
+		t.Error("Expected the buffer to refuse messages")
+	}
+	if !reliable.PushReliable(PriorityNormal, m) {
+		t.Error("Expected the buffer to take the message anyway")
+	}
+
+	// Until it doesn't fit at all.
+	if reliable.PushReliable(PriorityNormal, m) || !shed {
+		t.Error("Expected the buffer to be shed")
+	}
+	if reliable.Bytes() != 0 {
+		t.Errorf("Expected the buffer to be released, got %d", reliable.Bytes())
+	}
+}
@@ -0,0 +1,386 @@
+package broadcaster
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Error codes when a tenant is over a quota, see Server.Quotas. Sent as the
+// "code" of the AuthFailedMessage, SubscribeErrorMessage or
+// PublishErrorMessage that refuses the request, and used as keys in
+// TenantStats.Exceeded.
+const (
+	QuotaConnections   = "quota_connections"
+	QuotaSubscriptions = "quota_subscriptions"
+	QuotaPublishRate   = "quota_publish_rate"
+	QuotaBufferedBytes = "quota_buffered_bytes"
+)
+
+// Ceilings for a single tenant, zero means unlimited.
+type Quota struct {
+	// Open connections, across all nodes. Long-poll sessions count until
+	// they end or expire.
+	Connections int
+
+	// Subscriptions, across all nodes. Each channel counts once per
+	// connection.
+	Subscriptions int
+
+	// Client publishes, on each node. Over the quota, publishing fails with
+	// code QuotaPublishRate, which tells when to retry.
+	PublishRate PublishRate
+
+	// Bytes held in outbound buffers, on each node. Messages over the quota
+	// are dropped, as with Server.MaxBufferedBytes.
+	BufferedBytes int64
+}
+
+// Quotas per tenant, see Server.Tenant.
+type Quotas struct {
+	// Applies to each tenant that isn't listed
+	Default Quota
+
+	Tenants map[string]Quota
+}
+
+func (q Quotas) quota(tenant string) Quota {
+	if quota, ok := q.Tenants[tenant]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// Usage of a tenant, see Stats.Tenants.
+type TenantStats struct {
+	// Across all nodes
+	Connections   int `json:"connections"`
+	Subscriptions int `json:"subscriptions"`
+
+	// Bytes held in outbound buffers on this node
+	BufferedBytes int64 `json:"buffered_bytes"`
+
+	// Requests refused and messages dropped on this node, by quota error
+	// code
+	Exceeded map[string]uint64 `json:"exceeded,omitempty"`
+}
+
+// Replaces the quotas while running, on this node only, see UpdateConfig
+// for all of them. New limits apply to what's counted from then on:
+// connections and subscriptions over a lowered limit are kept, new ones are
+// refused until the tenant is back under it.
+func (s *Server) SetQuotas(q Quotas) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	c := *s.config()
+	c.Quotas = q
+	s.applyConfig(&c, s.configData)
+	return nil
+}
+
+func (s *Server) tenant(data map[string]interface{}) string {
+	if s.Tenant == nil || data == nil {
+		return ""
+	}
+	tenant := ""
+	s.runCallback("Tenant", func() {
+		tenant = s.Tenant(data)
+	})
+	return tenant
+}
+
+var errTenantChanged = errors.New("Tenant can't change")
+
+// Refuses a request that would take a tenant over a quota.
+type quotaError struct {
+	code string
+}
+
+func (e *quotaError) Error() string {
+	return "Quota exceeded: " + strings.TrimPrefix(e.code, "quota_")
+}
+
+// Adds the quota error code to an error reply, if that's why it failed.
+func withQuotaCode(reply ClientMessage, err error) ClientMessage {
+	if qerr, ok := err.(*quotaError); ok {
+		reply["code"] = qerr.code
+	}
+	return reply
+}
+
+// Names of the quotas counted in Redis.
+const (
+	quotaKeyConnections   = "connections"
+	quotaKeySubscriptions = "subscriptions"
+)
+
+// Subscriptions are counted per connection and channel, like their TTLs.
+func subscriptionMember(auth ClientMessage, channel string) string {
+	return auth.ConnectionID() + " " + channel
+}
+
+// How long a long-poll session counts towards the quotas after its last
+// poll.
+func (s *Server) longpollLease() time.Duration {
+	return 2 * s.Timeout
+}
+
+// Zero for connections that are held open, they count until released.
+func (s *Server) leaseExpiry(lease time.Duration) time.Time {
+	if lease == 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(lease)
+}
+
+// Counts a connection towards the quota of its tenant, before it's accepted.
+func (s *Server) claimConnection(auth ClientMessage, lease time.Duration) error {
+	st := s.current()
+	tenant := auth.Tenant()
+	if tenant == "" {
+		return nil
+	}
+
+	limit := s.tenants.Quota(tenant).Connections
+	ok, err := st.redis.QuotaClaim(tenant, quotaKeyConnections, auth.ConnectionID(), limit, s.leaseExpiry(lease), s.clock.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.tenants.Exceeded(tenant, QuotaConnections)
+		return &quotaError{QuotaConnections}
+	}
+	return nil
+}
+
+// Counts a subscription towards the quota of its tenant, before subscribing.
+// Subscribing again to the same channel always succeeds.
+func (s *Server) claimSubscription(auth ClientMessage, channel string, lease time.Duration) error {
+	st := s.current()
+	tenant := auth.Tenant()
+	if tenant == "" {
+		return nil
+	}
+
+	limit := s.tenants.Quota(tenant).Subscriptions
+	ok, err := st.redis.QuotaClaim(tenant, quotaKeySubscriptions, subscriptionMember(auth, channel), limit, s.leaseExpiry(lease), s.clock.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.tenants.Exceeded(tenant, QuotaSubscriptions)
+		return &quotaError{QuotaSubscriptions}
+	}
+	return nil
+}
+
+// Called by the transports after unsubscribing, failures are logged like
+// those of presence.
+func (s *Server) releaseSubscriptions(auth ClientMessage, channels ...string) {
+	st := s.current()
+	tenant := auth.Tenant()
+	if tenant == "" || len(channels) == 0 {
+		return
+	}
+
+	members := make([]string, len(channels))
+	for i, channel := range channels {
+		members[i] = subscriptionMember(auth, channel)
+	}
+	err := st.redis.QuotaRelease(tenant, quotaKeySubscriptions, members...)
+	if err != nil {
+		s.logf("Connection %s: failed to release subscriptions: %s", auth.ConnectionID(), err)
+	}
+}
+
+// Called by the transports after disconnecting, along with the channels the
+// connection was subscribed to.
+func (s *Server) releaseConnection(auth ClientMessage, channels ...string) {
+	st := s.current()
+	tenant := auth.Tenant()
+	if tenant == "" {
+		return
+	}
+
+	s.releaseSubscriptions(auth, channels...)
+	err := st.redis.QuotaRelease(tenant, quotaKeyConnections, auth.ConnectionID())
+	if err != nil {
+		s.logf("Connection %s: failed to release connection: %s", auth.ConnectionID(), err)
+	}
+}
+
+// Keeps a long-poll session and its subscriptions counted, on every poll.
+func (s *Server) renewLongpollQuotas(auth ClientMessage, channels map[string]bool) error {
+	st := s.current()
+	tenant := auth.Tenant()
+	if tenant == "" {
+		return nil
+	}
+
+	expires := s.leaseExpiry(s.longpollLease())
+	err := st.redis.QuotaRenew(tenant, quotaKeyConnections, expires, auth.ConnectionID())
+	if err != nil || len(channels) == 0 {
+		return err
+	}
+
+	members := make([]string, 0, len(channels))
+	for channel, _ := range channels {
+		members = append(members, subscriptionMember(auth, channel))
+	}
+	return st.redis.QuotaRenew(tenant, quotaKeySubscriptions, expires, members...)
+}
+
+// Charges the buffered bytes of an outbox to the tenant of a connection.
+func (s *Server) chargeTenant(o *outbox, auth ClientMessage) {
+	if tenant := auth.Tenant(); tenant != "" {
+		o.tenant = s.tenants.Get(tenant)
+	}
+}
+
+// Usage per tenant: those known to any node, and those with a quota.
+func (s *Server) tenantStats() (map[string]TenantStats, error) {
+	st := s.current()
+	names, err := st.redis.Tenants()
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, s.tenants.Names()...)
+
+	result := make(map[string]TenantStats)
+	for _, tenant := range names {
+		if _, ok := result[tenant]; ok {
+			continue
+		}
+
+		connections, subscriptions, err := st.redis.QuotaUsage(tenant, s.clock.Now())
+		if err != nil {
+			return nil, err
+		}
+		stats := s.tenants.Get(tenant).Stats()
+		stats.Connections = connections
+		stats.Subscriptions = subscriptions
+		result[tenant] = stats
+	}
+	return result, nil
+}
+
+// Usage of the tenants on this node, along with the current quotas.
+type tenantAccounts struct {
+	// Holds Quotas, read on every delivery
+	quotas atomic.Value
+
+	usage map[string]*tenantUsage
+
+	sync.Mutex
+}
+
+func newTenantAccounts(q Quotas) *tenantAccounts {
+	a := &tenantAccounts{
+		usage: make(map[string]*tenantUsage),
+	}
+	a.SetQuotas(q)
+	return a
+}
+
+func (a *tenantAccounts) SetQuotas(q Quotas) {
+	a.quotas.Store(q)
+}
+
+func (a *tenantAccounts) Quota(tenant string) Quota {
+	return a.quotas.Load().(Quotas).quota(tenant)
+}
+
+func (a *tenantAccounts) Get(tenant string) *tenantUsage {
+	a.Lock()
+	defer a.Unlock()
+
+	u, ok := a.usage[tenant]
+	if !ok {
+		u = &tenantUsage{
+			name:     tenant,
+			accounts: a,
+			exceeded: make(map[string]uint64),
+		}
+		a.usage[tenant] = u
+	}
+	return u
+}
+
+func (a *tenantAccounts) Exceeded(tenant, code string) {
+	a.Get(tenant).Exceeded(code)
+}
+
+// Tenants seen on this node and those with a quota, sorted.
+func (a *tenantAccounts) Names() []string {
+	a.Lock()
+	names := make([]string, 0, len(a.usage))
+	for tenant, _ := range a.usage {
+		names = append(names, tenant)
+	}
+	a.Unlock()
+
+	for tenant, _ := range a.quotas.Load().(Quotas).Tenants {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type tenantUsage struct {
+	// Accessed atomically
+	bufferedBytes int64
+
+	name     string
+	accounts *tenantAccounts
+
+	// Guarded by the mutex of the accounts
+	exceeded map[string]uint64
+}
+
+// Decides whether a message of the given size can be queued for the tenant.
+func (u *tenantUsage) Admit(size int64) bool {
+	max := u.accounts.Quota(u.name).BufferedBytes
+	if max <= 0 || atomic.LoadInt64(&u.bufferedBytes)+size <= max {
+		return true
+	}
+	u.Exceeded(QuotaBufferedBytes)
+	return false
+}
+
+func (u *tenantUsage) Add(n int64) {
+	atomic.AddInt64(&u.bufferedBytes, n)
+}
+
+func (u *tenantUsage) Release(n int64) {
+	atomic.AddInt64(&u.bufferedBytes, -n)
+}
+
+func (u *tenantUsage) Exceeded(code string) {
+	u.accounts.Lock()
+	defer u.accounts.Unlock()
+	u.exceeded[code]++
+}
+
+func (u *tenantUsage) Stats() TenantStats {
+	u.accounts.Lock()
+	defer u.accounts.Unlock()
+
+	stats := TenantStats{
+		BufferedBytes: atomic.LoadInt64(&u.bufferedBytes),
+	}
+	if len(u.exceeded) > 0 {
+		stats.Exceeded = make(map[string]uint64, len(u.exceeded))
+		for code, n := range u.exceeded {
+			stats.Exceeded[code] = n
+		}
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTenantBufferedBytes(t *testing.T) {
+	s := &Server{
+		MaxBufferedBytes: 1 << 20,
+		Quotas: Quotas{
+			Default: Quota{BufferedBytes: 500},
+		},
+	}
+	s.buffers = newBufferAccount(s.MaxBufferedBytes)
+	s.tenants = newTenantAccounts(s.Quotas)
+
+	auth := ClientMessage{tenantField: "acme"}
+	a := s.newOutbox("", nil)
+	s.chargeTenant(a, auth)
+	b := s.newOutbox("", nil)
+	s.chargeTenant(b, auth)
+
+	m := newBroadcastMessage("test", string(make([]byte, 100)))
+	size := messageSize(m)
+
+	pushed := 0
+	for i := 0; i < 10; i++ {
+		o := a
+		if i%2 == 1 {
+			o = b
+		}
+		if o.Push(PriorityNormal, m) {
+			pushed++
+		}
+	}
+	if int64(pushed) != 500/size {
+		t.Errorf("Expected %d messages within the quota, got %d", 500/size, pushed)
+	}
+
+	// Protocol replies aren't limited
+	if !a.Push(priorityControl, newMessage(PongMessage)) {
+		t.Error("Expected a reply to be queued")
+	}
+
+	stats := s.tenants.Get("acme").Stats()
+	if stats.BufferedBytes != a.Bytes()+b.Bytes() {
+		t.Errorf("Expected %d bytes, got %d", a.Bytes()+b.Bytes(), stats.BufferedBytes)
+	}
+	if stats.Exceeded[QuotaBufferedBytes] != uint64(10-pushed) {
+		t.Errorf("Unexpected exceeded counts: %v", stats.Exceeded)
+	}
+
+	a.Drain()
+	b.Drain()
+	if n := s.tenants.Get("acme").Stats().BufferedBytes; n != 0 {
+		t.Errorf("Expected nothing buffered, got %d", n)
+	}
+
+	// Other tenants aren't affected
+	other := s.newOutbox("", nil)
+	s.chargeTenant(other, ClientMessage{tenantField: "initech"})
+	s.tenants.SetQuotas(Quotas{
+		Tenants: map[string]Quota{"acme": {BufferedBytes: 1}},
+	})
+	if a.Push(PriorityNormal, m) || !other.Push(PriorityNormal, m) {
+		t.Error("Expected the new quotas to apply")
+	}
+}
+
+func TestPublishLimiterTenant(t *testing.T) {
+	clock := newFakeClock()
+	l := newPublishLimiter(PublishRate{}, clock)
+
+	none := PublishRate{}
+	slow := PublishRate{PerSecond: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		wait, quota := l.AllowTenant("a", none, "alice", none, "acme", slow)
+		if wait != 0 || quota {
+			t.Fatalf("Expected to be allowed, got %s", wait)
+		}
+	}
+
+	// Shared across identities
+	wait, quota := l.AllowTenant("b", none, "bob", none, "acme", slow)
+	if wait != time.Second || !quota {
+		t.Errorf("Expected the tenant quota, got %s (%v)", wait, quota)
+	}
+	wait, quota = l.AllowTenant("b", none, "bob", none, "initech", slow)
+	if wait != 0 || quota {
+		t.Errorf("Expected another tenant to be allowed, got %s", wait)
+	}
+
+	// Another bucket running empty isn't the quota
+	clock.Advance(time.Second)
+	l.AllowTenant("c", slow, "", none, "", none)
+	l.AllowTenant("c", slow, "", none, "", none)
+	wait, quota = l.AllowTenant("c", slow, "", none, "acme", slow)
+	if wait == 0 || quota {
+		t.Errorf("Expected the channel limit, got %s (%v)", wait, quota)
+	}
+}
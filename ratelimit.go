@@ -0,0 +1,299 @@
+package broadcaster
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Allows at most Count operations per Interval. The zero value means no
+// limit.
+type RateLimit struct {
+	Count    int
+	Interval time.Duration
+}
+
+func (r RateLimit) enabled() bool {
+	return r.Count > 0 && r.Interval > 0
+}
+
+// Fixed window rate limiter, for a single client. The limit is passed with
+// each check, it can change in between (see Server.UpdateConfig).
+type rateLimiter struct {
+	clock clock
+	start time.Time
+	count int
+
+	sync.Mutex
+}
+
+func newRateLimiter(c clock) *rateLimiter {
+	return &rateLimiter{
+		clock: c,
+	}
+}
+
+func (r *rateLimiter) Allow(limit RateLimit) bool {
+	if !limit.enabled() {
+		return true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.clock.Now()
+	if now.Sub(r.start) >= limit.Interval {
+		r.start = now
+		r.count = 0
+	}
+
+	if r.count >= limit.Count {
+		return false
+	}
+	r.count++
+	return true
+}
+
+func (r *rateLimiter) idle(now time.Time, interval time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+	return now.Sub(r.start) >= interval
+}
+
+// Rate limiters by key, e.g. per client. Those of which the window passed
+// behave like new ones and are dropped.
+type rateLimiters struct {
+	clock     clock
+	limiters  map[string]*rateLimiter
+	lastSweep time.Time
+
+	sync.Mutex
+}
+
+func newRateLimiters(c clock) *rateLimiters {
+	return &rateLimiters{
+		clock:     c,
+		limiters:  make(map[string]*rateLimiter),
+		lastSweep: c.Now(),
+	}
+}
+
+// Returns the limiter of the key, under the current limit. Without one,
+// the limiter isn't kept: it's only shared once there's something to count.
+func (l *rateLimiters) Get(key string, limit RateLimit) *rateLimiter {
+	if !limit.enabled() {
+		return newRateLimiter(l.clock)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.clock.Now()
+	if now.Sub(l.lastSweep) >= limit.Interval {
+		l.lastSweep = now
+		for k, r := range l.limiters {
+			if r.idle(now, limit.Interval) {
+				delete(l.limiters, k)
+			}
+		}
+	}
+
+	r, ok := l.limiters[key]
+	if !ok {
+		r = newRateLimiter(l.clock)
+		l.limiters[key] = r
+	}
+	return r
+}
+
+// Sustained rate with a burst allowance, enforced with a token bucket. The
+// zero value means no limit.
+type PublishRate struct {
+	// Messages per second
+	PerSecond float64
+
+	// Messages that can be published at once after a quiet period, defaults
+	// to one second worth of messages (at least one).
+	Burst int
+}
+
+func (r PublishRate) enabled() bool {
+	return r.PerSecond > 0
+}
+
+func (r PublishRate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.PerSecond))
+}
+
+type tokenBucket struct {
+	rate   PublishRate
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate PublishRate, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate.burst(),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.rate.burst(), b.tokens+elapsed*b.rate.PerSecond)
+		b.last = now
+	}
+}
+
+// Time until a token is available, zero if there's one now.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
+
+func (b *tokenBucket) full() bool {
+	return b.tokens >= b.rate.burst()
+}
+
+// How often idle buckets are dropped.
+const publishLimiterSweep = time.Minute
+
+// Limits publishes on this node, before they reach Redis: overall, per
+// channel, per identity and per tenant. A publish takes a token from each
+// bucket that applies, or from none when one of them is empty.
+type publishLimiter struct {
+	clock      clock
+	global     *tokenBucket
+	channels   map[string]*tokenBucket
+	identities map[string]*tokenBucket
+	tenants    map[string]*tokenBucket
+	throttled  map[string]uint64
+	lastSweep  time.Time
+
+	sync.Mutex
+}
+
+func newPublishLimiter(global PublishRate, c clock) *publishLimiter {
+	l := &publishLimiter{
+		clock:      c,
+		channels:   make(map[string]*tokenBucket),
+		identities: make(map[string]*tokenBucket),
+		tenants:    make(map[string]*tokenBucket),
+		throttled:  make(map[string]uint64),
+		lastSweep:  c.Now(),
+	}
+	if global.enabled() {
+		l.global = newTokenBucket(global, c.Now())
+	}
+	return l
+}
+
+// Replaces the limit of all publishes, the bucket starts over.
+func (l *publishLimiter) SetGlobal(global PublishRate) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.global != nil && l.global.rate == global {
+		return
+	}
+	l.global = nil
+	if global.enabled() {
+		l.global = newTokenBucket(global, l.clock.Now())
+	}
+}
+
+// Returns how long to wait before retrying, zero if the publish may go
+// ahead. An empty identity isn't limited.
+func (l *publishLimiter) Allow(channel string, channelRate PublishRate, identity string, identityRate PublishRate) time.Duration {
+	wait, _ := l.AllowTenant(channel, channelRate, identity, identityRate, "", PublishRate{})
+	return wait
+}
+
+// Like Allow, but also limits the tenant. Reports whether the tenant's
+// bucket is one of those that ran empty.
+func (l *publishLimiter) AllowTenant(channel string, channelRate PublishRate, identity string, identityRate PublishRate, tenant string, tenantRate PublishRate) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.clock.Now()
+	l.sweep(now)
+
+	buckets := []*tokenBucket{}
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+	if channelRate.enabled() {
+		buckets = append(buckets, l.bucket(l.channels, channel, channelRate, now))
+	}
+	if identity != "" && identityRate.enabled() {
+		buckets = append(buckets, l.bucket(l.identities, identity, identityRate, now))
+	}
+	var tenantBucket *tokenBucket
+	if tenant != "" && tenantRate.enabled() {
+		tenantBucket = l.bucket(l.tenants, tenant, tenantRate, now)
+		buckets = append(buckets, tenantBucket)
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		b.refill(now)
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		l.throttled[channel]++
+		return wait, tenantBucket != nil && tenantBucket.wait() > 0
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, false
+}
+
+// Must hold the lock. Starts over when the rate changed.
+func (l *publishLimiter) bucket(buckets map[string]*tokenBucket, key string, rate PublishRate, now time.Time) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok || b.rate != rate {
+		b = newTokenBucket(rate, now)
+		buckets[key] = b
+	}
+	return b
+}
+
+// Must hold the lock. Full buckets behave like new ones, so they can go.
+func (l *publishLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < publishLimiterSweep {
+		return
+	}
+	l.lastSweep = now
+
+	for _, buckets := range []map[string]*tokenBucket{l.channels, l.identities, l.tenants} {
+		for key, b := range buckets {
+			b.refill(now)
+			if b.full() {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// Throttled publishes per channel.
+func (l *publishLimiter) Throttled() map[string]uint64 {
+	l.Lock()
+	defer l.Unlock()
+
+	result := make(map[string]uint64, len(l.throttled))
+	for channel, n := range l.throttled {
+		result[channel] = n
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := newPublishLimiter(PublishRate{PerSecond: 10, Burst: 5}, clock)
+
+	none := PublishRate{}
+	slow := PublishRate{PerSecond: 1, Burst: 2}
+
+	allow := func(channel string, rate PublishRate, identity string, expected time.Duration) {
+		wait := l.Allow(channel, rate, identity, slow)
+		if wait != expected {
+			t.Fatalf("Expected to wait %s on %s, got %s", expected, channel, wait)
+		}
+	}
+
+	// Burst, then the global rate
+	for i := 0; i < 5; i++ {
+		allow("a", none, "", 0)
+	}
+	allow("a", none, "", 100*time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
+	allow("b", none, "", 0)
+
+	// Channel limit, on top of the global one
+	clock.Advance(time.Second)
+	allow("c", slow, "", 0)
+	allow("c", slow, "", 0)
+	allow("c", slow, "", time.Second)
+	allow("a", none, "", 0)
+
+	// A refused publish takes no tokens
+	clock.Advance(500 * time.Millisecond)
+	allow("c", slow, "", 500*time.Millisecond)
+
+	// Identity limit, across channels
+	clock.Advance(time.Second)
+	allow("a", none, "alice", 0)
+	allow("b", none, "alice", 0)
+	allow("a", none, "alice", time.Second)
+	allow("a", none, "bob", 0)
+
+	throttled := l.Throttled()
+	if throttled["a"] != 2 || throttled["c"] != 2 || throttled["b"] != 0 {
+		t.Errorf("Unexpected throttled counts: %v", throttled)
+	}
+
+	// Idle buckets are dropped
+	clock.Advance(time.Minute)
+	allow("a", none, "", 0)
+	l.Lock()
+	if len(l.channels) != 0 || len(l.identities) != 0 {
+		t.Errorf("Expected idle buckets to be dropped, got %d and %d", len(l.channels), len(l.identities))
+	}
+	l.Unlock()
+}
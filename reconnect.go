@@ -0,0 +1,56 @@
+package broadcaster
+
+import (
+	"math/rand"
+	"time"
+)
+
+// How a Client reconnects after losing its connection, see
+// Client.ReconnectPolicy. The first attempt is made right away, each
+// failed one doubles the wait before the next, from MinDelay up to
+// MaxDelay. Reconnecting re-runs auth and restores the subscriptions.
+type ReconnectPolicy struct {
+	// Attempts in a row before giving up, after which the client stays
+	// disconnected and Disconnected receives true. Zero means it doesn't
+	// reconnect at all.
+	MaxAttempts int
+
+	// Wait after the first failed attempt, and the most to wait between
+	// any two.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Fraction of each wait that's random, between 0 and 1, so that
+	// clients cut off at the same time don't all come back at once. A
+	// jitter of 0.2 shortens waits by up to a fifth.
+	Jitter float64
+}
+
+// Used by NewClient: 10 attempts, waiting 1s, 2s, 4s and so on up to 30s
+// in between, each up to 20% shorter.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	MaxAttempts: 10,
+	MinDelay:    time.Second,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.2,
+}
+
+// Wait after the given number of failed attempts in a row.
+func (p ReconnectPolicy) delay(failed int) time.Duration {
+	d := p.MinDelay
+	for i := 1; i < failed && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
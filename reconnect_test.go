@@ -0,0 +1,62 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	p := ReconnectPolicy{MinDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, d := range expected {
+		got := p.delay(i + 1)
+		if got != d*time.Millisecond {
+			t.Errorf("Expected attempt %d to wait %s, got %s", i+2, d*time.Millisecond, got)
+		}
+	}
+
+	// Shortened, never lengthened
+	p.Jitter = 0.5
+	varied := false
+	for i := 0; i < 100; i++ {
+		got := p.delay(10)
+		if got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("Expected a wait between 500ms and 1s, got %s", got)
+		}
+		varied = varied || got != time.Second
+	}
+	if !varied {
+		t.Error("Expected waits to vary")
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	clock := newFakeClock()
+	client, err := NewClient("http://localhost:1/broadcaster/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mode = ClientModeWebsocket
+	client.clock = clock
+	client.ReconnectPolicy = ReconnectPolicy{MaxAttempts: 3, MinDelay: time.Second, MaxDelay: time.Minute}
+
+	go client.disconnected()
+
+	// Two waits between three attempts
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(clock.Pending()[0])
+	}
+
+	select {
+	case <-client.Disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to give up")
+	}
+	if client.Error == nil {
+		t.Error("Expected an error")
+	}
+	if pending := clock.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no more attempts, got %v", pending)
+	}
+}
@@ -1,10 +1,13 @@
 package broadcaster
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,20 +17,74 @@ import (
 
 type redisBackend struct {
 	conn           redis.Pool
-	pubSub         redis.PubSubConn
-	pubSubHost     string
+	bus            messageBus
+	pubSub         busConn
 	prefix         string
 	timeout        int
 	controlChannel string
 	listening      bool
 	controlWait    sync.WaitGroup
 
+	// Messages kept for at-least-once subscribers, see Server.PendingTTL
+	pendingTTL   time.Duration
+	pendingLimit int
+
+	// Stream length of a durable channel, 0 for the others. See
+	// ChannelConfig.Durable.
+	durable func(channel string) int
+
+	// Names the consumer groups of this node
+	nodeID string
+
+	// Instance name, namespaces the keys and channels. See Server.Name.
+	name string
+
+	// Channels without subscribers, nil unless Server.SkipEmptyChannels
+	empty *emptyChannels
+
+	// Called when a node scheduled a message, see Server.PublishAt
+	scheduled func(at time.Time)
+
+	// Called when a node asked to check subscriptions again, see
+	// Server.RevalidateSubscriptions
+	revalidate func(kind, value string)
+
+	// Called when a node updated the configuration, see Server.UpdateConfig
+	configChanged func()
+
+	// Consumers of the durable channels subscribed to, guarded by
+	// subscriptionsLock
+	streams       map[string]*streamConsumer
+	streamSkipped uint64
+
 	dialRetrier *retrier.Retrier
-	dialOptions []redis.DialOption
+
+	// Done once the backend is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	subscriptions     map[string]bool
 	subscriptionsLock sync.Mutex
 
+	// Closed once Redis confirmed the subscription, guarded by
+	// subscriptionsLock.
+	confirmed map[string]chan struct{}
+
+	// Subscribe requests per channel that Redis didn't reply to yet. A
+	// reply to an earlier request doesn't confirm a later one.
+	pending map[string]int
+
+	// Subscribed to the pattern of all channels rather than to each, see
+	// SetFirehose. Guarded by subscriptionsLock, like the channel the
+	// subscriptions made meanwhile wait on and the unanswered requests.
+	firehose          bool
+	firehoseConfirmed chan struct{}
+	firehosePending   int
+
+	// Channels subscribed to on their own, as far as the replies of Redis
+	// received so far tell. Only used by the listening goroutine.
+	live map[string]bool
+
 	Messages chan redis.Message
 }
 
@@ -39,9 +96,14 @@ const (
 	redisWriteTimeout   time.Duration = 5 * time.Second
 )
 
-func newRedisBackend(redisHost, pubSubHost, controlChannel, prefix string, timeout time.Duration) (*redisBackend, error) {
+func newRedisBackend(redisHost, pubSubHost, name, controlChannel, prefix string, timeout time.Duration, bufferSize int) (*redisBackend, error) {
 	r := newConnectionRetrier(nil)
 
+	if name != "" {
+		controlChannel += ":" + name
+		prefix += name + ":"
+	}
+
 	opts := []redis.DialOption{
 		redis.DialConnectTimeout(redisConnectTimeout),
 		redis.DialReadTimeout(redisReadTimeout),
@@ -72,15 +134,19 @@ func newRedisBackend(redisHost, pubSubHost, controlChannel, prefix string, timeo
 				return nil
 			},
 		},
-		dialOptions:    opts,
 		dialRetrier:    r,
 		prefix:         prefix,
-		pubSubHost:     pubSubHost,
+		name:           name,
 		timeout:        int(timeout.Seconds()) + 1,
 		controlChannel: controlChannel,
 		subscriptions:  make(map[string]bool),
-		Messages:       make(chan redis.Message, 250),
+		confirmed:      make(map[string]chan struct{}),
+		pending:        make(map[string]int),
+		streams:        make(map[string]*streamConsumer),
+		Messages:       make(chan redis.Message, bufferSize),
 	}
+	b.bus = &redisBus{pool: &b.conn, host: pubSubHost, dialOptions: opts}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
 
 	go b.listen()
 
@@ -90,12 +156,68 @@ func newRedisBackend(redisHost, pubSubHost, controlChannel, prefix string, timeo
 func (b *redisBackend) listen() {
 	for {
 		err := b.receive()
+		if b.ctx.Err() != nil {
+			return
+		}
 		if err != nil && err != io.EOF {
-			log.Printf("Redis error: %s", err)
+			b.logf("Redis error: %s", err)
 		}
 
 		// Sleep until next iteration
-		time.Sleep(redisSleep)
+		select {
+		case <-time.After(redisSleep):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stops listening and consuming streams, and closes the connections.
+func (b *redisBackend) Close() error {
+	b.cancel()
+
+	b.subscriptionsLock.Lock()
+	for channel := range b.streams {
+		b.stopStream(channel)
+	}
+	b.subscriptionsLock.Unlock()
+
+	if b.pubSub != nil {
+		b.pubSub.Close()
+	}
+	return b.conn.Close()
+}
+
+// Checks that Redis accepts connections at each of the addresses, within
+// the connect timeout or until the context is done.
+func dialRedis(ctx context.Context, hosts ...string) error {
+	dialer := net.Dialer{Timeout: redisConnectTimeout}
+	for _, host := range hosts {
+		conn, err := dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return fmt.Errorf("Can't reach Redis at %s: %s", host, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func (b *redisBackend) State() BackendState {
+	b.subscriptionsLock.Lock()
+	subscribed := len(b.subscriptions)
+	streams := len(b.streams)
+	firehose := b.firehose
+	b.subscriptionsLock.Unlock()
+
+	return BackendState{
+		Listening:          b.listening,
+		SubscribedChannels: subscribed,
+		Firehose:           firehose,
+		ConsumedStreams:    streams,
+		QueuedMessages:     len(b.Messages),
+		QueueCapacity:      cap(b.Messages),
+		ActiveConnections:  b.conn.ActiveCount(),
+		IdleConnections:    b.conn.IdleCount(),
 	}
 }
 
@@ -104,9 +226,9 @@ func (b *redisBackend) connect() error {
 	b.controlWait.Add(1)
 	defer b.controlWait.Done()
 
-	var p redis.Conn
-	err := b.dialRetrier.Run(func() error {
-		c, err := redis.Dial("tcp", b.pubSubHost, b.dialOptions...)
+	var p busConn
+	err := b.dialRetrier.RunCtx(b.ctx, func(ctx context.Context) error {
+		c, err := b.bus.Listen()
 		if err != nil {
 			return err
 		}
@@ -117,7 +239,8 @@ func (b *redisBackend) connect() error {
 		return err
 	}
 
-	b.pubSub = redis.PubSubConn{Conn: p}
+	b.pubSub = p
+	b.live = make(map[string]bool)
 
 	err = b.pubSub.Subscribe(b.controlChannel)
 	if err != nil {
@@ -127,8 +250,20 @@ func (b *redisBackend) connect() error {
 
 	b.subscriptionsLock.Lock()
 	defer b.subscriptionsLock.Unlock()
+	b.pending = make(map[string]int)
+	if b.firehose {
+		b.firehosePending = 1
+		err = b.pubSub.PSubscribe(b.firehosePattern())
+		if err != nil {
+			b.pubSub.Close()
+			return err
+		}
+		b.listening = true
+		return nil
+	}
 	for k, _ := range b.subscriptions {
-		err = b.pubSub.Subscribe(k)
+		b.pending[k]++
+		err = b.pubSub.Subscribe(b.pubSubChannel(k))
 		if err != nil {
 			b.pubSub.Close()
 			return err
@@ -144,11 +279,34 @@ func (b *redisBackend) receive() error {
 	if err != nil {
 		return err
 	}
+	if b.ctx.Err() != nil {
+		// Closed while connecting
+		return b.pubSub.Close()
+	}
 
 	for {
 		switch v := b.pubSub.Receive().(type) {
-		case redis.Message:
-			b.Messages <- v
+		case busMessage:
+			channel := b.channelOf(v.Channel)
+			if v.Pattern != "" && (v.Channel == b.controlChannel || b.live[channel]) {
+				// Those subscribed to on their own arrive twice meanwhile
+				continue
+			}
+			select {
+			case b.Messages <- redis.Message{Channel: channel, Data: v.Data}:
+			case <-b.ctx.Done():
+				return nil
+			}
+		case busSubscription:
+			switch v.Kind {
+			case "subscribe":
+				b.live[b.channelOf(v.Channel)] = true
+				b.confirm(b.channelOf(v.Channel))
+			case "unsubscribe":
+				delete(b.live, b.channelOf(v.Channel))
+			case "psubscribe":
+				b.confirmFirehose()
+			}
 		case error:
 			// Server stopped?
 			return v.(error)
@@ -156,6 +314,28 @@ func (b *redisBackend) receive() error {
 	}
 }
 
+// Pub/sub channel of the messages of a channel, namespaced by the instance
+// name.
+func (b *redisBackend) pubSubChannel(channel string) string {
+	if b.name == "" {
+		return channel
+	}
+	return b.name + ":" + channel
+}
+
+// Channel of the messages received on a pub/sub channel, see
+// pubSubChannel. The control channel keeps its name.
+func (b *redisBackend) channelOf(pubSubChannel string) string {
+	if b.name == "" || pubSubChannel == b.controlChannel {
+		return pubSubChannel
+	}
+	return strings.TrimPrefix(pubSubChannel, b.name+":")
+}
+
+func (b *redisBackend) logf(format string, args ...interface{}) {
+	logf(b.name, format, args...)
+}
+
 func (b *redisBackend) key(name string, args ...interface{}) string {
 	if len(args) > 0 {
 		return b.prefix + fmt.Sprintf(name, args...)
@@ -185,8 +365,8 @@ func (b *redisBackend) GetConnected() (int, error) {
 
 func (b *redisBackend) StoreSession(token string, auth ClientMessage) error {
 	// No need to store these
-	delete(auth, "__token")
-	delete(auth, "__type")
+	delete(auth, tokenField)
+	delete(auth, typeField)
 	data, err := json.Marshal(auth)
 	if err != nil {
 		return err
@@ -207,16 +387,21 @@ func (b *redisBackend) DeleteSession(token string) error {
 	conn.Send("MULTI")
 	conn.Send("DEL", b.key("sess:%s", token))
 	conn.Send("DEL", b.key("channels:%s", token))
+	conn.Send("DEL", b.key("subscription-ids:%s", token))
 	conn.Send("DECR", b.key("connected"))
 	_, err := conn.Do("EXEC")
 	return err
 }
 
+// Returns nil if there's no such session.
 func (b *redisBackend) GetSession(token string) (ClientMessage, error) {
 	conn := b.conn.Get()
 	defer conn.Close()
 
 	s, err := redis.Bytes(conn.Do("GET", b.key("sess:"+token)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -230,6 +415,92 @@ func (b *redisBackend) GetSession(token string) (ClientMessage, error) {
 	return data, nil
 }
 
+// Keeps the auth data a session credential restores, see Server.SessionTTL.
+func (b *redisBackend) StoreResumable(id string, auth ClientMessage, ttl time.Duration) error {
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+	_, err = conn.Do("PSETEX", b.key("resume:%s", id), int64(ttl/time.Millisecond), string(data))
+	return err
+}
+
+// Keeps the auth data for another ttl, if it's still there.
+func (b *redisBackend) RenewResumable(id string, ttl time.Duration) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+	_, err := conn.Do("PEXPIRE", b.key("resume:%s", id), int64(ttl/time.Millisecond))
+	return err
+}
+
+// Returns nil when there's no auth data for the ID (anymore).
+func (b *redisBackend) GetResumable(id string) (ClientMessage, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	s, err := redis.Bytes(conn.Do("GET", b.key("resume:%s", id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := ClientMessage{}
+	err = json.Unmarshal(s, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Removes the auth data, returns false if it was already gone: a session
+// can only be resumed once.
+func (b *redisBackend) TakeResumable(id string) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("DEL", b.key("resume:%s", id)))
+	return n == 1, err
+}
+
+func (b *redisBackend) StoreNonce(nonce string, timeout time.Duration) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", b.key("nonce:%s", nonce), int(timeout.Seconds())+1, "1")
+	return err
+}
+
+// Returns true if the nonce was valid, it can't be used again afterwards.
+func (b *redisBackend) ConsumeNonce(nonce string) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("DEL", b.key("nonce:%s", nonce)))
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Returns true the first time it's called for the signature of a publish
+// request, for as long as it's kept. See Server.PublishKey.
+func (b *redisBackend) ConsumePublishSignature(signature string, ttl time.Duration) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	// A second more for the clocks of the nodes that are slightly apart
+	reply, err := conn.Do("SET", b.key("publish-signature:%s", signature), 1, "PX", int64((ttl+time.Second)/time.Millisecond), "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
 func (b *redisBackend) IsConnected(token string) (bool, error) {
 	conn := b.conn.Get()
 	defer conn.Close()
@@ -248,7 +519,76 @@ func (b *redisBackend) Subscribe(channel string) error {
 	b.subscriptionsLock.Lock()
 	defer b.subscriptionsLock.Unlock()
 	b.subscriptions[channel] = true
-	return b.pubSub.Subscribe(channel)
+	if b.firehose {
+		// Covered once Redis confirmed the pattern
+		if _, ok := b.confirmed[channel]; !ok {
+			b.confirmed[channel] = b.firehoseConfirmed
+		}
+	} else {
+		if _, ok := b.confirmed[channel]; !ok {
+			b.confirmed[channel] = make(chan struct{})
+		}
+		b.pending[channel]++
+		err := b.pubSub.Subscribe(b.pubSubChannel(channel))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Published messages of durable channels come from their stream,
+	// anything else still arrives through pub/sub.
+	if b.streamLength(channel) > 0 {
+		return b.consumeStream(channel)
+	}
+	return nil
+}
+
+func (b *redisBackend) confirm(channel string) {
+	b.subscriptionsLock.Lock()
+	defer b.subscriptionsLock.Unlock()
+
+	if b.pending[channel] > 1 {
+		b.pending[channel]--
+		return
+	}
+	delete(b.pending, channel)
+
+	c, ok := b.confirmed[channel]
+	if !ok {
+		return
+	}
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// Returns a channel closed once Redis confirmed the subscription to a
+// channel, false if it isn't subscribed to. See WaitSubscribed.
+func (b *redisBackend) Confirmed(channel string) (<-chan struct{}, bool) {
+	b.subscriptionsLock.Lock()
+	defer b.subscriptionsLock.Unlock()
+
+	c, ok := b.confirmed[channel]
+	return c, ok
+}
+
+// Waits until Redis confirmed the subscription to a channel: from then on,
+// all published messages are received. Gives up after the timeout, false
+// if it wasn't confirmed by then.
+func (b *redisBackend) WaitSubscribed(channel string, timeout time.Duration) bool {
+	c, ok := b.Confirmed(channel)
+	if !ok {
+		return true
+	}
+
+	select {
+	case <-c:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func (b *redisBackend) Unsubscribe(channel string) error {
@@ -258,25 +598,269 @@ func (b *redisBackend) Unsubscribe(channel string) error {
 	b.subscriptionsLock.Lock()
 	defer b.subscriptionsLock.Unlock()
 	delete(b.subscriptions, channel)
-	return b.pubSub.Unsubscribe(channel)
+	delete(b.confirmed, channel)
+	err := b.stopStream(channel)
+	if err != nil {
+		b.logf("Redis error stopping stream of %s: %s", channel, err)
+	}
+	if b.firehose {
+		return nil
+	}
+	return b.pubSub.Unsubscribe(b.pubSubChannel(channel))
 }
 
-// Records channel subscription and broadcasts it to listeners
-func (b *redisBackend) LongpollSubscribe(token, channel string) error {
+// Publishes a message in an envelope, with a unique ID and a sequence number
+// that increases for each message on the channel. The message is also kept
+// while the channel has at-least-once subscribers, see PendingJoin.
+// Messages of durable channels are added to their stream instead, see
+// streamConsumer. Also returns the number of nodes that got the message, or
+// receiversStored when it's kept.
+func (b *redisBackend) Publish(channel, body string, opts messageOptions, origin publishOrigin, now time.Time) (string, int64, int, error) {
 	conn := b.conn.Get()
 	defer conn.Close()
 
+	subscribers := b.key("pending-subscribers:%s", channel)
+	conn.Send("MULTI")
+	conn.Send("INCR", b.key("seq:%s", channel))
+	conn.Send("ZREMRANGEBYSCORE", subscribers, "-inf", quotaScore(now))
+	conn.Send("ZCARD", subscribers)
+	values, err := redis.Int64s(conn.Do("EXEC"))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	seq, pending := values[0], values[2] > 0
+
+	var version uint64
+	if b.empty != nil {
+		version = b.empty.Version()
+	}
+
+	e := envelope{
+		ID:           randomId(8),
+		Seq:          seq,
+		Body:         body,
+		Origin:       origin.ConnectionID,
+		SuppressEcho: origin.SuppressEcho,
+		Time:         now.UnixNano() / int64(time.Millisecond),
+		Node:         b.nodeID,
+		Headers:      opts.Headers,
+		TTL:          int64(opts.TTL / time.Millisecond),
+
+		CompactionKey: opts.CompactionKey,
+	}
+	data, err := encodeEnvelope(e)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	cmd, args := "PUBLISH", []interface{}{b.pubSubChannel(channel), data}
+	if length := b.streamLength(channel); length > 0 {
+		cmd, args = "XADD", []interface{}{b.key("stream:%s", channel), "MAXLEN", "~", length, "*", "data", data}
+	}
+
+	if pending {
+		key := b.key("pending:%s", channel)
+		ttl := int64(b.pendingTTL / time.Millisecond)
+		conn.Send("MULTI")
+		if opts.CompactionKey != "" {
+			// Replaces the previous message with the same key
+			keys := b.key("pending-keys:%s", channel)
+			conn.Send("ZADD", key, seq, compactedPrefix+opts.CompactionKey)
+			conn.Send("HSET", keys, opts.CompactionKey, data)
+			conn.Send("PEXPIRE", keys, ttl)
+		} else {
+			conn.Send("ZADD", key, seq, data)
+		}
+		conn.Send("ZREMRANGEBYRANK", key, 0, -b.pendingLimit-1)
+		conn.Send("PEXPIRE", key, ttl)
+		conn.Send(cmd, args...)
+		_, err = conn.Do("EXEC")
+	} else if cmd == "PUBLISH" {
+		// Back to the pool first, the bus takes a connection of its own
+		conn.Close()
+		var receivers int
+		receivers, err = b.bus.Publish(b.pubSubChannel(channel), data)
+		if reply, ok := err.(*unexpectedReplyError); ok {
+			b.logf("Unexpected reply to PUBLISH on %s: %s", channel, reply)
+			return e.ID, e.Seq, receiversUnknown, nil
+		}
+		if err == nil {
+			if receivers == 0 && b.empty != nil {
+				b.empty.Mark(channel, version)
+			}
+			return e.ID, e.Seq, receivers, nil
+		}
+	} else {
+		_, err = conn.Do(cmd, args...)
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return e.ID, e.Seq, receiversStored, nil
+}
+
+// Tells all nodes that this one subscribed to a channel, so they publish
+// to it again. See emptyChannels.
+func (b *redisBackend) AnnounceSubscribed(channel string) error {
+	return b.publishControl("subscribed " + channel)
+}
+
+// Publishes a control message to all nodes on its own, not along with other
+// changes in Redis.
+func (b *redisBackend) publishControl(message string) error {
+	_, err := b.bus.Publish(b.controlChannel, []byte(message))
+	if _, ok := err.(*unexpectedReplyError); ok {
+		// Went out nonetheless
+		return nil
+	}
+	return err
+}
+
+// Registers an at-least-once subscriber of a channel, identified by its
+// client key: the channel's messages are kept from then on. Returns the
+// sequence number up to which the client acknowledged them (the current
+// one for a new subscriber), and the current one.
+func (b *redisBackend) PendingJoin(channel, client string) (int64, int64, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	acked := b.key("acked:%s:%s", client, channel)
+	conn.Send("MULTI")
+	conn.Send("ZADD", b.key("pending-subscribers:%s", channel), quotaScore(time.Time{}), client)
+	conn.Send("PERSIST", acked)
+	conn.Send("GET", acked)
+	conn.Send("GET", b.key("seq:%s", channel))
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	current, err := redis.Int64(values[3], nil)
+	if err == redis.ErrNil {
+		current, err = 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := redis.Int64(values[2], nil)
+	if err != redis.ErrNil {
+		return seq, current, err
+	}
+	_, err = conn.Do("SET", acked, current, "NX")
+	return current, current, err
+}
+
+// Returns the kept messages of a channel after the given sequence number,
+// as published, only the latest of those with the same compaction key.
+func (b *redisBackend) PendingMessages(channel string, after int64) ([][]byte, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	members, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", b.key("pending:%s", channel), "("+strconv.FormatInt(after, 10), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+	return b.resolveCompacted(conn, channel, members)
+}
+
+// Acknowledges the messages of a channel up to the given sequence number.
+// Ignored for clients that aren't registered.
+func (b *redisBackend) PendingAck(channel, client string, seq int64) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", b.key("acked:%s:%s", client, channel), seq, "XX")
+	return err
+}
+
+// Keeps a disconnected subscriber registered until expires, for it to come
+// back for what it didn't acknowledge.
+func (b *redisBackend) PendingRelease(client string, expires time.Time, channels ...string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, channel := range channels {
+		conn.Send("ZADD", b.key("pending-subscribers:%s", channel), quotaScore(expires), client)
+		conn.Send("PEXPIRE", b.key("acked:%s:%s", client, channel), int64(b.pendingTTL/time.Millisecond))
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Forgets a subscriber.
+func (b *redisBackend) PendingDrop(client string, channels ...string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, channel := range channels {
+		conn.Send("ZREM", b.key("pending-subscribers:%s", channel), client)
+		conn.Send("DEL", b.key("acked:%s:%s", client, channel))
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Records channel subscription and broadcasts it to listeners. A TTL of zero
+// means no expiry. Returns the ID of the subscription: a new one, or the
+// one it had when it's updated.
+func (b *redisBackend) LongpollSubscribe(token, channel string, ttl time.Duration, echo bool, now time.Time) (string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	value := encodeLongpollTTL(ttl, now)
+	notification := fmt.Sprintf("subscribe %s %s", token, channel)
+	if echo {
+		value += longpollEchoSuffix
+		notification += " echo"
+	}
+
 	key := b.key("channels:%s", token)
 	conn.Send("MULTI")
-	conn.Send("HSET", key, channel, "1")
+	conn.Send("HSET", key, channel, value)
 	conn.Send("EXPIRE", key, b.timeout)
-	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("subscribe %s %s", token, channel))
-	_, err := conn.Do("EXEC")
+	conn.Send("PUBLISH", b.controlChannel, notification)
+	values, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
-		return err
+		return "", err
+	}
+	added, err := redis.Int(values[0], nil)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	set := "HSETNX"
+	if added == 1 {
+		set = "HSET"
+	}
+	ids := b.key("subscription-ids:%s", token)
+	conn.Send("MULTI")
+	conn.Send(set, ids, channel, randomId(8))
+	conn.Send("EXPIRE", ids, b.timeout)
+	conn.Send("HGET", ids, channel)
+	values, err = redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	return redis.String(values[2], nil)
+}
+
+// Returns the channel of a long-poll subscription with the given ID.
+func (b *redisBackend) LongpollSubscriptionChannel(token, id string) (string, bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	ids, err := redis.StringMap(conn.Do("HGETALL", b.key("subscription-ids:%s", token)))
+	if err != nil {
+		return "", false, err
+	}
+	for channel, v := range ids {
+		if v == id {
+			return channel, true, nil
+		}
+	}
+	return "", false, nil
 }
 
 // Records channel unsubscription and broadcasts it to listeners
@@ -287,6 +871,7 @@ func (b *redisBackend) LongpollUnsubscribe(token, channel string) error {
 	key := b.key("channels:%s", token)
 	conn.Send("MULTI")
 	conn.Send("HDEL", key, channel)
+	conn.Send("HDEL", b.key("subscription-ids:%s", token), channel)
 	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("unsubscribe %s %s", token, channel))
 	_, err := conn.Do("EXEC")
 	if err != nil {
@@ -296,17 +881,298 @@ func (b *redisBackend) LongpollUnsubscribe(token, channel string) error {
 	return nil
 }
 
-func (b *redisBackend) LongpollGetChannels(token string) ([]string, error) {
+// Restarts the TTL of a subscription, returns false when not subscribed.
+func (b *redisBackend) LongpollTouch(token, channel string, now time.Time) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("channels:%s", token)
+	v, err := redis.String(conn.Do("HGET", key, channel))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ttl, _, ok := decodeLongpollTTL(v)
+	if !ok {
+		return true, nil
+	}
+	value := encodeLongpollTTL(ttl, now)
+	if strings.HasSuffix(v, longpollEchoSuffix) {
+		value += longpollEchoSuffix
+	}
+	_, err = conn.Do("HSET", key, channel, value)
+	return true, err
+}
+
+// Returns the subscriptions whose TTL passed.
+func (b *redisBackend) LongpollExpiredChannels(token string, now time.Time) ([]string, error) {
 	conn := b.conn.Get()
 	defer conn.Close()
 
 	key := b.key("channels:%s", token)
+	entries, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []string{}
+	for channel, v := range entries {
+		_, deadline, ok := decodeLongpollTTL(v)
+		if ok && !deadline.After(now) {
+			expired = append(expired, channel)
+		}
+	}
+	return expired, nil
+}
+
+// Channels of a long-poll session are stored as "1", or as the TTL and the
+// deadline in milliseconds when they expire. Subscriptions with echo have
+// longpollEchoSuffix appended.
+func encodeLongpollTTL(ttl time.Duration, now time.Time) string {
+	if ttl <= 0 {
+		return "1"
+	}
+	deadline := now.Add(ttl).UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("%d %d", ttl/time.Millisecond, deadline)
+}
+
+func decodeLongpollTTL(v string) (time.Duration, time.Time, bool) {
+	var ttl, deadline int64
+	_, err := fmt.Sscanf(v, "%d %d", &ttl, &deadline)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return time.Duration(ttl) * time.Millisecond, time.Unix(0, deadline*int64(time.Millisecond)), true
+}
+
+const longpollEchoSuffix = " echo"
+
+// Returns the channels of a long-poll session, and whether they echo.
+func (b *redisBackend) LongpollGetSubscriptions(token string) (map[string]bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("channels:%s", token)
+	entries, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make(map[string]bool, len(entries))
+	for channel, v := range entries {
+		subscriptions[channel] = strings.HasSuffix(v, longpollEchoSuffix)
+	}
+	return subscriptions, nil
+}
+
+// Counts an operation against a rate limit that's shared by all nodes,
+// returns false when over the limit.
+func (b *redisBackend) RateLimit(name string, limit RateLimit) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("rate:%s", name)
+	conn.Send("MULTI")
+	conn.Send("SET", key, 0, "PX", int64(limit.Interval/time.Millisecond), "NX")
+	conn.Send("INCR", key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	count, err := redis.Int(values[1], nil)
+	if err != nil {
+		return false, err
+	}
+	return count <= limit.Count, nil
+}
+
+// Counts a member (a connection, or a connection and channel) towards a
+// tenant quota that's shared by all nodes. Returns false, without counting
+// it, when that would exceed the limit. Members count until released, or
+// until they expire when expires is set. Counting a member again renews it
+// and always succeeds. Like RateLimit, concurrent claims over the limit may
+// all be refused.
+func (b *redisBackend) QuotaClaim(tenant, quota, member string, limit int, expires, now time.Time) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("quota:%s:%s", tenant, quota)
+	conn.Send("MULTI")
+	conn.Send("SADD", b.key("tenants"), tenant)
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", quotaScore(now))
+	conn.Send("ZADD", key, quotaScore(expires), member)
+	conn.Send("ZCARD", key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	added, err := redis.Int(values[2], nil)
+	if err != nil {
+		return false, err
+	}
+	count, err := redis.Int(values[3], nil)
+	if err != nil {
+		return false, err
+	}
+	if added == 0 || limit <= 0 || count <= limit {
+		return true, nil
+	}
+
+	_, err = conn.Do("ZREM", key, member)
+	return false, err
+}
+
+func (b *redisBackend) QuotaRelease(tenant, quota string, members ...string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(b.key("quota:%s:%s", tenant, quota)).AddFlat(members)
+	_, err := conn.Do("ZREM", args...)
+	return err
+}
+
+// Extends the expiry of members. Those released in the meantime stay
+// released.
+func (b *redisBackend) QuotaRenew(tenant, quota string, expires time.Time, members ...string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(b.key("quota:%s:%s", tenant, quota), "XX")
+	for _, member := range members {
+		args = args.Add(quotaScore(expires), member)
+	}
+	_, err := conn.Do("ZADD", args...)
+	return err
+}
+
+// Returns the connections and subscriptions counted for a tenant.
+func (b *redisBackend) QuotaUsage(tenant string, now time.Time) (int, int, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
 
-	c, err := redis.Strings(conn.Do("HKEYS", key))
+	min := "(" + quotaScore(now)
+	conn.Send("MULTI")
+	conn.Send("ZCOUNT", b.key("quota:%s:%s", tenant, quotaKeyConnections), min, "+inf")
+	conn.Send("ZCOUNT", b.key("quota:%s:%s", tenant, quotaKeySubscriptions), min, "+inf")
+	values, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return values[0], values[1], nil
+}
+
+// Returns the tenants that have ever been counted towards a quota.
+func (b *redisBackend) Tenants() ([]string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", b.key("tenants")))
+}
+
+// Members that don't expire sort last.
+func quotaScore(t time.Time) string {
+	if t.IsZero() {
+		return "+inf"
+	}
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Adds a connection to a member of a presence channel, announces the member
+// when it's the first connection. Atomic, so concurrent joins and leaves on
+// several nodes are announced in order.
+var presenceJoinScript = redis.NewScript(3, `
+if redis.call("SADD", KEYS[1], ARGV[1]) == 1 and redis.call("SCARD", KEYS[1]) == 1 then
+	redis.call("SADD", KEYS[2], ARGV[2])
+	redis.call("HSET", KEYS[3], ARGV[2], ARGV[5])
+	redis.call("PUBLISH", ARGV[3], ARGV[4])
+	return 1
+end
+return 0
+`)
+
+// Removes a connection from a member, announces that the member left when it
+// was the last one.
+var presenceLeaveScript = redis.NewScript(3, `
+if redis.call("SREM", KEYS[1], ARGV[1]) == 1 and redis.call("SCARD", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[2])
+	redis.call("HDEL", KEYS[3], ARGV[2])
+	redis.call("PUBLISH", ARGV[3], ARGV[4])
+	return 1
+end
+return 0
+`)
+
+func (b *redisBackend) PresenceJoin(channel, member, id string, attributes map[string]interface{}) error {
+	return b.presence(presenceJoinScript, MemberAddedMessage, channel, member, id, attributes)
+}
+
+func (b *redisBackend) PresenceLeave(channel, member, id string) error {
+	return b.presence(presenceLeaveScript, MemberRemovedMessage, channel, member, id, nil)
+}
+
+func (b *redisBackend) presence(script *redis.Script, event, channel, member, id string, attributes map[string]interface{}) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	data, err := encodeEnvelope(envelope{Event: event, Member: member, Attributes: attributes})
+	if err != nil {
+		return err
+	}
+
+	// Kept for listing the members, see Client.Subscribers
+	attrs := []byte{}
+	if len(attributes) > 0 {
+		attrs, err = json.Marshal(attributes)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = script.Do(conn,
+		b.key("presence:%s:%s", channel, member), b.key("members:%s", channel), b.key("member-attributes:%s", channel),
+		id, member, b.pubSubChannel(channel), data, attrs)
+	return err
+}
+
+func (b *redisBackend) PresenceMembers(channel string) ([]string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", b.key("members:%s", channel)))
+}
+
+// The members of a presence channel with their attributes, unordered.
+func (b *redisBackend) PresenceMemberList(channel string) ([]Member, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", b.key("members:%s", channel)))
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	args := []interface{}{b.key("member-attributes:%s", channel)}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	attrs, err := redis.ByteSlices(conn.Do("HMGET", args...))
 	if err != nil {
 		return nil, err
 	}
-	return c, err
+
+	members := make([]Member, len(keys))
+	for i, key := range keys {
+		members[i].Key = key
+		if len(attrs[i]) > 0 {
+			json.Unmarshal(attrs[i], &members[i].Attributes)
+		}
+	}
+	return members, nil
 }
 
 func (b *redisBackend) LongpollPing(token string) error {
@@ -317,6 +1183,7 @@ func (b *redisBackend) LongpollPing(token string) error {
 	// allowed lingering time.
 	conn.Send("MULTI")
 	conn.Send("EXPIRE", b.key("channels:%s", token), b.timeout*2)
+	conn.Send("EXPIRE", b.key("subscription-ids:%s", token), b.timeout*2)
 	conn.Send("EXPIRE", b.key("sess:%s", token), b.timeout*2)
 	_, err := conn.Do("EXEC")
 	if err != nil {
@@ -331,8 +1198,12 @@ func (b *redisBackend) LongpollBacklog(token string, m ClientMessage) error {
 	defer conn.Close()
 
 	// No need to store type
-	delete(m, "__type")
-	data, err := json.Marshal(m)
+	stored := make(ClientMessage, len(m))
+	for k, v := range m {
+		stored[k] = v
+	}
+	delete(stored, typeField)
+	data, err := json.Marshal(stored)
 	if err != nil {
 		return err
 	}
@@ -361,6 +1232,85 @@ func (b *redisBackend) LongpollTransfer(token string, seq string) error {
 	return nil
 }
 
+// Stores the final message of a kicked long-poll session, for the next poll.
+func (b *redisBackend) LongpollKick(token, message string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", b.key("kick:%s", token), b.timeout, message)
+	return err
+}
+
+// Returns the final message if the session was kicked, while polling or in
+// between polls.
+func (b *redisBackend) LongpollTakeKick(token, id string) (string, bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("kick:%s", token)
+	idKey := b.key("kick-id:%s", id)
+	conn.Send("MULTI")
+	conn.Send("GET", key)
+	conn.Send("GET", idKey)
+	conn.Send("DEL", key, idKey)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, v := range values[:2] {
+		message, err := redis.String(v, nil)
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return "", false, err
+		}
+		return message, true, nil
+	}
+	return "", false, nil
+}
+
+// Returns true the first time it's called for a session, to ask a long-poll
+// client to move only once while draining.
+func (b *redisBackend) LongpollMigrate(token string) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", b.key("migrate:%s", token), 1, "EX", b.timeout*2, "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Returns true the first time it's called for a session, to tell a
+// long-poll client only once that the node is about to shut down.
+func (b *redisBackend) LongpollDraining(token string) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", b.key("draining:%s", token), 1, "EX", b.timeout*2, "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Asks the node that holds a connection to close it.
+func (b *redisBackend) Kick(id, message string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	// Also kept for a long-poll session that isn't polling right now, see
+	// LongpollTakeKick.
+	conn.Send("MULTI")
+	conn.Send("SETEX", b.key("kick-id:%s", id), b.timeout, message)
+	conn.Send("DEL", b.key("resume:%s", id))
+	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("kick %s %s", id, message))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
 func (b *redisBackend) LongpollGetBacklog(token string, result chan ClientMessage) {
 	conn := b.conn.Get()
 	defer conn.Close()
@@ -378,7 +1328,7 @@ func (b *redisBackend) LongpollGetBacklog(token string, result chan ClientMessag
 			return
 		}
 
-		data["__type"] = MessageMessage
+		data[typeField] = MessageMessage
 
 		result <- data
 	}
@@ -0,0 +1,242 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reason of the UnsubscribeOKMessage sent when a subscription is revoked,
+// see Server.RevalidateSubscriptions.
+const reasonRevoked = "revoked"
+
+// Subscriptions checked between two pauses, see Server.RevalidateRate.
+const revalidateChunkSize = 100
+
+// Kinds of revalidation, as sent on the control channel.
+const (
+	revalidateChannel  = "channel"
+	revalidateIdentity = "identity"
+)
+
+func newRevokedMessage(channel string) ClientMessage {
+	return ClientMessage{
+		typeField: UnsubscribeOKMessage,
+		"channel": channel,
+		"reason":  reasonRevoked,
+	}
+}
+
+// Whether an UnsubscribeOKMessage ended a subscription the server revoked,
+// as opposed to one the client ended, or that expired. See
+// Server.RevalidateSubscriptions.
+func (c ClientMessage) Revoked() bool {
+	return c.Type() == UnsubscribeOKMessage && c["reason"] == reasonRevoked
+}
+
+// A connection whose subscriptions can be revoked by the server.
+type revocableConnection interface {
+	connection
+	authData() ClientMessage
+	audit(t, channel, reason string)
+
+	// Ends the subscription and tells the client with the notice, see
+	// newRevokedMessage and newUnsubscribedMessage.
+	revokeSubscription(channel string, notice ClientMessage)
+}
+
+// Runs CanSubscribe again for all subscriptions to a channel, on all nodes,
+// e.g. after permissions changed. Subscriptions it refuses now are ended,
+// the client receives an UnsubscribeOKMessage with reason "revoked" (see
+// ClientMessage.Revoked) and doesn't resubscribe on its own.
+//
+// Returns once the nodes were told, they check in the background at
+// RevalidateRate. Stats tell how far along they are. Long-poll clients are
+// checked while they poll, one that's between two polls is missed.
+func (s *Server) RevalidateSubscriptions(channel string) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	return st.redis.Revalidate(revalidateChannel, channel)
+}
+
+// Like RevalidateSubscriptions, for all subscriptions of the connections
+// with the given Identity, e.g. after a user left a team.
+func (s *Server) RevalidateUser(identity string) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	if s.Identity == nil {
+		return errors.New("RevalidateUser requires an Identity callback")
+	}
+	return st.redis.Revalidate(revalidateIdentity, identity)
+}
+
+func (b *redisBackend) Revalidate(kind, value string) error {
+	return b.publishControl(fmt.Sprintf("revalidate %s %s", kind, value))
+}
+
+type revalidation struct {
+	kind  string
+	value string
+}
+
+// Checks subscriptions in the background, one revalidation after the other,
+// in chunks with pauses between them: the hub is locked to list what to
+// check, and for each subscription as it's checked, never for the walk.
+type revalidator struct {
+	checked uint64
+	revoked uint64
+
+	s     *Server
+	queue []revalidation
+	busy  bool
+	sync.Mutex
+
+	wake chan struct{}
+	quit chan struct{}
+}
+
+func newRevalidator(s *Server) *revalidator {
+	return &revalidator{
+		s:    s,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+}
+
+// Queues a revalidation, without blocking: called by the hub.
+func (r *revalidator) Add(kind, value string) {
+	r.Lock()
+	r.queue = append(r.queue, revalidation{kind: kind, value: value})
+	r.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *revalidator) Run() {
+	for {
+		select {
+		case <-r.wake:
+		case <-r.quit:
+			return
+		}
+
+		for {
+			r.Lock()
+			if len(r.queue) == 0 {
+				r.busy = false
+				r.Unlock()
+				break
+			}
+			job := r.queue[0]
+			r.queue = r.queue[1:]
+			r.busy = true
+			r.Unlock()
+
+			if !r.revalidate(job) {
+				return
+			}
+		}
+	}
+}
+
+func (r *revalidator) Stop() {
+	close(r.quit)
+}
+
+// Revalidations waiting or under way.
+func (r *revalidator) Len() int {
+	r.Lock()
+	defer r.Unlock()
+
+	n := len(r.queue)
+	if r.busy {
+		n++
+	}
+	return n
+}
+
+func (r *revalidator) Checked() uint64 {
+	return atomic.LoadUint64(&r.checked)
+}
+
+func (r *revalidator) Revoked() uint64 {
+	return atomic.LoadUint64(&r.revoked)
+}
+
+// A subscription to check.
+type revalidationTarget struct {
+	conn    revocableConnection
+	channel string
+}
+
+// Returns false when stopped along the way.
+func (r *revalidator) revalidate(job revalidation) bool {
+	st := r.s.current()
+	hub := st.hub
+
+	var targets []revalidationTarget
+	switch job.kind {
+	case revalidateChannel:
+		for _, conn := range hub.Subscribers(job.value) {
+			if c, ok := conn.(revocableConnection); ok {
+				targets = append(targets, revalidationTarget{c, job.value})
+			}
+		}
+	case revalidateIdentity:
+		for _, conn := range hub.Connections() {
+			c, ok := conn.(revocableConnection)
+			if !ok || r.s.identity(c.authData()) != job.value {
+				continue
+			}
+			for _, channel := range hub.Channels(c) {
+				targets = append(targets, revalidationTarget{c, channel})
+			}
+		}
+	}
+
+	// A long-poll client can be in the hub twice, while a poll takes over.
+	seen := make(map[string]bool)
+	for i, target := range targets {
+		if i > 0 && i%revalidateChunkSize == 0 && !r.pause() {
+			return false
+		}
+
+		key := target.conn.GetToken() + " " + target.channel
+		if seen[key] || !hub.hasSubscription(target.conn, target.channel) {
+			continue
+		}
+		seen[key] = true
+
+		atomic.AddUint64(&r.checked, 1)
+		if r.s.canSubscribe(target.conn.authData(), target.channel) {
+			continue
+		}
+		r.s.forgetSubscribeAccess(target.conn.authData(), target.channel)
+		target.conn.revokeSubscription(target.channel, newRevokedMessage(target.channel))
+		target.conn.audit(AuditSubscriptionRevoked, target.channel, AuditReasonRefused)
+		atomic.AddUint64(&r.revoked, 1)
+	}
+	return true
+}
+
+// Waits long enough for a chunk to stay within RevalidateRate.
+func (r *revalidator) pause() bool {
+	t := r.s.clock.NewTimer(time.Second * revalidateChunkSize / time.Duration(r.s.RevalidateRate))
+	defer t.Stop()
+
+	select {
+	case <-t.C():
+		return true
+	case <-r.quit:
+		return false
+	}
+}
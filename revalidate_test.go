@@ -0,0 +1,134 @@
+package broadcaster
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRevalidateSubscriptions(t *testing.T) {
+	var lock sync.Mutex
+	members := map[string]bool{"alice": true, "bob": true, "carol": true}
+	c := startCluster(t, 2, func(node int) *Server {
+		return &Server{
+			Identity: func(data map[string]interface{}) string {
+				user, _ := data["user"].(string)
+				return user
+			},
+			CanSubscribe: func(data map[string]interface{}, channel string) bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return channel != "team" || members[data["user"].(string)]
+			},
+		}
+	})
+	leave := func(user string) {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(members, user)
+	}
+
+	clients := map[string]*Client{}
+	for user, node := range map[string]int{"alice": 1, "bob": 1, "carol": 0} {
+		mode := ClientModeWebsocket
+		if user == "bob" {
+			mode = ClientModeLongPoll
+		}
+		user := user
+		client := c.Connect(node, mode, func(c *Client) {
+			c.AuthData = map[string]interface{}{"user": user}
+		})
+		for _, channel := range []string{"team", "lobby"} {
+			err := client.Subscribe(channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		clients[user] = client
+	}
+	c.SettleSubscriptions("team", 3)
+
+	expectRevoked := func(client *Client, channel string) {
+		t.Helper()
+		select {
+		case m := <-client.Messages:
+			if !m.Revoked() || m.Channel() != channel {
+				t.Fatalf("Expected %s to be revoked, got %v", channel, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s to be revoked, got nothing", channel)
+		}
+	}
+
+	// Asked on one node, revoked on the other
+	leave("alice")
+	leave("bob")
+	err := c.Server(0).RevalidateSubscriptions("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRevoked(clients["alice"], "team")
+	expectRevoked(clients["bob"], "team")
+	c.SettleSubscriptions("team", 1)
+
+	err = c.Server(1).Publish("team", "Secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Expect(clients["carol"], "message Secret")
+	c.ExpectNothing(clients["alice"])
+
+	// By user, every channel of theirs is checked
+	leave("carol")
+	err = c.Server(1).RevalidateUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRevoked(clients["carol"], "team")
+	c.SettleSubscriptions("team", 0)
+
+	// The others stand
+	err = c.Server(0).Publish("lobby", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range clients {
+		c.Expect(client, "message Hello")
+	}
+
+	var checked, revoked uint64
+	for i := 0; i < 500; i++ {
+		checked, revoked = 0, 0
+		for node := range c.Nodes {
+			stats, err := c.Server(node).Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checked += stats.RevalidatedSubscriptions
+			revoked += stats.RevokedSubscriptions
+			if stats.Revalidations != 0 {
+				revoked = 0
+			}
+		}
+		if checked == 5 && revoked == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if checked != 5 || revoked != 3 {
+		t.Errorf("Expected 5 subscriptions checked and 3 revoked, got %d and %d", checked, revoked)
+	}
+}
+
+func TestRevalidateUserWithoutIdentity(t *testing.T) {
+	server, err := startServer(&Server{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	err = server.Broadcaster.RevalidateUser("alice")
+	if err == nil {
+		t.Error("Expected RevalidateUser to fail without an Identity callback")
+	}
+}
@@ -0,0 +1,293 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Scheduled messages claimed from Redis at once
+	scheduleBatchSize = 100
+
+	// How long to wait before trying again when Redis failed
+	scheduleRetryDelay = time.Second
+)
+
+// A message that's published at a later time, see Server.PublishAt.
+type ScheduledMessage struct {
+	// Identifies the message for CancelScheduled. Not the ID it gets when
+	// it's published.
+	ID string
+
+	Channel string
+	At      time.Time
+
+	server *Server
+}
+
+// Cancels the message, returns false if it was published (or cancelled)
+// already.
+func (m *ScheduledMessage) Cancel() (bool, error) {
+	return m.server.CancelScheduled(m.ID)
+}
+
+// Stored in Redis until it's due.
+type scheduledEntry struct {
+	Channel string `json:"channel"`
+	Body    string `json:"body"`
+}
+
+// Publishes a message at the given time, e.g. for reminders. The message is
+// checked like with Publish, but only then. A time that passed publishes it
+// right away.
+//
+// Scheduled messages are kept in Redis: they survive restarts and are
+// published once, by whichever node gets to them first. Nodes wait for the
+// earliest one, so messages go out within milliseconds of their time, as
+// long as a node is up. One that's prepared later publishes what it missed.
+// Once due, a message is published like any other: when there are no
+// subscribers at that time it's lost, unless the channel is durable or has
+// at-least-once subscribers.
+func (s *Server) PublishAt(channel, body string, at time.Time) (*ScheduledMessage, error) {
+	if !s.isPrepared() {
+		return nil, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	if err := s.validateChannel(channel); err != nil {
+		return nil, &PublishError{Code: PublishErrorInvalidChannel, Reason: err.Error()}
+	}
+	if !s.channelExists(channel) {
+		return nil, &PublishError{Code: PublishErrorUnknownChannel, Reason: "Unknown channel: " + channel}
+	}
+	if !s.acceptsBody(channel, body) {
+		return nil, &PublishError{Code: PublishErrorNotEncrypted, Reason: "Body not encrypted"}
+	}
+	if err := s.validateBody(channel, body); err != nil {
+		return nil, err
+	}
+
+	// Kept to the millisecond, rounded up so that it never goes out early
+	at = at.Add(time.Millisecond - 1).Truncate(time.Millisecond)
+	id := randomId(8)
+	err := st.redis.Schedule(id, scheduledEntry{Channel: channel, Body: body}, at)
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler.Add(at)
+	return &ScheduledMessage{ID: id, Channel: channel, At: at, server: s}, nil
+}
+
+// Cancels a scheduled message by its ID, e.g. after a restart. Returns false
+// if it was published (or cancelled) already.
+func (s *Server) CancelScheduled(id string) (bool, error) {
+	if !s.isPrepared() {
+		return false, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	return st.redis.Unschedule(id)
+}
+
+// Publishes scheduled messages once they're due. Waits for the earliest one
+// it knows of: the first in Redis, or one announced by a node that scheduled
+// it since. Nodes race for the messages, only one gets each.
+type scheduler struct {
+	s *Server
+
+	// Zero when there's nothing to wait for
+	next time.Time
+	sync.Mutex
+
+	wake chan struct{}
+	quit chan struct{}
+}
+
+func newScheduler(s *Server) *scheduler {
+	return &scheduler{
+		s:    s,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+}
+
+// Makes sure the scheduler wakes up at the given time.
+func (r *scheduler) Add(at time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.next.IsZero() || at.Before(r.next) {
+		r.next = at
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Publishes what's due already, then waits for what's next.
+func (r *scheduler) Run() {
+	r.publishDue()
+
+	for {
+		r.Lock()
+		next := r.next
+		r.Unlock()
+
+		if next.IsZero() {
+			select {
+			case <-r.wake:
+			case <-r.quit:
+				return
+			}
+			continue
+		}
+
+		wait := next.Sub(r.s.clock.Now())
+		if wait <= 0 {
+			r.publishDue()
+			continue
+		}
+
+		t := r.s.clock.NewTimer(wait)
+		select {
+		case <-t.C():
+		case <-r.wake:
+			t.Stop()
+		case <-r.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (r *scheduler) Stop() {
+	close(r.quit)
+}
+
+func (r *scheduler) publishDue() {
+	st := r.s.current()
+	r.Lock()
+	r.next = time.Time{}
+	r.Unlock()
+
+	for {
+		entries, err := st.redis.TakeScheduled(r.s.clock.Now(), scheduleBatchSize)
+		if err != nil {
+			r.s.logf("Failed to take scheduled messages: %s", err)
+			r.Add(r.s.clock.Now().Add(scheduleRetryDelay))
+			return
+		}
+		for _, e := range entries {
+			_, _, err := r.s.publish(context.Background(), e.Channel, e.Body, messageOptions{}, publishOrigin{}, false)
+			if err != nil {
+				r.s.logf("Failed to publish scheduled message on %s: %s", e.Channel, err)
+			}
+		}
+		if len(entries) < scheduleBatchSize {
+			break
+		}
+	}
+
+	next, err := st.redis.NextScheduled()
+	if err != nil {
+		r.s.logf("Failed to get scheduled messages: %s", err)
+		r.Add(r.s.clock.Now().Add(scheduleRetryDelay))
+		return
+	}
+	if !next.IsZero() {
+		r.Add(next)
+	}
+}
+
+func (b *redisBackend) Schedule(id string, e scheduledEntry, at time.Time) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Tells the other nodes to wake up for it
+	conn.Send("MULTI")
+	conn.Send("HSET", b.key("scheduled-messages"), id, data)
+	conn.Send("ZADD", b.key("scheduled"), at.UnixMilli(), id)
+	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("scheduled %d", at.UnixMilli()))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) Unschedule(id string) (bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", b.key("scheduled"), id)
+	conn.Send("HDEL", b.key("scheduled-messages"), id)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	removed, err := redis.Int(values[0], nil)
+	return removed == 1, err
+}
+
+// Removes and returns the messages that are due, so that no other node
+// publishes them.
+var takeScheduledScript = redis.NewScript(2, `
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+local result = {}
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[1], id)
+	local data = redis.call("HGET", KEYS[2], id)
+	if data then
+		redis.call("HDEL", KEYS[2], id)
+		table.insert(result, data)
+	end
+end
+return result
+`)
+
+func (b *redisBackend) TakeScheduled(now time.Time, limit int) ([]scheduledEntry, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(takeScheduledScript.Do(conn,
+		b.key("scheduled"), b.key("scheduled-messages"), now.UnixMilli(), limit))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]scheduledEntry, 0, len(values))
+	for _, data := range values {
+		var e scheduledEntry
+		err := json.Unmarshal(data, &e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Returns the time of the earliest scheduled message, zero if there's none.
+func (b *redisBackend) NextScheduled() (time.Time, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("ZRANGE", b.key("scheduled"), 0, 0, "WITHSCORES"))
+	if err != nil || len(values) < 2 {
+		return time.Time{}, err
+	}
+	ms, err := strconv.ParseInt(values[1], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
@@ -0,0 +1,73 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishAt(t *testing.T) {
+	server1, err := startServer(&Server{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+
+	cancelled, err := server1.Broadcaster.PublishAt("test", "Cancelled", time.Now().Add(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := server1.Broadcaster.PublishAt("test", "Later", time.Now().Add(400*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Survives the node that scheduled it
+	server1.Broadcaster.Close()
+	server2 := &testServer{
+		Port:        nextPort(),
+		Broadcaster: &Server{},
+		Redis:       server1.Redis,
+	}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Broadcaster.Close()
+
+	ok, err := server2.Broadcaster.CancelScheduled(cancelled.ID)
+	if err != nil || !ok {
+		t.Fatalf("Expected the message to be cancelled, got %v %v", ok, err)
+	}
+	ok, err = server2.Broadcaster.CancelScheduled(cancelled.ID)
+	if err != nil || ok {
+		t.Errorf("Expected nothing to cancel, got %v %v", ok, err)
+	}
+
+	client, err := newWSClient(server2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-client.Messages:
+		if m.Type() != MessageMessage || m["body"] != "Later" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+		if time.Now().Before(later.At) {
+			t.Error("Expected the message to wait until it's due")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the scheduled message")
+	}
+
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,7 +1,15 @@
 package broadcaster
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -9,17 +17,76 @@ import (
 
 // A Server is the main class of this package, pass it to http.Handle on a
 // chosen path to start a broadcast server.
+//
+// Panics in callbacks are recovered and logged. Access checks that panic
+// count as a denial.
 type Server struct {
 	// Invoked upon initial connection, can be used to enforce access control.
+	// The connection ID is available in data["__id"].
 	CanConnect func(data map[string]interface{}) bool
 
 	// Invoked upon channel subscription, can be used to enforce access control
-	// for channels.
+	// for channels. The connection ID is available in data["__id"].
 	CanSubscribe func(data map[string]interface{}, channel string) bool
 
+	// Remembers the answers of CanSubscribe for this long, for the same auth
+	// data and channel, so that a client subscribing again, e.g. after
+	// reconnecting, doesn't have to wait for an expensive check. Zero, the
+	// default, asks every time. Auth data counts as the same when only the
+	// connection ID, token or session credential differ; re-authenticating
+	// drops what's remembered for the old and new auth data.
+	//
+	// Meanwhile, answers can be stale: a client whose access was taken away
+	// can still subscribe until the answer expires, and one that was granted
+	// access is still refused. RevalidateSubscriptions and RevalidateUser
+	// always ask CanSubscribe, and drop the answers they contradict.
+	SubscribeCacheTTL time.Duration
+
+	// Invoked upon channel subscription, returns which of the channel's
+	// messages the subscriber gets, e.g. only those meant for its user. The
+	// filter applies to live messages and to those replayed at least once
+	// alike, see QoSAtLeastOnce. A nil filter delivers all of them, a
+	// filter that panics none. It runs for every message to every such
+	// subscriber, so it must be fast.
+	SubscriptionFilter func(data map[string]interface{}, channel string) func(m ClientMessage) bool
+
+	// Invoked when a client publishes a message, can be used to enforce
+	// access control. Clients can't publish unless this is set.
+	CanPublish func(data map[string]interface{}, channel string) bool
+
+	// Reports whether a channel exists, optional. Publishing to a channel
+	// for which this returns false fails with a PublishError, which catches
+	// typos in channel names. By default, channels are created on the fly.
+	ChannelExists func(channel string) bool
+
+	// Makes channel names hierarchical, split into segments on this
+	// separator: "orders.eu.paid" with ".". Subscribing or publishing to a
+	// name with an empty segment, such as "orders..paid" or one with a
+	// leading or trailing separator, or with a segment ChannelSegment
+	// doesn't match, fails. Empty, the default, leaves names unchecked.
+	// Patterns of Client.OnMessage and JSONSchemaValidator split on dots.
+	ChannelSeparator string
+
+	// Matches the segments allowed in hierarchical channel names, see
+	// ChannelSeparator. Defaults to letters, digits, "_" and "-".
+	ChannelSegment *regexp.Regexp
+
+	// Checks the body of each message published, by the server or by a
+	// client, optional. Returning an error refuses the message before it
+	// reaches anyone: the publisher gets a PublishError with code
+	// PublishErrorInvalidBody and the error as its reason. Channels can opt
+	// out with ChannelConfig.SkipValidation, encrypted channels aren't
+	// checked. See JSONSchemaValidator for checking JSON bodies.
+	ValidateBody func(channel string, body []byte) error
+
 	// Can be set to allow CORS requests.
 	CheckOrigin func(r *http.Request) bool
 
+	// Origins allowed to make CORS requests and open WebSocket connections,
+	// e.g. "https://example.com", in addition to those CheckOrigin allows.
+	// Can change while running, see UpdateConfig.
+	AllowedOrigins []string
+
 	// Can be used to configure buffer sizes etc.
 	// See http://godoc.org/github.com/gorilla/websocket#Upgrader
 	Upgrader websocket.Upgrader
@@ -41,15 +108,511 @@ type Server struct {
 	// Timeout for long-polling connections
 	Timeout time.Duration
 
+	// How long writing a message to a client may take, defaults to 10
+	// seconds. Connections of clients that stop reading without hanging up
+	// (e.g. behind a dead network path) are closed once it passes, see
+	// Stats.WriteTimeouts. Long-poll and stream responses only get a deadline
+	// when the http.ResponseWriter supports it, as the one of net/http does
+	// since Go 1.20.
+	WriteTimeout time.Duration
+
+	// How long a WebSocket client has to send its auth packet after
+	// connecting, defaults to 10 seconds. Those that stay silent get an
+	// AuthFailedMessage and are disconnected.
+	HandshakeTimeout time.Duration
+
+	// How long clients that connect while draining are told to wait before
+	// trying again, in the Retry-After header. Defaults to 10 seconds. See
+	// EnterDrainMode.
+	DrainRetryAfter time.Duration
+
+	// Writes the error responses of the HTTP endpoints, e.g. to match the
+	// format of an API. Defaults to a JSON error object, see HTTPError.
+	WriteHTTPError func(w http.ResponseWriter, e *HTTPError)
+
+	// Refuses long-poll and stream requests with an HTTPError, like those
+	// of the other endpoints, rather than a protocol message. For clients
+	// that don't speak the protocol: those of this package expect messages.
+	HTTPErrorObjects bool
+
 	// Combine long poll message for given duration (more latency, less load)
 	PollTime time.Duration
 
-	redis    *redisBackend
-	hub      *hub
-	prepared bool
+	// Number of messages a long-poll request buffers while they're being
+	// combined, defaults to 10. Raise this for channels with bursty traffic.
+	LongPollBufferSize int
+
+	// Number of messages buffered between Redis and the hub, defaults to
+	// 250. A larger buffer absorbs bursts when fanning out to many
+	// subscribers.
+	PubSubBufferSize int
+
+	// Number of connections a message is delivered to in one go, defaults
+	// to 500. Larger fan-outs are split into slices, which take turns with
+	// those of other channels: a busy channel with many subscribers doesn't
+	// delay the delivery on smaller ones.
+	FanoutSliceSize int
+
+	// Switches this node to a single Redis subscription to all channels,
+	// the "firehose", while a connection holds more than this many
+	// subscriptions, and back once none holds more than half as many.
+	// Redis then sends this node the messages of every channel, and those
+	// nobody here subscribed to are dropped: fewer subscriptions for Redis
+	// to track, and none to make or release as clients come and go, at the
+	// cost of receiving and discarding the traffic of the other channels.
+	// Worth it when clients subscribe to thousands of quiet channels, not
+	// when the cluster publishes much more than this node delivers.
+	// Meanwhile, SkipEmptyChannels no longer skips channels nobody
+	// subscribed to. Zero, the default, never switches.
+	FirehoseThreshold int
+
+	// Require long-poll clients to authenticate with a one-time nonce, which
+	// protects against replaying captured auth requests. Clients first
+	// receive an AuthChallengeMessage and repeat their auth packet with the
+	// nonce and a proof binding it to the auth data (see the Client).
+	RequireNonce bool
+
+	// How long a nonce stays valid, defaults to 30 seconds.
+	NonceTimeout time.Duration
+
+	// Signs client IDs, optional. Each client is given an ID when it first
+	// connects (in data["__client"]) and presents it again when it
+	// reconnects, unlike the connection ID which changes every time. State
+	// that should outlive a connection is kept per client ID: the subscribe
+	// rate limit, and the presence key and publish rate limit when there's
+	// no Identity. Subscriptions aren't kept, clients subscribe again after
+	// reconnecting.
+	//
+	// Without a key, the server takes the client's word for its ID: a client
+	// can claim the ID of another one and share its rate limits or presence.
+	// With a key, only IDs issued by the server (by any node with the same
+	// key) are accepted, anything else is replaced by a new one. A client ID
+	// is a bearer token either way, don't use it for access control.
+	ClientIDKey []byte
+
+	// How long a client can resume its session after disconnecting, without
+	// sending its auth data again, e.g. when falling back to long-poll or
+	// reconnecting. Zero, the default, disables sessions. The AuthOKMessage
+	// carries a credential the client presents instead of its auth data
+	// (the Client does so by itself): the server restores the auth data it
+	// accepted before, without calling CanConnect again. AuthExpiry still
+	// applies. A credential that can't be resumed is refused with an
+	// AuthFailedMessage, the client then authenticates in full.
+	//
+	// Credentials are signed with SessionKey and bound to the Identity of
+	// the connection. Each one works once, the new connection gets a new
+	// one. They're kept in Redis until SessionTTL after the connection ends,
+	// or after it authenticated if its node went away without ending it.
+	// Long-poll sessions count as going on as long as they poll. Kick
+	// revokes the credential of the connection.
+	SessionTTL time.Duration
+
+	// Signs session credentials, required with SessionTTL. Nodes of the
+	// same instance need the same key.
+	SessionKey []byte
+
+	// Unique name of this node, used as a prefix for connection IDs.
+	// Defaults to a random identifier.
+	NodeID string
+
+	// Makes the IDs of new connections, e.g. to embed the time they were
+	// made. A connection keeps its ID for life: it's what logs, Stats,
+	// DumpState, the WireTap and Kick know it by, and what the client
+	// receives when it connects. IDs must be unique across nodes and can't
+	// contain spaces, others are replaced with the default: the NodeID, a
+	// dash and a random part.
+	ConnIDGenerator func(nodeID string) string
+
+	// Name of this instance, for several instances sharing a Redis server,
+	// e.g. in one process. Namespaces the Redis keys and the pub/sub
+	// channels, the messages of a channel are published on "name:channel".
+	// Also prefixes log lines. Nodes of the same instance need the same
+	// name. Optional, without one nothing is namespaced.
+	Name string
+
+	// Returns the identity (e.g. the user ID) of a connection based on its
+	// auth data, optional. Used in audit events.
+	Identity func(data map[string]interface{}) string
+
+	// Returns the presence key of a connection based on its auth data,
+	// optional. Connections with the same key count as one member of a
+	// presence channel, e.g. a user with several tabs open. Defaults to the
+	// Identity, or the client ID when that's empty.
+	PresenceKey func(data map[string]interface{}) string
+
+	// Returns the auth data to include in state dumps, e.g. without
+	// secrets, optional. Auth data is left out unless this is set. See
+	// DumpState.
+	RedactAuthData func(data map[string]interface{}) map[string]interface{}
+
+	// Returns the auth data kept for a connection once it's accepted,
+	// optional, e.g. to strip raw tokens. CanConnect sees the auth packet as
+	// sent, all other callbacks, the session and state dumps only see what's
+	// returned here, so keep whatever they need (such as the claims read by
+	// AuthExpiry). Protocol fields are always removed, the connection and
+	// client IDs are always kept. Both transports and re-authentication go through this.
+	SanitizeAuthData func(data map[string]interface{}) map[string]interface{}
+
+	// Auth data fields included in MemberAddedMessage events as "attributes",
+	// e.g. a display name. See ChannelConfig.Presence.
+	PresenceAttributes []string
+
+	// Receives security-relevant events, such as failed authentication and
+	// refused subscriptions. Called from a background goroutine.
+	OnAuditEvent func(e AuditEvent)
+
+	// Called on each node when the runtime configuration changed, see
+	// UpdateConfig.
+	OnConfigChange func(old, new RuntimeConfig)
+
+	// Audit events are written here as JSON, one per line, optional.
+	AuditLog io.Writer
+
+	// Number of audit events queued before new ones get dropped.
+	// Defaults to 1000.
+	AuditQueueSize int
+
+	// Receives every frame exchanged with clients as it goes over the wire,
+	// for debugging protocol issues: direction is WireInbound (before
+	// decoding) or WireOutbound (after encoding). Websocket messages are
+	// frames, for long-poll and stream connections it's request bodies and
+	// response writes. The connection ID is empty for requests that can't
+	// be attributed to one. Called from a background goroutine, frames are
+	// dropped when it falls behind (see Stats.WireFramesDropped). Local
+	// clients aren't tapped, nothing goes over the wire.
+	WireTap func(connID string, direction string, raw []byte)
+
+	// Called for each published message written to a connection, local
+	// clients included, e.g. for an audit trail of who received what.
+	// Along with whose the connections are (see Identity and DumpState),
+	// it's a complete delivery log. Called in order from a background
+	// goroutine, shortly after the message went out: deliveries are
+	// queued, up to DeliveryQueueSize, and dropped when it falls behind
+	// (see Stats.DeliveriesDropped). It runs for every message to every
+	// subscriber, so it must be fast: hand the deliveries to a buffered
+	// writer or batch them, rather than doing I/O for each one. The
+	// message is shared with other receivers and shouldn't be modified.
+	OnDeliver func(connID, channel string, m ClientMessage)
+
+	// Number of deliveries queued for OnDeliver before new ones get
+	// dropped. Defaults to 10000.
+	DeliveryQueueSize int
+
+	// Returns when the auth data expires (e.g. based on a JWT "exp" claim),
+	// optional. Once expired, all subscriptions of the connection are
+	// revoked and the client receives an AuthExpiredMessage. Clients can
+	// re-authenticate in-band to extend their access. The zero time means no
+	// expiry.
+	AuthExpiry func(data map[string]interface{}) time.Time
+
+	// Invoked on subscription, returns how long the subscription lasts, e.g.
+	// to cap the TTL requested by the client (zero if it didn't ask for
+	// one). Expired subscriptions are dropped, unless renewed by subscribing
+	// again or with a TouchMessage. Defaults to the requested TTL, zero means
+	// no expiry. Long-poll subscriptions expire on the next poll.
+	SubscriptionTTL func(data map[string]interface{}, channel string, requested time.Duration) time.Duration
+
+	// Limits subscribe and unsubscribe requests per client, to counter
+	// clients that flap subscriptions. Requests over the limit are refused
+	// with a RateLimitedMessage, reconnecting doesn't start over (see
+	// ClientIDKey). Zero means unlimited.
+	SubscribeRateLimit RateLimit
+
+	// Limits latency probes (a PingMessage with a "__ref") per connection,
+	// defaults to 10 per 10 seconds. Probes over the limit are answered with
+	// a RateLimitedMessage. Keepalives aren't limited.
+	PingRateLimit RateLimit
+
+	// Limits requests for the members of a presence channel (see
+	// Client.Subscribers) per connection, defaults to 10 per 10 seconds.
+	// Requests over the limit are answered with a RateLimitedMessage.
+	SubscribersRateLimit RateLimit
+
+	// How long a publish may take to reach Redis, from clients and through
+	// Publish. Zero means no limit other than the Redis timeouts. Publishing
+	// doesn't go through the hub: PubSubBufferSize and a backed up hub delay
+	// delivery, not publishing. See PublishContext for deadlines per call.
+	PublishTimeout time.Duration
+
+	// Limits publishes on this node, from clients and through Publish,
+	// before they reach Redis. Over the limit, publishing fails with a
+	// PublishError with code PublishErrorRateLimited, which tells when to
+	// retry. Channels can have their own limit, see ChannelConfig.
+	MaxPublishRate PublishRate
+
+	// Subscriptions checked per second on each node by
+	// RevalidateSubscriptions and RevalidateUser, so that revalidating a
+	// large channel doesn't hold up delivery. Defaults to 10000.
+	RevalidateRate int
+
+	// How often each node tells Redis how many subscribers it has per
+	// channel, for ChannelStats on the other nodes. Only the counts that
+	// changed are sent. Defaults to 5 seconds.
+	ChannelStatsInterval time.Duration
+
+	// Limits client publishes per identity (or per client, without an
+	// Identity callback) on this node.
+	IdentityPublishRate PublishRate
+
+	// Validates every client message against the protocol: unknown message
+	// types, unknown or missing fields, fields of the wrong type and
+	// messages before auth are answered with a ProtocolErrorMessage instead
+	// of being tolerated. Meant for testing client implementations.
+	StrictProtocol bool
+
+	// In strict mode, also close the connection after a protocol error.
+	// Long-poll sessions are ended.
+	DisconnectOnProtocolError bool
+
+	// Names of the envelope fields on the wire, for all transports. Clients
+	// need the same mapping, see Client.EnvelopeFields. Defaults to the
+	// broadcaster's own names.
+	EnvelopeFields EnvelopeFields
+
+	// Sends broadcast messages over WebSocket as compact binary frames to
+	// clients that ask for it, which spares them parsing JSON. See
+	// BinaryFramesProtocol for the format, and Client.BinaryFrames.
+	BinaryFrames bool
+
+	// Upper bound for the bytes held in outbound buffers across all
+	// connections, and by paused subscriptions (see PauseMessage). Zero means
+	// unlimited. To stay within it, in this order:
+	//
+	//  1. Above 80% of the limit, outbound buffers holding more than their
+	//     fair share stop accepting messages, so the largest are cut off
+	//     first.
+	//  2. When a message wouldn't fit, messages held by paused
+	//     subscriptions are dropped, oldest first across all of them, until
+	//     it does. Their subscribers get a SkippedMessage when resuming.
+	//  3. If that isn't enough, the connection with the largest outbound
+	//     buffer is dropped. The message is refused if it still doesn't fit.
+	//
+	// Messages for paused subscriptions only make room by the second step,
+	// they never drop a connection. Replies are never refused. Stats tells
+	// how often each step kicks in.
+	MaxBufferedBytes int64
+
+	// Subscribes to the channels of the long-poll sessions this node served
+	// when it's prepared, e.g. after a restart, and keeps their messages for
+	// this long. Sessions that poll this node again meanwhile are served what
+	// they missed since, before new messages: without it, nothing is
+	// subscribed until they're back. Messages published while the node was
+	// down are lost either way, as are those of sessions that poll another
+	// node. Zero, the default, disables it. WebSocket subscriptions aren't
+	// kept in Redis, their clients subscribe again when they reconnect.
+	//
+	// The /health endpoint answers 503 Service Unavailable until all these
+	// channels are subscribed, so that traffic can wait for it. Channels
+	// without local subscribers are dropped once the window is over.
+	WarmStartWindow time.Duration
+
+	// Number of messages kept per channel during a warm start, the oldest
+	// give way. Defaults to 100. See WarmStartWindow.
+	WarmStartBufferSize int
+
+	// Levels at which the /load endpoint reports this node as overloaded,
+	// for load balancers to send new connections elsewhere before it's in
+	// trouble. Unlike /health, which only tells whether the node is up, it
+	// answers with the load as it rises. See LoadReport.
+	LoadThresholds LoadThresholds
+
+	// How long the messages of at-least-once subscriptions are kept in
+	// Redis for clients to come back for them, after they were published.
+	// Defaults to a minute. See QoSAtLeastOnce.
+	PendingTTL time.Duration
+
+	// Number of recent messages kept per channel for at-least-once
+	// subscriptions, clients that were away for longer miss the older
+	// ones. Defaults to 1000.
+	PendingLimit int
+
+	// Number of recent messages each node keeps in memory per channel with
+	// local subscribers, zero disables it. At-least-once subscribers that
+	// come back within seconds, e.g. resuming their session after a network
+	// hiccup, get what they missed from there rather than from Redis. The
+	// messages of a channel are kept for 30 seconds after its last local
+	// subscriber left. They count towards MaxBufferedBytes, and are the
+	// first to go when it's tight.
+	LocalCacheSize int
+
+	// Returns the configuration for a given channel, optional. Called for
+	// every delivered message, so it should be fast.
+	ChannelConfig func(channel string) ChannelConfig
+
+	// Configuration of all channels when there's no ChannelConfig
+	// callback. Can change while running, see UpdateConfig.
+	ChannelDefaults ChannelConfig
+
+	// Returns the tenant of a connection based on its auth data (as kept
+	// by SanitizeAuthData), optional. The connections of a tenant share the
+	// limits in Quotas and are reported together in the Stats. Callbacks
+	// find the tenant in data["__tenant"]. Re-authenticating as another
+	// tenant is refused. Connections without a tenant aren't subject to
+	// quotas.
+	Tenant func(data map[string]interface{}) string
+
+	// Limits per tenant, enforced along with the limits above. Connections
+	// and subscriptions are counted across all nodes in Redis, publishes
+	// and buffered bytes on each node. Requests over a quota are refused
+	// with an error code naming it, e.g. QuotaConnections. Use SetQuotas to
+	// change them while running.
+	Quotas Quotas
+
+	// Forwards the messages published on matching channels to URLs, e.g.
+	// for serverless functions that can't hold a connection. Messages are
+	// forwarded by the node they're published on, through Publish or by
+	// clients: anything published to Redis directly isn't. Requests are
+	// sent in the background and retried with backoff, the messages of a
+	// channel reach a URL in the order they were published.
+	Forwards []Forward
+
+	// Number of messages queued for forwarding on this node, including
+	// those being sent, before new ones get dropped. Defaults to 1000.
+	ForwardQueueSize int
+
+	// Retries of a failed forward, defaults to 5. The wait in between
+	// starts at 100 milliseconds and doubles up to 10 seconds.
+	ForwardRetries int
+
+	// Invoked when a message couldn't be forwarded once the retries ran
+	// out, with the last error. Messages dropped because the queue was full
+	// are only counted, see Stats.ForwardsDropped. Called from a background
+	// goroutine.
+	OnForwardFailed func(f Forward, m ForwardedMessage, err error)
+
+	// Serves POST /publish when set, for services that publish without a
+	// Redis client of their own. Requests present the key in an
+	// "Authorization: Bearer" header, or sign the body with it: the
+	// PublishTimestampHeader holds the Unix time in seconds, the
+	// PublishSignatureHeader "sha256=" followed by the hex HMAC-SHA256 of
+	// the timestamp, a dot and the body. Signed requests more than 5
+	// minutes off are refused, as are repeats of one: a signature is kept in
+	// Redis until its timestamp would be refused anyway. Requests with the
+	// key itself can be replayed by whoever sees them, only send those over
+	// TLS. The body is a PublishRequest, published as by PublishWith, the
+	// answer a PublishResponse, which tells a message that reached no
+	// subscriber with UnroutedFail. Failures are answered with an HTTPError
+	// carrying the PublishError code: 429 when rate limited (with a
+	// Retry-After), 404 for unknown channels, 503 when Redis failed, 400
+	// otherwise. Requests without the key get a 401.
+	PublishKey []byte
+
+	// Invoked for each message that expired before it reached a
+	// subscriber, see ChannelConfig.MessageTTL. Called while delivering to
+	// the connection, it should return quickly.
+	OnMessageExpired func(connectionID, channel, id string)
+
+	// What server-side publishes do when their message reached no
+	// subscriber on any node, unless PublishOptions.Unrouted says otherwise.
+	// Defaults to UnroutedAccept.
+	Unrouted UnroutedPolicy
+
+	// Invoked for each message published on this node that reached no
+	// subscriber on any node, client publishes included, e.g. to keep it
+	// elsewhere. See UnroutedPolicy for what counts. Called while
+	// publishing, it should return quickly.
+	OnUnroutedMessage func(channel, id, body string)
+
+	// Skips publishing to Redis on channels without subscribers on any
+	// node. A publish that reached no one marks its channel as empty, the
+	// next ones only get an ID (no sequence number) until a node subscribes
+	// to the channel again or EmptyChannelTTL passes. Nodes announce their
+	// new subscriptions on the control channel, so all of them need the
+	// same setting. Saves a Redis round trip per message on channels nobody
+	// listens to, at the cost of an announcement whenever a node starts
+	// listening to one. Channels with at-least-once subscribers and durable
+	// channels are never skipped. Messages are still forwarded, see
+	// Forwards.
+	//
+	// A subscriber can miss the messages published on other nodes right
+	// after it subscribed: until the announcement reaches a node, it still
+	// skips the channel. That's usually a few milliseconds, but up to
+	// EmptyChannelTTL when a node missed it, e.g. while reconnecting to
+	// Redis.
+	SkipEmptyChannels bool
+
+	// How long a channel is known to be empty at most, see
+	// SkipEmptyChannels. Defaults to 10 seconds.
+	EmptyChannelTTL time.Duration
+
+	// Tells subscribers when and on which node each message was published,
+	// in its "publishedAt" (milliseconds since the epoch) and "node" fields.
+	// See ClientMessage.PublishedAt. Off by default: messages with them
+	// don't fit binary frames, see BinaryFrames.
+	MessageMetadata bool
+
+	// Injects faults into the transports, for testing. Only active in
+	// builds with the "faults" tag, see Faults.
+	Faults Faults
+
+	auditor           *auditor
+	wireTap           *wireTap
+	deliveries        *deliveryObserver
+	forwarder         *forwarder
+	buffers           *bufferAccount
+	cache             *recentCache
+	subscribeCache    *subscribeCache
+	expiries          *expiryQueue
+	scheduler         *scheduler
+	revalidator       *revalidator
+	channelReporter   *channelReporter
+	limiter           *publishLimiter
+	subscribeLimiters *rateLimiters
+	tenants           *tenantAccounts
+	warmStart         *warmStart
+	contexts          *connectionContexts
+	validations       *validationCounter
+	expired           *expiredCounter
+	clock             clock
+	prepareLock       sync.Mutex
+
+	// Holds the *preparedState of the last Prepare, kept after Close.
+	// prepared is 1 in between, accessed atomically.
+	state    atomic.Value
+	prepared uint32
+
+	// Holds the *RuntimeConfig in effect, see UpdateConfig. configData is
+	// how it was stored in Redis, nil until it's updated.
+	runtimeConfig atomic.Value
+	configData    []byte
+	configLock    sync.Mutex
+
+	// Set while draining, see Drain and EnterDrainMode.
+	migration     *MigrateOptions
+	drainMode     bool
+	migrationLock sync.Mutex
+
+	// Accessed atomically
+	writeTimeouts    uint64
+	unroutedMessages uint64
 }
 
+// The hub and the backend a Prepare set up. A request or a connection takes
+// them once, see Server.current, so that a Close and a new Prepare meanwhile
+// don't switch it over halfway.
+type preparedState struct {
+	hub   *hub
+	redis *redisBackend
+}
+
+// Sets up the server: connects to Redis and starts the hub and the
+// background work. Call it before serving, the HTTP endpoints answer with
+// 503 Service Unavailable until it succeeded. See PrepareContext.
 func (s *Server) Prepare() error {
+	return s.PrepareContext(context.Background())
+}
+
+// Like Prepare, giving up when the context is done. Redis has to be
+// reachable, an error tells why it isn't. Does nothing when already
+// prepared.
+func (s *Server) PrepareContext(ctx context.Context) error {
+	s.prepareLock.Lock()
+	defer s.prepareLock.Unlock()
+
+	if s.isPrepared() {
+		return nil
+	}
+
 	// Defaults
 	if s.RedisHost == "" {
 		s.RedisHost = "localhost:6379"
@@ -66,94 +629,686 @@ func (s *Server) Prepare() error {
 	if s.Timeout == 0 {
 		s.Timeout = 30 * time.Second
 	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = 10 * time.Second
+	}
+	if s.HandshakeTimeout == 0 {
+		s.HandshakeTimeout = 10 * time.Second
+	}
+	if s.Unrouted == UnroutedDefault {
+		s.Unrouted = UnroutedAccept
+	}
+	if s.DrainRetryAfter == 0 {
+		s.DrainRetryAfter = 10 * time.Second
+	}
 	if s.PollTime == 0 {
 		s.PollTime = 500 * time.Millisecond
 	}
+	if s.clock == nil {
+		s.clock = realClock{}
+	}
+	if s.LongPollBufferSize == 0 {
+		s.LongPollBufferSize = 10
+	}
+	if s.PubSubBufferSize == 0 {
+		s.PubSubBufferSize = 250
+	}
+	if s.FanoutSliceSize == 0 {
+		s.FanoutSliceSize = 500
+	}
+	if s.NodeID == "" {
+		s.NodeID = randomId(4)
+	}
+	if s.NonceTimeout == 0 {
+		s.NonceTimeout = 30 * time.Second
+	}
+	if !s.PingRateLimit.enabled() {
+		s.PingRateLimit = defaultPingRateLimit
+	}
+	if !s.SubscribersRateLimit.enabled() {
+		s.SubscribersRateLimit = defaultSubscribersRateLimit
+	}
+	if s.AuditQueueSize == 0 {
+		s.AuditQueueSize = 1000
+	}
+	if s.WarmStartBufferSize == 0 {
+		s.WarmStartBufferSize = 100
+	}
+	if s.DeliveryQueueSize == 0 {
+		s.DeliveryQueueSize = 10000
+	}
+	if s.PendingTTL == 0 {
+		s.PendingTTL = time.Minute
+	}
+	if s.EmptyChannelTTL == 0 {
+		s.EmptyChannelTTL = 10 * time.Second
+	}
+	if s.PendingLimit == 0 {
+		s.PendingLimit = 1000
+	}
+	if s.ForwardQueueSize == 0 {
+		s.ForwardQueueSize = 1000
+	}
+	if s.ForwardRetries == 0 {
+		s.ForwardRetries = 5
+	}
+	if s.RevalidateRate == 0 {
+		s.RevalidateRate = 10000
+	}
+	if s.ChannelStatsInterval == 0 {
+		s.ChannelStatsInterval = 5 * time.Second
+	}
+	if s.ChannelSegment == nil {
+		s.ChannelSegment = defaultChannelSegment
+	}
+	if s.SessionTTL > 0 && len(s.SessionKey) == 0 {
+		return errors.New("SessionTTL requires a SessionKey")
+	}
 
-	if s.Upgrader.CheckOrigin == nil && s.CheckOrigin != nil {
-		s.Upgrader.CheckOrigin = s.CheckOrigin
+	if s.Upgrader.CheckOrigin == nil {
+		s.Upgrader.CheckOrigin = s.checkUpgradeOrigin
+	}
+	if s.Upgrader.Error == nil {
+		s.Upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			s.httpError(w, newHTTPError(status, reason.Error()))
+		}
+	}
+	if s.BinaryFrames && s.Upgrader.Subprotocols != nil && !containsString(s.Upgrader.Subprotocols, BinaryFramesProtocol) {
+		// Otherwise only those are agreed on.
+		protocols := make([]string, 0, len(s.Upgrader.Subprotocols)+1)
+		protocols = append(protocols, s.Upgrader.Subprotocols...)
+		s.Upgrader.Subprotocols = append(protocols, BinaryFramesProtocol)
 	}
 
-	redis, err := newRedisBackend(s.RedisHost, s.PubSubHost, s.ControlChannel, s.ControlNamespace, s.Timeout)
+	hosts := []string{s.RedisHost}
+	if s.PubSubHost != s.RedisHost {
+		hosts = append(hosts, s.PubSubHost)
+	}
+	err := dialRedis(ctx, hosts...)
 	if err != nil {
 		return err
 	}
-	s.redis = redis
+	if s.forwarder == nil && len(s.Forwards) > 0 {
+		s.forwarder, err = newForwarder(s.Forwards, s.ForwardQueueSize, s.ForwardRetries, s.OnForwardFailed, s.logf)
+		if err != nil {
+			return err
+		}
+	}
 
-	s.hub = &hub{
-		redis: redis,
+	s.runtimeConfig.Store(s.initialConfig())
+	s.configData = nil
+	s.buffers = newBufferAccount(s.MaxBufferedBytes)
+	if s.LocalCacheSize > 0 {
+		s.cache = newRecentCache(s.LocalCacheSize, s.clock, s.buffers)
+	}
+	s.expiries = newExpiryQueue(s.clock)
+	s.limiter = newPublishLimiter(s.MaxPublishRate, s.clock)
+	s.subscribeLimiters = newRateLimiters(s.clock)
+	s.tenants = newTenantAccounts(s.Quotas)
+	s.contexts = newConnectionContexts()
+	s.validations = newValidationCounter()
+	s.expired = newExpiredCounter()
+	if s.SubscribeCacheTTL > 0 {
+		s.subscribeCache = newSubscribeCache(s.SubscribeCacheTTL, s.clock)
 	}
+	go s.expiries.Run()
 
-	err = s.hub.Prepare()
+	// Kept running by Close, in case events are still coming in
+	if s.auditor == nil && (s.OnAuditEvent != nil || s.AuditLog != nil) {
+		s.auditor = newAuditor(s.AuditQueueSize, s.OnAuditEvent, s.AuditLog, s.logf)
+	}
+	if s.wireTap == nil && s.WireTap != nil {
+		s.wireTap = newWireTap(wireTapQueueSize, s.WireTap, s.logf)
+	}
+	if s.deliveries == nil && s.OnDeliver != nil {
+		s.deliveries = newDeliveryObserver(s.DeliveryQueueSize, s.OnDeliver, s.logf)
+	}
+
+	redis, err := newRedisBackend(s.RedisHost, s.PubSubHost, s.Name, s.ControlChannel, s.ControlNamespace, s.Timeout, s.PubSubBufferSize)
 	if err != nil {
 		return err
 	}
+	redis.pendingTTL = s.PendingTTL
+	redis.pendingLimit = s.PendingLimit
+	redis.nodeID = s.NodeID
+	if s.SkipEmptyChannels {
+		redis.empty = newEmptyChannels(s.clock, s.EmptyChannelTTL)
+	}
+	redis.durable = func(channel string) int {
+		return s.channelConfig(channel).durableLength()
+	}
+	s.scheduler = newScheduler(s)
+	redis.scheduled = s.scheduler.Add
+	s.revalidator = newRevalidator(s)
+	redis.revalidate = s.revalidator.Add
+	s.channelReporter = newChannelReporter(s)
+	redis.configChanged = func() {
+		go s.reloadConfig()
+	}
 
-	go s.hub.Run()
-	s.prepared = true
+	h := &hub{
+		redis:             redis,
+		sliceSize:         s.FanoutSliceSize,
+		firehoseThreshold: s.FirehoseThreshold,
+		metadata:          s.MessageMetadata,
+		deadline:          s.messageDeadline,
+		buffers:           s.buffers,
+		cache:             s.cache,
+	}
+	if s.WarmStartWindow > 0 {
+		h.warm = newWarmBuffers(s.WarmStartBufferSize)
+	}
+
+	err = h.Prepare()
+	if err != nil {
+		return err
+	}
+	s.state.Store(&preparedState{hub: h, redis: redis})
+
+	go h.Run()
+	go s.scheduler.Run()
+	go s.revalidator.Run()
+	go s.channelReporter.Run()
+	s.warmStart = nil
+	if s.WarmStartWindow > 0 {
+		s.warmStart = newWarmStart(s)
+		go s.warmStart.Run()
+	}
+
+	// Set by UpdateConfig before this node was prepared
+	go s.reloadConfig()
+	atomic.StoreUint32(&s.prepared, 1)
 	return nil
 }
 
+// Counterpart of Prepare: stops the hub and the background work and closes
+// the connections to Redis. Connections of clients aren't closed, Drain
+// them first. The HTTP endpoints answer with 503 Service Unavailable
+// afterwards, until the server is prepared again.
+func (s *Server) Close() error {
+	s.prepareLock.Lock()
+	defer s.prepareLock.Unlock()
+
+	if !s.isPrepared() {
+		return nil
+	}
+	atomic.StoreUint32(&s.prepared, 0)
+
+	st := s.current()
+	st.hub.Stop()
+	s.expiries.Stop()
+	s.scheduler.Stop()
+	s.revalidator.Stop()
+	s.channelReporter.Stop()
+	if s.warmStart != nil {
+		s.warmStart.Stop()
+	}
+	return st.redis.Close()
+}
+
+// Whether the server is prepared, see Prepare and Close.
+func (s *Server) isPrepared() bool {
+	return atomic.LoadUint32(&s.prepared) == 1
+}
+
+// Returns what the last Prepare set up, nil before the first one.
+func (s *Server) current() *preparedState {
+	st, _ := s.state.Load().(*preparedState)
+	return st
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	logf(s.Name, format, args...)
+}
+
+// Connection IDs are unique across nodes and stay the same for the lifetime
+// of a connection. See ConnIDGenerator.
+func (s *Server) newConnectionId() string {
+	if s.ConnIDGenerator != nil {
+		id := ""
+		s.runCallback("ConnIDGenerator", func() {
+			id = s.ConnIDGenerator(s.NodeID)
+		})
+		if id != "" && !strings.ContainsAny(id, " \t\r\n") {
+			return id
+		}
+		s.logf("Invalid connection ID %q, using a random one", id)
+	}
+	return s.NodeID + "-" + randomId(8)
+}
+
+// Delivers a final message to a connection and closes it, on whichever node
+// it lives. The client receives the message as a KickMessage, after
+// everything that was queued before, and won't reconnect. Its session can't
+// be resumed, see SessionTTL.
+func (s *Server) Kick(id, message string) error {
+	if !s.isPrepared() {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+	return st.redis.Kick(id, message)
+}
+
+func (s *Server) identity(data map[string]interface{}) string {
+	if s.Identity == nil || data == nil {
+		return ""
+	}
+	identity := ""
+	s.runCallback("Identity", func() {
+		identity = s.Identity(data)
+	})
+	return identity
+}
+
+var errAuthExpired = errors.New("Auth expired")
+
+func (s *Server) authExpiry(data map[string]interface{}) time.Time {
+	if s.AuthExpiry == nil || data == nil {
+		return time.Time{}
+	}
+	// Expired right away if the callback fails
+	expiry := s.clock.Now()
+	s.runCallback("AuthExpiry", func() {
+		expiry = s.AuthExpiry(data)
+	})
+	return expiry
+}
+
+func (s *Server) authExpired(data map[string]interface{}) bool {
+	expires := s.authExpiry(data)
+	return !expires.IsZero() && !expires.After(s.clock.Now())
+}
+
+func (s *Server) channelConfig(channel string) ChannelConfig {
+	if s.ChannelConfig == nil {
+		return s.config().ChannelDefaults
+	}
+	config := ChannelConfig{}
+	s.runCallback("ChannelConfig", func() {
+		config = s.ChannelConfig(channel)
+	})
+	return config
+}
+
+// A single HTTP endpoint of the server, see Server.Routes.
+type Route struct {
+	// Request method, empty to match all methods
+	Method string
+
+	// Path, relative to where the server is mounted. The "/" routes match
+	// everything that isn't matched by another route.
+	Path string
+
+	Handler http.Handler
+}
+
+// Returns the individual endpoints of the server, so they can be composed
+// into any router. Each of them is usable on its own.
+func (s *Server) Routes() []Route {
+	routes := s.routes()
+	for i, r := range routes {
+		routes[i].Handler = s.wrap(r.Handler)
+	}
+	return routes
+}
+
+func (s *Server) routes() []Route {
+	routes := []Route{
+		{"GET", "/health", http.HandlerFunc(s.handleHealth)},
+		{"GET", "/load", http.HandlerFunc(s.handleLoad)},
+		{"GET", "/stream", http.HandlerFunc(s.handleStream)},
+		{"GET", "/", http.HandlerFunc(s.handleWebsocket)},
+		{"POST", "/", http.HandlerFunc(s.handleLongPoll)},
+	}
+	if len(s.PublishKey) > 0 {
+		routes = append(routes, Route{"POST", "/publish", http.HandlerFunc(s.handleHTTPPublish)})
+	}
+	return routes
+}
+
+// Returns a handler for all endpoints. Paths are matched relative to the
+// root, use http.StripPrefix when mounting it on a sub-path.
+func (s *Server) Handler() http.Handler {
+	return s
+}
+
+// Prepares the server and serves it on addr, for when the broadcaster is the
+// only thing running. Use Handler or Routes to embed it.
+func (s *Server) ListenAndServe(addr string) error {
+	if !s.isPrepared() {
+		err := s.Prepare()
+		if err != nil {
+			return err
+		}
+	}
+	return http.ListenAndServe(addr, s)
+}
+
 // Main HTTP server.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !s.prepared {
-		http.Error(w, "Prepare() not called on broadcaster.Server", http.StatusInternalServerError)
-		return
+	s.wrap(http.HandlerFunc(s.route)).ServeHTTP(w, r)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	var fallback http.Handler
+	for _, route := range s.routes() {
+		if route.Method != "" && route.Method != r.Method {
+			continue
+		}
+		if route.Path == r.URL.Path {
+			route.Handler.ServeHTTP(w, r)
+			return
+		}
+		if route.Path == "/" && fallback == nil {
+			fallback = route.Handler
+		}
 	}
 
-	if s.CheckOrigin != nil && s.CheckOrigin(r) {
-		origin := r.Header.Get("Origin")
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if fallback != nil {
+		fallback.ServeHTTP(w, r)
+		return
 	}
+	s.httpError(w, newHTTPError(http.StatusNotFound, "Not found"))
+}
 
-	if r.Method == "GET" {
-		if r.URL.Path == "/health" {
-			if !s.redis.listening {
-				http.Error(w, "No connection to redis", http.StatusServiceUnavailable)
-			}
-		} else {
-			s.handleWebsocket(w, r)
+// Checks that we're prepared and sets CORS headers.
+func (s *Server) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isPrepared() {
+			s.httpError(w, newHTTPError(http.StatusServiceUnavailable, "Prepare() not called on broadcaster.Server"))
+			return
 		}
-	} else if r.Method == "POST" {
-		s.handleLongPoll(w, r)
+
+		if s.allowsOrigin(r) {
+			origin := r.Header.Get("Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	st := s.current()
+	if !st.redis.listening {
+		s.httpError(w, newHTTPError(http.StatusServiceUnavailable, "No connection to redis"))
+		return
+	}
+	if s.inDrainMode() {
+		s.httpError(w, &HTTPError{Status: http.StatusServiceUnavailable, Code: HTTPErrorDraining, Message: "Draining"})
+		return
+	}
+	if ready, total, ok := s.warmStart.Progress(); !ok {
+		s.httpError(w, newHTTPError(http.StatusServiceUnavailable, fmt.Sprintf("Warming up: %d of %d channels subscribed", ready, total)))
 	}
 }
 
 func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	// Always a new client, easy!
+	if s.inDrainMode() {
+		s.refuseDraining(w)
+		return
+	}
+	if isHTTP2(r) {
+		s.refuseWebsocketHTTP2(w)
+		return
+	}
 	newWebsocketConnection(w, r, s)
 }
 
 func (s *Server) handleLongPoll(w http.ResponseWriter, r *http.Request) {
 	err := handleLongpollConnection(w, r, s)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.httpError(w, newHTTPError(http.StatusInternalServerError, err.Error()))
 	}
 }
 
+// Delivery priority of a channel.
+type Priority int
+
+// Priority levels. Queued messages of a higher priority are delivered first,
+// lower priorities are still guaranteed a share of the bandwidth.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// Per-channel settings, see Server.ChannelConfig.
+type ChannelConfig struct {
+	// Delivery priority of messages on this channel, defaults to
+	// PriorityNormal. Protocol replies always take precedence.
+	Priority Priority
+
+	// Track who's subscribed: subscribers receive a MemberAddedMessage when
+	// a member joins and a MemberRemovedMessage when the last connection of
+	// a member leaves, see Server.PresenceKey and Server.Members. Only
+	// connections that are held open take part, long-poll clients don't.
+	Presence bool
+
+	// Bodies are encrypted end-to-end by the publisher and opaque to the
+	// server, see ChannelKey. Publishing a body that isn't in the encrypted
+	// format fails, which protects against leaking plaintext by accident.
+	Encrypted bool
+
+	// Limits publishes to this channel on each node, see
+	// Server.MaxPublishRate.
+	PublishRate PublishRate
+
+	// Messages held back for a paused subscription, see PauseMessage.
+	// Defaults to 100. Past that, the latest ones are dropped, or the oldest
+	// with PauseKeepLatest. Either way the client learns how many with a
+	// SkippedMessage when it resumes.
+	PauseBufferSize int
+	PauseKeepLatest bool
+
+	// Only the latest message matters, e.g. for prices or sensor readings:
+	// a message that's still waiting to be written to a connection is
+	// replaced by the next one, which then carries the number it replaced
+	// in "conflated". With ConflateKey, a field of the JSON body, messages
+	// are only replaced by those with the same value for it. Messages of
+	// at-least-once subscriptions and long-poll clients aren't conflated.
+	Conflate    bool
+	ConflateKey string
+
+	// Published messages go through a Redis Stream capped at DurableLength
+	// entries (1000 by default), rather than pub/sub. Each node reads it
+	// with a cursor of its own that Redis keeps, so messages published
+	// while a node's connection to Redis is down arrive once it's back.
+	// Should a node fall further behind than the stream is long, its
+	// subscribers get a SkippedMessage with the number of messages lost.
+	// Getting them to the client is up to the subscription, see
+	// QoSAtLeastOnce. Must be the same on all nodes.
+	Durable       bool
+	DurableLength int
+
+	// Messages not yet delivered this long after they were published are
+	// dropped: wherever they wait, queued for a connection, held for a
+	// long-poll client between polls, or kept for an at-least-once
+	// subscriber to replay. Zero, the default, keeps them, PublishOptions.TTL
+	// overrides it per message. With NotifyExpired, the subscriber gets an
+	// ExpiredMessage in their place. When the publish time is ahead of a
+	// node's clock, which skewed clocks make it look, the age counts from
+	// when the message reached the node.
+	MessageTTL    time.Duration
+	NotifyExpired bool
+
+	// Bodies published on this channel aren't checked by
+	// Server.ValidateBody, for hot paths where it isn't worth the cost.
+	SkipValidation bool
+}
+
 type Stats struct {
 	// Number of active connections
 	Connections int
 
+	// IDs of the connections on this node, for debugging purposes only
+	LocalConnections []string
+
+	// Number of connections on this node per transport: "websocket",
+	// "longpoll", "stream" or "local". Counts connections from the moment
+	// they're authenticated until they're gone, however they end. A
+	// long-poll session counts between polls too, until it times out.
+	LocalTransports map[string]int
+
 	// For debugging purposes only
 	LocalSubscriptions map[string]int
+
+	// Subscriptions on this node that are paused, per channel. These are
+	// also counted in LocalSubscriptions.
+	LocalPausedSubscriptions map[string]int
+
+	// Number of audit events dropped because the queue was full
+	AuditEventsDropped uint64
+
+	// Number of frames not passed to the WireTap because it fell behind
+	WireFramesDropped uint64
+
+	// Number of deliveries not passed to OnDeliver because it fell behind
+	DeliveriesDropped uint64
+
+	// Bytes currently held in outbound buffers and the cache on this node,
+	// and the highest value seen, see MaxBufferedBytes
+	BufferedBytes          int64
+	BufferedBytesHighWater int64
+
+	// Messages dropped and connections shed to stay within MaxBufferedBytes,
+	// and messages paused subscriptions held that were trimmed
+	BufferDroppedMessages uint64
+	ShedConnections       uint64
+	BufferTrimmedMessages uint64
+
+	// Replays of at-least-once subscriptions this node served from its
+	// cache, and those that went to Redis. See LocalCacheSize.
+	LocalCacheHits   uint64
+	LocalCacheMisses uint64
+
+	// Subscribes answered from what CanSubscribe answered before, and those
+	// that asked it. See SubscribeCacheTTL.
+	SubscribeCacheHits   uint64
+	SubscribeCacheMisses uint64
+
+	// Subscriptions with a TTL on this node, and the number that expired
+	ExpiringSubscriptions int
+	ExpiredSubscriptions  uint64
+
+	// Revalidations waiting or under way on this node, the subscriptions
+	// they checked and those they revoked. See
+	// Server.RevalidateSubscriptions.
+	Revalidations            int
+	RevalidatedSubscriptions uint64
+	RevokedSubscriptions     uint64
+
+	// Publishes refused by a publish rate limit on this node, per channel
+	ThrottledPublishes map[string]uint64
+
+	// Connections closed on this node because a write timed out, see
+	// WriteTimeout
+	WriteTimeouts uint64
+
+	// Messages of durable channels this node missed because their stream
+	// was trimmed before it read them, see ChannelConfig.Durable
+	DurableSkippedMessages uint64
+
+	// Messages this node didn't forward: dropped because the queue was
+	// full, or failed once the retries ran out. See Server.Forwards.
+	ForwardsDropped uint64
+	ForwardsFailed  uint64
+
+	// Messages that expired before they reached a subscriber on this node,
+	// and per channel. See ChannelConfig.MessageTTL and PublishOptions.TTL.
+	ExpiredMessages        uint64
+	ChannelExpiredMessages map[string]uint64
+
+	// Messages published on this node that reached no subscriber on any
+	// node, see Server.OnUnroutedMessage
+	UnroutedMessages uint64
+
+	// Publishes this node didn't send to Redis, for lack of subscribers.
+	// See Server.SkipEmptyChannels.
+	SkippedPublishes uint64
+
+	// Bodies that passed or failed Server.ValidateBody on this node, per
+	// channel
+	BodyValidations map[string]ValidationStats
+
+	// Time subscribe and unsubscribe requests took in the hub of this
+	// node, queued behind others and handled, per message type. Rising
+	// latency is an early sign of a saturated hub.
+	HubLatency map[string]LatencyHistogram
+
+	// Usage per tenant, only with a Tenant callback
+	Tenants map[string]TenantStats
 }
 
 func (s *Server) Stats() (Stats, error) {
-	hubStats, err := s.hub.Stats()
+	st := s.current()
+	hubStats, err := st.hub.Stats()
 	if err != nil {
 		return Stats{}, err
 	}
 
-	connected, err := s.redis.GetConnected()
+	connected, err := st.redis.GetConnected()
 	if err != nil {
 		return Stats{}, err
 	}
 
+	buffers := s.buffers.Stats()
 	stats := Stats{
-		Connections:        connected,
-		LocalSubscriptions: hubStats.LocalSubscriptions,
+		Connections:              connected,
+		LocalConnections:         hubStats.LocalConnections,
+		LocalTransports:          hubStats.LocalTransports,
+		LocalSubscriptions:       hubStats.LocalSubscriptions,
+		LocalPausedSubscriptions: hubStats.LocalPausedSubscriptions,
+		BufferedBytes:            buffers.Used,
+		BufferedBytesHighWater:   buffers.HighWater,
+		BufferDroppedMessages:    buffers.Dropped,
+		ShedConnections:          buffers.Shed,
+		BufferTrimmedMessages:    buffers.Trimmed,
+		ExpiringSubscriptions:    s.expiries.Len(),
+		ExpiredSubscriptions:     s.expiries.Expired(),
+		Revalidations:            s.revalidator.Len(),
+		RevalidatedSubscriptions: s.revalidator.Checked(),
+		RevokedSubscriptions:     s.revalidator.Revoked(),
+		ThrottledPublishes:       s.limiter.Throttled(),
+		WriteTimeouts:            atomic.LoadUint64(&s.writeTimeouts),
+		ExpiredMessages:          s.expired.Total(),
+		ChannelExpiredMessages:   s.expired.Stats(),
+		UnroutedMessages:         atomic.LoadUint64(&s.unroutedMessages),
+		DurableSkippedMessages:   st.redis.StreamSkipped(),
+		HubLatency:               st.hub.Latency(),
+		BodyValidations:          s.validations.Stats(),
+	}
+	if s.cache != nil {
+		cache := s.cache.Stats()
+		stats.LocalCacheHits = cache.Hits
+		stats.LocalCacheMisses = cache.Misses
+	}
+	if s.subscribeCache != nil {
+		stats.SubscribeCacheHits, stats.SubscribeCacheMisses = s.subscribeCache.Stats()
+	}
+	if st.redis.empty != nil {
+		stats.SkippedPublishes = st.redis.empty.Skipped()
+	}
+	if s.auditor != nil {
+		stats.AuditEventsDropped = s.auditor.Dropped()
+	}
+	if s.wireTap != nil {
+		stats.WireFramesDropped = s.wireTap.Dropped()
+	}
+	if s.deliveries != nil {
+		stats.DeliveriesDropped = s.deliveries.Dropped()
+	}
+	if s.forwarder != nil {
+		stats.ForwardsDropped = s.forwarder.Dropped()
+		stats.ForwardsFailed = s.forwarder.Failed()
+	}
+	if s.Tenant != nil {
+		stats.Tenants, err = s.tenantStats()
+		if err != nil {
+			return Stats{}, err
+		}
 	}
 
 	return stats, nil
@@ -0,0 +1,457 @@
+package broadcaster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Mount everything in a custom router, next to other routes
+	mux := http.NewServeMux()
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, route := range server.Broadcaster.Routes() {
+		if route.Path == "/health" {
+			mux.Handle("/status/broadcaster", route.Handler)
+		}
+	}
+	mux.Handle("/rt/", http.StripPrefix("/rt", server.Broadcaster.Handler()))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Healthy once listening to Redis, which happens in the background
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(srv.URL + "/rt/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for path, code := range map[string]int{
+		"/other":              http.StatusTeapot,
+		"/status/broadcaster": http.StatusOK,
+		"/rt/health":          http.StatusOK,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("Expected %d for %s, got %d", code, path, resp.StatusCode)
+		}
+	}
+
+	// Clients connect through the embedded handler
+	client, err := NewClient(fmt.Sprintf("%s/rt/", srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mode = ClientModeWebsocket
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+}
+
+func TestRoutesNotPrepared(t *testing.T) {
+	s := &Server{}
+	for _, route := range s.Routes() {
+		w := httptest.NewRecorder()
+		route.Handler.ServeHTTP(w, httptest.NewRequest(route.Method, route.Path, nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected error for %s %s, got %d", route.Method, route.Path, w.Code)
+		}
+	}
+}
+
+func TestPrepareUnreachable(t *testing.T) {
+	// Nothing listens there
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	s := &Server{RedisHost: addr}
+	start := time.Now()
+	err = s.Prepare()
+	if err == nil || !strings.Contains(err.Error(), addr) {
+		t.Errorf("Expected an error naming %s, got %v", addr, err)
+	}
+	if elapsed := time.Since(start); elapsed > redisConnectTimeout {
+		t.Errorf("Took too long: %s", elapsed)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected to be unavailable, got %d", w.Code)
+	}
+
+	// Gives up when the context is done
+	listener, err = net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s = &Server{RedisHost: listener.Addr().String()}
+	err = s.PrepareContext(ctx)
+	if err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestClose(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	s := server.Broadcaster
+	// Already prepared
+	err = s.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected to be unavailable, got %d", w.Code)
+	}
+	err = s.Publish("test", "Test message")
+	if err == nil {
+		t.Error("Expected publishing to fail")
+	}
+
+	// Ready again
+	err = s.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+}
+
+func TestPublishTimeout(t *testing.T) {
+	// Accepts connections, but never answers
+	stalled, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		conns := []net.Conn{}
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	s := &Server{
+		RedisHost:      stalled.Addr().String(),
+		PublishTimeout: 100 * time.Millisecond,
+	}
+	err = s.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = s.Publish("test", "Test message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Took too long: %s", elapsed)
+	}
+
+	// The context can be shorter
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, _, err = s.PublishContext(ctx, "test", "Test message")
+	if perr, ok := err.(*PublishError); !ok || perr.Code != PublishErrorTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 90*time.Millisecond {
+		t.Errorf("Didn't respect the context: %s", elapsed)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	public, err := startServer(&Server{Name: "public"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Stop()
+
+	// Same Redis, same channel names
+	admin := &testServer{
+		Port:        nextPort(),
+		Broadcaster: &Server{Name: "admin"},
+		Redis:       public.Redis,
+	}
+	err = admin.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Broadcaster.Close()
+
+	publicClient, err := newWSClient(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publicClient.Disconnect()
+	adminClient, err := newWSClient(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adminClient.Disconnect()
+
+	for _, c := range []*Client{publicClient, adminClient} {
+		err = c.Subscribe("events")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(client *Client, body string) {
+		select {
+		case m := <-client.Messages:
+			if m["body"] != body {
+				t.Fatalf("Expected %q, got %v", body, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q", body)
+		}
+	}
+
+	err = public.Broadcaster.Publish("events", "Public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(publicClient, "Public")
+
+	// Published straight to Redis, on the namespaced channel
+	err = public.sendMessage("admin:events", "Admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(adminClient, "Admin")
+
+	// Neither saw the other's message
+	err = admin.Broadcaster.Publish("events", "Admin marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(adminClient, "Admin marker")
+	err = public.Broadcaster.Publish("events", "Public marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(publicClient, "Public marker")
+
+	clients := map[*testServer]*Client{public: publicClient, admin: adminClient}
+	for s, client := range clients {
+		stats, err := s.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.LocalConnections) != 1 || stats.LocalConnections[0] != client.ConnectionID() {
+			t.Errorf("%s: expected only its own connection, got %v", s.Broadcaster.Name, stats.LocalConnections)
+		}
+		if stats.LocalSubscriptions["events"] != 1 {
+			t.Errorf("%s: expected only its own subscription, got %v", s.Broadcaster.Name, stats.LocalSubscriptions)
+		}
+	}
+}
+
+func TestTransportStats(t *testing.T) {
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return data["user"] != "mallory"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	transports := func(expected string) {
+		t.Helper()
+		var got string
+		for i := 0; i < 500; i++ {
+			stats, err := server.Broadcaster.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = fmt.Sprintf("websocket=%d longpoll=%d local=%d",
+				stats.LocalTransports["websocket"], stats.LocalTransports["longpoll"], stats.LocalTransports["local"])
+			if got == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+	mallory := func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "mallory"}
+	}
+
+	ws, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp, err := newLPClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := server.Broadcaster.LocalClient(map[string]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transports("websocket=1 longpoll=1 local=1")
+
+	// Refused before reaching the hub
+	for _, clientFn := range []func(*testServer, ...func(c *Client)) (*Client, error){newWSClient, newLPClient} {
+		_, err := clientFn(server, mallory)
+		if err == nil {
+			t.Fatal("Expected the connection to be refused")
+		}
+	}
+	_, err = server.Broadcaster.LocalClient(map[string]interface{}{"user": "mallory"})
+	if err == nil {
+		t.Fatal("Expected the local client to be refused")
+	}
+
+	// Polls come and go, the session counts once.
+	err = lp.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err := server.Broadcaster.Publish("test", "Test message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-lp.Messages:
+		case <-time.After(200 * time.Millisecond):
+			// Published before the poll subscribed
+		}
+		transports("websocket=1 longpoll=1 local=1")
+	}
+
+	ws.Disconnect()
+	local.Disconnect()
+	transports("websocket=0 longpoll=1 local=0")
+
+	lp.Disconnect()
+	transports("websocket=0 longpoll=0 local=0")
+}
+
+func TestConnIDGenerator(t *testing.T) {
+	var n int32
+	server, err := startServer(&Server{
+		NodeID: "node",
+		ConnIDGenerator: func(nodeID string) string {
+			if atomic.AddInt32(&n, 1) == 2 {
+				return "not valid"
+			}
+			return fmt.Sprintf("%s/%d", nodeID, atomic.LoadInt32(&n))
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if id := client.ConnectionID(); id != "node/1" {
+		t.Errorf("Expected node/1, got %s", id)
+	}
+
+	// Replaced when not usable
+	other, err := s.LocalClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+	if id := other.ConnectionID(); !strings.HasPrefix(id, "node-") {
+		t.Errorf("Expected a random ID, got %s", id)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(stats.LocalConnections)
+	if fmt.Sprint(stats.LocalConnections) != fmt.Sprintf("[%s node/1]", other.ConnectionID()) {
+		t.Errorf("Unexpected connections: %v", stats.LocalConnections)
+	}
+
+	// Known by it everywhere. Once Redis confirmed a subscription, the node
+	// listens for control messages too.
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Kick("node/1", "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-client.Messages:
+		if m.Type() != KickMessage {
+			t.Errorf("Expected a kick, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a kick")
+	}
+}
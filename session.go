@@ -0,0 +1,92 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Refuses a session credential that's unknown, expired, revoked or used.
+var errNoSession = errors.New("Session expired")
+
+// Issues a session credential for an accepted connection, see
+// Server.SessionTTL. Empty when sessions are disabled, or when storing the
+// auth data failed: the client then authenticates in full next time.
+func (s *Server) issueSession(auth ClientMessage) string {
+	st := s.current()
+	if s.SessionTTL <= 0 {
+		return ""
+	}
+	id := auth.ConnectionID()
+	err := st.redis.StoreResumable(id, auth, s.SessionTTL)
+	if err != nil {
+		s.logf("Connection %s: failed to store session: %s", id, err)
+		return ""
+	}
+	return id + "." + s.signSession(id, s.identity(auth))
+}
+
+// The AuthOKMessage for an accepted connection, with a session credential
+// when enabled.
+func (s *Server) newAuthOKMessage(auth ClientMessage) ClientMessage {
+	m := ClientMessage{typeField: AuthOKMessage, idField: auth.ConnectionID(), clientIDField: auth.ClientID()}
+	if session := s.issueSession(auth); session != "" {
+		m[sessionField] = session
+	}
+	return m
+}
+
+func (s *Server) signSession(id, identity string) string {
+	mac := hmac.New(sha256.New, s.SessionKey)
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(identity))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Restores the auth data of a session credential for a new connection.
+// Checks the signature before using up the credential, so that guessing
+// doesn't revoke the sessions of others.
+func (s *Server) resumeSession(credential, connectionID string) (ClientMessage, error) {
+	st := s.current()
+	i := strings.LastIndex(credential, ".")
+	if s.SessionTTL <= 0 || i < 0 {
+		return nil, errNoSession
+	}
+	id, signature := credential[:i], credential[i+1:]
+
+	data, err := st.redis.GetResumable(id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil || !hmac.Equal([]byte(signature), []byte(s.signSession(id, s.identity(data)))) {
+		return nil, errNoSession
+	}
+	taken, err := st.redis.TakeResumable(id)
+	if err != nil {
+		return nil, err
+	}
+	if !taken {
+		return nil, errNoSession
+	}
+
+	data[idField] = connectionID
+	return data, nil
+}
+
+// Keeps the session of a connection until SessionTTL after it ends, which is
+// in the given time: now when disconnecting, a poll timeout later for a
+// long-poll session that polls.
+func (s *Server) renewSession(auth ClientMessage, ends time.Duration) {
+	st := s.current()
+	if s.SessionTTL <= 0 {
+		return
+	}
+	err := st.redis.RenewResumable(auth.ConnectionID(), ends+s.SessionTTL)
+	if err != nil {
+		s.logf("Connection %s: failed to renew session: %s", auth.ConnectionID(), err)
+	}
+}
@@ -0,0 +1,225 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Point-in-time state of a node, see Server.DumpState.
+type StateDump struct {
+	Time time.Time `json:"time"`
+
+	// How long taking the snapshot took. It's taken piece by piece while
+	// the node keeps running, so it can be slightly inconsistent.
+	SnapshotDuration string `json:"snapshot_duration"`
+
+	Connections []ConnectionState `json:"connections"`
+	Channels    []ChannelState    `json:"channels"`
+	Backend     BackendState      `json:"backend"`
+
+	// Only with a Server.Tenant callback, see Stats.Tenants
+	Tenants map[string]TenantStats `json:"tenants,omitempty"`
+
+	// See Server.UpdateConfig
+	Config RuntimeConfig `json:"config"`
+}
+
+type ConnectionState struct {
+	ID         string `json:"id"`
+	ClientID   string `json:"client_id,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	Transport  string `json:"transport"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Only included when Server.RedactAuthData is set
+	AuthData map[string]interface{} `json:"auth_data,omitempty"`
+
+	// Messages and bytes waiting to be written
+	BufferedMessages int   `json:"buffered_messages"`
+	BufferedBytes    int64 `json:"buffered_bytes"`
+
+	Subscriptions []string `json:"subscriptions"`
+
+	// Last message from the client, or when the connection was made
+	LastActivity time.Time `json:"last_activity"`
+
+	// Long-poll sessions between polls, collecting messages for the next
+	WaitingForPoll bool `json:"waiting_for_poll,omitempty"`
+}
+
+type ChannelState struct {
+	Name        string `json:"name"`
+	Subscribers int    `json:"subscribers"`
+
+	// Messages still being fanned out
+	PendingFanouts int `json:"pending_fanouts"`
+}
+
+type BackendState struct {
+	// Connected to Redis pub/sub
+	Listening bool `json:"listening"`
+
+	SubscribedChannels int `json:"subscribed_channels"`
+
+	// Receiving all channels through a single subscription, see
+	// Server.FirehoseThreshold
+	Firehose bool `json:"firehose"`
+
+	// Durable channels among them, read from their stream
+	ConsumedStreams int `json:"consumed_streams"`
+
+	// Received messages waiting for the hub, see Server.PubSubBufferSize
+	QueuedMessages int `json:"queued_messages"`
+	QueueCapacity  int `json:"queue_capacity"`
+
+	ActiveConnections int `json:"active_connections"`
+	IdleConnections   int `json:"idle_connections"`
+}
+
+// Implemented by connections that can describe themselves in a state dump.
+// The server fills in the identity and subscriptions.
+type inspectable interface {
+	inspect() ConnectionState
+}
+
+// Time of the last message from the client, accessed atomically.
+type activity struct {
+	last int64
+}
+
+func (a *activity) touch(t time.Time) {
+	atomic.StoreInt64(&a.last, t.UnixNano())
+}
+
+func (a *activity) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// Writes the state of this node as JSON: connections, channels and the
+// Redis connection. The hub isn't stopped for it, each connection is looked
+// at in turn. Meant for debugging, e.g. on a signal:
+//
+//	sig := make(chan os.Signal, 1)
+//	signal.Notify(sig, syscall.SIGUSR1)
+//	go func() {
+//		for range sig {
+//			server.DumpState(os.Stderr)
+//		}
+//	}()
+func (s *Server) DumpState(w io.Writer) error {
+	dump, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(dump)
+}
+
+func (s *Server) snapshot() (StateDump, error) {
+	if !s.isPrepared() {
+		return StateDump{}, errors.New("Prepare() not called on broadcaster.Server")
+	}
+	st := s.current()
+
+	start := time.Now()
+	dump := StateDump{
+		Time:        s.clock.Now(),
+		Connections: []ConnectionState{},
+		Channels:    []ChannelState{},
+	}
+
+	for _, conn := range st.hub.Connections() {
+		state := ConnectionState{
+			ID:        conn.GetID(),
+			Transport: conn.GetTransport(),
+		}
+		if c, ok := conn.(inspectable); ok {
+			state = c.inspect()
+		}
+
+		state.ClientID = ClientMessage(state.AuthData).ClientID()
+		state.Identity = s.identity(state.AuthData)
+		state.Tenant = ClientMessage(state.AuthData).Tenant()
+		state.AuthData = s.redactAuthData(state.AuthData)
+		state.Subscriptions = st.hub.Channels(conn)
+		sort.Strings(state.Subscriptions)
+		dump.Connections = append(dump.Connections, state)
+	}
+
+	stats, err := st.hub.Stats()
+	if err != nil {
+		return StateDump{}, err
+	}
+	pending := st.hub.fanout.Pending()
+	for channel, n := range stats.LocalSubscriptions {
+		dump.Channels = append(dump.Channels, ChannelState{
+			Name:           channel,
+			Subscribers:    n,
+			PendingFanouts: pending[channel],
+		})
+	}
+	sort.Sort(channelStates(dump.Channels))
+
+	dump.Backend = st.redis.State()
+	dump.Config = *s.config()
+	if s.Tenant != nil {
+		dump.Tenants, err = s.tenantStats()
+		if err != nil {
+			return StateDump{}, err
+		}
+	}
+	dump.SnapshotDuration = time.Since(start).String()
+	return dump, nil
+}
+
+func (s *Server) redactAuthData(data map[string]interface{}) map[string]interface{} {
+	if s.RedactAuthData == nil || data == nil {
+		return nil
+	}
+
+	// Handed a copy, the connection keeps using the original.
+	copied := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+
+	var result map[string]interface{}
+	s.runCallback("RedactAuthData", func() {
+		result = s.RedactAuthData(copied)
+	})
+	return result
+}
+
+// Serves DumpState, to requests allowed by authorize. Not part of the
+// Routes, mount it on an admin endpoint.
+func (s *Server) StateHandler(authorize func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := false
+		s.runCallback("StateHandler", func() {
+			allowed = authorize != nil && authorize(r)
+		})
+		if !allowed {
+			s.httpError(w, newHTTPError(http.StatusForbidden, "Forbidden"))
+			return
+		}
+
+		dump, err := s.snapshot()
+		if err != nil {
+			s.httpError(w, newHTTPError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dump)
+	})
+}
+
+type channelStates []ChannelState
+
+func (c channelStates) Len() int           { return len(c) }
+func (c channelStates) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c channelStates) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,192 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	server, err := startServer(&Server{
+		Identity: func(data map[string]interface{}) string {
+			user, _ := data["user"].(string)
+			return user
+		},
+		RedactAuthData: func(data map[string]interface{}) map[string]interface{} {
+			delete(data, "secret")
+			return data
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	client, err := newWSClient(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice", "secret": "hunter2"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"b", "a"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.DumpState(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Error("Expected auth data to be redacted")
+	}
+
+	dump := StateDump{}
+	err = json.Unmarshal(buf.Bytes(), &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dump.Connections) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(dump.Connections))
+	}
+	c := dump.Connections[0]
+	if c.ID != client.ConnectionID() || c.Identity != "alice" || c.Transport != "websocket" || c.RemoteAddr == "" {
+		t.Errorf("Unexpected connection: %+v", c)
+	}
+	if c.AuthData["user"] != "alice" {
+		t.Errorf("Expected redacted auth data, got %v", c.AuthData)
+	}
+	if fmt.Sprint(c.Subscriptions) != "[a b]" {
+		t.Errorf("Unexpected subscriptions: %v", c.Subscriptions)
+	}
+	if c.LastActivity.IsZero() || time.Since(c.LastActivity) > time.Minute {
+		t.Errorf("Unexpected last activity: %s", c.LastActivity)
+	}
+
+	if len(dump.Channels) != 2 || dump.Channels[0].Name != "a" || dump.Channels[0].Subscribers != 1 {
+		t.Errorf("Unexpected channels: %+v", dump.Channels)
+	}
+	if dump.SnapshotDuration == "" || dump.Backend.QueueCapacity == 0 {
+		t.Errorf("Unexpected dump: %+v", dump)
+	}
+
+	// The handler asks first
+	srv := httptest.NewServer(s.StateHandler(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer admin"
+	}))
+	defer srv.Close()
+
+	for auth, code := range map[string]int{"": 403, "Bearer admin": 200} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("Expected %d, got %d", code, resp.StatusCode)
+		}
+	}
+}
+
+func TestDumpStateUnderLoad(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	s := server.Broadcaster
+
+	observer, err := s.LocalClient(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Disconnect()
+	err = observer.Subscribe("marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		client, err := s.LocalClient(map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			channel := fmt.Sprintf("load-%d", i%3)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				client.Subscribe(channel)
+				s.Publish(channel, "Load")
+				client.Unsubscribe(channel)
+			}
+		}(i)
+
+		// Drained, so publishing never blocks
+		go func() {
+			for range client.Messages {
+			}
+		}()
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			err := s.DumpState(&bytes.Buffer{})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Dumping state deadlocked")
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// The hub still delivers
+	err = s.Publish("marker", "Still here")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-observer.Messages:
+		if m["body"] != "Still here" {
+			t.Errorf("Unexpected message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hub wedged")
+	}
+}
@@ -0,0 +1,331 @@
+package broadcaster
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// Streams messages as newline-delimited JSON on a held HTTP response, for
+// simple consumers such as curl or data pipelines. It's one-way: the auth
+// data and channels are passed as query parameters, e.g.
+// /stream?channel=a&channel=b&user=alice. Every parameter other than
+// "channel" is part of the auth data.
+type streamConnection struct {
+	activity
+
+	ID         string
+	Token      string
+	Server     *Server
+	AuthData   ClientMessage
+	RemoteAddr string
+
+	// The hub and the backend of Server when the connection started
+	*preparedState
+
+	outbox *outbox
+	expiry timer
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	st := s.current()
+	_, ok := w.(http.Flusher)
+	if !ok {
+		s.httpError(w, newHTTPError(http.StatusInternalServerError, "Streaming not supported"))
+		return
+	}
+	if s.inDrainMode() {
+		s.refuseDraining(w)
+		return
+	}
+
+	c := &streamConnection{
+		Server:        s,
+		preparedState: st,
+		ID:            s.newConnectionId(),
+		Token:         uuid.New(),
+		AuthData:      ClientMessage{typeField: AuthMessage},
+		RemoteAddr:    r.RemoteAddr,
+	}
+
+	query := r.URL.Query()
+	for k, v := range query {
+		if k != "channel" && !strings.HasPrefix(k, "__") {
+			c.AuthData[k] = v[0]
+		}
+	}
+	c.AuthData[idField] = c.ID
+	c.AuthData[clientIDField] = query.Get(clientIDField)
+	c.AuthData[clientIDField] = s.assignClientID(c.AuthData)
+	c.touch(s.clock.Now())
+
+	channels := query["channel"]
+	if len(channels) == 0 {
+		s.httpError(w, newHTTPError(http.StatusBadRequest, "No channels given"))
+		return
+	}
+
+	w = s.tapResponse(w, c.ID)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := newEnvelopeEncoder(w, s.EnvelopeFields)
+
+	if !s.canConnect(c.AuthData) {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		s.streamFailure(w, enc, http.StatusUnauthorized, newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")))
+		return
+	}
+	c.AuthData = s.connectionAttributes(c.AuthData)
+	if s.authExpired(c.AuthData) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		s.streamFailure(w, enc, http.StatusUnauthorized, newErrorMessage(AuthFailedMessage, errAuthExpired))
+		return
+	}
+
+	err := s.claimConnection(c.AuthData, 0)
+	if qerr, ok := err.(*quotaError); ok {
+		s.streamFailure(w, enc, http.StatusTooManyRequests, withQuotaCode(newErrorMessage(AuthFailedMessage, qerr), qerr))
+		return
+	}
+	if err != nil {
+		s.httpError(w, newHTTPError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	err = st.redis.StoreSession(c.Token, c.AuthData)
+	if err != nil {
+		s.releaseConnection(c.AuthData)
+		s.httpError(w, newHTTPError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	// Shedding closes the outbox, which ends the stream.
+	c.outbox = s.newOutbox(c.ID, nil)
+	s.chargeTenant(c.outbox, c.AuthData)
+	s.contexts.Open(c.ID)
+	defer c.Cleanup()
+
+	c.reply(ClientMessage{typeField: AuthOKMessage, idField: c.ID, clientIDField: c.AuthData.ClientID()})
+
+	err = st.hub.Connect(c)
+	if err != nil {
+		c.outbox.CloseWith(newErrorMessage(ServerErrorMessage, err))
+	} else {
+		c.subscribe(channels)
+		c.scheduleExpiry()
+		if opts, ok := s.draining(); ok {
+			c.migrate(opts)
+		} else if s.inDrainMode() {
+			c.notifyDraining()
+		}
+	}
+
+	// Stop once the client goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			c.outbox.Close()
+		case <-done:
+		}
+	}()
+
+	h2 := isHTTP2(r)
+	for {
+		m, ok := c.outbox.Pop()
+		if !ok {
+			return
+		}
+
+		// Over HTTP/2 each flush ends a frame, what's queued meanwhile goes
+		// out along with it.
+		batch := []ClientMessage{m}
+		if h2 {
+			batch = append(batch, c.outbox.Drain()...)
+		}
+		err := s.writeResponse(w, func() error {
+			for _, m := range batch {
+				err := enc.Encode(m)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if isTimeout(err) {
+				s.writeTimedOut(c.ID)
+			}
+			return
+		}
+		s.delivered(c.ID, batch...)
+	}
+}
+
+func (c *streamConnection) subscribe(channels []string) {
+	s := c.Server
+	for _, channel := range channels {
+		if err := s.validateClientChannel(channel); err != nil {
+			c.reply(newInvalidChannelMessage(channel, err))
+			continue
+		}
+		if !s.authorizeSubscribe(c.AuthData, channel) {
+			c.audit(AuditSubscribeRefused, channel, AuditReasonRefused)
+			c.reply(newChannelErrorMessage(SubscribeErrorMessage, channel, errors.New("Channel refused")))
+			continue
+		}
+
+		err := s.claimSubscription(c.AuthData, channel, 0)
+		if err != nil {
+			c.reply(withQuotaCode(newChannelErrorMessage(SubscribeErrorMessage, channel, err), err))
+			continue
+		}
+
+		err = c.hub.SubscribeWith(c, channel, s.subscriptionOptions(c.AuthData, channel, false, QoSAtMostOnce))
+		if err != nil {
+			s.releaseSubscriptions(c.AuthData, channel)
+			c.reply(newChannelErrorMessage(SubscribeErrorMessage, channel, err))
+		} else {
+			s.joinPresence(c.AuthData, channel)
+			c.reply(newSubscribeOKMessage(channel, c.hub.subscriptionID(c, channel)))
+		}
+	}
+}
+
+// There's no way to re-authenticate, the stream ends when the auth data
+// expires.
+func (c *streamConnection) scheduleExpiry() {
+	expires := c.Server.authExpiry(c.AuthData)
+	if expires.IsZero() {
+		return
+	}
+
+	clock := c.Server.clock
+	c.expiry = clock.AfterFunc(expires.Sub(clock.Now()), func() {
+		c.outbox.CloseWith(newMessage(AuthExpiredMessage))
+	})
+}
+
+// Answers a stream request refused with a protocol message, or with the
+// equivalent HTTPError, see Server.HTTPErrorObjects.
+func (s *Server) streamFailure(w http.ResponseWriter, enc envelopeEncoder, status int, reply ClientMessage) {
+	if s.HTTPErrorObjects {
+		s.httpError(w, replyHTTPError(status, reply))
+		return
+	}
+	w.WriteHeader(status)
+	enc.Encode(reply)
+}
+
+func (c *streamConnection) authData() ClientMessage {
+	return c.AuthData
+}
+
+func (c *streamConnection) revokeSubscription(channel string, notice ClientMessage) {
+	hub := c.hub
+	if !hub.hasSubscription(c, channel) {
+		return
+	}
+
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to revoke %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.leavePresence(c.AuthData, channel)
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	c.reply(notice)
+}
+
+func (c *streamConnection) reply(m ClientMessage) {
+	c.outbox.Push(priorityControl, m)
+}
+
+func (c *streamConnection) Cleanup() {
+	defer c.Server.contexts.Cancel(c.ID)
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.outbox.Close()
+
+	err := c.redis.DeleteSession(c.Token)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to delete session: %s", c.ID, err)
+	}
+
+	if !c.hub.hasConnection(c) {
+		c.Server.releaseConnection(c.AuthData)
+		return
+	}
+	channels := c.hub.Channels(c)
+	err = c.hub.Disconnect(c)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to disconnect: %s", c.ID, err)
+	}
+	c.Server.leavePresence(c.AuthData, channels...)
+	c.Server.releaseConnection(c.AuthData, channels...)
+}
+
+func (c *streamConnection) Send(m ClientMessage) {
+	c.Server.queueMessage(c.outbox, m)
+}
+
+func (c *streamConnection) Process(t string, args []string) {
+	switch t {
+	case "kick":
+		c.outbox.CloseWith(newKickMessage(strings.Join(args, " ")))
+	case "unsubscribe-id":
+		c.Server.processForcedUnsubscribes(c)
+	default:
+		panic("Stream connections don't use control messages!")
+	}
+}
+
+// The client reconnects on its own, see Server.EnterDrainMode.
+func (c *streamConnection) notifyDraining() {
+	c.reply(newMessage(DrainingMessage))
+}
+
+// Streams are one-way, the client can't confirm: the MigrateMessage ends it.
+func (c *streamConnection) migrate(opts MigrateOptions) {
+	c.outbox.CloseWith(newMigrateMessage(MigrateOptions{URL: opts.URL}))
+}
+
+func (c *streamConnection) inspect() ConnectionState {
+	return ConnectionState{
+		ID:               c.ID,
+		Transport:        c.GetTransport(),
+		RemoteAddr:       c.RemoteAddr,
+		AuthData:         c.AuthData,
+		BufferedMessages: c.outbox.Len(),
+		BufferedBytes:    c.outbox.Bytes(),
+		LastActivity:     c.lastActivity(),
+	}
+}
+
+func (c *streamConnection) GetToken() string {
+	return c.Token
+}
+
+func (c *streamConnection) GetID() string {
+	return c.ID
+}
+
+func (c *streamConnection) GetTransport() string {
+	return "stream"
+}
+
+func (c *streamConnection) audit(t, channel, reason string) {
+	c.Server.audit(AuditEvent{
+		Type:         t,
+		ConnectionID: c.ID,
+		Identity:     c.Server.identity(c.AuthData),
+		RemoteAddr:   c.RemoteAddr,
+		Transport:    c.GetTransport(),
+		Channel:      channel,
+		Reason:       reason,
+	})
+}
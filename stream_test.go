@@ -0,0 +1,123 @@
+package broadcaster
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return data["user"] == "alice" && channel != "secret"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	srv := httptest.NewServer(server.Broadcaster.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream?channel=test&channel=secret&user=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Unexpected content type: %s", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() ClientMessage {
+		if !lines.Scan() {
+			t.Fatalf("Stream ended: %v", lines.Err())
+		}
+		m := ClientMessage{}
+		err := json.Unmarshal(lines.Bytes(), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if m := next(); m.Type() != AuthOKMessage || m.ConnectionID() == "" {
+		t.Errorf("Expected auth to succeed, got %v", m)
+	}
+	if m := next(); m.Type() != SubscribeOKMessage || m.Channel() != "test" {
+		t.Errorf("Expected subscribe to succeed, got %v", m)
+	}
+	if m := next(); m.Type() != SubscribeErrorMessage || m.Channel() != "secret" {
+		t.Errorf("Expected subscribe to be refused, got %v", m)
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := next(); m.Type() != MessageMessage || m["body"] != "Test message" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LocalTransports["stream"] != 1 {
+		t.Errorf("Expected a stream connection, got %v", stats.LocalTransports)
+	}
+
+	// Hanging up cleans up.
+	resp.Body.Close()
+	deadline := time.After(5 * time.Second)
+	for {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Connections == 0 && stats.LocalSubscriptions["test"] == 0 {
+			break
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("Expected the connection to be gone, got %v", stats)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamCanConnect(t *testing.T) {
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return data["user"] == "alice"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	srv := httptest.NewServer(server.Broadcaster.Handler())
+	defer srv.Close()
+
+	for url, code := range map[string]int{
+		"/stream?user=alice":              http.StatusBadRequest,
+		"/stream?channel=test&user=bob":   http.StatusUnauthorized,
+		"/stream?channel=test&__id=alice": http.StatusUnauthorized,
+	} {
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("Expected %d for %s, got %d", code, url, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Error codes of a ProtocolErrorMessage, see Server.StrictProtocol.
+const (
+	// Not a JSON object
+	ProtocolErrorMalformed = "malformed"
+
+	// Message type unknown to this transport
+	ProtocolErrorUnknownType = "unknown_type"
+
+	// Field not part of the message type
+	ProtocolErrorUnknownField = "unknown_field"
+
+	// Required field not present
+	ProtocolErrorMissingField = "missing_field"
+
+	// Field has the wrong JSON type
+	ProtocolErrorInvalidField = "invalid_field"
+
+	// Message not allowed at this point, e.g. subscribing before auth
+	ProtocolErrorUnexpected = "unexpected_message"
+
+	// Not valid UTF-8, which JSON requires
+	ProtocolErrorInvalidEncoding = "invalid_encoding"
+)
+
+// JSON types of message fields.
+const (
+	fieldString = "string"
+	fieldNumber = "number"
+	fieldBool   = "bool"
+	fieldObject = "object"
+	fieldAny    = "any"
+)
+
+// Fields of a client message and their JSON types.
+type messageSchema struct {
+	required map[string]string
+	optional map[string]string
+
+	// At least one of these optional fields is required
+	anyOf []string
+
+	// Allows fields that aren't listed, as long as they're not envelope
+	// fields. Auth packets carry application data.
+	open bool
+}
+
+var websocketSchemas = map[string]messageSchema{
+	AuthMessage: {
+		optional: map[string]string{clientIDField: fieldString, sessionField: fieldString, maxRateField: fieldNumber},
+		open:     true,
+	},
+	SubscribeMessage: {
+		required: map[string]string{"channel": fieldString},
+		optional: map[string]string{"ttl": fieldNumber, "echo": fieldBool, "qos": fieldString, "cursor": fieldBool, "lastSeq": fieldNumber},
+	},
+	UnsubscribeMessage: {
+		optional: map[string]string{"channel": fieldString, "subscription": fieldString},
+		anyOf:    []string{"channel", "subscription"},
+	},
+	TouchMessage: {
+		required: map[string]string{"channel": fieldString},
+	},
+	PublishMessage: {
+		required: map[string]string{"channel": fieldString, "body": fieldString},
+		optional: map[string]string{refField: fieldAny, "suppressEcho": fieldBool, "headers": fieldObject, "compactionKey": fieldString, "ttl": fieldNumber},
+	},
+	PingMessage: {
+		optional: map[string]string{refField: fieldAny, "ts": fieldNumber, "payload": fieldAny},
+	},
+	MigratedMessage: {},
+	AckMessage: {
+		required: map[string]string{"channel": fieldString, "seq": fieldNumber},
+	},
+	PauseMessage: {
+		required: map[string]string{"channel": fieldString},
+	},
+	SubscribersMessage: {
+		required: map[string]string{"channel": fieldString},
+	},
+	ResumeMessage: {
+		required: map[string]string{"channel": fieldString},
+	},
+}
+
+// Every long-poll request after the handshake carries the session token.
+var longpollSchemas = map[string]messageSchema{
+	AuthMessage: {
+		optional: map[string]string{tokenField: fieldString, nonceField: fieldString, proofField: fieldString, clientIDField: fieldString, sessionField: fieldString, maxRateField: fieldNumber},
+		open:     true,
+	},
+	SubscribeMessage: {
+		required: map[string]string{tokenField: fieldString, "channel": fieldString},
+		optional: map[string]string{"ttl": fieldNumber, "echo": fieldBool, "qos": fieldString, "cursor": fieldBool, "lastSeq": fieldNumber},
+	},
+	UnsubscribeMessage: {
+		required: map[string]string{tokenField: fieldString},
+		optional: map[string]string{"channel": fieldString, "subscription": fieldString},
+		anyOf:    []string{"channel", "subscription"},
+	},
+	TouchMessage: {
+		required: map[string]string{tokenField: fieldString, "channel": fieldString},
+	},
+	PublishMessage: {
+		required: map[string]string{tokenField: fieldString, "channel": fieldString, "body": fieldString},
+		optional: map[string]string{refField: fieldAny, "suppressEcho": fieldBool, "headers": fieldObject, "compactionKey": fieldString, "ttl": fieldNumber},
+	},
+	PollMessage: {
+		required: map[string]string{tokenField: fieldString, "seq": fieldString},
+		optional: map[string]string{"short": fieldBool},
+	},
+	// Polling keeps the session alive, pings are only latency probes.
+	PingMessage: {
+		required: map[string]string{tokenField: fieldString, refField: fieldAny},
+		optional: map[string]string{"ts": fieldNumber, "payload": fieldAny},
+	},
+	MigratedMessage: {
+		required: map[string]string{tokenField: fieldString},
+	},
+	SubscribersMessage: {
+		required: map[string]string{tokenField: fieldString, "channel": fieldString},
+	},
+}
+
+func newProtocolErrorMessage(code, request, reason string) ClientMessage {
+	m := ClientMessage{
+		typeField: ProtocolErrorMessage,
+		"code":    code,
+		"reason":  reason,
+	}
+	if request != "" {
+		m["request"] = request
+	}
+	return m
+}
+
+// Decodes a frame and checks it against the schemas of the transport.
+// Returns the error reply when it doesn't conform. Fields are checked by
+// their own names, after renaming them back.
+func decodeStrict(schemas map[string]messageSchema, fields EnvelopeFields, data []byte) (ClientMessage, ClientMessage) {
+	if reply := checkEncoding(data); reply != nil {
+		return nil, reply
+	}
+	m := ClientMessage{}
+	err := json.Unmarshal(data, &m)
+	if err != nil || m == nil {
+		return nil, newProtocolErrorMessage(ProtocolErrorMalformed, "", "Expected a JSON object")
+	}
+	m = fields.decode(m)
+	return m, validateMessage(schemas, m)
+}
+
+func validateMessage(schemas map[string]messageSchema, m ClientMessage) ClientMessage {
+	v, ok := m[typeField]
+	if !ok {
+		return newProtocolErrorMessage(ProtocolErrorMissingField, "", "Missing field: "+typeField)
+	}
+	t, ok := v.(string)
+	if !ok {
+		return newProtocolErrorMessage(ProtocolErrorInvalidField, "", "Invalid field: "+typeField+", expected string")
+	}
+
+	schema, ok := schemas[t]
+	if !ok {
+		return newProtocolErrorMessage(ProtocolErrorUnknownType, t, "Unknown message type: "+t)
+	}
+
+	for field, kind := range schema.required {
+		v, ok := m[field]
+		if !ok {
+			return newProtocolErrorMessage(ProtocolErrorMissingField, t, "Missing field: "+field)
+		}
+		if !hasKind(v, kind) {
+			return newProtocolErrorMessage(ProtocolErrorInvalidField, t, fmt.Sprintf("Invalid field: %s, expected %s", field, kind))
+		}
+	}
+
+	if len(schema.anyOf) > 0 {
+		found := false
+		for _, field := range schema.anyOf {
+			if _, ok := m[field]; ok {
+				found = true
+			}
+		}
+		if !found {
+			return newProtocolErrorMessage(ProtocolErrorMissingField, t, "Missing field: "+strings.Join(schema.anyOf, " or "))
+		}
+	}
+
+	for field, v := range m {
+		if field == typeField {
+			continue
+		}
+		if _, ok := schema.required[field]; ok {
+			continue
+		}
+		kind, ok := schema.optional[field]
+		if !ok {
+			if schema.open && !strings.HasPrefix(field, "__") {
+				continue
+			}
+			return newProtocolErrorMessage(ProtocolErrorUnknownField, t, "Unknown field: "+field)
+		}
+		if !hasKind(v, kind) {
+			return newProtocolErrorMessage(ProtocolErrorInvalidField, t, fmt.Sprintf("Invalid field: %s, expected %s", field, kind))
+		}
+	}
+
+	return nil
+}
+
+func hasKind(v interface{}, kind string) bool {
+	switch kind {
+	case fieldString:
+		_, ok := v.(string)
+		return ok
+	case fieldNumber:
+		_, ok := v.(float64)
+		return ok
+	case fieldBool:
+		_, ok := v.(bool)
+		return ok
+	case fieldObject:
+		_, ok := v.(map[string]interface{})
+		return ok
+	default:
+		return true
+	}
+}
@@ -0,0 +1,250 @@
+package broadcaster
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A frame and the expected reply: a message type, or the code of a protocol
+// error.
+type conformanceStep struct {
+	frame  string
+	expect string
+}
+
+func runConformance(t *testing.T, exchange func(frame string) map[string]interface{}, steps []conformanceStep) {
+	for _, step := range steps {
+		m := exchange(step.frame)
+		got := m["__type"]
+		if got == ProtocolErrorMessage {
+			got = m["code"]
+		}
+		if got != step.expect {
+			t.Errorf("%s: expected %s, got %v", step.frame, step.expect, m)
+		}
+	}
+}
+
+func dialStrict(t *testing.T, server *testServer) *websocket.Conn {
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func wsExchange(t *testing.T, conn *websocket.Conn) func(frame string) map[string]interface{} {
+	return func(frame string) map[string]interface{} {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := map[string]interface{}{}
+		err = conn.ReadJSON(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+}
+
+func TestWSStrictProtocol(t *testing.T) {
+	server, err := startServer(&Server{StrictProtocol: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Handshake violations end the connection.
+	handshake := []conformanceStep{
+		{`not json`, ProtocolErrorMalformed},
+		{`{"__type":"subscribe","channel":"test"}`, ProtocolErrorUnexpected},
+		{`{"__type":"auth","__bogus":1}`, ProtocolErrorUnknownField},
+	}
+	for _, step := range handshake {
+		conn := dialStrict(t, server)
+		runConformance(t, wsExchange(t, conn), []conformanceStep{step})
+
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, 1002) {
+			t.Errorf("%s: expected a protocol error close, got %v", step.frame, err)
+		}
+		conn.Close()
+	}
+
+	conn := dialStrict(t, server)
+	defer conn.Close()
+
+	runConformance(t, wsExchange(t, conn), []conformanceStep{
+		{`{"__type":"auth","user":"alice"}`, AuthOKMessage},
+		{`[1,2]`, ProtocolErrorMalformed},
+		{`{"channel":"test"}`, ProtocolErrorMissingField},
+		{`{"__type":1}`, ProtocolErrorInvalidField},
+		{`{"__type":"dance"}`, ProtocolErrorUnknownType},
+		{`{"__type":"poll","seq":"1"}`, ProtocolErrorUnknownType},
+		{`{"__type":"subscribe"}`, ProtocolErrorMissingField},
+		{`{"__type":"subscribe","channel":1}`, ProtocolErrorInvalidField},
+		{`{"__type":"subscribe","channel":"test","extra":true}`, ProtocolErrorUnknownField},
+		{`{"__type":"subscribe","__token":"abc","channel":"test"}`, ProtocolErrorUnknownField},
+		{`{"__type":"subscribe","channel":"test"}`, SubscribeOKMessage},
+		{`{"__type":"publish","channel":"test"}`, ProtocolErrorMissingField},
+		{`{"__type":"publish","channel":"test","body":"hi","__ref":"1"}`, PublishErrorMessage},
+		{"{\"__type\":\"publish\",\"channel\":\"test\",\"body\":\"h\xffi\"}", ProtocolErrorInvalidEncoding},
+		{`{"__type":"ping","__ref":"1","ts":"now"}`, ProtocolErrorInvalidField},
+		{`{"__type":"ping","__ref":"1","ts":1,"payload":{"a":1}}`, PongMessage},
+		{`{"__type":"auth","user":"alice","__bogus":1}`, ProtocolErrorUnknownField},
+		{`{"__type":"auth","user":"bob"}`, AuthOKMessage},
+		{`{"__type":"unsubscribe"}`, ProtocolErrorMissingField},
+		{`{"__type":"unsubscribe","subscription":"unknown"}`, UnsubscribeErrorMessage},
+		{`{"__type":"unsubscribe","channel":"test"}`, UnsubscribeOKMessage},
+	})
+}
+
+func TestWSStrictProtocolDisconnect(t *testing.T) {
+	server, err := startServer(&Server{
+		StrictProtocol:            true,
+		DisconnectOnProtocolError: true,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn := dialStrict(t, server)
+	defer conn.Close()
+
+	runConformance(t, wsExchange(t, conn), []conformanceStep{
+		{`{"__type":"auth"}`, AuthOKMessage},
+		{`{"__type":"subscribe","channel":"test"}`, SubscribeOKMessage},
+		{`{"__type":"dance"}`, ProtocolErrorUnknownType},
+	})
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 1002) {
+		t.Errorf("Expected a protocol error close, got %v", err)
+	}
+}
+
+func TestLPStrictProtocol(t *testing.T) {
+	server, err := startServer(&Server{StrictProtocol: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	token := ""
+	exchange := func(frame string) map[string]interface{} {
+		m := longpollPost(t, server, strings.Replace(frame, "TOKEN", token, -1))
+		if m["__type"] == AuthOKMessage {
+			token = m["__token"].(string)
+		}
+		return m
+	}
+
+	runConformance(t, exchange, []conformanceStep{
+		{`not json`, ProtocolErrorMalformed},
+		{`{"__type":"subscribe","channel":"test"}`, ProtocolErrorMissingField},
+		{`{"__type":"subscribe","__token":"abc","channel":"test"}`, ProtocolErrorUnexpected},
+		{`{"__type":"auth","__bogus":1}`, ProtocolErrorUnknownField},
+		{`{"__type":"auth","user":"alice"}`, AuthOKMessage},
+		{`{"__type":"dance","__token":"TOKEN"}`, ProtocolErrorUnknownType},
+		{`{"__type":"ping","__token":"TOKEN"}`, ProtocolErrorMissingField},
+		{`{"__type":"ping","__token":"TOKEN","__ref":"1","ts":1}`, PongMessage},
+		{`{"__type":"subscribe","__token":"TOKEN","channel":1}`, ProtocolErrorInvalidField},
+		{`{"__type":"subscribe","__token":"TOKEN","channel":"test","extra":true}`, ProtocolErrorUnknownField},
+		{`{"__type":"poll","__token":"TOKEN"}`, ProtocolErrorMissingField},
+		{`{"__type":"subscribe","__token":"TOKEN","channel":"test"}`, SubscribeOKMessage},
+		{`{"__type":"publish","__token":"TOKEN","channel":"test","body":1}`, ProtocolErrorInvalidField},
+		{"{\"__type\":\"subscribe\",\"__token\":\"TOKEN\",\"channel\":\"te\xc3st\"}", ProtocolErrorInvalidEncoding},
+		{`{"__type":"unsubscribe","__token":"TOKEN"}`, ProtocolErrorMissingField},
+		{`{"__type":"unsubscribe","__token":"TOKEN","subscription":"unknown"}`, UnsubscribeErrorMessage},
+		{`{"__type":"unsubscribe","__token":"TOKEN","channel":"test"}`, UnsubscribeOKMessage},
+	})
+}
+
+func TestLPStrictProtocolDisconnect(t *testing.T) {
+	server, err := startServer(&Server{
+		StrictProtocol:            true,
+		DisconnectOnProtocolError: true,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	m := longpollPost(t, server, `{"__type":"auth"}`)
+	token := m["__token"].(string)
+
+	m = longpollPost(t, server, fmt.Sprintf(`{"__type":"dance","__token":"%s"}`, token))
+	if m["code"] != ProtocolErrorUnknownType {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+
+	// Session is gone
+	m = longpollPost(t, server, fmt.Sprintf(`{"__type":"subscribe","__token":"%s","channel":"test"}`, token))
+	if m["code"] != ProtocolErrorUnexpected {
+		t.Errorf("Expected the session to be ended, got %v", m)
+	}
+}
+
+// The bundled client conforms.
+func TestStrictProtocolClients(t *testing.T) {
+	server, err := startServer(&Server{
+		StrictProtocol:            true,
+		DisconnectOnProtocolError: true,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for _, clientFn := range []clientFunc{newWSClient, newLPClient} {
+		client, err := clientFn(server, func(c *Client) {
+			c.AuthData = map[string]interface{}{"user": "alice"}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.Subscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ready := false
+		for !ready {
+			stats, _ := server.Broadcaster.Stats()
+			if stats.LocalSubscriptions["test"] != 1 {
+				<-time.After(10 * time.Millisecond)
+			} else {
+				ready = true
+			}
+		}
+
+		err = server.Broadcaster.Publish("test", "Test message")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-client.Messages:
+			if m["body"] != "Test message" {
+				t.Errorf("Unexpected message: %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a message")
+		}
+
+		err = client.Unsubscribe("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Disconnect()
+	}
+}
@@ -0,0 +1,90 @@
+package broadcaster
+
+import (
+	"errors"
+)
+
+// Messages buffered by a channel of SubscribeChan.
+const subscriptionChanSize = 10
+
+// Subscribes to a channel and returns a Go channel that receives its
+// messages, instead of Messages or a handler (see OnMessage), e.g. for a
+// goroutine per channel. Subscribing again returns the same Go channel.
+//
+// The Go channel buffers 10 messages. Like Messages, a full one holds up the
+// delivery of all other messages until it's read: keep reading until it's
+// closed. It's closed once the subscription ends: on Unsubscribe (or
+// UnsubscribeID), when its TTL runs out or the auth data expires, and on
+// Disconnect. Messages that arrive after that go to a handler or Messages
+// again. Reconnecting keeps it open. Not used in RawMode.
+func (c *Client) SubscribeChan(channel string) (<-chan ClientMessage, error) {
+	if c.RawMode {
+		return nil, errors.New("SubscribeChan isn't supported in RawMode")
+	}
+
+	// Set up first, so that no message goes elsewhere.
+	c.deliverLock.Lock()
+	if c.closed {
+		c.deliverLock.Unlock()
+		return nil, ErrClientClosed
+	}
+	if c.subscriptionChans == nil {
+		c.subscriptionChans = make(map[string]chan ClientMessage)
+	}
+	ch, existed := c.subscriptionChans[channel]
+	if !existed {
+		ch = make(chan ClientMessage, subscriptionChanSize)
+		c.subscriptionChans[channel] = ch
+	}
+	c.deliverLock.Unlock()
+
+	err := c.Subscribe(channel)
+	if err != nil {
+		if !existed {
+			c.deliverLock.Lock()
+			c.closeSubscriptionChan(channel)
+			c.deliverLock.Unlock()
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Hands a message to the Go channel of its subscription, returns false if
+// there's none. Only dropped when disconnecting while nobody's reading and
+// the buffer is full.
+func (c *Client) deliverSubscription(m ClientMessage) bool {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+
+	ch, ok := c.subscriptionChans[m.Channel()]
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- m:
+		return true
+	default:
+	}
+	select {
+	case ch <- m:
+	case <-c.stopping:
+	}
+	return true
+}
+
+// Must hold deliverLock. Closes the Go channel of a subscription that ended,
+// an empty channel closes all of them.
+func (c *Client) closeSubscriptionChan(channel string) {
+	if channel == "" {
+		for _, ch := range c.subscriptionChans {
+			close(ch)
+		}
+		c.subscriptionChans = nil
+		return
+	}
+	if ch, ok := c.subscriptionChans[channel]; ok {
+		close(ch)
+		delete(c.subscriptionChans, channel)
+	}
+}
@@ -0,0 +1,89 @@
+package broadcaster
+
+import (
+	"errors"
+)
+
+// Subscription IDs are assigned by the server and passed to the client in
+// the "subscription" field of a SubscribeOKMessage. An UnsubscribeMessage
+// can name one instead of the channel.
+//
+// Subscriptions are per channel: the server has no wildcard subscriptions,
+// a connection holds at most one subscription per channel and its ID
+// stands for exactly that channel. Subscribing again to update it keeps the
+// ID, a subscription made after unsubscribing gets a new one. Patterns
+// registered with Client.OnMessage only dispatch messages on the client,
+// they don't subscribe to anything.
+
+var errUnknownSubscription = errors.New("Unknown subscription")
+
+// ID of a connection's subscription to a channel, empty when it isn't
+// subscribed.
+func (h *hub) subscriptionID(conn connection, channel string) string {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.subscriptions[conn][channel].ID
+}
+
+// Channel of a connection's subscription with the given ID.
+func (h *hub) subscriptionChannel(conn connection, id string) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	for channel, s := range h.subscriptions[conn] {
+		if s.ID == id {
+			return channel, true
+		}
+	}
+	return "", false
+}
+
+// Finds the channel an UnsubscribeMessage is about, looking up the
+// subscription ID if it names one. Returns the error reply when the ID is
+// unknown.
+func unsubscribeChannel(m ClientMessage, lookup func(id string) (string, bool, error)) (string, ClientMessage, error) {
+	id := m.SubscriptionID()
+	if id == "" {
+		return m.Channel(), nil, nil
+	}
+
+	channel, ok, err := lookup(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		reply := newChannelErrorMessage(UnsubscribeErrorMessage, m.Channel(), errUnknownSubscription)
+		reply["subscription"] = id
+		return "", reply, nil
+	}
+	return channel, nil, nil
+}
+
+// Replies to an UnsubscribeMessage. The subscription ID is passed back when
+// the request named one, the client waits for the reply by it.
+func newUnsubscribeOKMessage(m ClientMessage, channel string) ClientMessage {
+	reply := newChannelMessage(UnsubscribeOKMessage, channel)
+	if id := m.SubscriptionID(); id != "" {
+		reply["subscription"] = id
+	}
+	return reply
+}
+
+func newSubscribeOKMessage(channel, id string) ClientMessage {
+	m := newChannelMessage(SubscribeOKMessage, channel)
+	if id != "" {
+		m["subscription"] = id
+	}
+	return m
+}
+
+// Refuses a rate limited (un)subscribe request, with the subscription ID
+// when it names one.
+func newSubscribeRateLimitedMessage(m ClientMessage) ClientMessage {
+	reply := newRateLimitedMessage(m.Type(), m.Channel())
+	if id := m.SubscriptionID(); id != "" {
+		reply["subscription"] = id
+	}
+	return reply
+}
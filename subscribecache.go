@@ -0,0 +1,167 @@
+package broadcaster
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Remembers the answers of CanSubscribe, see Server.SubscribeCacheTTL.
+type subscribeCache struct {
+	ttl   time.Duration
+	clock clock
+
+	// By fingerprint of the auth data, then by channel
+	entries   map[string]map[string]subscribeCacheEntry
+	nextSweep time.Time
+
+	hits   uint64
+	misses uint64
+
+	sync.Mutex
+}
+
+type subscribeCacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+func newSubscribeCache(ttl time.Duration, clock clock) *subscribeCache {
+	return &subscribeCache{
+		ttl:       ttl,
+		clock:     clock,
+		entries:   make(map[string]map[string]subscribeCacheEntry),
+		nextSweep: clock.Now().Add(ttl),
+	}
+}
+
+// Fields of the auth data that differ between connections of the same
+// client, or between its requests.
+var authFingerprintSkipped = map[string]bool{
+	typeField:    true,
+	tokenField:   true,
+	idField:      true,
+	sessionField: true,
+	nonceField:   true,
+	proofField:   true,
+	refField:     true,
+	maxRateField: true,
+}
+
+// Identifies the auth data a connection presented, so that the client gets
+// the same answers when it reconnects. Empty when it can't be encoded, which
+// isn't cached.
+func authFingerprint(data map[string]interface{}) string {
+	stripped := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if !authFingerprintSkipped[k] {
+			stripped[k] = v
+		}
+	}
+	encoded, err := json.Marshal(stripped)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return string(sum[:])
+}
+
+// Returns the cached answer, false when there's none.
+func (c *subscribeCache) Get(fingerprint, channel string) (allowed bool, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[fingerprint][channel]
+	if !ok || !c.clock.Now().Before(e.expires) {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	return e.allowed, true
+}
+
+func (c *subscribeCache) Put(fingerprint, channel string, allowed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.clock.Now()
+	if !now.Before(c.nextSweep) {
+		c.sweep(now)
+	}
+
+	channels, ok := c.entries[fingerprint]
+	if !ok {
+		channels = make(map[string]subscribeCacheEntry)
+		c.entries[fingerprint] = channels
+	}
+	channels[channel] = subscribeCacheEntry{allowed: allowed, expires: now.Add(c.ttl)}
+}
+
+// Drops the answers for a channel, or for all channels when empty.
+func (c *subscribeCache) Forget(fingerprint, channel string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if channel == "" {
+		delete(c.entries, fingerprint)
+		return
+	}
+	delete(c.entries[fingerprint], channel)
+	if len(c.entries[fingerprint]) == 0 {
+		delete(c.entries, fingerprint)
+	}
+}
+
+// Drops expired answers, must hold the lock.
+func (c *subscribeCache) sweep(now time.Time) {
+	for fingerprint, channels := range c.entries {
+		for channel, e := range channels {
+			if !now.Before(e.expires) {
+				delete(channels, channel)
+			}
+		}
+		if len(channels) == 0 {
+			delete(c.entries, fingerprint)
+		}
+	}
+	c.nextSweep = now.Add(c.ttl)
+}
+
+func (c *subscribeCache) Stats() (hits, misses uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.hits, c.misses
+}
+
+// Like canSubscribe, but answered from the cache when enabled. For
+// subscribes made by clients: revalidating always asks CanSubscribe.
+func (s *Server) authorizeSubscribe(data map[string]interface{}, channel string) bool {
+	if s.subscribeCache == nil || s.CanSubscribe == nil {
+		return s.canSubscribe(data, channel)
+	}
+
+	fingerprint := authFingerprint(data)
+	if fingerprint == "" {
+		return s.canSubscribe(data, channel)
+	}
+	if allowed, ok := s.subscribeCache.Get(fingerprint, channel); ok {
+		return allowed
+	}
+	allowed := s.canSubscribe(data, channel)
+	s.subscribeCache.Put(fingerprint, channel, allowed)
+	return allowed
+}
+
+// Drops what's cached for auth data that's replaced or found to have lost
+// access, so that the next subscribe asks CanSubscribe. All channels when
+// channel is empty.
+func (s *Server) forgetSubscribeAccess(data map[string]interface{}, channel string) {
+	if s.subscribeCache == nil {
+		return
+	}
+	if fingerprint := authFingerprint(data); fingerprint != "" {
+		s.subscribeCache.Forget(fingerprint, channel)
+	}
+}
@@ -0,0 +1,154 @@
+package broadcaster
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubscribeCache(t *testing.T) {
+	clock := newFakeClock()
+	c := newSubscribeCache(time.Minute, clock)
+
+	alice := authFingerprint(map[string]interface{}{"user": "alice", idField: "1"})
+	if other := authFingerprint(map[string]interface{}{"user": "alice", idField: "2"}); other != alice {
+		t.Error("Expected the connection ID not to count")
+	}
+	if bob := authFingerprint(map[string]interface{}{"user": "bob", idField: "1"}); bob == alice {
+		t.Error("Expected different auth data to differ")
+	}
+
+	if _, ok := c.Get(alice, "test"); ok {
+		t.Error("Expected nothing cached yet")
+	}
+	c.Put(alice, "test", true)
+	c.Put(alice, "secret", false)
+	if allowed, ok := c.Get(alice, "test"); !ok || !allowed {
+		t.Errorf("Expected test to be allowed, got %v, %v", allowed, ok)
+	}
+	if allowed, ok := c.Get(alice, "secret"); !ok || allowed {
+		t.Errorf("Expected secret to be refused, got %v, %v", allowed, ok)
+	}
+
+	c.Forget(alice, "secret")
+	if _, ok := c.Get(alice, "secret"); ok {
+		t.Error("Expected secret to be forgotten")
+	}
+
+	clock.Advance(time.Minute)
+	if _, ok := c.Get(alice, "test"); ok {
+		t.Error("Expected test to expire")
+	}
+
+	// Expired entries are swept out
+	c.Put(alice, "other", true)
+	if n := len(c.entries[alice]); n != 1 {
+		t.Errorf("Expected one entry, got %d", n)
+	}
+
+	hits, misses := c.Stats()
+	if hits != 2 || misses != 3 {
+		t.Errorf("Expected 2 hits and 3 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestSubscribeCacheTTL(t *testing.T) {
+	var checks int32
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			atomic.AddInt32(&checks, 1)
+			return data["role"] == "reader"
+		},
+		SubscribeCacheTTL: time.Minute,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	connect := func(role string) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			c.AuthData = map[string]interface{}{"user": "alice", "role": role}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	expectChecks := func(expected int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&checks); n != expected {
+			t.Errorf("Expected %d checks, got %d", expected, n)
+		}
+	}
+
+	client := connect("reader")
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChecks(1)
+
+	// Restored when reconnecting, same client
+	id := client.ConnectionID()
+	client.transport.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.ConnectionID() == id {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscription to be restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectChecks(1)
+
+	// Different auth data is asked about, refusals are kept too
+	guest := connect("guest")
+	defer guest.Disconnect()
+	for i := 0; i < 2; i++ {
+		if err := guest.Subscribe("test"); err == nil {
+			t.Error("Expected the subscribe to be refused")
+		}
+	}
+	expectChecks(2)
+
+	// Re-authenticating starts over
+	err = guest.Reauthenticate(map[string]interface{}{"user": "alice", "role": "reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = guest.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChecks(3)
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SubscribeCacheHits != 3 || stats.SubscribeCacheMisses != 3 {
+		t.Errorf("Expected 3 hits and 3 misses, got %d and %d", stats.SubscribeCacheHits, stats.SubscribeCacheMisses)
+	}
+}
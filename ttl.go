@@ -0,0 +1,211 @@
+package broadcaster
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reason of the UnsubscribeOKMessage sent when a subscription expires.
+const reasonExpired = "expired"
+
+func newExpiredMessage(channel string) ClientMessage {
+	return ClientMessage{
+		typeField: UnsubscribeOKMessage,
+		"channel": channel,
+		"reason":  reasonExpired,
+	}
+}
+
+// Returns how long a subscription lasts, zero means it doesn't expire.
+func (s *Server) subscriptionTTL(auth ClientMessage, channel string, requested time.Duration) time.Duration {
+	if s.SubscriptionTTL == nil {
+		return requested
+	}
+	ttl := requested
+	s.runCallback("SubscriptionTTL", func() {
+		ttl = s.SubscriptionTTL(auth, channel, requested)
+	})
+	return ttl
+}
+
+func subscriptionKey(c connection, channel string) string {
+	return c.GetID() + " " + channel
+}
+
+// Expires subscriptions that were made with a TTL. A single goroutine waits
+// for the earliest deadline, instead of a timer per subscription.
+type expiryQueue struct {
+	expired uint64
+
+	clock   clock
+	entries expiryHeap
+	keys    map[string]*expiryEntry
+	wake    chan struct{}
+	quit    chan struct{}
+
+	sync.Mutex
+}
+
+type expiryEntry struct {
+	key   string
+	ttl   time.Duration
+	when  time.Time
+	fn    func()
+	index int
+}
+
+func newExpiryQueue(c clock) *expiryQueue {
+	return &expiryQueue{
+		clock: c,
+		keys:  make(map[string]*expiryEntry),
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Calls fn once ttl passed, unless renewed or cancelled. Replaces what was
+// scheduled for the key.
+func (q *expiryQueue) Schedule(key string, ttl time.Duration, fn func()) {
+	q.Lock()
+	defer q.Unlock()
+
+	when := q.clock.Now().Add(ttl)
+	if e, ok := q.keys[key]; ok {
+		e.ttl = ttl
+		e.when = when
+		e.fn = fn
+		heap.Fix(&q.entries, e.index)
+	} else {
+		e := &expiryEntry{key: key, ttl: ttl, when: when, fn: fn}
+		heap.Push(&q.entries, e)
+		q.keys[key] = e
+	}
+	q.notify()
+}
+
+// Restarts the TTL, returns false if nothing is scheduled for the key.
+func (q *expiryQueue) Renew(key string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	e, ok := q.keys[key]
+	if !ok {
+		return false
+	}
+	e.when = q.clock.Now().Add(e.ttl)
+	heap.Fix(&q.entries, e.index)
+	q.notify()
+	return true
+}
+
+func (q *expiryQueue) Cancel(key string) {
+	q.Lock()
+	defer q.Unlock()
+
+	e, ok := q.keys[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&q.entries, e.index)
+	delete(q.keys, key)
+}
+
+func (q *expiryQueue) Scheduled(key string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	_, ok := q.keys[key]
+	return ok
+}
+
+func (q *expiryQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.entries)
+}
+
+// Counts expirations, including those not handled by the queue.
+func (q *expiryQueue) countExpired(n int) {
+	atomic.AddUint64(&q.expired, uint64(n))
+}
+
+func (q *expiryQueue) Expired() uint64 {
+	return atomic.LoadUint64(&q.expired)
+}
+
+func (q *expiryQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *expiryQueue) Run() {
+	for {
+		q.Lock()
+		if len(q.entries) == 0 {
+			q.Unlock()
+			select {
+			case <-q.wake:
+			case <-q.quit:
+				return
+			}
+			continue
+		}
+
+		next := q.entries[0]
+		wait := next.when.Sub(q.clock.Now())
+		if wait <= 0 {
+			heap.Pop(&q.entries)
+			delete(q.keys, next.key)
+			q.Unlock()
+
+			q.countExpired(1)
+			next.fn()
+			continue
+		}
+		q.Unlock()
+
+		t := q.clock.NewTimer(wait)
+		select {
+		case <-t.C():
+		case <-q.wake:
+			t.Stop()
+		case <-q.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Ends Run, what's scheduled is dropped.
+func (q *expiryQueue) Stop() {
+	close(q.quit)
+}
+
+// Ordered by deadline, implements heap.Interface.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
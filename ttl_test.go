@@ -0,0 +1,75 @@
+package broadcaster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiryQueue(t *testing.T) {
+	clock := newFakeClock()
+	q := newExpiryQueue(clock)
+
+	fired := make(chan string, 10)
+	schedule := func(key string, ttl time.Duration) {
+		q.Schedule(key, ttl, func() { fired <- key })
+	}
+
+	// Waits for the queue to sleep until its next deadline.
+	waitFor := func(d time.Duration) {
+		for fmt.Sprint(clock.Pending()) != fmt.Sprint([]time.Duration{d}) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	expect := func(keys ...string) {
+		for _, key := range keys {
+			select {
+			case got := <-fired:
+				if got != key {
+					t.Fatalf("Expected %s to expire, got %s", key, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %s to expire", key)
+			}
+		}
+		select {
+		case got := <-fired:
+			t.Fatalf("Unexpected expiry: %s", got)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	schedule("a", 2*time.Second)
+	schedule("b", time.Second)
+	schedule("c", 3*time.Second)
+	q.Cancel("c")
+	if q.Scheduled("c") || q.Len() != 2 {
+		t.Fatalf("Expected c to be cancelled, %d left", q.Len())
+	}
+
+	go q.Run()
+
+	waitFor(time.Second)
+	clock.Advance(time.Second)
+	expect("b")
+
+	// Renewing restarts the full TTL
+	if !q.Renew("a") {
+		t.Fatal("Expected a to be scheduled")
+	}
+	if q.Renew("b") {
+		t.Fatal("Expected b to be gone")
+	}
+	waitFor(2 * time.Second)
+	clock.Advance(1500 * time.Millisecond)
+	expect()
+
+	waitFor(500 * time.Millisecond)
+	clock.Advance(500 * time.Millisecond)
+	expect("a")
+
+	if q.Len() != 0 || q.Expired() != 2 {
+		t.Errorf("Expected an empty queue and 2 expired, got %d and %d", q.Len(), q.Expired())
+	}
+}
@@ -0,0 +1,62 @@
+package broadcaster
+
+import "sync/atomic"
+
+// What a server-side publish does when its message reached no subscriber on
+// any node, see Server.Unrouted.
+//
+// Redis tells how many nodes got a message when it's published, that's all
+// it takes to know. Messages kept in Redis for subscribers to come are never
+// unrouted: those of durable channels, and of channels with at-least-once
+// subscribers. With SkipEmptyChannels, a publish on a channel known to be
+// empty is unrouted, even if a node subscribed to it a moment ago.
+type UnroutedPolicy int
+
+const (
+	// Do what Server.Unrouted says, only for PublishOptions
+	UnroutedDefault UnroutedPolicy = iota
+
+	// Succeed as if the message reached someone, the default
+	UnroutedAccept
+
+	// Fail with ErrNoSubscribers. The message was published nonetheless,
+	// its ID and sequence number are returned along with the error.
+	UnroutedFail
+)
+
+// Code of ErrNoSubscribers
+const PublishErrorNoSubscribers = "no_subscribers"
+
+// Returned by server-side publishes whose message reached no subscriber on
+// any node, when asked to, see UnroutedFail.
+var ErrNoSubscribers = &PublishError{Code: PublishErrorNoSubscribers, Reason: "No subscribers"}
+
+// Receiver counts of redisBackend.Publish that aren't one.
+const (
+	// Kept in Redis for subscribers to come
+	receiversStored = -1
+
+	// Redis didn't say
+	receiversUnknown = -2
+)
+
+// Policy of a server-side publish, falls back to Server.Unrouted.
+func (s *Server) unroutedPolicy(opts PublishOptions) UnroutedPolicy {
+	if opts.Unrouted != UnroutedDefault {
+		return opts.Unrouted
+	}
+	return s.Unrouted
+}
+
+// Counts a message that reached no subscriber, and passes it on to
+// OnUnroutedMessage.
+func (s *Server) messageUnrouted(channel, id, body string) {
+	atomic.AddUint64(&s.unroutedMessages, 1)
+	if s.OnUnroutedMessage == nil {
+		return
+	}
+
+	s.runCallback("OnUnroutedMessage", func() {
+		s.OnUnroutedMessage(channel, id, body)
+	})
+}
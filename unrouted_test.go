@@ -0,0 +1,114 @@
+package broadcaster
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestUnroutedMessages(t *testing.T) {
+	var lock sync.Mutex
+	unrouted := []string{}
+	server, err := startServer(&Server{
+		ChannelConfig: func(channel string) ChannelConfig {
+			return ChannelConfig{Durable: channel == "durable"}
+		},
+		OnUnroutedMessage: func(channel, id, body string) {
+			lock.Lock()
+			defer lock.Unlock()
+			unrouted = append(unrouted, channel+" "+body)
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	fail := PublishOptions{Unrouted: UnroutedFail}
+	publish := func(channel, body string, opts PublishOptions) error {
+		_, _, err := server.Broadcaster.PublishWith(context.Background(), channel, body, opts)
+		return err
+	}
+
+	err = publish("test", "one", PublishOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publish("test", "two", fail)
+	if err != ErrNoSubscribers {
+		t.Errorf("Expected ErrNoSubscribers, got %v", err)
+	}
+
+	// Kept for subscribers to come
+	err = publish("durable", "three", fail)
+	if err != nil {
+		t.Errorf("Expected a durable channel to be routed, got %s", err)
+	}
+
+	// Subscribed on another node
+	server2 := &testServer{Port: nextPort(), Redis: server.Redis}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Stop()
+
+	client, err := newWSClient(server2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publish("test", "four", fail)
+	if err != nil {
+		t.Errorf("Expected a subscribed channel to be routed, got %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(unrouted) != 2 || unrouted[0] != "test one" || unrouted[1] != "test two" {
+		t.Errorf("Unexpected unrouted messages: %v", unrouted)
+	}
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UnroutedMessages != 2 {
+		t.Errorf("Expected two unrouted messages, got %d", stats.UnroutedMessages)
+	}
+}
+
+func TestUnroutedSkippedPublish(t *testing.T) {
+	server, err := startServer(&Server{
+		SkipEmptyChannels: true,
+		Unrouted:          UnroutedFail,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for i := 0; i < 2; i++ {
+		err = server.Broadcaster.Publish("test", "Test message")
+		if err != ErrNoSubscribers {
+			t.Errorf("Expected ErrNoSubscribers, got %v", err)
+		}
+	}
+
+	// Unless the publish says otherwise
+	_, _, err = server.Broadcaster.PublishWith(context.Background(), "test", "Test message", PublishOptions{Unrouted: UnroutedAccept})
+	if err != nil {
+		t.Errorf("Expected the publish to be accepted, got %s", err)
+	}
+
+	stats, err := server.Broadcaster.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SkippedPublishes != 2 || stats.UnroutedMessages != 3 {
+		t.Errorf("Unexpected stats: %d skipped, %d unrouted", stats.SkippedPublishes, stats.UnroutedMessages)
+	}
+}
@@ -1,6 +1,9 @@
 package broadcaster
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
 	"time"
 
 	"github.com/eapache/go-resiliency/retrier"
@@ -19,3 +22,31 @@ func limitWait(dur []time.Duration, max time.Duration) []time.Duration {
 	}
 	return dur
 }
+
+// Logs a line, prefixed with the name of the instance if it has one. See
+// Server.Name.
+func logf(name, format string, args ...interface{}) {
+	if name != "" {
+		format = "[" + name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// Random hex string of n bytes.
+func randomId(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
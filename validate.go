@@ -0,0 +1,78 @@
+package broadcaster
+
+import (
+	"errors"
+	"sync"
+)
+
+// Refuses the body when ValidateBody panics.
+var errValidationPanicked = errors.New("Body validation failed")
+
+// Outcome of validating the bodies published on a channel, see
+// Server.ValidateBody.
+type ValidationStats struct {
+	Passed uint64
+	Failed uint64
+}
+
+// Counts validations per channel.
+type validationCounter struct {
+	channels map[string]ValidationStats
+
+	sync.Mutex
+}
+
+func newValidationCounter() *validationCounter {
+	return &validationCounter{
+		channels: make(map[string]ValidationStats),
+	}
+}
+
+func (v *validationCounter) Count(channel string, passed bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	stats := v.channels[channel]
+	if passed {
+		stats.Passed++
+	} else {
+		stats.Failed++
+	}
+	v.channels[channel] = stats
+}
+
+func (v *validationCounter) Stats() map[string]ValidationStats {
+	v.Lock()
+	defer v.Unlock()
+
+	result := make(map[string]ValidationStats, len(v.channels))
+	for channel, stats := range v.channels {
+		result[channel] = stats
+	}
+	return result
+}
+
+// Checks a body with ValidateBody, unless the channel skips it. Encrypted
+// bodies can't be read, they aren't checked either.
+func (s *Server) validateBody(channel, body string) *PublishError {
+	if s.ValidateBody == nil {
+		return nil
+	}
+	config := s.channelConfig(channel)
+	if config.SkipValidation || config.Encrypted {
+		return nil
+	}
+
+	var err error
+	ok := s.runCallback("ValidateBody", func() {
+		err = s.ValidateBody(channel, []byte(body))
+	})
+	if !ok {
+		err = errValidationPanicked
+	}
+	s.validations.Count(channel, err == nil)
+	if err != nil {
+		return &PublishError{Code: PublishErrorInvalidBody, Reason: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package broadcaster
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Escapes the glob characters of a Redis pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Subscribes to the channels of the long-poll sessions of this node when
+// it's prepared, so that their messages are kept until the sessions are
+// back. See Server.WarmStartWindow.
+type warmStart struct {
+	s     *Server
+	start time.Time
+
+	// Channels this node subscribed to, and those Redis confirmed so far.
+	// Listed once they're known.
+	channels []string
+	ready    int
+	listed   bool
+
+	// Drops the channels nobody subscribed to once the window is over
+	cool    timer
+	stopped bool
+	quit    chan struct{}
+
+	sync.Mutex
+}
+
+func newWarmStart(s *Server) *warmStart {
+	return &warmStart{
+		s:     s,
+		start: s.clock.Now(),
+		quit:  make(chan struct{}),
+	}
+}
+
+func (w *warmStart) Run() {
+	st := w.s.current()
+	sessions, err := st.redis.NodeSessions(w.s.NodeID)
+	if err != nil {
+		// Rather than holding up traffic for good
+		w.s.logf("Warm start: failed to read the sessions of this node: %s", err)
+	}
+	active := make(map[string]bool)
+	for _, channels := range sessions {
+		for channel := range channels {
+			active[channel] = true
+		}
+	}
+	list := make([]string, 0, len(active))
+	for channel := range active {
+		list = append(list, channel)
+	}
+
+	// Closed while reading the sessions
+	select {
+	case <-w.quit:
+		return
+	default:
+	}
+
+	hub := st.hub
+	hub.warm.Expect(sessions)
+	channels := hub.Warm(list)
+
+	w.Lock()
+	if w.stopped {
+		w.Unlock()
+		return
+	}
+	w.channels = channels
+	w.listed = true
+	w.cool = w.s.clock.AfterFunc(w.s.WarmStartWindow-w.s.clock.Now().Sub(w.start), func() {
+		hub.Cool(channels)
+	})
+	w.Unlock()
+
+	// One at a time: Redis confirms in order anyway.
+	for _, channel := range channels {
+		if confirmed, ok := hub.redis.Confirmed(channel); ok {
+			select {
+			case <-confirmed:
+			case <-after(w.s.clock, redisWriteTimeout):
+			case <-w.quit:
+				return
+			}
+		}
+
+		w.Lock()
+		if w.stopped {
+			w.Unlock()
+			return
+		}
+		w.ready++
+		w.Unlock()
+	}
+}
+
+// Stops waiting for the subscriptions when the server closes. The channels
+// are left be, closing the connection to Redis drops them anyway.
+func (w *warmStart) Stop() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.quit)
+	if w.cool != nil {
+		w.cool.Stop()
+	}
+}
+
+// Returns how many channels were subscribed to out of how many, and whether
+// that's all of them. Always done without a warm start.
+func (w *warmStart) Progress() (int, int, bool) {
+	if w == nil {
+		return 0, 0, true
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	return w.ready, len(w.channels), w.listed && w.ready == len(w.channels)
+}
+
+// Messages of the channels a warm start subscribed to, kept for the
+// long-poll sessions of this node until they're back. Bounded per channel,
+// and dropped along with the channels once the window is over.
+type warmBuffers struct {
+	size int
+
+	// Up to size messages per channel, oldest first
+	channels map[string][]warmMessage
+
+	// Sessions expected back, by token
+	sessions map[string]*warmSession
+
+	// Orders the messages across channels
+	received uint64
+
+	sync.Mutex
+}
+
+type warmMessage struct {
+	m        ClientMessage
+	origin   publishOrigin
+	received uint64
+}
+
+type warmSession struct {
+	// Channels the session was subscribed to, until it subscribes again
+	channels map[string]bool
+
+	// Messages of those channels it missed, for the next poll
+	missed []warmMessage
+}
+
+func newWarmBuffers(size int) *warmBuffers {
+	return &warmBuffers{
+		size:     size,
+		channels: make(map[string][]warmMessage),
+		sessions: make(map[string]*warmSession),
+	}
+}
+
+// Starts keeping the messages of the channels of the sessions, by token.
+func (b *warmBuffers) Expect(sessions map[string]map[string]bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	for token, channels := range sessions {
+		b.sessions[token] = &warmSession{channels: channels}
+		for channel := range channels {
+			if _, ok := b.channels[channel]; !ok {
+				b.channels[channel] = nil
+			}
+		}
+	}
+}
+
+// Keeps a message of a channel that's kept, replacing the oldest one once
+// it's full.
+func (b *warmBuffers) Add(channel string, m ClientMessage, origin publishOrigin) {
+	b.Lock()
+	defer b.Unlock()
+
+	messages, ok := b.channels[channel]
+	if !ok {
+		return
+	}
+	if len(messages) == b.size {
+		messages = messages[1:]
+	}
+	b.received++
+	b.channels[channel] = append(messages, warmMessage{m: m, origin: origin, received: b.received})
+}
+
+// Called when a connection subscribes, with the hub's lock held: an
+// expected session is owed what its channel kept so far, later messages
+// reach it as usual.
+func (b *warmBuffers) Claim(conn connection, channel string, opts subscriptionOptions) {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.sessions[conn.GetToken()]
+	if !ok || !s.channels[channel] {
+		return
+	}
+	delete(s.channels, channel)
+	for _, m := range b.channels[channel] {
+		if !opts.delivers(conn.GetID(), m.m, m.origin) {
+			continue
+		}
+		s.missed = append(s.missed, m)
+	}
+}
+
+// Returns what a session is owed, in the order it was received.
+func (b *warmBuffers) Take(token string) []ClientMessage {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.sessions[token]
+	if !ok {
+		return nil
+	}
+	if len(s.channels) == 0 {
+		delete(b.sessions, token)
+	}
+	missed := s.missed
+	s.missed = nil
+
+	sort.Slice(missed, func(i, j int) bool {
+		return missed[i].received < missed[j].received
+	})
+	result := make([]ClientMessage, len(missed))
+	for i, m := range missed {
+		result[i] = m.m
+	}
+	return result
+}
+
+// Drops everything once the window is over.
+func (b *warmBuffers) Drop() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.channels = make(map[string][]warmMessage)
+	b.sessions = make(map[string]*warmSession)
+}
+
+// Subscribes to the channels that have no local subscribers yet, without
+// any, so that their messages are kept. Returns those it subscribed to.
+func (h *hub) Warm(channels []string) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	warmed := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		if _, ok := h.channels[channel]; ok {
+			continue
+		}
+		err := h.redis.Subscribe(channel)
+		if err != nil {
+			h.redis.logf("Redis error subscribing to %s: %s", channel, err)
+			continue
+		}
+		h.channels[channel] = make(map[connection]bool)
+		warmed = append(warmed, channel)
+	}
+	return warmed
+}
+
+// Drops the channels of Warm that still have no local subscribers, and the
+// messages kept for the sessions that didn't come back.
+func (h *hub) Cool(channels []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, channel := range channels {
+		if conns, ok := h.channels[channel]; !ok || len(conns) > 0 {
+			continue
+		}
+		err := h.redis.Unsubscribe(channel)
+		if err != nil {
+			h.redis.logf("Redis error unsubscribing from %s: %s", channel, err)
+		}
+		delete(h.channels, channel)
+	}
+	h.warm.Drop()
+}
+
+// Returns the channels of the long-poll sessions whose connections this
+// node started, by token. Their subscriptions are kept in Redis, whichever
+// node they're polling.
+func (b *redisBackend) NodeSessions(node string) (map[string]map[string]bool, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	prefix := b.key("channels:")
+	sessions := make(map[string]map[string]bool)
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", globEscaper.Replace(prefix)+"*", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		_, err = redis.Scan(values, &cursor, &keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			token := strings.TrimPrefix(key, prefix)
+			auth, err := b.GetSession(token)
+			if err != nil {
+				return nil, err
+			}
+			if auth == nil || !strings.HasPrefix(auth.ConnectionID(), node+"-") {
+				continue
+			}
+			subscriptions, err := b.LongpollGetSubscriptions(token)
+			if err != nil {
+				return nil, err
+			}
+			channels := make(map[string]bool, len(subscriptions))
+			for channel := range subscriptions {
+				channels[channel] = true
+			}
+			sessions[token] = channels
+		}
+
+		if cursor == 0 {
+			return sessions, nil
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWarmStart(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// A long-poll session of node1, which is about to restart, and one of
+	// another node.
+	redis := server.Broadcaster.current().redis
+	sessions := map[string]string{"ours": "node1-abc", "theirs": "node2-abc"}
+	for token, id := range sessions {
+		err := redis.StoreSession(token, ClientMessage{idField: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = redis.LongpollSubscribe(token, token+"-news", 0, false, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := &testServer{
+		Port: nextPort(),
+		Broadcaster: &Server{
+			NodeID:              "node1",
+			WarmStartWindow:     500 * time.Millisecond,
+			WarmStartBufferSize: 2,
+		},
+		Redis: server.Redis,
+	}
+	err = restarted.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := restarted.Broadcaster
+	defer node.Close()
+
+	health := func() int {
+		w := httptest.NewRecorder()
+		node.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		return w.Code
+	}
+	for i := 0; health() != http.StatusOK; i++ {
+		if i == 100 {
+			t.Fatal("Still warming up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ready, total, _ := node.warmStart.Progress(); ready != 1 || total != 1 {
+		t.Errorf("Expected one channel to warm up, got %d of %d", ready, total)
+	}
+
+	// Kept until the session is back, the oldest give way.
+	for _, body := range []string{"one", "two", "three"} {
+		err := server.Broadcaster.Publish("ours-news", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; ; i++ {
+		node.current().hub.warm.Lock()
+		n := len(node.current().hub.warm.channels["ours-news"])
+		var last interface{}
+		if n > 0 {
+			last = node.current().hub.warm.channels["ours-news"][n-1].m["body"]
+		}
+		node.current().hub.warm.Unlock()
+		if last == "three" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Messages weren't kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	poll, _ := json.Marshal(ClientMessage{typeField: PollMessage, tokenField: "ours", "seq": "0"})
+	w := httptest.NewRecorder()
+	node.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(poll)))
+	result := []ClientMessage{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	bodies := []string{}
+	for _, m := range result {
+		bodies = append(bodies, fmt.Sprint(m["body"]))
+	}
+	if len(bodies) != 2 || bodies[0] != "two" || bodies[1] != "three" {
+		t.Errorf("Expected the kept messages, got %v", bodies)
+	}
+
+	// Dropped once the window is over
+	for i := 0; ; i++ {
+		stats, err := node.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.current().hub.warm.Lock()
+		kept := len(node.current().hub.warm.channels)
+		node.current().hub.warm.Unlock()
+		if _, ok := stats.LocalSubscriptions["ours-news"]; !ok && kept == 0 {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("Expected the channel to be dropped, got %v", stats.LocalSubscriptions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWarmStartHealth(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	server.Broadcaster.warmStart = &warmStart{channels: []string{"news", "lobby"}, ready: 1, listed: true, quit: make(chan struct{})}
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ {
+		w = httptest.NewRecorder()
+		server.Broadcaster.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if !bytes.Contains(w.Body.Bytes(), []byte("redis")) {
+			break
+		}
+		// Not listening yet
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusServiceUnavailable || !bytes.Contains(w.Body.Bytes(), []byte("1 of 2")) {
+		t.Errorf("Expected warm start progress, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWarmStartStop(t *testing.T) {
+	server, err := startServer(&Server{WarmStartWindow: time.Hour}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := server.Broadcaster.warmStart
+	for i := 0; ; i++ {
+		if _, _, ok := w.Progress(); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Still warming up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Stop()
+
+	w.Lock()
+	defer w.Unlock()
+	if w.cool == nil {
+		t.Fatal("Expected the window to be scheduled once listed")
+	}
+	if !w.stopped || w.cool.Stop() {
+		t.Error("Expected the warm start to stop with the server")
+	}
+}
@@ -2,9 +2,14 @@ package broadcaster
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pborman/uuid"
 
@@ -12,177 +17,800 @@ import (
 )
 
 type websocketConnection struct {
-	Token    string
-	Conn     *websocket.Conn
-	Server   *Server
-	AuthData ClientMessage
+	activity
+
+	ID         string
+	Token      string
+	Conn       *websocket.Conn
+	Server     *Server
+	AuthData   ClientMessage
+	RemoteAddr string
+
+	// The hub and the backend of Server when the connection started
+	*preparedState
+
+	outbox     *outbox
+	writerDone chan struct{}
+
+	// Broadcast messages go out as binary frames, see Server.BinaryFrames
+	binary bool
+
+	subscribeLimiter *rateLimiter
+	pingLimiter      *rateLimiter
+	membersLimiter   *rateLimiter
+
+	// Revokes the subscriptions when the auth data expires, guarded by the
+	// mutex. The generation invalidates timers replaced by re-authenticating.
+	expiry     timer
+	expired    bool
+	generation int
+
+	// Changes with every subscribe, so that a subscription that expired
+	// while being renewed is kept. Guarded by the mutex.
+	ttlGenerations map[string]int
+
+	// Orders replayed and live messages of at-least-once subscriptions.
+	replay replayGate
+
+	sync.Mutex
 }
 
 func newWebsocketConnection(w http.ResponseWriter, r *http.Request, s *Server) {
 	conn := &websocketConnection{
-		Server: s,
-		Token:  uuid.New(),
+		Server:        s,
+		preparedState: s.current(),
+		ID:            s.newConnectionId(),
+		Token:         uuid.New(),
+		RemoteAddr:    r.RemoteAddr,
 	}
 	err := conn.handshake(w, r)
 	if err != nil {
 		if conn.Conn != nil {
-			conn.Conn.WriteJSON(newErrorMessage(ServerErrorMessage, err))
+			conn.writeJSON(newErrorMessage(ServerErrorMessage, err))
 			conn.Conn.Close()
 		} else {
-			http.Error(w, err.Error(), 500)
+			s.httpError(w, newHTTPError(http.StatusInternalServerError, err.Error()))
 		}
 	}
 }
 
 func (c *websocketConnection) handshake(w http.ResponseWriter, r *http.Request) error {
-	conn, err := c.Server.Upgrader.Upgrade(w, r, nil)
+	var header http.Header
+	offered := containsString(websocket.Subprotocols(r), BinaryFramesProtocol)
+	if c.Server.BinaryFrames && offered && c.Server.Upgrader.Subprotocols == nil {
+		header = http.Header{"Sec-Websocket-Protocol": {BinaryFramesProtocol}}
+	}
+	conn, err := c.Server.Upgrader.Upgrade(w, r, header)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		// Answered by the Upgrader
 		return nil
 	}
 	c.Conn = conn
-
-	err = conn.ReadJSON(&c.AuthData)
-	if err != nil {
-		c.Close(400, err.Error())
+	c.binary = c.Server.BinaryFrames && conn.Subprotocol() == BinaryFramesProtocol
+	config := c.Server.config()
+	conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	conn.SetReadDeadline(time.Now().Add(config.HandshakeTimeout))
+
+	if c.Server.StrictProtocol {
+		m, reply, err := c.readStrict()
+		if isTimeout(err) {
+			c.authTimedOut()
+			return nil
+		}
+		if err != nil {
+			c.Close(400, err.Error())
+			return nil
+		}
+		if reply == nil && m.Type() != AuthMessage {
+			reply = newProtocolErrorMessage(ProtocolErrorUnexpected, m.Type(), "Auth expected")
+		}
+		if reply != nil {
+			c.audit(AuditAuthFailed, "", AuditReasonAuthExpected)
+			c.writeJSON(reply)
+			c.Close(1002, reply["reason"].(string))
+			return nil
+		}
+		c.AuthData = m
+	} else {
+		err = c.readJSON(&c.AuthData)
+		if isTimeout(err) {
+			c.authTimedOut()
+			return nil
+		}
+		if err != nil {
+			c.Close(400, err.Error())
+		}
 	}
+	conn.SetReadDeadline(time.Time{})
 
 	// Expect auth packet first.
-	if c.AuthData.Type() != AuthMessage {
-		conn.WriteJSON(newErrorMessage(AuthFailedMessage, errors.New("Auth expected")))
-		c.Close(401, "Auth expected")
+	if reply := c.Server.checkAuthType(c.AuthData); reply != nil {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpected)
+		c.writeJSON(reply)
+		c.Close(401, reply["reason"].(string))
 		return nil
 	}
+	c.AuthData[idField] = c.ID
+	rate := maxRate(c.AuthData)
+
+	if credential, ok := c.AuthData[sessionField].(string); ok {
+		// Accepted before, see Server.SessionTTL.
+		data, err := c.Server.resumeSession(credential, c.ID)
+		if err == errNoSession {
+			c.audit(AuditAuthFailed, "", AuditReasonNoSession)
+			c.writeJSON(newErrorMessage(AuthFailedMessage, err))
+			c.Close(401, err.Error())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.AuthData = data
+	} else {
+		c.AuthData[clientIDField] = c.Server.assignClientID(c.AuthData)
+
+		if !c.Server.canConnect(c.AuthData) {
+			c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+			c.writeJSON(newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")))
+			c.Close(401, "Unauthorized")
+			return nil
+		}
+		c.AuthData = c.Server.connectionAttributes(c.AuthData)
+	}
 
-	if c.Server.CanConnect != nil && !c.Server.CanConnect(c.AuthData) {
-		conn.WriteJSON(newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")))
-		c.Close(401, "Unauthorized")
+	if c.Server.authExpired(c.AuthData) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		c.writeJSON(newErrorMessage(AuthFailedMessage, errAuthExpired))
+		c.Close(401, "Auth expired")
 		return nil
 	}
 
-	redis := c.Server.redis
-	err = redis.StoreSession(c.Token, c.AuthData)
+	err = c.Server.claimConnection(c.AuthData, 0)
+	if qerr, ok := err.(*quotaError); ok {
+		c.writeJSON(withQuotaCode(newErrorMessage(AuthFailedMessage, qerr), qerr))
+		c.Close(1008, qerr.Error())
+		return nil
+	}
 	if err != nil {
 		return err
-		conn.WriteJSON(newMessage(ServerErrorMessage))
-		conn.Close()
 	}
 
-	defer c.Cleanup()
-
-	err = conn.WriteJSON(newMessage(AuthOKMessage))
+	redis := c.redis
+	err = redis.StoreSession(c.Token, c.AuthData)
 	if err != nil {
+		// The caller replies with the error and closes the connection
+		c.Server.releaseConnection(c.AuthData)
 		return err
 	}
 
-	hub := c.Server.hub
+	c.subscribeLimiter = c.Server.subscribeLimiters.Get(clientKey(c.AuthData), c.Server.config().SubscribeRateLimit)
+	c.pingLimiter = newRateLimiter(c.Server.clock)
+	c.membersLimiter = newRateLimiter(c.Server.clock)
+
+	// All writes go through the outbox from here on.
+	c.outbox = c.Server.newOutbox(c.ID, func() {
+		// Unblocks the read loop, which takes care of the cleanup.
+		c.Conn.Close()
+	})
+	c.Server.chargeTenant(c.outbox, c.AuthData)
+	c.outbox.SetMaxRate(rate)
+	c.writerDone = make(chan struct{})
+	go c.writer()
+
+	c.Server.contexts.Open(c.ID)
+	defer c.Cleanup()
+
+	c.reply(c.Server.newAuthOKMessage(c.AuthData))
+
+	hub := c.hub
 	err = hub.Connect(c)
 	if err != nil {
 		return err
 	}
+	c.scheduleExpiry()
+
+	if opts, ok := c.Server.draining(); ok {
+		c.migrate(opts)
+	} else if c.Server.inDrainMode() {
+		c.notifyDraining()
+	}
 
 	c.Run()
 
 	return nil
 }
 
-func (c *websocketConnection) Run() {
-	conn := c.Conn
-	hub := c.Server.hub
+// Hangs up on a client that didn't send its auth packet in time, see
+// Server.HandshakeTimeout.
+func (c *websocketConnection) authTimedOut() {
+	c.audit(AuditAuthFailed, "", AuditReasonAuthTimeout)
+	c.writeJSON(newErrorMessage(AuthFailedMessage, errors.New("Auth timeout")))
+	c.Close(1008, "Auth timeout")
+}
+
+func (c *websocketConnection) writer() {
+	defer close(c.writerDone)
 
-	m := ClientMessage{}
 	for {
-		err := conn.ReadJSON(&m)
+		m, ok := c.outbox.Pop()
+		if !ok {
+			return
+		}
+
+		switch c.Server.Faults.write() {
+		case faultDrop:
+			continue
+		case faultClose:
+			closeMidFrame(c.Conn)
+			return
+		}
+
+		// Real time: the deadline ends up on the socket.
+		c.Conn.SetWriteDeadline(time.Now().Add(c.Server.config().WriteTimeout))
+		err := c.writeFrame(m)
+		if err != nil {
+			if isTimeout(err) {
+				c.Server.writeTimedOut(c.ID)
+				c.Close(1008, "Write timeout")
+			}
+			// Unblocks the read loop, which takes care of the cleanup.
+			c.Conn.Close()
+			return
+		}
+		c.Server.delivered(c.ID, m)
+	}
+}
+
+// Queues a protocol reply, these always go first.
+func (c *websocketConnection) reply(m ClientMessage) {
+	c.outbox.Push(priorityControl, m)
+}
+
+func (c *websocketConnection) Run() {
+	for {
+		c.Server.Faults.read()
+		m, reply, err := c.readMessage()
 		if err != nil {
 			c.Close(400, err.Error())
 			break
 		}
-
-		switch m.Type() {
-		case SubscribeMessage:
-			channel := m.Channel()
-			if c.Server.CanSubscribe != nil && !c.Server.CanSubscribe(c.AuthData, channel) {
-				conn.WriteJSON(newChannelErrorMessage(SubscribeErrorMessage, channel, errors.New("Channel refused")))
-				continue
+		c.touch(c.Server.clock.Now())
+
+		if reply != nil {
+			if c.Server.DisconnectOnProtocolError {
+				// Hang up once the error is written.
+				c.outbox.CloseWith(reply)
+				<-c.writerDone
+				c.Close(1002, reply["reason"].(string))
+				break
 			}
+			c.reply(reply)
+			continue
+		}
 
-			err := hub.Subscribe(c, channel)
-			if err != nil {
-				conn.WriteJSON(newChannelErrorMessage(SubscribeErrorMessage, channel, err))
-			} else {
-				conn.WriteJSON(newChannelMessage(SubscribeOKMessage, channel))
-			}
+		reply, err = c.Server.handleClientMessage(c, m)
+		if err != nil {
+			c.Server.logf("Connection %s: failed to handle %s: %s", c.ID, m.Type(), err)
+			reply = newErrorMessage(ServerErrorMessage, err)
+		}
+		if reply != nil {
+			c.reply(reply)
+		}
+	}
+}
 
-		case UnsubscribeMessage:
-			channel := m.Channel()
+// Reads the next client message. In strict mode, returns the error reply if it
+// doesn't conform to the protocol. Errors are those of the connection.
+func (c *websocketConnection) readMessage() (ClientMessage, ClientMessage, error) {
+	if c.Server.StrictProtocol {
+		return c.readStrict()
+	}
 
-			err := hub.Unsubscribe(c, channel)
-			if err != nil {
-				conn.WriteJSON(newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
-			}
-			conn.WriteJSON(newChannelMessage(UnsubscribeOKMessage, channel))
+	// Fresh each time: decoding into a used map keeps the fields of
+	// earlier messages.
+	m := ClientMessage{}
+	err := c.readJSON(&m)
+	return m, nil, err
+}
 
-		case PingMessage:
-			// Do nothing
+func (c *websocketConnection) authData() ClientMessage {
+	return c.AuthData
+}
 
-		default:
-			conn.WriteJSON(newMessage(UnknownMessage))
-			break
+func (c *websocketConnection) allowSubscribe() (bool, error) {
+	return c.subscribeLimiter.Allow(c.Server.config().SubscribeRateLimit), nil
+}
+
+func (c *websocketConnection) allowPing() (bool, error) {
+	return c.pingLimiter.Allow(c.Server.config().PingRateLimit), nil
+}
+
+func (c *websocketConnection) allowSubscribers() (bool, error) {
+	return c.membersLimiter.Allow(c.Server.config().SubscribersRateLimit), nil
+}
+
+func (c *websocketConnection) handleSubscribe(channel string, m ClientMessage) (string, error) {
+	err := c.subscribe(channel, m.TTL(), m.Echo(), m.QoS(), m.LastSeq())
+	if err != nil {
+		return "", err
+	}
+	c.Server.joinPresence(c.AuthData, channel)
+	return c.hub.subscriptionID(c, channel), nil
+}
+
+func (c *websocketConnection) handleUnsubscribe(channel string) error {
+	hub := c.hub
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		return err
+	}
+	c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	c.Server.leavePresence(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	return nil
+}
+
+func (c *websocketConnection) lookupSubscription(id string) (string, bool, error) {
+	channel, ok := c.hub.subscriptionChannel(c, id)
+	return channel, ok, nil
+}
+
+func (c *websocketConnection) isSubscribed(channel string) (bool, error) {
+	return c.hub.hasSubscription(c, channel), nil
+}
+
+func (c *websocketConnection) handleTouch(channel string) (bool, error) {
+	if !c.hub.hasSubscription(c, channel) {
+		return false, nil
+	}
+	c.Server.expiries.Renew(subscriptionKey(c, channel))
+	return true, nil
+}
+
+func (c *websocketConnection) handleAuth(m ClientMessage) (ClientMessage, error) {
+	return c.reauthenticate(m), nil
+}
+
+func (c *websocketConnection) handleMigrated() (ClientMessage, error) {
+	c.hangUp(nil, "Migrated")
+	return nil, nil
+}
+
+func (c *websocketConnection) hubConnection() connection {
+	return c
+}
+
+// Reads the next message. Decoded as a whole, to check its encoding and to
+// pass on the frame as received when tapping.
+func (c *websocketConnection) readJSON(m *ClientMessage) error {
+	_, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	c.Server.tap(c.ID, WireInbound, data)
+	if !utf8.Valid(data) {
+		return errInvalidUTF8
+	}
+	err = json.Unmarshal(data, m)
+	*m = c.Server.EnvelopeFields.decode(*m)
+	return err
+}
+
+// Writes a message, encoding it first when tapping.
+func (c *websocketConnection) writeJSON(m ClientMessage) error {
+	m = c.Server.EnvelopeFields.encode(m)
+	if c.Server.wireTap == nil {
+		return c.Conn.WriteJSON(m)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.Server.tap(c.ID, WireOutbound, data)
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Writes a message, as a binary frame if agreed on and it fits the format.
+func (c *websocketConnection) writeFrame(m ClientMessage) error {
+	if !c.binary {
+		return c.writeJSON(m)
+	}
+	data, ok := encodeBinaryFrame(m)
+	if !ok {
+		return c.writeJSON(m)
+	}
+	c.Server.tap(c.ID, WireOutbound, data)
+	return c.Conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Reads the next message in strict mode. Returns the error reply when it
+// doesn't conform to the protocol, errors are those of the connection.
+func (c *websocketConnection) readStrict() (ClientMessage, ClientMessage, error) {
+	_, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Server.tap(c.ID, WireInbound, data)
+
+	m, reply := decodeStrict(websocketSchemas, c.Server.EnvelopeFields, data)
+	return m, reply, nil
+}
+
+// Subscribes, unless the auth data has expired. Subscribing again renews or
+// replaces the TTL, echo and QoS. At least once, what the client didn't
+// acknowledge yet is delivered again first, or what came after the given
+// sequence number (unless noCursor).
+func (c *websocketConnection) subscribe(channel string, requested time.Duration, echo bool, qos string, after int64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.expired {
+		return errAuthExpired
+	}
+	err := c.Server.claimSubscription(c.AuthData, channel, 0)
+	if err != nil {
+		return err
+	}
+
+	hub := c.hub
+	wasReliable := hub.isReliable(c, channel)
+	if qos == QoSAtLeastOnce {
+		c.replay.Hold(channel)
+	}
+	opts := c.Server.subscriptionOptions(c.AuthData, channel, echo, qos)
+	err = hub.SubscribeWith(c, channel, opts)
+	if err != nil {
+		c.replay.Release(channel, nil, 0, c.pushReliable)
+		c.Server.releaseSubscriptions(c.AuthData, channel)
+		return err
+	}
+	if qos == QoSAtLeastOnce {
+		c.Server.replayPending(c.AuthData, channel, opts, after, &c.replay, c.pushReliable)
+	} else if wasReliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+
+	if c.ttlGenerations == nil {
+		c.ttlGenerations = make(map[string]int)
+	}
+	c.ttlGenerations[channel]++
+	generation := c.ttlGenerations[channel]
+
+	key := subscriptionKey(c, channel)
+	ttl := c.Server.subscriptionTTL(c.AuthData, channel, requested)
+	if ttl > 0 {
+		c.Server.expiries.Schedule(key, ttl, func() {
+			c.expireSubscription(channel, generation)
+		})
+	} else {
+		c.Server.expiries.Cancel(key)
+	}
+	return nil
+}
+
+// Drops a subscription once its TTL passed.
+func (c *websocketConnection) expireSubscription(channel string, generation int) {
+	c.Lock()
+	defer c.Unlock()
+
+	hub := c.hub
+	if generation != c.ttlGenerations[channel] || !hub.hasSubscription(c, channel) {
+		return // Renewed or gone in the meantime
+	}
+
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to expire %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.leavePresence(c.AuthData, channel)
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	c.reply(newExpiredMessage(channel))
+}
+
+func (c *websocketConnection) revokeSubscription(channel string, notice ClientMessage) {
+	c.Lock()
+	defer c.Unlock()
+
+	hub := c.hub
+	if !hub.hasSubscription(c, channel) {
+		return
+	}
+
+	reliable := hub.isReliable(c, channel)
+	err := hub.Unsubscribe(c, channel)
+	if err != nil {
+		c.Server.logf("Connection %s: failed to revoke %s: %s", c.ID, channel, err)
+		return
+	}
+	c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	c.Server.leavePresence(c.AuthData, channel)
+	c.Server.releaseSubscriptions(c.AuthData, channel)
+	if reliable {
+		c.Server.dropPending(c.AuthData, channel)
+	}
+	c.reply(notice)
+}
+
+// Replaces the auth data of the connection, e.g. to refresh a token, returns
+// the reply. The connection keeps its ID and subscriptions. When refused,
+// the previous auth data stays in effect.
+func (c *websocketConnection) reauthenticate(m ClientMessage) ClientMessage {
+	// Leaves the message as received.
+	packet := make(ClientMessage, len(m))
+	for k, v := range m {
+		packet[k] = v
+	}
+	packet[idField] = c.ID
+	packet[clientIDField] = c.AuthData.ClientID()
+
+	if !c.Server.canConnect(packet) {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		return newErrorMessage(AuthFailedMessage, errors.New("Unauthorized"))
+	}
+	data := c.Server.connectionAttributes(packet)
+	if c.Server.authExpired(data) {
+		c.audit(AuditAuthFailed, "", AuditReasonAuthExpired)
+		return newErrorMessage(AuthFailedMessage, errAuthExpired)
+	}
+	if data.Tenant() != c.AuthData.Tenant() {
+		c.audit(AuditAuthFailed, "", AuditReasonUnauthorized)
+		return newErrorMessage(AuthFailedMessage, errTenantChanged)
+	}
+
+	err := c.redis.StoreSession(c.Token, data)
+	if err != nil {
+		return newErrorMessage(AuthFailedMessage, err)
+	}
+	c.Server.forgetSubscribeAccess(c.AuthData, "")
+	c.Server.forgetSubscribeAccess(data, "")
+
+	// Moves the presence over, in case the key changed.
+	if c.Server.presenceKey(data) != c.Server.presenceKey(c.AuthData) {
+		channels := c.hub.Channels(c)
+		c.Server.leavePresence(c.AuthData, channels...)
+		for _, channel := range channels {
+			c.Server.joinPresence(data, channel)
+		}
+	}
+
+	c.Lock()
+	c.AuthData = data
+	c.Unlock()
+	c.scheduleExpiry()
+	return c.Server.newAuthOKMessage(data)
+}
+
+// (Re)schedules the expiry of the current auth data.
+func (c *websocketConnection) scheduleExpiry() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	c.expired = false
+	c.generation++
+
+	expires := c.Server.authExpiry(c.AuthData)
+	if expires.IsZero() {
+		return
+	}
+
+	generation := c.generation
+	clock := c.Server.clock
+	c.expiry = clock.AfterFunc(expires.Sub(clock.Now()), func() {
+		c.expire(generation)
+	})
+}
+
+// Revokes all subscriptions, new ones are refused until re-authenticating.
+func (c *websocketConnection) expire(generation int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if generation != c.generation {
+		return // Re-authenticated in the meantime
+	}
+	c.expired = true
+
+	hub := c.hub
+	c.Server.dropPending(c.AuthData, hub.ReliableChannels(c)...)
+	for _, channel := range hub.Channels(c) {
+		err := hub.Unsubscribe(c, channel)
+		if err != nil {
+			c.Server.logf("Connection %s: failed to revoke %s: %s", c.ID, channel, err)
+		} else {
+			c.Server.expiries.Cancel(subscriptionKey(c, channel))
+			c.Server.leavePresence(c.AuthData, channel)
+			c.Server.releaseSubscriptions(c.AuthData, channel)
 		}
 	}
+	c.reply(newMessage(AuthExpiredMessage))
 }
 
 func (c *websocketConnection) Cleanup() {
-	redis := c.Server.redis
-	hub := c.Server.hub
+	redis := c.redis
+	hub := c.hub
+
+	c.Lock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.generation++
+	c.Unlock()
 
 	err := redis.DeleteSession(c.Token)
 	if err != nil {
-		c.Conn.WriteJSON(newErrorMessage(ServerErrorMessage, err))
+		c.Server.logf("Connection %s: failed to delete session: %s", c.ID, err)
+		c.reply(newErrorMessage(ServerErrorMessage, err))
 	}
 
+	channels := hub.Channels(c)
+	for _, channel := range channels {
+		c.Server.expiries.Cancel(subscriptionKey(c, channel))
+	}
+	reliable := hub.ReliableChannels(c)
 	err = hub.Disconnect(c)
 	if err != nil {
-		c.Conn.WriteJSON(newErrorMessage(ServerErrorMessage, err))
+		c.Server.logf("Connection %s: failed to disconnect: %s", c.ID, err)
+		c.reply(newErrorMessage(ServerErrorMessage, err))
 	}
+	c.Server.leavePresence(c.AuthData, channels...)
+	c.Server.releaseConnection(c.AuthData, channels...)
+	c.Server.releasePending(c.AuthData, reliable...)
+	c.Server.renewSession(c.AuthData, 0)
 
+	c.outbox.Close()
+	<-c.writerDone
 	c.Conn.Close()
+	c.Server.contexts.Cancel(c.ID)
 }
 
 func (c *websocketConnection) Close(code uint16, msg string) {
 	payload := make([]byte, 2)
 	binary.BigEndian.PutUint16(payload, code)
 	payload = append(payload, []byte(msg)...)
-	c.Conn.WriteMessage(websocket.CloseMessage, payload)
+	c.Conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(time.Second))
 	c.Conn.Close()
 }
 
-func (c *websocketConnection) Send(channel, message string) {
-	c.Conn.WriteJSON(newBroadcastMessage(channel, message))
+func (c *websocketConnection) Send(m ClientMessage) {
+	c.Server.queueMessage(c.outbox, m)
+}
+
+func (c *websocketConnection) SendReliable(m ClientMessage) {
+	c.replay.Deliver(m, c.pushReliable)
+}
+
+func (c *websocketConnection) pushReliable(m ClientMessage) {
+	p := c.Server.channelConfig(m.Channel()).Priority
+	c.outbox.PushReliable(p, m)
 }
 
 func (c *websocketConnection) Process(t string, args []string) {
-	panic("Websocket connections don't use control messages!")
+	switch t {
+	case "kick":
+		c.hangUp(newKickMessage(strings.Join(args, " ")), "Kicked")
+	case "unsubscribe-id":
+		c.Server.processForcedUnsubscribes(c)
+	default:
+		panic("Websocket connections don't use control messages!")
+	}
+}
+
+// Hangs up once everything is written, final is delivered last if set.
+func (c *websocketConnection) hangUp(final ClientMessage, reason string) {
+	if final != nil {
+		c.outbox.CloseWith(final)
+	} else {
+		c.outbox.Close()
+	}
+	go func() {
+		<-c.writerDone
+		c.Close(1000, reason)
+	}()
+}
+
+// Tells the client to move when it suits it, see Server.EnterDrainMode.
+func (c *websocketConnection) notifyDraining() {
+	c.reply(newMessage(DrainingMessage))
+}
+
+// Asks the client to move, when held the connection stays open until the
+// client confirms or the hold times out.
+func (c *websocketConnection) migrate(opts MigrateOptions) {
+	m := newMigrateMessage(opts)
+	if !m.Hold() {
+		c.hangUp(m, "Migrated")
+		return
+	}
+
+	c.reply(m)
+	c.Server.clock.AfterFunc(opts.HoldTimeout, func() {
+		c.hangUp(nil, "Migrated")
+	})
+}
+
+func (c *websocketConnection) inspect() ConnectionState {
+	c.Lock()
+	auth := c.AuthData
+	c.Unlock()
+
+	return ConnectionState{
+		ID:               c.ID,
+		Transport:        c.GetTransport(),
+		RemoteAddr:       c.RemoteAddr,
+		AuthData:         auth,
+		BufferedMessages: c.outbox.Len(),
+		BufferedBytes:    c.outbox.Bytes(),
+		LastActivity:     c.lastActivity(),
+	}
 }
 
 func (c *websocketConnection) GetToken() string {
 	return c.Token
 }
 
+func (c *websocketConnection) GetID() string {
+	return c.ID
+}
+
+func (c *websocketConnection) GetTransport() string {
+	return "websocket"
+}
+
+func (c *websocketConnection) audit(t, channel, reason string) {
+	c.Server.audit(AuditEvent{
+		Type:         t,
+		ConnectionID: c.ID,
+		Identity:     c.Server.identity(c.AuthData),
+		RemoteAddr:   c.RemoteAddr,
+		Transport:    c.GetTransport(),
+		Channel:      channel,
+		Reason:       reason,
+	})
+}
+
 // Client transport
 type websocketClientTransport struct {
 	conn    *websocket.Conn
 	client  *Client
 	running bool
+
+	// Agreed on binary frames, see Client.BinaryFrames
+	binary bool
+
+	// Keepalives, pings and requests are written from different goroutines.
+	writeLock sync.Mutex
 }
 
 func (t *websocketClientTransport) Connect(authData ClientMessage) error {
-	conn, _, err := websocket.DefaultDialer.Dial(t.client.url(ClientModeWebsocket), nil)
+	dialer := websocket.DefaultDialer
+	if t.client.BinaryFrames && !t.client.RawMode {
+		d := *dialer
+		d.Subprotocols = []string{BinaryFramesProtocol}
+		dialer = &d
+	}
+	conn, resp, err := dialer.Dial(t.client.url(ClientModeWebsocket), nil)
+	if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+		return ErrWebsocketUnsupported
+	}
 	if err != nil {
 		return err
 	}
 
 	t.conn = conn
+	t.binary = conn.Subprotocol() == BinaryFramesProtocol
 
 	// Authenticate
 	if !t.client.skip_auth {
@@ -190,7 +818,7 @@ func (t *websocketClientTransport) Connect(authData ClientMessage) error {
 		if data == nil {
 			data = make(ClientMessage)
 		}
-		data["__type"] = AuthMessage
+		data[typeField] = AuthMessage
 		err := t.Send(data)
 		if err != nil {
 			return err
@@ -199,8 +827,11 @@ func (t *websocketClientTransport) Connect(authData ClientMessage) error {
 
 	t.running = true
 	go func() {
+		ping := t.client.clock.NewTicker(t.client.PingInterval)
+		defer ping.Stop()
+
 		for {
-			time.Sleep(t.client.PingInterval)
+			<-ping.C()
 			if !t.running {
 				return
 			}
@@ -220,13 +851,53 @@ func (t *websocketClientTransport) Close() error {
 }
 
 func (t *websocketClientTransport) Send(data ClientMessage) error {
-	return t.conn.WriteJSON(data)
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	switch t.client.Faults.write() {
+	case faultDrop:
+		return nil
+	case faultClose:
+		closeMidFrame(t.conn)
+		return io.ErrClosedPipe
+	}
+	return t.conn.WriteJSON(t.client.EnvelopeFields.encode(data))
 }
 
 func (t *websocketClientTransport) Receive() (ClientMessage, error) {
+	t.client.Faults.read()
+	if t.binary {
+		return t.receiveFrame()
+	}
 	m := ClientMessage{}
 	err := t.conn.ReadJSON(&m)
-	return m, err
+	return t.client.EnvelopeFields.decode(m), err
+}
+
+// Reads a binary or a JSON frame. Drops binary frames it doesn't know.
+func (t *websocketClientTransport) receiveFrame() (ClientMessage, error) {
+	for {
+		frameType, data, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if frameType == websocket.BinaryMessage {
+			m, err := decodeBinaryFrame(data)
+			if err != nil {
+				continue
+			}
+			return m, nil
+		}
+		m := ClientMessage{}
+		err = json.Unmarshal(data, &m)
+		return t.client.EnvelopeFields.decode(m), err
+	}
+}
+
+func (t *websocketClientTransport) ReceiveRaw() ([]byte, error) {
+	t.client.Faults.read()
+	_, data, err := t.conn.ReadMessage()
+	return data, err
 }
 
 func (t *websocketClientTransport) onConnect() {
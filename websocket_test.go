@@ -1,6 +1,19 @@
 package broadcaster
 
-import "testing"
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 func TestWSClient(t *testing.T) {
 	testClient(t, newWSClient)
@@ -17,3 +30,516 @@ func TestWSRefusesUnauthedCommands(t *testing.T) {
 func TestWSCanSubscribe(t *testing.T) {
 	testCanSubscribe(t, newWSClient)
 }
+
+func TestWSIgnoreRefusedSubscribes(t *testing.T) {
+	testIgnoreRefusedSubscribes(t, newWSClient)
+}
+
+func TestWSRawMessages(t *testing.T) {
+	testRawMessages(t, newWSClient)
+}
+
+func TestWSConnectionID(t *testing.T) {
+	testConnectionID(t, newWSClient)
+}
+
+func TestWSPublish(t *testing.T) {
+	testPublish(t, newWSClient)
+}
+
+func TestWSAuthExpiry(t *testing.T) {
+	testAuthExpiry(t, newWSClient)
+}
+
+func TestWSKick(t *testing.T) {
+	testKick(t, newWSClient)
+}
+
+func TestWSSubscribeRateLimit(t *testing.T) {
+	testSubscribeRateLimit(t, newWSClient)
+}
+
+func TestWSSubscriptionTTL(t *testing.T) {
+	testSubscriptionTTL(t, newWSClient)
+}
+
+func TestWSCallbackPanics(t *testing.T) {
+	testCallbackPanics(t, newWSClient)
+}
+
+func TestWSPublishRateLimit(t *testing.T) {
+	testPublishRateLimit(t, newWSClient)
+}
+
+func TestWSPublishValidation(t *testing.T) {
+	testPublishValidation(t, newWSClient)
+}
+
+func TestWSConnectionAttributes(t *testing.T) {
+	testConnectionAttributes(t, newWSClient)
+}
+
+func TestWSClientID(t *testing.T) {
+	testClientID(t, newWSClient)
+}
+
+func TestWSPing(t *testing.T) {
+	testPing(t, newWSClient)
+}
+
+func TestWSEcho(t *testing.T) {
+	testEcho(t, newWSClient)
+}
+
+func TestWSMessageHeaders(t *testing.T) {
+	testMessageHeaders(t, newWSClient)
+}
+
+func TestWSMigrate(t *testing.T) {
+	testMigrate(t, newWSClient)
+}
+
+func TestWSDrainMode(t *testing.T) {
+	testDrainMode(t, newWSClient)
+}
+
+func TestWSTenantQuotas(t *testing.T) {
+	testTenantQuotas(t, newWSClient)
+}
+
+func TestWSWireTap(t *testing.T) {
+	testWireTap(t, newWSClient)
+}
+
+func TestWSQoS(t *testing.T) {
+	testQoS(t, newWSClient)
+}
+
+func TestWSPause(t *testing.T) {
+	testPause(t, newWSClient)
+}
+
+func TestWSSubscriptionID(t *testing.T) {
+	testSubscriptionID(t, newWSClient)
+}
+
+func TestWSEnvelopeFields(t *testing.T) {
+	testEnvelopeFields(t, newWSClient)
+}
+
+func TestWSDisconnectRace(t *testing.T) {
+	testDisconnectRace(t, newWSClient)
+}
+
+func TestWSResubscribeOrder(t *testing.T) {
+	testResubscribeOrder(t, newWSClient)
+}
+
+func TestWSResubscribed(t *testing.T) {
+	testResubscribed(t, newWSClient)
+}
+
+func TestWSSubscribers(t *testing.T) {
+	testSubscribers(t, newWSClient)
+}
+
+func TestWSSessionResume(t *testing.T) {
+	testSessionResume(t, newWSClient)
+}
+
+func TestWSSubscribeChan(t *testing.T) {
+	testSubscribeChan(t, newWSClient)
+}
+
+func TestWSAuthType(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	for _, c := range authTypeFrames {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = conn.WriteMessage(websocket.TextMessage, []byte(c.frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[string]interface{}{}
+		err = conn.ReadJSON(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["__type"] != AuthFailedMessage || m["code"] != c.code || m["reason"] != c.reason {
+			t.Errorf("Unexpected reply to %s: %v", c.frame, m)
+		}
+		conn.Close()
+	}
+}
+
+// Clients move on their own once told the node is draining, wherever the
+// load balancer sends them.
+func TestWSDrainModeMoves(t *testing.T) {
+	server1, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+
+	server2 := &testServer{
+		Port:  nextPort(),
+		Redis: server1.Redis,
+	}
+	err = server2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Broadcaster.Close()
+
+	// Sends everything to the first node while it's healthy.
+	balancer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend := server2
+		health := httptest.NewRecorder()
+		server1.Broadcaster.ServeHTTP(health, httptest.NewRequest("GET", "/health", nil))
+		if health.Code == http.StatusOK {
+			backend = server1
+		}
+		target := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", backend.Port)}
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	}))
+	defer balancer.Close()
+	u, _ := url.Parse(balancer.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	client, err := newWSClient(&testServer{Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server1.Broadcaster.EnterDrainMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		if i == 500 {
+			t.Fatal("Expected the client to subscribe on the other node")
+		}
+		stats, _ := server2.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = server2.sendMessage("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case m := <-client.Messages:
+			if m.Type() == DrainingMessage {
+				continue
+			}
+			if m.Type() != MessageMessage || m["body"] != "Test message" {
+				t.Errorf("Wrong message payload: %v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a message")
+		}
+		break
+	}
+}
+
+func TestWSWireKeys(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exchange := func(frame string, keys ...string) map[string]interface{} {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := map[string]interface{}{}
+		err = conn.ReadJSON(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertWireKeys(t, m, keys...)
+		return m
+	}
+
+	m := exchange(`{"__type":"auth"}`, "__type", "__id", "__client")
+	if m["__type"] != AuthOKMessage {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+
+	m = exchange(`{"__type":"subscribe","channel":"test"}`, "__type", "channel", "subscription")
+	if m["__type"] != SubscribeOKMessage {
+		t.Errorf("Unexpected reply: %v", m)
+	}
+}
+
+func TestWSHandshakeTimeout(t *testing.T) {
+	server, err := startServer(&Server{HandshakeTimeout: 200 * time.Millisecond}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Stays silent after upgrading.
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	m := ClientMessage{}
+	err = conn.ReadJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type() != AuthFailedMessage {
+		t.Errorf("Expected %s, got %v", AuthFailedMessage, m)
+	}
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 1008) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Closed after %s", elapsed)
+	}
+}
+
+func TestWSConnectionContext(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"__type":"auth"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ClientMessage{}
+	err = conn.ReadJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, ok := server.Broadcaster.ConnectionContext(m.ConnectionID())
+	if !ok {
+		t.Fatal("Expected a context for the connection")
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	// Gone without a word.
+	conn.UnderlyingConn().Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the context to be cancelled")
+	}
+
+	_, ok = server.Broadcaster.ConnectionContext(m.ConnectionID())
+	if ok {
+		t.Error("Expected the context to be gone")
+	}
+}
+
+func TestWSWriteTimeout(t *testing.T) {
+	server, err := startServer(&Server{WriteTimeout: 100 * time.Millisecond}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// A client that stops reading, with as little buffering as possible.
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			conn.(*net.TCPConn).SetReadBuffer(4096)
+			return conn, nil
+		},
+	}
+	url := fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port)
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, frame := range []string{`{"__type":"auth"}`, `{"__type":"subscribe","channel":"test"}`} {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := strings.Repeat("x", 256*1024)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection wasn't closed")
+		}
+
+		stats, err := server.Broadcaster.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.WriteTimeouts > 0 && len(stats.LocalConnections) == 0 {
+			break
+		}
+		if stats.WriteTimeouts == 0 {
+			err = server.Broadcaster.Publish("test", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Others are still served.
+	client, err := newWSClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+}
+
+// Resuming after a sequence number doesn't depend on the client ID.
+func TestWSCursor(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	resumed := SubscribeOptions{QoS: QoSAtLeastOnce, Cursor: true}
+	subscribe := func(channel string, cursor int64) *Client {
+		client, err := newWSClient(server, func(c *Client) {
+			if cursor != noCursor {
+				c.cursors = map[string]int64{channel: cursor}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SubscribeWith(channel, resumed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	receive := func(client *Client, expected ...string) {
+		for _, e := range expected {
+			select {
+			case m := <-client.Messages:
+				got := fmt.Sprint(m["body"])
+				if m.Type() == SkippedMessage {
+					got = fmt.Sprintf("skipped %v", m["count"])
+				}
+				if got != e {
+					t.Fatalf("Expected %s, got %s", e, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Didn't receive %s", e)
+			}
+		}
+	}
+	cursor := func(client *Client, channel string, expected int64) {
+		seq, ok := client.Cursor(channel)
+		if !ok || seq != expected {
+			t.Errorf("Expected cursor %d, got %d (%v)", expected, seq, ok)
+		}
+	}
+	publish := func(channel string, bodies ...string) {
+		for _, body := range bodies {
+			err := server.Broadcaster.Publish(channel, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Nothing published yet
+	client := subscribe("test", noCursor)
+	defer client.Disconnect()
+	cursor(client, "test", 0)
+
+	publish("test", "one", "two", "three")
+	receive(client, "one", "two", "three")
+	cursor(client, "test", 3)
+
+	// Another client ID, from a cursor kept elsewhere
+	resumer := subscribe("test", 1)
+	defer resumer.Disconnect()
+	receive(resumer, "two", "three")
+	publish("test", "four")
+	receive(resumer, "four")
+	receive(client, "four")
+	cursor(resumer, "test", 4)
+
+	// Only kept once the channel has at-least-once subscribers
+	publish("gap", "lost")
+	keeper := subscribe("gap", noCursor)
+	defer keeper.Disconnect()
+	cursor(keeper, "gap", 1)
+	publish("gap", "kept")
+	receive(keeper, "kept")
+
+	late := subscribe("gap", 0)
+	defer late.Disconnect()
+	receive(late, "skipped 1", "kept")
+	cursor(late, "gap", 2)
+}
@@ -0,0 +1,137 @@
+package broadcaster
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Directions of frames passed to Server.WireTap.
+const (
+	// Received from the client, before decoding
+	WireInbound = "in"
+
+	// Sent to the client, after encoding
+	WireOutbound = "out"
+)
+
+// Number of frames queued for the WireTap before new ones get dropped.
+const wireTapQueueSize = 1000
+
+type wireFrame struct {
+	connID    string
+	direction string
+	raw       []byte
+}
+
+// Delivers frames to the WireTap in the background. Frames are dropped (and
+// counted) when the queue is full, tapping never blocks the connection.
+type wireTap struct {
+	dropped uint64
+	frames  chan wireFrame
+
+	fn   func(connID, direction string, raw []byte)
+	logf func(format string, args ...interface{})
+}
+
+func newWireTap(size int, fn func(connID, direction string, raw []byte), logf func(format string, args ...interface{})) *wireTap {
+	t := &wireTap{
+		frames: make(chan wireFrame, size),
+		fn:     fn,
+		logf:   logf,
+	}
+	go t.run()
+	return t
+}
+
+func (t *wireTap) Emit(f wireFrame) {
+	select {
+	case t.frames <- f:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *wireTap) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *wireTap) run() {
+	for f := range t.frames {
+		runCallback(t.logf, "WireTap", func() {
+			t.fn(f.connID, f.direction, f.raw)
+		})
+	}
+}
+
+// Passes a copy of a frame to the WireTap, if there is one.
+func (s *Server) tap(connID, direction string, raw []byte) {
+	if s.wireTap == nil {
+		return
+	}
+	s.wireTap.Emit(wireFrame{
+		connID:    connID,
+		direction: direction,
+		raw:       append([]byte(nil), raw...),
+	})
+}
+
+// Taps what's written to an HTTP response, each write is a frame. The
+// request body can be held back until the connection is known.
+type wireTapWriter struct {
+	http.ResponseWriter
+
+	server *Server
+	connID string
+
+	body    []byte
+	pending bool
+}
+
+// Returns w as is when there's no WireTap.
+func (s *Server) tapResponse(w http.ResponseWriter, connID string) http.ResponseWriter {
+	if s.wireTap == nil {
+		return w
+	}
+	return &wireTapWriter{ResponseWriter: w, server: s, connID: connID}
+}
+
+// Holds back the request body until attach, or the first write.
+func (w *wireTapWriter) receive(body []byte) {
+	w.body = body
+	w.pending = true
+}
+
+// Sets the connection ID once it's known and taps the request body. Does
+// nothing when not tapping.
+func (w *wireTapWriter) attach(connID string) {
+	if w == nil {
+		return
+	}
+	w.connID = connID
+	if w.pending {
+		w.server.tap(connID, WireInbound, w.body)
+		w.body = nil
+		w.pending = false
+	}
+}
+
+func (w *wireTapWriter) Write(p []byte) (int, error) {
+	w.attach(w.connID)
+	w.server.tap(w.connID, WireOutbound, p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Keeps deadlines working, see responseDeadliner.
+func (w *wireTapWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *wireTapWriter) FlushError() error {
+	if f, ok := w.ResponseWriter.(errorFlusher); ok {
+		return f.FlushError()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}